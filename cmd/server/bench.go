@@ -0,0 +1,426 @@
+// cmd/server/bench.go
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/acazau/ghcsd/internal/config"
+	"github.com/acazau/ghcsd/internal/proxy"
+	"github.com/acazau/ghcsd/pkg/copilot"
+)
+
+const benchUsage = `usage: ghcsd bench [flags]
+
+Sends concurrent chat completions to a running instance, or to an in-process
+server, and reports latency, time to first token and error rates.
+
+Flags:`
+
+// benchOptions are the settings of a benchmark run
+type benchOptions struct {
+	url         string
+	apiKey      string
+	model       string
+	prompt      string
+	mode        string
+	requests    int
+	concurrency int
+	maxTokens   int
+	timeout     time.Duration
+	inProcess   bool
+	mock        bool
+	mockDelay   time.Duration
+}
+
+// benchResult is the outcome of a single benchmark request
+type benchResult struct {
+	stream  bool
+	latency time.Duration
+	// ttft is the time to the first streamed content; zero when not streamed
+	ttft time.Duration
+	// failure describes why the request failed; empty on success
+	failure string
+}
+
+// runBench implements the "bench" subcommand
+func runBench(args []string) error {
+	var opts benchOptions
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), benchUsage)
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&opts.url, "url", "http://localhost:8080", "Base URL of the running instance")
+	fs.StringVar(&opts.apiKey, "key", os.Getenv("GHCSD_BENCH_KEY"), "API key sent as a bearer token (default $GHCSD_BENCH_KEY)")
+	fs.StringVar(&opts.model, "model", "gpt-4o", "Model to request")
+	fs.StringVar(&opts.prompt, "prompt", "Count from one to ten.", "User message of every request")
+	fs.StringVar(&opts.mode, "mode", "mixed", "Requests to send: stream, complete or mixed")
+	fs.IntVar(&opts.requests, "n", 100, "Total number of requests")
+	fs.IntVar(&opts.concurrency, "c", 10, "Number of concurrent requests")
+	fs.IntVar(&opts.maxTokens, "max-tokens", 64, "max_tokens of every request")
+	fs.DurationVar(&opts.timeout, "timeout", 2*time.Minute, "Timeout of a single request")
+	fs.BoolVar(&opts.inProcess, "in-process", false, "Serve the requests from an in-process server instead of -url")
+	fs.BoolVar(&opts.mock, "mock", false, "Answer from a mock upstream to measure the proxy overhead alone (implies -in-process)")
+	fs.DurationVar(&opts.mockDelay, "mock-delay", 10*time.Millisecond, "Delay of the mock upstream between streamed chunks")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+	switch opts.mode {
+	case "stream", "complete", "mixed":
+	default:
+		return fmt.Errorf("invalid -mode %q, expected stream, complete or mixed", opts.mode)
+	}
+	if opts.requests < 1 || opts.concurrency < 1 {
+		return errors.New("-n and -c must be at least 1")
+	}
+
+	if opts.inProcess || opts.mock {
+		url, shutdown, err := startBenchServer(opts)
+		if err != nil {
+			return err
+		}
+		defer shutdown()
+		opts.url = url
+	}
+
+	fmt.Printf("Benchmarking %s: %d requests (%s), concurrency %d, model %s\n",
+		opts.url, opts.requests, opts.mode, opts.concurrency, opts.model)
+	results, elapsed := runBenchRequests(opts)
+	printBenchReport(os.Stdout, results, elapsed)
+	return nil
+}
+
+// startBenchServer serves the proxy on a loopback port and returns its URL.
+// With opts.mock the proxy talks to a mock upstream instead of Copilot.
+func startBenchServer(opts benchOptions) (string, func(), error) {
+	cfg, err := config.New()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to load config: %w", err)
+	}
+	// Measure the proxy, not the auth and limits configured for production
+	cfg.APIKeys = nil
+	cfg.KeysFile = ""
+	cfg.RateLimit = 0
+	cfg.UserRateLimit = 0
+	cfg.ModelBudgets = nil
+	cfg.AuditDir = ""
+	cfg.AdminListen = nil
+
+	var closers []func()
+	shutdown := func() {
+		for i := len(closers) - 1; i >= 0; i-- {
+			closers[i]()
+		}
+	}
+
+	token := "tid=bench"
+	if opts.mock {
+		upstream, err := serveBench(mockUpstream(opts.mockDelay))
+		if err != nil {
+			return "", nil, err
+		}
+		closers = append(closers, upstream.close)
+		cfg.CopilotBaseURL = upstream.url
+		cfg.CopilotEndpoints = nil
+	} else {
+		token, err = copilotToken(cfg)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	router, _, stopRouter, err := proxy.NewRouter(cfg, token)
+	if err != nil {
+		shutdown()
+		return "", nil, fmt.Errorf("failed to create router: %w", err)
+	}
+	closers = append(closers, stopRouter)
+	server, err := serveBench(router)
+	if err != nil {
+		shutdown()
+		return "", nil, err
+	}
+	closers = append(closers, server.close)
+	return server.url, shutdown, nil
+}
+
+// benchServer is an HTTP server on a loopback port
+type benchServer struct {
+	url   string
+	close func()
+}
+
+func serveBench(handler http.Handler) (*benchServer, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{Handler: handler}
+	go server.Serve(listener)
+	return &benchServer{
+		url:   "http://" + listener.Addr().String(),
+		close: func() { server.Close() },
+	}, nil
+}
+
+// mockUpstream answers chat completions like the Copilot API with a fixed
+// reply, streamed one word per delay
+func mockUpstream(delay time.Duration) http.Handler {
+	words := strings.Fields("one two three four five six seven eight nine ten")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req copilot.CompletionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		usage := map[string]int{"prompt_tokens": 10, "completion_tokens": len(words), "total_tokens": 10 + len(words)}
+		if !req.Stream {
+			time.Sleep(delay * time.Duration(len(words)))
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"id":      "mock",
+				"object":  "chat.completion",
+				"model":   req.Model,
+				"choices": []interface{}{map[string]interface{}{"index": 0, "message": map[string]string{"role": "assistant", "content": strings.Join(words, " ")}, "finish_reason": "stop"}},
+				"usage":   usage,
+			})
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		controller := http.NewResponseController(w)
+		writeChunk := func(chunk map[string]interface{}) {
+			data, _ := json.Marshal(chunk)
+			fmt.Fprintf(w, "data: %s\n\n", data)
+			controller.Flush()
+		}
+		for i, word := range words {
+			time.Sleep(delay)
+			if i > 0 {
+				word = " " + word
+			}
+			writeChunk(map[string]interface{}{
+				"id":      "mock",
+				"object":  "chat.completion.chunk",
+				"model":   req.Model,
+				"choices": []interface{}{map[string]interface{}{"index": 0, "delta": map[string]string{"content": word}}},
+			})
+		}
+		writeChunk(map[string]interface{}{
+			"id":      "mock",
+			"object":  "chat.completion.chunk",
+			"model":   req.Model,
+			"choices": []interface{}{map[string]interface{}{"index": 0, "delta": map[string]string{}, "finish_reason": "stop"}},
+			"usage":   usage,
+		})
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	})
+}
+
+// runBenchRequests sends the requests with the configured concurrency and
+// returns their results and the total time taken
+func runBenchRequests(opts benchOptions) ([]benchResult, time.Duration) {
+	client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: opts.concurrency}}
+	results := make([]benchResult, opts.requests)
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	start := time.Now()
+	for range opts.concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(next.Add(1)) - 1
+				if i >= opts.requests {
+					return
+				}
+				stream := opts.mode == "stream" || opts.mode == "mixed" && i%2 == 1
+				results[i] = benchRequest(client, opts, stream)
+			}
+		}()
+	}
+	wg.Wait()
+	return results, time.Since(start)
+}
+
+// benchRequest sends one chat completion and measures it
+func benchRequest(client *http.Client, opts benchOptions, stream bool) (result benchResult) {
+	result.stream = stream
+	body, _ := json.Marshal(map[string]interface{}{
+		"model":      opts.model,
+		"messages":   []map[string]string{{"role": "user", "content": opts.prompt}},
+		"max_tokens": opts.maxTokens,
+		"stream":     stream,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), opts.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(opts.url, "/")+"/v1/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		result.failure = err.Error()
+		return result
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if opts.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+opts.apiKey)
+	}
+
+	start := time.Now()
+	defer func() { result.latency = time.Since(start) }()
+	resp, err := client.Do(req)
+	if err != nil {
+		result.failure = benchFailure(err)
+		return result
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		result.failure = fmt.Sprintf("HTTP %d", resp.StatusCode)
+		return result
+	}
+
+	if !stream {
+		var completion copilot.CompletionResponse
+		if err := json.NewDecoder(resp.Body).Decode(&completion); err != nil {
+			result.failure = "invalid response"
+		}
+		return result
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		data, ok := bytes.CutPrefix(scanner.Bytes(), []byte("data: "))
+		if !ok || bytes.Equal(data, []byte("[DONE]")) {
+			continue
+		}
+		var chunk copilot.CompletionResponse
+		if err := json.Unmarshal(data, &chunk); err != nil {
+			continue
+		}
+		if chunk.Error != nil {
+			result.failure = "stream error: " + chunk.Error.Code
+			return result
+		}
+		if result.ttft == 0 {
+			for _, choice := range chunk.Choices {
+				if text, _ := choice.Delta.Content.(string); text != "" {
+					result.ttft = time.Since(start)
+					break
+				}
+			}
+		}
+	}
+	// Interrupted streams end with an error chunk
+	if err := scanner.Err(); err != nil {
+		result.failure = benchFailure(err)
+	}
+	return result
+}
+
+// benchFailure classifies a transport error
+func benchFailure(err error) string {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "timeout"
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return "network error"
+	}
+	return err.Error()
+}
+
+// printBenchReport writes the latency and error statistics of the results
+func printBenchReport(out io.Writer, results []benchResult, elapsed time.Duration) {
+	fmt.Fprintf(out, "\nCompleted %d requests in %s (%.1f req/s)\n\n",
+		len(results), elapsed.Round(time.Millisecond), float64(len(results))/elapsed.Seconds())
+
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "\tRequests\tErrors\tError rate\tp50\tp95\tMax\tTTFT p50\tTTFT p95\t")
+	for _, kind := range []struct {
+		name   string
+		stream bool
+	}{{"complete", false}, {"stream", true}} {
+		var latencies, ttfts []time.Duration
+		count, failed := 0, 0
+		for _, result := range results {
+			if result.stream != kind.stream {
+				continue
+			}
+			count++
+			if result.failure != "" {
+				failed++
+				continue
+			}
+			latencies = append(latencies, result.latency)
+			if result.ttft > 0 {
+				ttfts = append(ttfts, result.ttft)
+			}
+		}
+		if count == 0 {
+			continue
+		}
+		ttftP50, ttftP95 := "-", "-"
+		if kind.stream {
+			ttftP50, ttftP95 = formatPercentile(ttfts, 0.50), formatPercentile(ttfts, 0.95)
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.1f%%\t%s\t%s\t%s\t%s\t%s\t\n", kind.name, count, failed,
+			100*float64(failed)/float64(count), formatPercentile(latencies, 0.50), formatPercentile(latencies, 0.95),
+			formatPercentile(latencies, 1), ttftP50, ttftP95)
+	}
+	tw.Flush()
+
+	failures := make(map[string]int)
+	for _, result := range results {
+		if result.failure != "" {
+			failures[result.failure]++
+		}
+	}
+	if len(failures) == 0 {
+		return
+	}
+	reasons := make([]string, 0, len(failures))
+	for reason := range failures {
+		reasons = append(reasons, reason)
+	}
+	sort.Slice(reasons, func(i, j int) bool { return failures[reasons[i]] > failures[reasons[j]] })
+	fmt.Fprintln(out, "\nErrors:")
+	for _, reason := range reasons {
+		fmt.Fprintf(out, "  %5d  %s\n", failures[reason], reason)
+	}
+}
+
+// formatPercentile returns the p-th percentile (0-1) of the durations
+func formatPercentile(durations []time.Duration, p float64) string {
+	if len(durations) == 0 {
+		return "-"
+	}
+	sorted := append([]time.Duration(nil), durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	i = min(max(i, 0), len(sorted)-1)
+	return sorted[i].Round(100 * time.Microsecond).String()
+}
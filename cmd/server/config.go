@@ -0,0 +1,65 @@
+// cmd/server/config.go
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/acazau/ghcsd/internal/config"
+)
+
+const configUsage = `usage: ghcsd config print [flags]
+
+Prints the effective configuration, the defaults merged with the GHCSD_*
+environment variables, for troubleshooting. API keys, tokens, passwords
+and header values are masked, so the output can be shared.
+
+Flags:`
+
+// runConfig runs the config command
+func runConfig(args []string) error {
+	fs := flag.NewFlagSet("config", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), configUsage)
+		fs.PrintDefaults()
+	}
+	configDir := fs.String("config-dir", "", "Directory of the login and machine ID (default: the platform config directory)")
+	asJSON := fs.Bool("json", false, "Print the settings as JSON")
+	if len(args) == 0 || args[0] != "print" {
+		fs.Usage()
+		return errors.New("expected the print action")
+	}
+	if err := fs.Parse(args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+
+	cfg, err := config.Load(*configDir)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	settings := cfg.Settings()
+	if *asJSON {
+		values := make(map[string]string, len(settings))
+		for _, setting := range settings {
+			values[setting.Name] = setting.Value
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(values)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, setting := range settings {
+		fmt.Fprintf(tw, "%s\t%s\n", setting.Name, setting.Value)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,49 @@
+// cmd/server/listeners.go
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// listenFlag collects repeated -listen flags
+type listenFlag []string
+
+func (l *listenFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listenFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// openListener creates a listener for an address of the form
+// unix:///path/to.sock, tcp://host:port or plain host:port
+func openListener(address string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(address, "unix://"); ok {
+		if path == "" {
+			return nil, fmt.Errorf("missing socket path in %q", address)
+		}
+		// Remove a stale socket left behind by a previous run
+		if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			if err := os.Remove(path); err != nil {
+				return nil, fmt.Errorf("failed to remove stale socket %s: %w", path, err)
+			}
+		}
+		listener, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		// Restrict access to the owner and group of the socket
+		if err := os.Chmod(path, 0660); err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("failed to set socket permissions: %w", err)
+		}
+		return listener, nil
+	}
+
+	return net.Listen("tcp", strings.TrimPrefix(address, "tcp://"))
+}
@@ -2,53 +2,293 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
 
+	"github.com/acazau/ghcsd/internal/cassette"
 	"github.com/acazau/ghcsd/internal/config"
-	"github.com/acazau/ghcsd/internal/copilot"
+	"github.com/acazau/ghcsd/internal/logfile"
 	"github.com/acazau/ghcsd/internal/proxy"
+	"github.com/acazau/ghcsd/internal/state"
+	"github.com/acazau/ghcsd/internal/transport"
+	"github.com/acazau/ghcsd/internal/version"
+	"github.com/acazau/ghcsd/pkg/copilot"
+	"github.com/acazau/ghcsd/pkg/logging"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "service" {
+		if err := runService(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		if err := runBench(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "top" {
+		if err := runTop(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "status" {
+		if err := runStatus(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		if err := runConfig(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Parse command line flags
-	debug := flag.Bool("debug", false, "Enable debug logging")
+	debug := flag.Bool("debug", false, "Enable debug logging (same as -log-level debug)")
+	logLevel := flag.String("log-level", "", "Log level: off, error, warn, info, debug or trace (overrides GHCSD_LOG_LEVEL)")
+	showVersion := flag.Bool("version", false, "Print version information and exit")
+	configDir := flag.String("config-dir", "", "Directory of the login and machine ID (default: the platform config directory)")
+	mock := flag.Bool("mock", false, "Answer completions from fixtures instead of Copilot, without logging in")
+	mockDir := flag.String("mock-dir", "", "Directory of the JSON fixtures answered in mock mode (implies -mock)")
+	enableOpenAI := flag.Bool("enable-openai", true, "Serve the OpenAI chat completions API (overrides GHCSD_ENABLE_OPENAI)")
+	enableResponses := flag.Bool("enable-responses", true, "Serve the OpenAI Responses API (overrides GHCSD_ENABLE_RESPONSES)")
+	enableOllama := flag.Bool("enable-ollama", true, "Serve the Ollama API (overrides GHCSD_ENABLE_OLLAMA)")
+	enableAnthropic := flag.Bool("enable-anthropic", true, "Serve the Anthropic-format endpoints (overrides GHCSD_ENABLE_ANTHROPIC)")
+	enableGRPC := flag.Bool("enable-grpc", false, "Serve the gRPC API (overrides GHCSD_ENABLE_GRPC)")
+	var listen, adminListen listenFlag
+	flag.Var(&listen, "listen", "Listen address, e.g. :8080 or unix:///run/ghcsd.sock (repeatable)")
+	flag.Var(&adminListen, "admin-listen", "Listen address of the admin and metrics endpoints, e.g. 127.0.0.1:9090 (repeatable)")
 	flag.Parse()
 
-	if *debug {
-		log.Println("Debug mode enabled")
+	if *showVersion {
+		fmt.Println(version.Get())
+		return
 	}
 
 	// Load configuration
-	cfg, err := config.New()
+	cfg, err := config.Load(*configDir)
 	if err != nil {
 		log.Fatalf("Failed to load config: %v", err)
 	}
+	if *debug {
+		cfg.LogLevel = logging.Debug
+	}
+	if *logLevel != "" {
+		if cfg.LogLevel, err = logging.ParseLevel(*logLevel); err != nil {
+			log.Fatalf("Invalid -log-level: %v", err)
+		}
+	}
+	if len(listen) > 0 {
+		cfg.Listen = listen
+	}
+	if len(adminListen) > 0 {
+		cfg.AdminListen = adminListen
+	}
+	if *mockDir != "" {
+		cfg.MockDir = *mockDir
+	}
+	cfg.Mock = cfg.Mock || *mock || *mockDir != ""
+	// Only the frontend flags given override the environment
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "enable-openai":
+			cfg.EnableOpenAI = *enableOpenAI
+		case "enable-responses":
+			cfg.EnableResponses = *enableResponses
+		case "enable-ollama":
+			cfg.EnableOllama = *enableOllama
+		case "enable-anthropic":
+			cfg.EnableAnthropic = *enableAnthropic
+		case "enable-grpc":
+			cfg.EnableGRPC = *enableGRPC
+		}
+	})
+	if cfg.LogFile != "" {
+		logFile, err := logfile.Open(cfg.LogFile, cfg.LogOptions())
+		if err != nil {
+			log.Fatalf("Failed to open log file: %v", err)
+		}
+		log.SetOutput(logFile)
+	}
+	if err := logging.Configure(logging.Settings{Level: cfg.LogLevel, Components: cfg.LogComponents}); err != nil {
+		log.Fatalf("Failed to configure logging: %v", err)
+	}
+	log.Printf("ghcsd %s starting with %s", version.Get().Version, cfg.Summary())
 
-	// Initialize auth manager and get Copilot token
-	log.Println("Obtaining Copilot token...")
-	authManager := copilot.NewAuthManager(&http.Client{}, cfg.ConfigDir, *debug)
-	accessToken, err := authManager.GetCopilotToken()
-	if err != nil {
-		log.Fatalf("Failed to get copilot token: %v", err)
+	if cfg.InsecureSkipVerify {
+		log.Println("WARNING: TLS certificate verification is disabled for outbound requests")
 	}
-	log.Println("Successfully obtained Copilot token")
 
-	// Create and configure the proxy handler
-	handler, err := proxy.NewHandler(accessToken, cfg.Model, *debug)
+	// Initialize auth manager and get Copilot token. Without a terminal to
+	// show the device flow prompt on, the login is completed over HTTP.
+	var accessToken string
+	if cfg.Mock {
+		accessToken = "tid=mock"
+		log.Println("Mock mode enabled: completions are answered from fixtures, not Copilot")
+	} else if cfg.CassetteMode == cassette.Replay {
+		// Replayed interactions are matched without their credentials
+		accessToken = "tid=replay"
+		log.Println("Replay mode enabled: upstream responses are replayed from recorded cassettes")
+	} else if cached := cachedCopilotToken(cfg); cached != "" {
+		accessToken = cached
+		log.Println("Using the Copilot token shared in Redis")
+	} else if needsDeviceLogin(cfg) {
+		if copilot.NewAuthManager(nil, cfg.ConfigDir).PendingDeviceCode() != nil {
+			log.Println("No GitHub token is stored and no terminal is attached; resuming the device login started before the restart, see GET /auth/status")
+		} else {
+			log.Println("No GitHub token is stored and no terminal is attached; start the login with POST /auth/device")
+		}
+	} else {
+		log.Println("Obtaining Copilot token...")
+		accessToken, err = copilotToken(cfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println("Successfully obtained Copilot token")
+	}
+
+	// Build the router with its middleware stack
+	api, control, shutdown, err := proxy.NewRouter(cfg, accessToken)
 	if err != nil {
-		log.Fatalf("Failed to create proxy handler: %v", err)
+		log.Fatalf("Failed to create router: %v", err)
+	}
+
+	addresses := cfg.Listen
+	if len(addresses) == 0 {
+		addresses = cfg.ServerAddr
+	}
+	server := &http.Server{Handler: api}
+	if cfg.EnableGRPC {
+		// gRPC clients speak HTTP/2 without TLS
+		server.Protocols = new(http.Protocols)
+		server.Protocols.SetHTTP1(true)
+		server.Protocols.SetUnencryptedHTTP2(true)
+	}
+	servers := []serverGroup{{name: "server", server: server, addresses: addresses}}
+	if control != nil {
+		servers = append(servers, serverGroup{name: "admin server", server: &http.Server{Handler: control}, addresses: cfg.AdminListen})
+	}
+
+	// Open every listener before serving, so that a bad address fails startup
+	type boundListener struct {
+		net.Listener
+		group   serverGroup
+		address string
+	}
+	var listeners []boundListener
+	for _, group := range servers {
+		for _, address := range group.addresses {
+			listener, err := openListener(address)
+			if err != nil {
+				log.Fatalf("Failed to listen on %s: %v", address, err)
+			}
+			listeners = append(listeners, boundListener{Listener: listener, group: group, address: address})
+		}
 	}
 
-	// Configure the server
-	server := &http.Server{
-		Addr:    cfg.ServerAddr,
-		Handler: handler,
+	errCh := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		log.Printf("Starting %s on %s", listener.group.name, listener.address)
+		go func(l boundListener) {
+			errCh <- l.group.server.Serve(l.Listener)
+		}(listener)
 	}
 
-	log.Printf("Starting server on %s", cfg.ServerAddr)
-	if err := server.ListenAndServe(); err != nil {
+	if err := <-errCh; err != nil {
+		// Send the spans still queued before exiting
+		shutdown()
 		log.Fatalf("Server failed: %v", err)
 	}
 }
+
+// serverGroup is a server and the addresses it listens on
+type serverGroup struct {
+	name      string
+	server    *http.Server
+	addresses []string
+}
+
+// copilotToken obtains a Copilot token from the configured personal access
+// token, or else the stored login, running the GitHub device flow if no
+// GitHub token is stored yet
+func copilotToken(cfg *config.Config) (string, error) {
+	httpClient, err := transport.NewClient(cfg.TransportOptions())
+	if err != nil {
+		return "", fmt.Errorf("failed to configure outbound transport: %w", err)
+	}
+	authManager := copilot.NewAuthManager(httpClient, cfg.ConfigDir)
+	authManager.SetEndpoints(cfg.GitHubURL, cfg.GitHubAPIURL)
+	authManager.SetPersonalAccessToken(cfg.GitHubToken)
+	token, err := authManager.GetCopilotToken()
+	if err != nil {
+		return "", fmt.Errorf("failed to get copilot token: %w", err)
+	}
+	shareCopilotToken(cfg, token)
+	return token, nil
+}
+
+// cachedCopilotToken returns the Copilot token another replica shared in
+// Redis, or "" when there is none or no Redis server is configured
+func cachedCopilotToken(cfg *config.Config) string {
+	if cfg.RedisURL == "" {
+		return ""
+	}
+	store, err := state.OpenRedis(cfg.RedisURL)
+	if err != nil {
+		log.Printf("[State] %v", err)
+		return ""
+	}
+	defer store.Close()
+	token, err := store.Token(context.Background())
+	if err != nil {
+		log.Printf("[State] Failed to read the shared Copilot token: %v", err)
+	}
+	return token
+}
+
+// shareCopilotToken stores token in Redis for the other replicas, when a
+// Redis server is configured
+func shareCopilotToken(cfg *config.Config, token string) {
+	expiresAt, ok := copilot.TokenExpiry(token)
+	if cfg.RedisURL == "" || !ok {
+		return
+	}
+	store, err := state.OpenRedis(cfg.RedisURL)
+	if err != nil {
+		log.Printf("[State] %v", err)
+		return
+	}
+	defer store.Close()
+	if err := store.SetToken(context.Background(), token, expiresAt); err != nil {
+		log.Printf("[State] Failed to share the Copilot token: %v", err)
+	}
+}
+
+// needsDeviceLogin reports whether no GitHub token is stored and stdin is not
+// a terminal, e.g. when running as a service, so that the device flow prompt
+// would not reach anyone
+func needsDeviceLogin(cfg *config.Config) bool {
+	if cfg.GitHubToken != "" {
+		return false
+	}
+	if _, err := copilot.NewAuthManager(nil, cfg.ConfigDir).LoadAuthToken(); err == nil {
+		return false
+	}
+	info, err := os.Stdin.Stat()
+	return err != nil || info.Mode()&os.ModeCharDevice == 0
+}
@@ -0,0 +1,295 @@
+// cmd/server/service.go
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+const (
+	// serviceName is the name of the systemd unit
+	serviceName = "ghcsd"
+	// launchdLabel is the label of the launchd agent
+	launchdLabel = "com.github.acazau.ghcsd"
+)
+
+const serviceUsage = `usage: ghcsd service install|uninstall|start|stop [-- server flags]
+
+install    write and enable a user service running this binary, capturing the
+           GHCSD_*, DEBUG, PORT and proxy environment variables of the shell
+uninstall  stop the service and remove it
+start      start the installed service
+stop       stop the running service
+
+Arguments after "--" are passed to the server, e.g.
+  ghcsd service install -- -listen unix:///tmp/ghcsd.sock`
+
+// serviceEnvPrefixes selects the environment variables copied into the
+// service definition on install
+var serviceEnvPrefixes = []string{"GHCSD_", "DEBUG=", "PORT=", "HTTP_PROXY=", "HTTPS_PROXY=", "NO_PROXY=",
+	"http_proxy=", "https_proxy=", "no_proxy="}
+
+// serviceManager installs and controls the proxy as a background service
+type serviceManager interface {
+	// Path returns the path of the service definition file
+	Path() string
+	// Definition renders the service definition running exe with args and env
+	Definition(exe string, args, env []string) string
+	Enable() error
+	Disable() error
+	Start() error
+	Stop() error
+}
+
+// runService implements the "service" subcommand
+func runService(args []string) error {
+	if len(args) == 0 {
+		return errors.New(serviceUsage)
+	}
+	action, serverArgs := args[0], args[1:]
+	if len(serverArgs) > 0 {
+		if serverArgs[0] != "--" {
+			return errors.New(serviceUsage)
+		}
+		serverArgs = serverArgs[1:]
+	}
+	if action != "install" && len(serverArgs) > 0 {
+		return fmt.Errorf("server flags are only accepted by install")
+	}
+
+	manager, err := newServiceManager()
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "install":
+		return installService(manager, serverArgs)
+	case "uninstall":
+		return uninstallService(manager)
+	case "start":
+		return manager.Start()
+	case "stop":
+		return manager.Stop()
+	default:
+		return errors.New(serviceUsage)
+	}
+}
+
+// newServiceManager returns the service manager of the current platform
+func newServiceManager() (serviceManager, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user home directory: %w", err)
+	}
+	switch runtime.GOOS {
+	case "linux":
+		return &systemdManager{dir: filepath.Join(home, ".config", "systemd", "user")}, nil
+	case "darwin":
+		return &launchdManager{dir: filepath.Join(home, "Library", "LaunchAgents"), logDir: filepath.Join(home, "Library", "Logs")}, nil
+	default:
+		return nil, fmt.Errorf("service management is not supported on %s", runtime.GOOS)
+	}
+}
+
+func installService(manager serviceManager, serverArgs []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate the ghcsd binary: %w", err)
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return fmt.Errorf("failed to locate the ghcsd binary: %w", err)
+	}
+
+	var env []string
+	for _, kv := range os.Environ() {
+		for _, prefix := range serviceEnvPrefixes {
+			if strings.HasPrefix(kv, prefix) {
+				env = append(env, kv)
+				break
+			}
+		}
+	}
+
+	path := manager.Path()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Dir(path), err)
+	}
+	// The definition may hold API keys from the environment
+	if err := os.WriteFile(path, []byte(manager.Definition(exe, serverArgs, env)), 0600); err != nil {
+		return fmt.Errorf("failed to write service definition: %w", err)
+	}
+	if err := manager.Enable(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Installed service %s\n", path)
+	fmt.Println("The service cannot complete the GitHub device flow; run ghcsd once in a terminal to authenticate before starting it.")
+	return nil
+}
+
+func uninstallService(manager serviceManager) error {
+	path := manager.Path()
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("service is not installed: %w", err)
+	}
+	if err := manager.Disable(); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("failed to remove service definition: %w", err)
+	}
+	fmt.Printf("Removed service %s\n", path)
+	return nil
+}
+
+// runCommand runs an external command, including its output in the error
+func runCommand(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s failed: %w: %s", name, strings.Join(args, " "), err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// systemdManager manages a systemd user unit
+type systemdManager struct {
+	dir string
+}
+
+func (m *systemdManager) Path() string {
+	return filepath.Join(m.dir, serviceName+".service")
+}
+
+func (m *systemdManager) Definition(exe string, args, env []string) string {
+	var b strings.Builder
+	b.WriteString("[Unit]\n")
+	b.WriteString("Description=GitHub Copilot proxy (ghcsd)\n")
+	b.WriteString("After=network-online.target\n")
+	b.WriteString("Wants=network-online.target\n\n")
+	b.WriteString("[Service]\n")
+	b.WriteString("ExecStart=" + systemdQuote(exe))
+	for _, arg := range args {
+		b.WriteString(" " + systemdQuote(arg))
+	}
+	b.WriteString("\n")
+	for _, kv := range env {
+		b.WriteString("Environment=" + systemdQuote(kv) + "\n")
+	}
+	b.WriteString("Restart=on-failure\n")
+	b.WriteString("RestartSec=5\n\n")
+	b.WriteString("[Install]\n")
+	b.WriteString("WantedBy=default.target\n")
+	return b.String()
+}
+
+func (m *systemdManager) Enable() error {
+	if err := runCommand("systemctl", "--user", "daemon-reload"); err != nil {
+		return err
+	}
+	return runCommand("systemctl", "--user", "enable", serviceName)
+}
+
+func (m *systemdManager) Disable() error {
+	if err := runCommand("systemctl", "--user", "disable", "--now", serviceName); err != nil {
+		return err
+	}
+	return runCommand("systemctl", "--user", "daemon-reload")
+}
+
+func (m *systemdManager) Start() error {
+	return runCommand("systemctl", "--user", "start", serviceName)
+}
+
+func (m *systemdManager) Stop() error {
+	return runCommand("systemctl", "--user", "stop", serviceName)
+}
+
+// systemdQuote quotes a unit file value when needed and escapes the "%"
+// specifier character
+func systemdQuote(s string) string {
+	s = strings.ReplaceAll(s, "%", "%%")
+	if s != "" && !strings.ContainsAny(s, " \t\"'\\;") {
+		return s
+	}
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + s + `"`
+}
+
+// launchdManager manages a launchd user agent
+type launchdManager struct {
+	dir    string
+	logDir string
+}
+
+func (m *launchdManager) Path() string {
+	return filepath.Join(m.dir, launchdLabel+".plist")
+}
+
+func (m *launchdManager) Definition(exe string, args, env []string) string {
+	var b strings.Builder
+	b.WriteString(xml.Header)
+	b.WriteString(`<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">` + "\n")
+	b.WriteString("<plist version=\"1.0\">\n<dict>\n")
+	b.WriteString("\t<key>Label</key>\n\t<string>" + xmlEscape(launchdLabel) + "</string>\n")
+	b.WriteString("\t<key>ProgramArguments</key>\n\t<array>\n")
+	for _, arg := range append([]string{exe}, args...) {
+		b.WriteString("\t\t<string>" + xmlEscape(arg) + "</string>\n")
+	}
+	b.WriteString("\t</array>\n")
+	if len(env) > 0 {
+		b.WriteString("\t<key>EnvironmentVariables</key>\n\t<dict>\n")
+		for _, kv := range env {
+			key, value, _ := strings.Cut(kv, "=")
+			b.WriteString("\t\t<key>" + xmlEscape(key) + "</key>\n\t\t<string>" + xmlEscape(value) + "</string>\n")
+		}
+		b.WriteString("\t</dict>\n")
+	}
+	b.WriteString("\t<key>RunAtLoad</key>\n\t<true/>\n")
+	b.WriteString("\t<key>KeepAlive</key>\n\t<dict>\n\t\t<key>SuccessfulExit</key>\n\t\t<false/>\n\t</dict>\n")
+	logPath := xmlEscape(filepath.Join(m.logDir, serviceName+".log"))
+	b.WriteString("\t<key>StandardOutPath</key>\n\t<string>" + logPath + "</string>\n")
+	b.WriteString("\t<key>StandardErrorPath</key>\n\t<string>" + logPath + "</string>\n")
+	b.WriteString("</dict>\n</plist>\n")
+	return b.String()
+}
+
+// domain is the launchd domain of the current user's agents
+func (m *launchdManager) domain() string {
+	return "gui/" + strconv.Itoa(os.Getuid())
+}
+
+// Enable has nothing to do: agents in LaunchAgents are loaded at login
+func (m *launchdManager) Enable() error {
+	return nil
+}
+
+func (m *launchdManager) Disable() error {
+	// Stopping fails when the agent is not loaded, which is fine here
+	m.Stop()
+	return nil
+}
+
+func (m *launchdManager) Start() error {
+	return runCommand("launchctl", "bootstrap", m.domain(), m.Path())
+}
+
+func (m *launchdManager) Stop() error {
+	return runCommand("launchctl", "bootout", m.domain()+"/"+launchdLabel)
+}
+
+// xmlEscape escapes text for use in a plist
+func xmlEscape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
@@ -0,0 +1,131 @@
+// cmd/server/status.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const statusUsage = `usage: ghcsd status [flags]
+
+Prints the status of a running instance: its version, uptime, in-flight
+requests, the expiry of the Copilot token and the upstream rate limits.
+Reads GET /admin/status; point -url at the admin listener when one is
+configured.
+
+Flags:`
+
+// statusReport is the response of GET /admin/status
+type statusReport struct {
+	Version struct {
+		Version string `json:"version"`
+	} `json:"version"`
+	UptimeSeconds    int64 `json:"uptime_seconds"`
+	InflightRequests int   `json:"inflight_requests"`
+	CopilotToken     struct {
+		Status           string     `json:"status"`
+		ExpiresAt        *time.Time `json:"expires_at"`
+		ExpiresInSeconds *int64     `json:"expires_in_seconds"`
+		RefreshAt        *time.Time `json:"refresh_at"`
+	} `json:"copilot_token"`
+	UpstreamRateLimits []struct {
+		Endpoint   string            `json:"endpoint"`
+		ObservedAt time.Time         `json:"observed_at"`
+		RateLimits map[string]string `json:"rate_limits"`
+		Quotas     map[string]struct {
+			Unlimited        bool    `json:"unlimited"`
+			RemainingPercent float64 `json:"remaining_percent"`
+		} `json:"quotas"`
+	} `json:"upstream_rate_limits"`
+}
+
+// runStatus implements the "status" subcommand
+func runStatus(args []string) error {
+	var opts topOptions
+	fs := flag.NewFlagSet("status", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), statusUsage)
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&opts.url, "url", "http://localhost:8080", "Base URL of the running instance or its admin listener")
+	fs.StringVar(&opts.adminKey, "key", os.Getenv("GHCSD_ADMIN_KEY"), "Admin key sent as a bearer token (default $GHCSD_ADMIN_KEY)")
+	asJSON := fs.Bool("json", false, "Print the status as JSON")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+	opts.url = strings.TrimSuffix(opts.url, "/")
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := topGet(context.Background(), client, opts, "/admin/status")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var raw json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		return fmt.Errorf("invalid status: %w", err)
+	}
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(raw)
+	}
+	var report statusReport
+	if err := json.Unmarshal(raw, &report); err != nil {
+		return fmt.Errorf("invalid status: %w", err)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Version\t%s\n", report.Version.Version)
+	fmt.Fprintf(tw, "Uptime\t%s\n", time.Duration(report.UptimeSeconds)*time.Second)
+	fmt.Fprintf(tw, "In-flight requests\t%d\n", report.InflightRequests)
+	fmt.Fprintf(tw, "Copilot token\t%s\n", describeToken(report))
+	if token := report.CopilotToken; token.RefreshAt != nil {
+		fmt.Fprintf(tw, "Token renewal due\t%s\n", token.RefreshAt.Local().Format(time.RFC3339))
+	}
+	for _, limits := range report.UpstreamRateLimits {
+		var fields []string
+		for name, quota := range limits.Quotas {
+			if quota.Unlimited {
+				fields = append(fields, name+" unlimited")
+			} else {
+				fields = append(fields, fmt.Sprintf("%s %.1f%% left", name, quota.RemainingPercent))
+			}
+		}
+		sort.Strings(fields)
+		if remaining, ok := limits.RateLimits["remaining"]; ok {
+			fields = append(fields, remaining+" requests left")
+		}
+		fmt.Fprintf(tw, "Upstream %s\t%s (as of %s)\n", limits.Endpoint, strings.Join(fields, ", "), limits.ObservedAt.Local().Format(time.RFC3339))
+	}
+	return tw.Flush()
+}
+
+// describeToken describes the state and expiry of the Copilot token
+func describeToken(report statusReport) string {
+	token := report.CopilotToken
+	if token.ExpiresAt == nil || token.ExpiresInSeconds == nil {
+		return token.Status
+	}
+	expiresAt := token.ExpiresAt.Local().Format(time.RFC3339)
+	expiresIn := time.Duration(*token.ExpiresInSeconds) * time.Second
+	if expiresIn <= 0 {
+		return fmt.Sprintf("%s at %s", token.Status, expiresAt)
+	}
+	return fmt.Sprintf("%s, expires in %s at %s", token.Status, expiresIn, expiresAt)
+}
@@ -0,0 +1,491 @@
+// cmd/server/top.go
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/acazau/ghcsd/internal/events"
+)
+
+const topUsage = `usage: ghcsd top [flags]
+
+Shows a live view of a running instance: request and error rates, active
+requests and streams, token usage, latency and throughput per model and
+recent errors. Reads the metrics and admin endpoints; point -url at the
+admin listener when one is configured.
+
+Flags:`
+
+const (
+	// topMaxRequests is the number of active requests listed
+	topMaxRequests = 15
+	// topMaxErrors is the number of recent errors kept
+	topMaxErrors = 10
+)
+
+// topOptions are the settings of the top command
+type topOptions struct {
+	url      string
+	adminKey string
+	interval time.Duration
+}
+
+// topSample is what one poll of the metrics endpoint reported
+type topSample struct {
+	at       time.Time
+	requests float64
+	errors   float64
+	tokens   map[string]float64
+}
+
+// topError is a failed request or error event shown in the error list
+type topError struct {
+	time      time.Time
+	requestID string
+	message   string
+}
+
+// topRequest is an active request as listed by GET /admin/requests
+type topRequest struct {
+	ID             string `json:"id"`
+	Model          string `json:"model"`
+	Caller         string `json:"caller"`
+	User           string `json:"user"`
+	Stream         bool   `json:"stream"`
+	DurationMs     int64  `json:"duration_ms"`
+	TokensStreamed int64  `json:"tokens_streamed"`
+}
+
+// topModelStats are the statistics of a model as reported by GET /admin/stats
+type topModelStats struct {
+	Model   string `json:"model"`
+	Windows map[string]struct {
+		Requests        int64   `json:"requests"`
+		ErrorRate       float64 `json:"error_rate"`
+		TTFTMs          float64 `json:"ttft_ms"`
+		TokensPerSecond float64 `json:"tokens_per_second"`
+	} `json:"windows"`
+}
+
+// topErrors keeps the most recent errors seen on the log stream
+type topErrors struct {
+	mu     sync.Mutex
+	recent []topError
+	// connErr describes why the log stream is disconnected
+	connErr string
+}
+
+func (e *topErrors) add(err topError) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.recent = append(e.recent, err)
+	if len(e.recent) > topMaxErrors {
+		e.recent = e.recent[len(e.recent)-topMaxErrors:]
+	}
+}
+
+func (e *topErrors) setConnErr(msg string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.connErr = msg
+}
+
+func (e *topErrors) snapshot() ([]topError, string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]topError(nil), e.recent...), e.connErr
+}
+
+// runTop implements the "top" subcommand
+func runTop(args []string) error {
+	var opts topOptions
+	fs := flag.NewFlagSet("top", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), topUsage)
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&opts.url, "url", "http://localhost:8080", "Base URL of the running instance or its admin listener")
+	fs.StringVar(&opts.adminKey, "key", os.Getenv("GHCSD_ADMIN_KEY"), "Admin key sent as a bearer token (default $GHCSD_ADMIN_KEY)")
+	fs.DurationVar(&opts.interval, "interval", 2*time.Second, "Refresh interval")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+	if opts.interval < 100*time.Millisecond {
+		return errors.New("-interval must be at least 100ms")
+	}
+	opts.url = strings.TrimSuffix(opts.url, "/")
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	recent := &topErrors{}
+	go followTopErrors(ctx, opts, recent)
+
+	// Draw on the alternate screen so that the terminal is left as it was
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	defer fmt.Print("\x1b[?25h\x1b[?1049l")
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	ticker := time.NewTicker(opts.interval)
+	defer ticker.Stop()
+	var prev *topSample
+	for {
+		sample, metricsErr := fetchTopSample(ctx, client, opts)
+		requests, requestsErr := fetchTopRequests(ctx, client, opts)
+		stats, statsErr := fetchTopStats(ctx, client, opts)
+		errs, connErr := recent.snapshot()
+
+		var b bytes.Buffer
+		b.WriteString("\x1b[H\x1b[2J")
+		renderTop(&b, opts, prev, sample, metricsErr, requests, requestsErr, stats, statsErr, errs, connErr)
+		os.Stdout.Write(b.Bytes())
+		if sample != nil {
+			prev = sample
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// topGet sends an authorized GET request to path
+func topGet(ctx context.Context, client *http.Client, opts topOptions, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, opts.url+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if opts.adminKey != "" {
+		req.Header.Set("Authorization", "Bearer "+opts.adminKey)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: HTTP %d", path, resp.StatusCode)
+	}
+	return resp, nil
+}
+
+// fetchTopSample reads the request and token counters from /metrics
+func fetchTopSample(ctx context.Context, client *http.Client, opts topOptions) (*topSample, error) {
+	resp, err := topGet(ctx, client, opts, "/metrics")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	sample := &topSample{at: time.Now(), tokens: make(map[string]float64)}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		name, labels, value, ok := parseMetricLine(scanner.Text())
+		if !ok {
+			continue
+		}
+		switch name {
+		case "ghcsd_requests_total":
+			sample.requests += value
+			if status, _ := strconv.Atoi(labels["status"]); status >= 400 {
+				sample.errors += value
+			}
+		case "ghcsd_tokens_total":
+			sample.tokens[labels["model"]] = value
+		}
+	}
+	return sample, scanner.Err()
+}
+
+// parseMetricLine parses a sample line of the Prometheus text format
+func parseMetricLine(line string) (name string, labels map[string]string, value float64, ok bool) {
+	if line == "" || line[0] == '#' {
+		return "", nil, 0, false
+	}
+	series, rawValue, found := strings.Cut(line, " ")
+	if !found {
+		return "", nil, 0, false
+	}
+	value, err := strconv.ParseFloat(strings.TrimSpace(rawValue), 64)
+	if err != nil {
+		return "", nil, 0, false
+	}
+	name, rest, hasLabels := strings.Cut(series, "{")
+	labels = make(map[string]string)
+	if !hasLabels {
+		return name, labels, value, true
+	}
+	rest = strings.TrimSuffix(rest, "}")
+	for rest != "" {
+		key, quoted, found := strings.Cut(rest, "=")
+		if !found {
+			return "", nil, 0, false
+		}
+		prefix, err := strconv.QuotedPrefix(quoted)
+		if err != nil {
+			return "", nil, 0, false
+		}
+		labels[key], _ = strconv.Unquote(prefix)
+		rest = strings.TrimPrefix(quoted[len(prefix):], ",")
+	}
+	return name, labels, value, true
+}
+
+// fetchTopRequests lists the active requests
+func fetchTopRequests(ctx context.Context, client *http.Client, opts topOptions) ([]topRequest, error) {
+	resp, err := topGet(ctx, client, opts, "/admin/requests")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var list struct {
+		Requests []topRequest `json:"requests"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("invalid request list: %w", err)
+	}
+	return list.Requests, nil
+}
+
+// fetchTopStats reads the latency and throughput statistics of the models
+func fetchTopStats(ctx context.Context, client *http.Client, opts topOptions) ([]topModelStats, error) {
+	resp, err := topGet(ctx, client, opts, "/admin/stats")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var list struct {
+		Models []topModelStats `json:"models"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("invalid model statistics: %w", err)
+	}
+	return list.Models, nil
+}
+
+// followTopErrors collects errors from the admin log stream until ctx is
+// done, reconnecting when the stream ends
+func followTopErrors(ctx context.Context, opts topOptions, recent *topErrors) {
+	client := &http.Client{}
+	for ctx.Err() == nil {
+		err := readTopErrors(ctx, client, opts, recent)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			err = errors.New("log stream ended")
+		}
+		recent.setConnErr(err.Error())
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(opts.interval):
+		}
+	}
+}
+
+func readTopErrors(ctx context.Context, client *http.Client, opts topOptions, recent *topErrors) error {
+	resp, err := topGet(ctx, client, opts, "/admin/logs/stream")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	recent.setConnErr("")
+
+	// The replayed history fills the list again after a reconnect
+	recent.mu.Lock()
+	recent.recent = nil
+	recent.mu.Unlock()
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		data, ok := bytes.CutPrefix(scanner.Bytes(), []byte("data: "))
+		if !ok {
+			continue
+		}
+		var event events.Event
+		if err := json.Unmarshal(data, &event); err != nil {
+			continue
+		}
+		if message := topErrorMessage(event); message != "" {
+			recent.add(topError{time: event.Time, requestID: event.RequestID, message: message})
+		}
+	}
+	return scanner.Err()
+}
+
+// topErrorMessage describes an error event or a failed request, or returns
+// "" for other events
+func topErrorMessage(event events.Event) string {
+	switch event.Type {
+	case events.TypeError:
+		message := fmt.Sprint(event.Fields["error"])
+		if model, ok := event.Fields["model"].(string); ok && model != "" {
+			message = model + ": " + message
+		}
+		return message
+	case events.TypeRequestFinished:
+		status, _ := event.Fields["status"].(float64)
+		if status < 400 {
+			return ""
+		}
+		return fmt.Sprintf("%v %v -> %d", event.Fields["method"], event.Fields["path"], int(status))
+	}
+	return ""
+}
+
+// renderTop draws one frame of the view
+func renderTop(out io.Writer, opts topOptions, prev, sample *topSample, metricsErr error,
+	requests []topRequest, requestsErr error, stats []topModelStats, statsErr error, errs []topError, connErr string) {
+	fmt.Fprintf(out, "ghcsd top - %s - %s (every %s, Ctrl-C to quit)\n\n",
+		opts.url, time.Now().Format("15:04:05"), opts.interval)
+
+	streams := 0
+	for _, req := range requests {
+		if req.Stream {
+			streams++
+		}
+	}
+	switch {
+	case metricsErr != nil:
+		fmt.Fprintf(out, "Metrics unavailable: %v\n", metricsErr)
+	case prev == nil:
+		fmt.Fprintf(out, "Requests %.0f total, %.0f errors\n", sample.requests, sample.errors)
+	default:
+		elapsed := sample.at.Sub(prev.at).Seconds()
+		fmt.Fprintf(out, "Requests %.1f/s   Errors %.1f/s   (%.0f total, %.0f errors)\n",
+			counterRate(sample.requests, prev.requests, elapsed), counterRate(sample.errors, prev.errors, elapsed),
+			sample.requests, sample.errors)
+	}
+	if requestsErr == nil {
+		fmt.Fprintf(out, "Active %d   Streams %d\n", len(requests), streams)
+	}
+
+	fmt.Fprintln(out, "\nTOKENS BY MODEL")
+	if sample != nil && len(sample.tokens) > 0 {
+		models := make([]string, 0, len(sample.tokens))
+		for model := range sample.tokens {
+			models = append(models, model)
+		}
+		sort.Slice(models, func(i, j int) bool { return sample.tokens[models[i]] > sample.tokens[models[j]] })
+		tw := tabwriter.NewWriter(out, 0, 0, 3, ' ', 0)
+		fmt.Fprintln(tw, "MODEL\tTOTAL\tPER SECOND")
+		for _, model := range models {
+			perSecond := "-"
+			if prev != nil {
+				perSecond = fmt.Sprintf("%.1f", counterRate(sample.tokens[model], prev.tokens[model], sample.at.Sub(prev.at).Seconds()))
+			}
+			fmt.Fprintf(tw, "%s\t%.0f\t%s\n", model, sample.tokens[model], perSecond)
+		}
+		tw.Flush()
+	} else if metricsErr == nil {
+		fmt.Fprintln(out, "No tokens used yet")
+	}
+
+	fmt.Fprintln(out, "\nMODEL LATENCY (LAST 5M / LAST 1H)")
+	switch {
+	case statsErr != nil:
+		fmt.Fprintf(out, "Unavailable: %v\n", statsErr)
+	case len(stats) == 0:
+		fmt.Fprintln(out, "No completions in the last hour")
+	default:
+		// Fastest first token first, so the quickest model tops the list
+		sort.Slice(stats, func(i, j int) bool {
+			return stats[i].Windows["last_1h"].TTFTMs < stats[j].Windows["last_1h"].TTFTMs
+		})
+		tw := tabwriter.NewWriter(out, 0, 0, 3, ' ', 0)
+		fmt.Fprintln(tw, "MODEL\tREQUESTS\tERRORS\tTTFT\tTOKENS/S")
+		for _, model := range stats {
+			short, long := model.Windows["last_5m"], model.Windows["last_1h"]
+			fmt.Fprintf(tw, "%s\t%d / %d\t%.0f%% / %.0f%%\t%s / %s\t%.1f / %.1f\n", model.Model,
+				short.Requests, long.Requests, short.ErrorRate*100, long.ErrorRate*100,
+				topMillis(short.TTFTMs), topMillis(long.TTFTMs), short.TokensPerSecond, long.TokensPerSecond)
+		}
+		tw.Flush()
+	}
+
+	fmt.Fprintln(out, "\nACTIVE REQUESTS")
+	switch {
+	case requestsErr != nil:
+		fmt.Fprintf(out, "Unavailable: %v\n", requestsErr)
+	case len(requests) == 0:
+		fmt.Fprintln(out, "None")
+	default:
+		// Longest running first
+		sort.Slice(requests, func(i, j int) bool { return requests[i].DurationMs > requests[j].DurationMs })
+		tw := tabwriter.NewWriter(out, 0, 0, 3, ' ', 0)
+		fmt.Fprintln(tw, "ID\tMODEL\tCALLER\tSTREAM\tAGE\tTOKENS")
+		for i, req := range requests {
+			if i == topMaxRequests {
+				fmt.Fprintf(tw, "... %d more\n", len(requests)-i)
+				break
+			}
+			caller := req.Caller
+			if req.User != "" {
+				caller += " (" + req.User + ")"
+			}
+			age := (time.Duration(req.DurationMs) * time.Millisecond).Round(100 * time.Millisecond)
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%t\t%s\t%d\n", req.ID, req.Model, caller, req.Stream, age, req.TokensStreamed)
+		}
+		tw.Flush()
+	}
+
+	fmt.Fprintln(out, "\nRECENT ERRORS")
+	if connErr != "" {
+		fmt.Fprintf(out, "Log stream disconnected: %s\n", connErr)
+	}
+	if len(errs) == 0 {
+		fmt.Fprintln(out, "None")
+	}
+	for i := len(errs) - 1; i >= 0; i-- {
+		e := errs[i]
+		fmt.Fprintf(out, "%s  %s  %s\n", e.time.Local().Format("15:04:05"), e.requestID, e.message)
+	}
+}
+
+// topMillis formats a mean duration in milliseconds, "-" when unknown
+func topMillis(ms float64) string {
+	if ms <= 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.0fms", ms)
+}
+
+// counterRate returns the per second increase of a counter, treating a reset as
+// a fresh start
+func counterRate(current, previous, seconds float64) float64 {
+	if seconds <= 0 {
+		return 0
+	}
+	if current < previous {
+		previous = 0
+	}
+	return (current - previous) / seconds
+}
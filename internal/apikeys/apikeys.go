@@ -0,0 +1,307 @@
+// internal/apikeys/apikeys.go
+package apikeys
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/acazau/ghcsd/internal/config"
+)
+
+// secretPrefix starts every generated key secret
+const secretPrefix = "ghcsd-"
+
+var (
+	// ErrNotFound is returned when no key has the requested name
+	ErrNotFound = errors.New("API key not found")
+	// ErrExists is returned when creating a key whose name is taken
+	ErrExists = errors.New("API key already exists")
+	// ErrInvalid wraps errors in the attributes of a created or updated key
+	ErrInvalid = errors.New("invalid API key")
+)
+
+// Key is a named client API key and the limits that apply to its requests
+type Key struct {
+	Name string `json:"name"`
+	// Secret is the value clients send as a bearer token or in x-api-key
+	Secret string `json:"key"`
+	// Models lists the models the key may use; empty allows every model
+	Models []string `json:"models,omitempty"`
+	// MaxTokens caps max_tokens of every request; 0 leaves it unchanged
+	MaxTokens int `json:"max_tokens,omitempty"`
+	// RateLimitClass names the rate limit class the key belongs to
+	RateLimitClass string `json:"rate_limit_class,omitempty"`
+	// PromptOverflow overrides the server's policy for prompts exceeding the
+	// model's context window
+	PromptOverflow string `json:"prompt_overflow,omitempty"`
+	// DailySpendLimit and MonthlySpendLimit cap the estimated spend of the
+	// key per UTC day and calendar month; 0 for no limit
+	DailySpendLimit   float64    `json:"daily_spend_limit,omitempty"`
+	MonthlySpendLimit float64    `json:"monthly_spend_limit,omitempty"`
+	ExpiresAt         *time.Time `json:"expires_at,omitempty"`
+	CreatedAt         time.Time  `json:"created_at"`
+}
+
+// Expired reports whether the key has expired at now
+func (k *Key) Expired(now time.Time) bool {
+	return k.ExpiresAt != nil && !now.Before(*k.ExpiresAt)
+}
+
+// AllowsModel reports whether the key may use any of the given model names,
+// typically the requested alias and the real model ID it resolves to
+func (k *Key) AllowsModel(names ...string) bool {
+	if len(k.Models) == 0 {
+		return true
+	}
+	for _, allowed := range k.Models {
+		for _, name := range names {
+			if strings.EqualFold(allowed, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Masked returns a copy of the key safe to display, with all but the start
+// of the secret hidden
+func (k Key) Masked() Key {
+	if len(k.Secret) > len(secretPrefix)+4 {
+		k.Secret = k.Secret[:len(secretPrefix)+4] + "..."
+	} else {
+		k.Secret = "..."
+	}
+	return k
+}
+
+// file is the on-disk format of the store
+type file struct {
+	// RateLimitClasses maps class names to requests per minute
+	RateLimitClasses map[string]int `json:"rate_limit_classes,omitempty"`
+	Keys             []*Key         `json:"keys"`
+}
+
+// Store holds the named API keys, persisted as a JSON file
+type Store struct {
+	mu      sync.RWMutex
+	path    string
+	classes map[string]int
+	keys    map[string]*Key
+}
+
+// Open loads the store from path. A missing file is an empty store that is
+// created on the first change.
+func Open(path string) (*Store, error) {
+	s := &Store{
+		path:    path,
+		classes: make(map[string]int),
+		keys:    make(map[string]*Key),
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read API keys: %w", err)
+	}
+
+	var f file
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse API keys %s: %w", path, err)
+	}
+	for class, perMinute := range f.RateLimitClasses {
+		s.classes[class] = perMinute
+	}
+	for _, key := range f.Keys {
+		if err := s.validate(key); err != nil {
+			return nil, fmt.Errorf("invalid API key in %s: %w", path, err)
+		}
+		if _, ok := s.keys[key.Name]; ok {
+			return nil, fmt.Errorf("duplicate API key name in %s: %s", path, key.Name)
+		}
+		s.keys[key.Name] = key
+	}
+	return s, nil
+}
+
+// validate checks the attributes of a key against the store
+func (s *Store) validate(key *Key) error {
+	if key.Name == "" {
+		return errors.New("name is required")
+	}
+	if key.Secret == "" {
+		return fmt.Errorf("key %s has no secret", key.Name)
+	}
+	if key.MaxTokens < 0 {
+		return fmt.Errorf("key %s: max_tokens must not be negative", key.Name)
+	}
+	if key.DailySpendLimit < 0 || key.MonthlySpendLimit < 0 {
+		return fmt.Errorf("key %s: spend limits must not be negative", key.Name)
+	}
+	if key.PromptOverflow != "" && !config.ValidOverflowPolicy(key.PromptOverflow) {
+		return fmt.Errorf("key %s: unknown prompt_overflow %s", key.Name, key.PromptOverflow)
+	}
+	if key.RateLimitClass != "" {
+		if _, ok := s.classes[key.RateLimitClass]; !ok {
+			return fmt.Errorf("key %s: unknown rate limit class %s", key.Name, key.RateLimitClass)
+		}
+	}
+	return nil
+}
+
+// Lookup returns the key with the given secret. A nil store holds no keys.
+func (s *Store) Lookup(secret string) (*Key, bool) {
+	if s == nil || secret == "" {
+		return nil, false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, key := range s.keys {
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(key.Secret)) == 1 {
+			copied := *key
+			return &copied, true
+		}
+	}
+	return nil, false
+}
+
+// RateLimit returns the requests per minute of a rate limit class, 0 for
+// no limit
+func (s *Store) RateLimit(class string) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.classes[class]
+}
+
+// List returns all keys sorted by name
+func (s *Store) List() []Key {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := make([]Key, 0, len(s.keys))
+	for _, key := range s.keys {
+		keys = append(keys, *key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Name < keys[j].Name })
+	return keys
+}
+
+// Get returns the key with the given name
+func (s *Store) Get(name string) (Key, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	key, ok := s.keys[name]
+	if !ok {
+		return Key{}, ErrNotFound
+	}
+	return *key, nil
+}
+
+// Create adds a key, generating its secret when none is set, and returns it
+func (s *Store) Create(key Key) (Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.keys[key.Name]; ok {
+		return Key{}, ErrExists
+	}
+	if key.Secret == "" {
+		secret, err := generateSecret()
+		if err != nil {
+			return Key{}, err
+		}
+		key.Secret = secret
+	}
+	key.CreatedAt = time.Now().UTC()
+	if err := s.validate(&key); err != nil {
+		return Key{}, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+
+	s.keys[key.Name] = &key
+	if err := s.save(); err != nil {
+		delete(s.keys, key.Name)
+		return Key{}, err
+	}
+	return key, nil
+}
+
+// Update replaces the attributes of an existing key, keeping its secret and
+// creation time
+func (s *Store) Update(key Key) (Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	existing, ok := s.keys[key.Name]
+	if !ok {
+		return Key{}, ErrNotFound
+	}
+	key.Secret = existing.Secret
+	key.CreatedAt = existing.CreatedAt
+	if err := s.validate(&key); err != nil {
+		return Key{}, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+
+	s.keys[key.Name] = &key
+	if err := s.save(); err != nil {
+		s.keys[key.Name] = existing
+		return Key{}, err
+	}
+	return key, nil
+}
+
+// Delete removes the key with the given name
+func (s *Store) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	existing, ok := s.keys[name]
+	if !ok {
+		return ErrNotFound
+	}
+	delete(s.keys, name)
+	if err := s.save(); err != nil {
+		s.keys[name] = existing
+		return err
+	}
+	return nil
+}
+
+// save writes the store to disk atomically. The caller must hold the lock.
+func (s *Store) save() error {
+	f := file{RateLimitClasses: s.classes, Keys: make([]*Key, 0, len(s.keys))}
+	for _, key := range s.keys {
+		f.Keys = append(f.Keys, key)
+	}
+	sort.Slice(f.Keys, func(i, j int) bool { return f.Keys[i].Name < f.Keys[j].Name })
+
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode API keys: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return fmt.Errorf("failed to create API keys directory: %w", err)
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write API keys: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("failed to write API keys: %w", err)
+	}
+	return nil
+}
+
+// generateSecret returns a new random key secret
+func generateSecret() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate API key: %w", err)
+	}
+	return secretPrefix + hex.EncodeToString(buf), nil
+}
@@ -0,0 +1,102 @@
+// internal/audit/audit.go
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/acazau/ghcsd/internal/logfile"
+	"github.com/acazau/ghcsd/pkg/logging"
+)
+
+// auditLog reports the entries that could not be written
+var auditLog = logging.For(logging.Audit)
+
+// Entry is a single audited request/response pair
+type Entry struct {
+	Time             time.Time `json:"time"`
+	RequestID        string    `json:"request_id"`
+	Caller           string    `json:"caller"`
+	ClientIP         string    `json:"client_ip,omitempty"`
+	EndUser          string    `json:"end_user,omitempty"`
+	Endpoint         string    `json:"endpoint"`
+	Model            string    `json:"model"`
+	Stream           bool      `json:"stream"`
+	Status           int       `json:"status"`
+	LatencyMs        int64     `json:"latency_ms"`
+	PromptTokens     int       `json:"prompt_tokens,omitempty"`
+	CompletionTokens int       `json:"completion_tokens,omitempty"`
+	Request          string    `json:"request"`
+	Response         string    `json:"response,omitempty"`
+	Error            string    `json:"error,omitempty"`
+	FilterTriggers   []string  `json:"filter_triggers,omitempty"`
+
+	// Tags are set on the request by the hook script
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+// Options configures an audit Logger
+type Options struct {
+	Dir            string
+	MaxSizeMB      int
+	MaxFiles       int
+	RedactPatterns []string
+}
+
+// Logger writes redacted audit entries as JSON lines
+type Logger struct {
+	mu       sync.Mutex
+	out      io.WriteCloser
+	redactor *Redactor
+}
+
+// NewLogger creates a logger writing to rotating audit.jsonl files in opts.Dir
+func NewLogger(opts Options) (*Logger, error) {
+	redactor, err := NewRedactor(opts.RedactPatterns)
+	if err != nil {
+		return nil, err
+	}
+	out, err := logfile.Open(filepath.Join(opts.Dir, "audit.jsonl"), logfile.Options{
+		MaxSize:  int64(opts.MaxSizeMB) * 1024 * 1024,
+		MaxFiles: opts.MaxFiles,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	return &Logger{out: out, redactor: redactor}, nil
+}
+
+// Log redacts and writes the entry. Failures are logged but never returned,
+// auditing must not break request handling.
+func (l *Logger) Log(entry Entry) {
+	if l == nil {
+		return
+	}
+	entry.Request = l.redactor.Redact(entry.Request)
+	entry.Response = l.redactor.Redact(entry.Response)
+	entry.Error = l.redactor.Redact(entry.Error)
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		auditLog.Errorf("[Audit] Failed to encode entry: %v", err)
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.out.Write(append(data, '\n')); err != nil {
+		auditLog.Errorf("[Audit] Failed to write entry: %v", err)
+	}
+}
+
+// Close flushes and closes the underlying file
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+	return l.out.Close()
+}
@@ -0,0 +1,46 @@
+// internal/audit/redact.go
+package audit
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// redactedPlaceholder replaces every secret found in audited text
+const redactedPlaceholder = "[REDACTED]"
+
+// defaultRedactPatterns match common credentials that should never end up in audit logs
+var defaultRedactPatterns = []string{
+	`(?i)bearer\s+[A-Za-z0-9._~+/=-]{8,}`,
+	`sk-[A-Za-z0-9_-]{16,}`,
+	`gh[pousr]_[A-Za-z0-9]{20,}`,
+	`github_pat_[A-Za-z0-9_]{20,}`,
+	`AKIA[0-9A-Z]{16}`,
+	`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`,
+}
+
+// Redactor replaces secrets in text using a list of regular expressions
+type Redactor struct {
+	patterns []*regexp.Regexp
+}
+
+// NewRedactor compiles the default patterns together with the extra ones
+func NewRedactor(extra []string) (*Redactor, error) {
+	r := &Redactor{}
+	for _, pattern := range append(append([]string{}, defaultRedactPatterns...), extra...) {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redaction pattern %q: %w", pattern, err)
+		}
+		r.patterns = append(r.patterns, re)
+	}
+	return r, nil
+}
+
+// Redact returns text with every match replaced by a placeholder
+func (r *Redactor) Redact(text string) string {
+	for _, re := range r.patterns {
+		text = re.ReplaceAllString(text, redactedPlaceholder)
+	}
+	return text
+}
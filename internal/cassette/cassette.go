@@ -0,0 +1,248 @@
+// internal/cassette/cassette.go
+package cassette
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/acazau/ghcsd/pkg/logging"
+)
+
+// upstreamLog writes the failures to record interactions
+var upstreamLog = logging.For(logging.Upstream)
+
+const (
+	// Record forwards requests upstream and stores every interaction
+	Record = "record"
+	// Replay answers requests from the stored interactions, without network
+	// access
+	Replay = "replay"
+)
+
+// ValidMode reports whether mode is a known cassette mode
+func ValidMode(mode string) bool {
+	return mode == Record || mode == Replay
+}
+
+// redacted replaces secrets in recorded bodies
+const redacted = "REDACTED"
+
+// redactedFields are the JSON fields whose values are redacted from recorded
+// request and response bodies, at any depth
+var redactedFields = map[string]bool{
+	"token":         true,
+	"access_token":  true,
+	"refresh_token": true,
+	"device_code":   true,
+}
+
+// keptHeaders are the response headers recorded; the others may identify
+// the account and are not needed to replay a response
+var keptHeaders = []string{"Content-Type", "Retry-After"}
+
+// Interaction is a recorded request and the response it received. Only the
+// path and query of the URL are kept, so that a cassette recorded against
+// one endpoint replays against another.
+type Interaction struct {
+	Method       string      `json:"method"`
+	URL          string      `json:"url"`
+	RequestBody  string      `json:"request_body,omitempty"`
+	Status       int         `json:"status"`
+	Header       http.Header `json:"header,omitempty"`
+	ResponseBody string      `json:"response_body"`
+	RecordedAt   time.Time   `json:"recorded_at"`
+}
+
+// Transport is an http.RoundTripper recording upstream interactions to
+// sanitized fixture files in a directory, or replaying them from it.
+// Requests are matched by method, path, query and body, after redaction;
+// headers are not compared, so the credentials of a replay do not matter.
+type Transport struct {
+	dir  string
+	mode string
+	next http.RoundTripper
+}
+
+// NewTransport creates a transport recording the interactions of next to
+// dir, or replaying them from dir, depending on mode
+func NewTransport(dir, mode string, next http.RoundTripper) (*Transport, error) {
+	if !ValidMode(mode) {
+		return nil, fmt.Errorf("invalid cassette mode %q, expected %s or %s", mode, Record, Replay)
+	}
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	if mode == Record {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, fmt.Errorf("failed to create cassette directory: %w", err)
+		}
+	} else if _, err := os.Stat(dir); err != nil {
+		return nil, fmt.Errorf("failed to open cassette directory: %w", err)
+	}
+	return &Transport{dir: dir, mode: mode, next: next}, nil
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read request body: %w", err)
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	interaction := Interaction{
+		Method:      req.Method,
+		URL:         req.URL.RequestURI(),
+		RequestBody: sanitizeBody(body),
+	}
+	path := filepath.Join(t.dir, interaction.fileName())
+
+	if t.mode == Replay {
+		return t.replay(req, path)
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	interaction.Status = resp.StatusCode
+	interaction.Header = make(http.Header)
+	for _, name := range keptHeaders {
+		if value := resp.Header.Get(name); value != "" {
+			interaction.Header.Set(name, value)
+		}
+	}
+	// Streams are recorded as they are relayed and stored once complete
+	resp.Body = &recordingBody{ReadCloser: resp.Body, interaction: interaction, path: path}
+	return resp, nil
+}
+
+// replay answers req from the interaction recorded in path
+func (t *Transport) replay(req *http.Request, path string) (*http.Response, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no recorded interaction for %s %s in %s", req.Method, req.URL.RequestURI(), path)
+		}
+		return nil, fmt.Errorf("failed to read recorded interaction: %w", err)
+	}
+	var interaction Interaction
+	if err := json.Unmarshal(data, &interaction); err != nil {
+		return nil, fmt.Errorf("invalid recorded interaction %s: %w", path, err)
+	}
+	header := interaction.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", interaction.Status, http.StatusText(interaction.Status)),
+		StatusCode:    interaction.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(interaction.ResponseBody)),
+		ContentLength: int64(len(interaction.ResponseBody)),
+		Request:       req,
+	}, nil
+}
+
+// fileName names the fixture of the interaction after its request, readable
+// by the path and unique by a hash of the whole request
+func (i Interaction) fileName() string {
+	sum := sha256.Sum256([]byte(i.Method + " " + i.URL + "\n" + i.RequestBody))
+	name := strings.Map(func(c rune) rune {
+		switch {
+		case c >= 'a' && c <= 'z' || c >= '0' && c <= '9':
+			return c
+		case c >= 'A' && c <= 'Z':
+			return c + 'a' - 'A'
+		case c == '/' || c == '-' || c == '_':
+			return '-'
+		}
+		return -1
+	}, i.Method+"-"+strings.Trim(strings.SplitN(i.URL, "?", 2)[0], "/"))
+	return name + "-" + hex.EncodeToString(sum[:8]) + ".json"
+}
+
+// recordingBody copies a response body as it is read and stores the
+// interaction once the body has been read to the end. Bodies closed early
+// are not recorded, since replaying them would truncate the response.
+type recordingBody struct {
+	io.ReadCloser
+	interaction Interaction
+	path        string
+
+	buf  bytes.Buffer
+	once sync.Once
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.Write(p[:n])
+	if err == io.EOF {
+		b.once.Do(b.save)
+	}
+	return n, err
+}
+
+// save writes the interaction, logging failures since the response itself
+// was received
+func (b *recordingBody) save() {
+	b.interaction.ResponseBody = sanitizeBody(b.buf.Bytes())
+	b.interaction.RecordedAt = time.Now().UTC()
+	data, err := json.MarshalIndent(b.interaction, "", "  ")
+	if err == nil {
+		err = os.WriteFile(b.path, append(data, '\n'), 0600)
+	}
+	if err != nil {
+		upstreamLog.Errorf("[Cassette] Failed to record %s %s: %v", b.interaction.Method, b.interaction.URL, err)
+	}
+}
+
+// sanitizeBody redacts the secrets of a JSON body and formats it canonically,
+// with sorted keys, so that equal requests match. Other bodies, including
+// event streams, are kept as they are.
+func sanitizeBody(body []byte) string {
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		return string(body)
+	}
+	data, err := json.Marshal(redact(value))
+	if err != nil {
+		return string(body)
+	}
+	return string(data)
+}
+
+// redact replaces the values of redactedFields in a decoded JSON value
+func redact(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if redactedFields[strings.ToLower(key)] {
+				v[key] = redacted
+			} else {
+				v[key] = redact(field)
+			}
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = redact(v[i])
+		}
+	}
+	return value
+}
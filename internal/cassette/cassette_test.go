@@ -0,0 +1,96 @@
+// internal/cassette/cassette_test.go
+package cassette
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Github-Request-Id", "ABCD:1234")
+		io.WriteString(w, `{"token":"tid=secret;exp=1760745600","expires_at":1760745600}`)
+	}))
+	defer upstream.Close()
+	dir := t.TempDir()
+
+	recorder, err := NewTransport(dir, Record, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("POST", upstream.URL+"/copilot_internal/v2/token?v=1", strings.NewReader(`{"refresh_token":"ghr_secret","b":1,"a":2}`))
+	req.Header.Set("Authorization", "token gho_secret")
+	resp, err := recorder.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorded, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(recorded), "tid=secret") {
+		t.Fatalf("recording changed the response relayed: %s", recorded)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(files) != 1 || !strings.HasPrefix(filepath.Base(files[0]), "post-copilot-internal-v2-token-") {
+		t.Fatalf("recorded files = %v", files)
+	}
+	data, _ := os.ReadFile(files[0])
+	for _, secret := range []string{"tid=secret", "ghr_secret", "gho_secret", "ABCD:1234", upstream.URL} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("recording contains %q: %s", secret, data)
+		}
+	}
+
+	// Replayed without network, with other credentials and key order
+	replayer, err := NewTransport(dir, Replay, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream.Close()
+	req, _ = http.NewRequest("POST", "https://api.example.com/copilot_internal/v2/token?v=1", strings.NewReader(`{"a":2,"b":1,"refresh_token":"ghr_other"}`))
+	resp, err = replayer.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("replayed status %d, headers %v", resp.StatusCode, resp.Header)
+	}
+	if string(replayed) != `{"expires_at":1760745600,"token":"REDACTED"}` {
+		t.Errorf("replayed body = %s", replayed)
+	}
+
+	req, _ = http.NewRequest("POST", "https://api.example.com/copilot_internal/v2/token?v=2", strings.NewReader(`{"a":2,"b":1}`))
+	if _, err := replayer.RoundTrip(req); err == nil || !strings.Contains(err.Error(), "no recorded interaction") {
+		t.Errorf("replaying an unrecorded request gave %v", err)
+	}
+}
+
+func TestIncompleteStreamsAreNotRecorded(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, strings.Repeat("data: {\"choices\":[]}\n\n", 1000))
+	}))
+	defer upstream.Close()
+	dir := t.TempDir()
+	recorder, err := NewTransport(dir, Record, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("POST", upstream.URL+"/chat/completions", strings.NewReader(`{"stream":true}`))
+	resp, err := recorder.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Read(make([]byte, 10))
+	resp.Body.Close()
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.json")); len(files) != 0 {
+		t.Errorf("recorded a stream closed early: %v", files)
+	}
+}
@@ -2,10 +2,26 @@
 package config
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"math"
+	"net/netip"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/acazau/ghcsd/internal/cassette"
+	"github.com/acazau/ghcsd/internal/logfile"
+	"github.com/acazau/ghcsd/internal/transport"
+	"github.com/acazau/ghcsd/pkg/copilot"
+	"github.com/acazau/ghcsd/pkg/logging"
+	"github.com/acazau/ghcsd/pkg/streambuf"
+	"github.com/acazau/ghcsd/pkg/upstream"
 )
 
 // Model represents an AI model with its properties
@@ -13,24 +29,48 @@ type Model struct {
 	ID       string // User-friendly ID for the model
 	RealID   string // Actual ID used in API requests
 	Provider string // Provider of the model (OpenAI, Anthropic, Google)
+	Upstream string // Upstream backend serving the model, empty for Copilot
+	Vision   bool   // Whether the model accepts image input
+	// HeaderProfile is the Copilot header profile requests for the model are
+	// sent with, empty for the server's
+	HeaderProfile string
+	// ContextWindow is the number of prompt tokens Copilot accepts for the model
+	ContextWindow int
+	// MaxOutputTokens is the largest completion the model produces
+	MaxOutputTokens int
+	// Reasoning marks models that think before answering
+	Reasoning bool
+}
+
+// SupportsResponseFormat reports whether the model accepts the OpenAI
+// response_format parameter; other models are instructed through the prompt
+func (m Model) SupportsResponseFormat() bool {
+	return m.Provider == "OpenAI"
+}
+
+// SupportsLogprobs reports whether the model can return the log
+// probabilities of its tokens; reasoning models and those of other providers
+// cannot
+func (m Model) SupportsLogprobs() bool {
+	return m.Provider == "OpenAI" && !m.Reasoning
 }
 
 // List of supported models
 var models = []Model{
-	{ID: "gpt-4", RealID: "gpt-4", Provider: "OpenAI"},
-	{ID: "4", RealID: "gpt-4", Provider: "OpenAI"},
-	{ID: "gpt-4o", RealID: "gpt-4o", Provider: "OpenAI"},
-	{ID: "4o", RealID: "gpt-4o", Provider: "OpenAI"},
-	{ID: "o1", RealID: "o1", Provider: "OpenAI"},
-	{ID: "o3-mini", RealID: "o3-mini", Provider: "OpenAI"},
-	{ID: "sonnet", RealID: "claude-3.7-sonnet", Provider: "Anthropic"},
-	{ID: "claude-3.5-sonnet", RealID: "claude-3.5-sonnet", Provider: "Anthropic"},
-	{ID: "claude-3.7-sonnet", RealID: "claude-3.7-sonnet", Provider: "Anthropic"},
-	{ID: "claude-3.7-sonnet-thought", RealID: "claude-3.7-sonnet-thought", Provider: "Anthropic"},
-	{ID: "gemini-2.0-flash", RealID: "gemini-2.0-flash-001", Provider: "Google"},
-	{ID: "gemini-2.5-pro", RealID: "gemini-2.5-pro-preview-03-25", Provider: "Google"},
-	{ID: "gemini-flash", RealID: "gemini-2.0-flash-001", Provider: "Google"},
-	{ID: "gemini-pro", RealID: "gemini-2.5-pro-preview-03-25", Provider: "Google"},
+	{ID: "gpt-4", RealID: "gpt-4", Provider: "OpenAI", ContextWindow: 32768, MaxOutputTokens: 4096},
+	{ID: "4", RealID: "gpt-4", Provider: "OpenAI", ContextWindow: 32768, MaxOutputTokens: 4096},
+	{ID: "gpt-4o", RealID: "gpt-4o", Provider: "OpenAI", Vision: true, ContextWindow: 128000, MaxOutputTokens: 16384},
+	{ID: "4o", RealID: "gpt-4o", Provider: "OpenAI", Vision: true, ContextWindow: 128000, MaxOutputTokens: 16384},
+	{ID: "o1", RealID: "o1", Provider: "OpenAI", ContextWindow: 200000, MaxOutputTokens: 100000, Reasoning: true},
+	{ID: "o3-mini", RealID: "o3-mini", Provider: "OpenAI", ContextWindow: 200000, MaxOutputTokens: 100000, Reasoning: true},
+	{ID: "sonnet", RealID: "claude-3.7-sonnet", Provider: "Anthropic", Vision: true, ContextWindow: 200000, MaxOutputTokens: 16384},
+	{ID: "claude-3.5-sonnet", RealID: "claude-3.5-sonnet", Provider: "Anthropic", Vision: true, ContextWindow: 90000, MaxOutputTokens: 8192},
+	{ID: "claude-3.7-sonnet", RealID: "claude-3.7-sonnet", Provider: "Anthropic", Vision: true, ContextWindow: 200000, MaxOutputTokens: 16384},
+	{ID: "claude-3.7-sonnet-thought", RealID: "claude-3.7-sonnet-thought", Provider: "Anthropic", Vision: true, ContextWindow: 200000, MaxOutputTokens: 16384, Reasoning: true},
+	{ID: "gemini-2.0-flash", RealID: "gemini-2.0-flash-001", Provider: "Google", Vision: true, ContextWindow: 128000, MaxOutputTokens: 8192},
+	{ID: "gemini-2.5-pro", RealID: "gemini-2.5-pro-preview-03-25", Provider: "Google", Vision: true, ContextWindow: 128000, MaxOutputTokens: 65536, Reasoning: true},
+	{ID: "gemini-flash", RealID: "gemini-2.0-flash-001", Provider: "Google", Vision: true, ContextWindow: 128000, MaxOutputTokens: 8192},
+	{ID: "gemini-pro", RealID: "gemini-2.5-pro-preview-03-25", Provider: "Google", Vision: true, ContextWindow: 128000, MaxOutputTokens: 65536, Reasoning: true},
 }
 
 // modelMap provides quick lookups for model validation and mapping
@@ -79,21 +119,717 @@ func GetModelInfo(modelName string) (Model, bool) {
 	return model, ok
 }
 
+// SetModelUpstream selects the upstream backend serving a model
+func SetModelUpstream(modelName, upstream string) error {
+	key := strings.ToLower(modelName)
+	model, ok := modelMap[key]
+	if !ok {
+		return fmt.Errorf("invalid model: %s", modelName)
+	}
+	model.Upstream = upstream
+	modelMap[key] = model
+	return nil
+}
+
+// applyModelUpstreams parses "model=upstream" pairs and applies them
+func applyModelUpstreams(pairs []string) error {
+	for _, pair := range pairs {
+		modelName, upstream, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(upstream) == "" {
+			return fmt.Errorf("invalid model upstream %q, expected model=upstream", pair)
+		}
+		if err := SetModelUpstream(strings.TrimSpace(modelName), strings.TrimSpace(upstream)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyModelHeaderProfiles parses "model=profile" pairs and applies them
+func applyModelHeaderProfiles(pairs []string) error {
+	for _, pair := range pairs {
+		modelName, profile, ok := strings.Cut(pair, "=")
+		modelName, profile = strings.TrimSpace(modelName), strings.TrimSpace(profile)
+		if !ok || profile == "" {
+			return fmt.Errorf("invalid model header profile %q, expected model=profile", pair)
+		}
+		if _, ok := copilot.LookupHeaderProfile(profile); !ok {
+			return fmt.Errorf("unknown header profile %q of model %s, expected one of %s", profile, modelName, strings.Join(copilot.HeaderProfileNames(), ", "))
+		}
+		key := strings.ToLower(modelName)
+		model, ok := modelMap[key]
+		if !ok {
+			return fmt.Errorf("invalid model: %s", modelName)
+		}
+		model.HeaderProfile = profile
+		modelMap[key] = model
+	}
+	return nil
+}
+
+// Policies for prompts that exceed the model's context window
+const (
+	// OverflowReject rejects the request with an error
+	OverflowReject = "reject"
+	// OverflowTruncate drops the oldest messages until the prompt fits
+	OverflowTruncate = "truncate"
+	// OverflowCompact replaces the oldest messages with a summary written by
+	// the compaction model, truncating if the prompt still does not fit
+	OverflowCompact = "compact"
+)
+
+// Tool call validation modes
+const (
+	// ToolValidationOff forwards tool calls unchecked
+	ToolValidationOff = "off"
+	// ToolValidationAnnotate reports tool calls not matching their schema
+	ToolValidationAnnotate = "annotate"
+	// ToolValidationRetry asks the model once to correct invalid tool calls
+	// before reporting them
+	ToolValidationRetry = "retry"
+)
+
+// ValidToolValidation reports whether mode is a known tool validation mode
+func ValidToolValidation(mode string) bool {
+	return mode == ToolValidationOff || mode == ToolValidationAnnotate || mode == ToolValidationRetry
+}
+
+// Transcript file formats
+const (
+	TranscriptJSONL    = "jsonl"
+	TranscriptMarkdown = "markdown"
+)
+
+// ValidOverflowPolicy reports whether policy is a known overflow policy
+func ValidOverflowPolicy(policy string) bool {
+	return policy == OverflowReject || policy == OverflowTruncate || policy == OverflowCompact
+}
+
+// ModelBudget limits how much a single model may be used. A zero field leaves
+// that dimension unlimited.
+type ModelBudget struct {
+	// RequestsPerMinute is the number of requests allowed in any one minute window
+	RequestsPerMinute int
+	// TokensPerMinute is the number of prompt and completion tokens allowed in
+	// any one minute window
+	TokensPerMinute int
+	// MaxConcurrent is the number of requests that may be in flight at once
+	MaxConcurrent int
+}
+
+// ModelCost is the price of a model per 1K prompt and completion tokens, in
+// the currency spend limits are set in
+type ModelCost struct {
+	Input  float64
+	Output float64
+}
+
+// parsePrefixes parses comma separated IP addresses and CIDR ranges, read
+// from the environment variable name
+func parsePrefixes(name string, entries []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, entry := range entries {
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(entry)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid %s entry %q, expected an IP address or CIDR range", name, entry)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// parseLogComponents parses "component=level" entries, e.g. "auth=debug"
+func parseLogComponents(entries []string) (map[string]logging.Level, error) {
+	components := make(map[string]logging.Level, len(entries))
+	for _, entry := range entries {
+		component, name, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid GHCSD_LOG_COMPONENTS entry %q, expected component=level", entry)
+		}
+		level, err := logging.ParseLevel(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid GHCSD_LOG_COMPONENTS entry %q: %w", entry, err)
+		}
+		components[strings.ToLower(strings.TrimSpace(component))] = level
+	}
+	if err := (logging.Settings{Components: components}).Validate(); err != nil {
+		return nil, fmt.Errorf("invalid GHCSD_LOG_COMPONENTS: %w", err)
+	}
+	return components, nil
+}
+
+// parseRouteStreamDurations parses "path=duration" entries, e.g.
+// "/v1/responses=20m", where a duration of 0 leaves the route unlimited
+func parseRouteStreamDurations(entries []string) (map[string]time.Duration, error) {
+	durations := make(map[string]time.Duration, len(entries))
+	for _, entry := range entries {
+		path, raw, ok := strings.Cut(entry, "=")
+		path = strings.TrimSpace(path)
+		if !ok || !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("invalid GHCSD_ROUTE_STREAM_DURATIONS entry %q, expected /path=duration", entry)
+		}
+		duration, err := time.ParseDuration(strings.TrimSpace(raw))
+		if err != nil || duration < 0 {
+			return nil, fmt.Errorf("invalid GHCSD_ROUTE_STREAM_DURATIONS entry %q: %q is not a valid duration", entry, raw)
+		}
+		durations[path] = duration
+	}
+	return durations, nil
+}
+
+// parseModelBudgets parses "model=rpm/tpm/concurrent" entries into budgets
+// keyed by real model ID. Trailing fields may be omitted and empty fields
+// are unlimited, e.g. "o1=10/50000" or "gpt-4o=/200000".
+func parseModelBudgets(entries []string) (map[string]ModelBudget, error) {
+	budgets := make(map[string]ModelBudget)
+	for _, entry := range entries {
+		modelName, spec, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid model budget %q, expected model=rpm/tpm/concurrent", entry)
+		}
+		realModelID, valid := ValidateModel(strings.TrimSpace(modelName))
+		if !valid {
+			return nil, fmt.Errorf("invalid model in budget %q", entry)
+		}
+
+		fields := strings.Split(spec, "/")
+		if len(fields) > 3 {
+			return nil, fmt.Errorf("invalid model budget %q, expected model=rpm/tpm/concurrent", entry)
+		}
+		var limits [3]int
+		for i, field := range fields {
+			if field = strings.TrimSpace(field); field == "" {
+				continue
+			}
+			value, err := strconv.Atoi(field)
+			if err != nil || value < 0 {
+				return nil, fmt.Errorf("invalid model budget %q: %q is not a valid limit", entry, field)
+			}
+			limits[i] = value
+		}
+		budgets[realModelID] = ModelBudget{
+			RequestsPerMinute: limits[0],
+			TokensPerMinute:   limits[1],
+			MaxConcurrent:     limits[2],
+		}
+	}
+	return budgets, nil
+}
+
+// parseModelCosts parses "model=input/output" entries, the prices per 1K
+// prompt and completion tokens, into costs keyed by real model ID, e.g.
+// "gpt-4o=0.0025/0.01". An omitted output price equals the input price.
+func parseModelCosts(entries []string) (map[string]ModelCost, error) {
+	costs := make(map[string]ModelCost)
+	for _, entry := range entries {
+		modelName, spec, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid model cost %q, expected model=input/output", entry)
+		}
+		realModelID, valid := ValidateModel(strings.TrimSpace(modelName))
+		if !valid {
+			return nil, fmt.Errorf("invalid model in cost %q", entry)
+		}
+
+		fields := strings.Split(spec, "/")
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("invalid model cost %q, expected model=input/output", entry)
+		}
+		var prices [2]float64
+		for i, field := range fields {
+			value, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+			if err != nil || value < 0 || math.IsNaN(value) || math.IsInf(value, 0) {
+				return nil, fmt.Errorf("invalid model cost %q: %q is not a valid price", entry, field)
+			}
+			prices[i] = value
+		}
+		if len(fields) == 1 {
+			prices[1] = prices[0]
+		}
+		costs[realModelID] = ModelCost{Input: prices[0], Output: prices[1]}
+	}
+	return costs, nil
+}
+
+// CopilotEndpoint is one of several Copilot deployments or accounts requests
+// are balanced across
+type CopilotEndpoint struct {
+	// URL is the base URL of the Copilot API
+	URL string
+	// Weight is the endpoint's share of the requests
+	Weight int
+	// TokenFile holds the GitHub token of a separate account to use on this
+	// endpoint; empty uses the server's own login
+	TokenFile string
+}
+
+// parseCopilotEndpoints parses "url[=weight][@token-file]" entries, e.g.
+// "https://api.githubcopilot.com=3" or
+// "https://api.githubcopilot.com=1@/etc/ghcsd/team-b.token"
+func parseCopilotEndpoints(entries []string) ([]CopilotEndpoint, error) {
+	var endpoints []CopilotEndpoint
+	for _, entry := range entries {
+		endpoint := CopilotEndpoint{URL: entry, Weight: 1}
+		if endpointURL, tokenFile, ok := strings.Cut(entry, "@"); ok {
+			endpoint.URL, endpoint.TokenFile = endpointURL, tokenFile
+		}
+		if i := strings.LastIndex(endpoint.URL, "="); i >= 0 {
+			weight, err := strconv.Atoi(endpoint.URL[i+1:])
+			if err != nil || weight < 1 {
+				return nil, fmt.Errorf("invalid Copilot endpoint %q: %q is not a valid weight", entry, endpoint.URL[i+1:])
+			}
+			endpoint.URL, endpoint.Weight = endpoint.URL[:i], weight
+		}
+		if !strings.HasPrefix(endpoint.URL, "http://") && !strings.HasPrefix(endpoint.URL, "https://") {
+			return nil, fmt.Errorf("invalid Copilot endpoint %q, expected url[=weight][@token-file]", entry)
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints, nil
+}
+
 type Config struct {
-	ServerAddr string
-	Model      string
-	ConfigDir  string
+	// ServerAddr holds the TCP addresses the API is served on
+	ServerAddr []string
+	// Listen holds additional listen addresses (tcp://host:port or
+	// unix:///path/to.sock). When set it replaces ServerAddr.
+	Listen []string
+	// AdminListen holds the addresses the admin, login and metrics endpoints
+	// are served on instead of the API listeners; empty serves them alongside
+	// the API
+	AdminListen []string
+
+	Model string
+	// ConfigDir holds the login and machine ID
+	ConfigDir string
+	// CacheDir holds files that can be recreated, such as debug captures
+	CacheDir string
+
+	// MachineID is sent to Copilot as VScode-MachineId. It is persisted in the
+	// config directory so that it stays stable across restarts.
+	MachineID string
+	// SessionID is the default VScode-SessionId used when a client does not
+	// supply its own session. A fresh ID is generated per process when empty.
+	SessionID string
+	// SessionHeader is the request header clients can use to tag requests
+	// belonging to the same conversation
+	SessionHeader string
+	// StickyModel pins each conversation, identified by SessionHeader, to the
+	// model its first request was served by
+	StickyModel bool
+	// StickyModelTTL is how long an idle conversation stays pinned
+	StickyModelTTL time.Duration
+
+	// LogLevel is the log level of the components not in LogComponents
+	LogLevel logging.Level
+	// LogComponents sets the log level of single components, such as auth
+	// or stream
+	LogComponents map[string]logging.Level
+	// APIKeys lists the keys accepted from clients; empty disables inbound auth
+	APIKeys []string
+	// KeysFile is a JSON store of named API keys with per-key limits, managed
+	// through /admin/keys. Setting it always enables inbound auth.
+	KeysFile string
+	// AdminKeys lists the keys accepted on the admin endpoints; empty limits
+	// them to localhost
+	AdminKeys []string
+	// RateLimit is the maximum number of requests per minute; 0 disables it
+	RateLimit int
+	// UserRateLimit is the maximum number of requests per minute for each end
+	// user identified by the OpenAI "user" field; 0 disables it
+	UserRateLimit int
+	// IPRateLimit is the maximum number of requests per minute for each
+	// client IP; 0 disables it
+	IPRateLimit int
+	// AllowCIDRs lists the client IP ranges allowed to connect; empty allows
+	// every client not denied
+	AllowCIDRs []netip.Prefix
+	// DenyCIDRs lists the client IP ranges rejected
+	DenyCIDRs []netip.Prefix
+	// TrustedProxies lists the reverse proxies whose X-Forwarded-For header
+	// is trusted to carry the client IP
+	TrustedProxies []netip.Prefix
+	// PromptOverflow is the policy for prompts exceeding the model's context
+	// window, OverflowReject, OverflowTruncate or OverflowCompact
+	PromptOverflow string
+	// ToolValidation checks generated tool calls against the declared tool
+	// schemas: ToolValidationOff, ToolValidationAnnotate or ToolValidationRetry
+	ToolValidation string
+	// DefaultMaxTokens is the max_tokens of requests that do not set one,
+	// before the model's output limit is applied
+	DefaultMaxTokens int
+	// ModelBudgets holds the usage budgets of individual models, keyed by real model ID
+	ModelBudgets map[string]ModelBudget
+	// ModelCosts holds the prices of models, keyed by real model ID, used to
+	// estimate the spend of API keys
+	ModelCosts map[string]ModelCost
+	// CORSOrigins lists the origins allowed to call the API from a browser
+	CORSOrigins []string
+
+	// EnableOpenAI serves the OpenAI chat completions API and its WebSocket
+	EnableOpenAI bool
+	// EnableResponses serves the OpenAI Responses API
+	EnableResponses bool
+	// EnableOllama serves the Ollama API
+	EnableOllama bool
+	// EnableAnthropic serves the Anthropic-format endpoints
+	EnableAnthropic bool
+	// EnableGRPC serves the gRPC API on the listeners of the HTTP API
+	EnableGRPC bool
+
+	// CopilotBaseURL overrides the Copilot API endpoint
+	CopilotBaseURL string
+	// CopilotEndpoints lists Copilot endpoints to balance requests across; when
+	// set it replaces CopilotBaseURL
+	CopilotEndpoints []CopilotEndpoint
+	// LoadBalancing is the strategy used across CopilotEndpoints,
+	// upstream.RoundRobin or upstream.LeastOutstanding
+	LoadBalancing string
+	// UpstreamHealthInterval is how often CopilotEndpoints are health checked;
+	// 0 disables the checks
+	UpstreamHealthInterval time.Duration
+	// GitHubURL overrides the GitHub web endpoint used for the device flow
+	GitHubURL string
+	// GitHubAPIURL overrides the GitHub API endpoint used for the token exchange
+	GitHubAPIURL string
+	// GitHubToken is a GitHub personal access token exchanged for Copilot
+	// tokens instead of logging in with the device flow
+	GitHubToken string
+	// ReauthWait is how long requests rejected for an invalid token wait for
+	// its renewal, including a device login, before failing
+	ReauthWait time.Duration
+	// HeaderProfile is the Copilot header profile sent by default, e.g.
+	// "jetbrains"; empty sends the built-in editor headers
+	HeaderProfile string
+
+	// CABundle is a PEM file of extra CA certificates trusted for outbound requests
+	CABundle string
+	// InsecureSkipVerify disables TLS verification of outbound requests
+	InsecureSkipVerify bool
+	// DialTimeout bounds establishing outbound connections
+	DialTimeout time.Duration
+
+	// RetryQueueSize is the number of rate limited requests that may wait for
+	// a retry at the same time; 0 disables retrying
+	RetryQueueSize int
+	// RetryMaxWait is the longest a request waits in the retry queue
+	RetryMaxWait time.Duration
+
+	// CircuitBreakerThreshold is the number of consecutive upstream failures
+	// of a model after which its requests fail fast; 0 disables the breaker
+	CircuitBreakerThreshold int
+	// CircuitBreakerCooldown is how long a tripped model fails fast before a
+	// request probes it again
+	CircuitBreakerCooldown time.Duration
+
+	// ShadowModel is a model sent a copy of a share of the completions, whose
+	// responses are logged for comparison; empty disables shadowing
+	ShadowModel string
+	// ShadowPercent is the percentage of completions mirrored to ShadowModel
+	ShadowPercent float64
+	// ShadowLog is the JSON lines file comparing the mirrored responses
+	ShadowLog string
+
+	// TranscriptDir enables appending every completion to a transcript file
+	// of its conversation in the directory when set
+	TranscriptDir string
+	// TranscriptFormat is TranscriptJSONL or TranscriptMarkdown
+	TranscriptFormat string
+
+	// Mock answers completions from fixtures instead of Copilot, for offline
+	// development and tests
+	Mock bool
+	// MockDir holds the JSON fixtures answered in mock mode; without any,
+	// the last user message is echoed
+	MockDir string
+
+	// CassetteMode records upstream interactions to CassetteDir, or replays
+	// them from it, when set to cassette.Record or cassette.Replay
+	CassetteMode string
+	// CassetteDir holds the recorded upstream interactions
+	CassetteDir string
+
+	// CompactModel summarizes the oldest messages of prompts compacted by
+	// OverflowCompact; a cheap model keeps compaction fast
+	CompactModel string
+	// CompactKeepMessages is the number of latest messages kept verbatim by
+	// compaction
+	CompactKeepMessages int
+	// CompactThreshold is the percentage of the context window above which
+	// prompts are compacted
+	CompactThreshold float64
+
+	// SmallModel and BigModel enable the auto model, which routes light
+	// requests to SmallModel and heavy ones to BigModel; empty disables it
+	SmallModel string
+	BigModel   string
+	// AutoPromptTokens is the estimated prompt size from which auto routes
+	// to BigModel; 0 disables the length rule
+	AutoPromptTokens int
+	// AutoSystemPattern is a regular expression routing auto requests whose
+	// system prompt matches it to BigModel
+	AutoSystemPattern string
+
+	// WarmUp sends a test completion to every model at startup to find the
+	// models the account cannot use
+	WarmUp bool
+
+	// StreamMeter ends every streamed completion with an SSE comment
+	// reporting its throughput and time to first token
+	StreamMeter bool
+
+	// MaxStreamDuration ends streams running longer, so that a stuck
+	// upstream does not hold connections forever; 0 for no limit
+	MaxStreamDuration time.Duration
+	// RouteStreamDurations overrides MaxStreamDuration by request path
+	RouteStreamDurations map[string]time.Duration
+
+	// CoalesceRequests serves identical concurrent non-streaming
+	// completions with a single upstream call
+	CoalesceRequests bool
+
+	// StreamBufferKB is how far a stream is read ahead of its client; 0
+	// relays it without buffering
+	StreamBufferKB int
+	// StreamBufferPolicy is what happens once a client falls that far behind
+	StreamBufferPolicy streambuf.Policy
+
+	// RedisURL is the Redis server keeping the Copilot token, rate limits and
+	// usage shared by replicas; empty keeps them in memory
+	RedisURL string
+
+	// FilterRulesFile is a JSON file of content filter rules applied to prompts
+	FilterRulesFile string
+	// SystemPromptFile is a JSON file of operator system prompts added to
+	// requests, globally or per model
+	SystemPromptFile string
+	// ResponseCleanupFile is a JSON file of cleanups stripping model-specific
+	// artifacts from completions, globally or per model
+	ResponseCleanupFile string
+	// HookScript is a Lua script run on every request and response, to
+	// apply policies the other settings cannot express
+	HookScript string
+	// HookTimeout bounds each call of a function of the hook script
+	HookTimeout time.Duration
+
+	// ResponsesDir enables the conversation store of /v1/responses when set
+	ResponsesDir string
+	// ResponsesTTL is how long stored responses are kept; 0 keeps them forever
+	ResponsesTTL time.Duration
+
+	// CaptureDir is where debug capture bundles requested with the
+	// X-Ghcsd-Debug header are stored
+	CaptureDir string
+
+	// TracesEndpoint is the OTLP/HTTP URL spans are exported to; empty
+	// disables tracing
+	TracesEndpoint string
+	// TracesHeaders are sent with every span export
+	TracesHeaders map[string]string
+	// ServiceName is the service.name reported with spans
+	ServiceName string
+
+	// LogFile receives the server log instead of stderr when set
+	LogFile string
+	// AccessLogFile receives the access log when set; otherwise it goes to
+	// the server log
+	AccessLogFile string
+	// LogMaxSizeMB is the size at which log files are rotated; 0 disables it
+	LogMaxSizeMB int
+	// LogRotateInterval additionally rotates log files every interval; 0
+	// disables it
+	LogRotateInterval time.Duration
+	// LogMaxFiles is the number of rotated log files kept; 0 keeps all
+	LogMaxFiles int
+	// LogMaxAge removes rotated log files older than it; 0 disables it
+	LogMaxAge time.Duration
+
+	// AuditDir enables the audit log of prompts and completions when set
+	AuditDir string
+	// AuditMaxSizeMB is the size at which the audit log is rotated
+	AuditMaxSizeMB int
+	// AuditMaxFiles is the number of rotated audit logs to keep
+	AuditMaxFiles int
+	// AuditRedactPatterns are extra regular expressions redacted from audit entries
+	AuditRedactPatterns []string
+}
+
+// getEnv returns the value of the environment variable or the fallback if unset
+func getEnv(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value
+	}
+	return fallback
+}
+
+// getEnvList returns the comma separated values of the environment variable
+func getEnvList(key string) []string {
+	var values []string
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
 }
 
+// getEnvBool reports whether the environment variable is set to a true value
+func getEnvBool(key string) bool {
+	value, err := strconv.ParseBool(os.Getenv(key))
+	return err == nil && value
+}
+
+// getEnvBoolDefault returns the environment variable parsed as a boolean, or
+// the fallback if unset
+func getEnvBoolDefault(key string, fallback bool) (bool, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback, nil
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q, expected true or false", key, value)
+	}
+	return parsed, nil
+}
+
+// getEnvInt returns the integer value of the environment variable or the fallback
+func getEnvInt(key string, fallback int) (int, error) {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return fallback, nil
+	}
+	value, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return value, nil
+}
+
+// getEnvFloat returns the numeric value of the environment variable or the fallback
+func getEnvFloat(key string, fallback float64) (float64, error) {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return fallback, nil
+	}
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return value, nil
+}
+
+// readLines returns the non-empty lines of a file, skipping # comments
+func readLines(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
+
+// getEnvDuration returns the duration value of the environment variable or the fallback
+func getEnvDuration(key string, fallback time.Duration) (time.Duration, error) {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return fallback, nil
+	}
+	value, err := time.ParseDuration(raw)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return value, nil
+}
+
+// otlpSettings reads the standard OpenTelemetry exporter variables. Only
+// OTLP over HTTP with JSON encoding is supported.
+func otlpSettings() (string, map[string]string, error) {
+	if protocol := getEnv("OTEL_EXPORTER_OTLP_TRACES_PROTOCOL", os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL")); protocol != "" && protocol != "http/json" {
+		return "", nil, fmt.Errorf("unsupported OTLP protocol %q, only http/json is supported", protocol)
+	}
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); endpoint == "" && base != "" {
+		endpoint = strings.TrimRight(base, "/") + "/v1/traces"
+	}
+
+	headers := make(map[string]string)
+	for _, name := range []string{"OTEL_EXPORTER_OTLP_HEADERS", "OTEL_EXPORTER_OTLP_TRACES_HEADERS"} {
+		for _, entry := range getEnvList(name) {
+			key, value, ok := strings.Cut(entry, "=")
+			if !ok {
+				return "", nil, fmt.Errorf("invalid %s entry %q, expected key=value", name, entry)
+			}
+			if unescaped, err := url.QueryUnescape(value); err == nil {
+				value = unescaped
+			}
+			headers[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+	return endpoint, headers, nil
+}
+
+// loadOrCreateMachineID reads the persisted machine ID or creates a new one
+func loadOrCreateMachineID(configDir string) (string, error) {
+	idPath := filepath.Join(configDir, ".machine-id")
+	data, err := os.ReadFile(idPath)
+	if err == nil {
+		if id := strings.TrimSpace(string(data)); id != "" {
+			return id, nil
+		}
+	} else if !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to read machine id: %w", err)
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate machine id: %w", err)
+	}
+	id := hex.EncodeToString(buf)
+	if err := os.WriteFile(idPath, []byte(id), 0600); err != nil {
+		return "", fmt.Errorf("failed to save machine id: %w", err)
+	}
+	return id, nil
+}
+
+// New loads the configuration from the environment, using the default
+// config directory
 func New() (*Config, error) {
-	homeDir, err := os.UserHomeDir()
+	return Load("")
+}
+
+// Load loads the configuration from the environment. configDir overrides
+// the config directory when set.
+func Load(configDir string) (*Config, error) {
+	configDir, err := resolveConfigDir(configDir)
+	if err != nil {
+		return nil, err
+	}
+	cacheDir, err := resolveCacheDir()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get home directory: %w", err)
+		return nil, err
 	}
 
-	configDir := filepath.Join(homeDir, ".config", "ghcsd")
-	if err := os.MkdirAll(configDir, 0700); err != nil {
-		return nil, fmt.Errorf("failed to create config directory: %w", err)
+	if err := applyModelHeaderProfiles(getEnvList("GHCSD_MODEL_HEADER_PROFILES")); err != nil {
+		return nil, err
+	}
+	headerProfile := os.Getenv("GHCSD_HEADER_PROFILE")
+	if _, ok := copilot.LookupHeaderProfile(headerProfile); headerProfile != "" && !ok {
+		return nil, fmt.Errorf("invalid GHCSD_HEADER_PROFILE %q, expected one of %s", headerProfile, strings.Join(copilot.HeaderProfileNames(), ", "))
+	}
+	if err := applyModelUpstreams(getEnvList("GHCSD_MODEL_UPSTREAMS")); err != nil {
+		return nil, err
 	}
 
 	defaultModel := "gpt-4o"
@@ -102,9 +838,473 @@ func New() (*Config, error) {
 		return nil, fmt.Errorf("invalid model: %s", defaultModel)
 	}
 
+	machineID := os.Getenv("GHCSD_MACHINE_ID")
+	if machineID == "" {
+		machineID, err = loadOrCreateMachineID(configDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	serverAddr := getEnvList("GHCSD_ADDR")
+	if len(serverAddr) == 0 {
+		serverAddr = []string{":8080"}
+		if port := os.Getenv("PORT"); port != "" {
+			serverAddr = []string{":" + port}
+		}
+	}
+
+	rateLimit, err := getEnvInt("GHCSD_RATE_LIMIT", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	userRateLimit, err := getEnvInt("GHCSD_USER_RATE_LIMIT", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	ipRateLimit, err := getEnvInt("GHCSD_IP_RATE_LIMIT", 0)
+	if err != nil {
+		return nil, err
+	}
+	allowCIDRs, err := parsePrefixes("GHCSD_ALLOW_CIDRS", getEnvList("GHCSD_ALLOW_CIDRS"))
+	if err != nil {
+		return nil, err
+	}
+	denyCIDRs, err := parsePrefixes("GHCSD_DENY_CIDRS", getEnvList("GHCSD_DENY_CIDRS"))
+	if err != nil {
+		return nil, err
+	}
+	trustedProxies, err := parsePrefixes("GHCSD_TRUSTED_PROXIES", getEnvList("GHCSD_TRUSTED_PROXIES"))
+	if err != nil {
+		return nil, err
+	}
+
+	promptOverflow := getEnv("GHCSD_PROMPT_OVERFLOW", OverflowReject)
+	if !ValidOverflowPolicy(promptOverflow) {
+		return nil, fmt.Errorf("invalid GHCSD_PROMPT_OVERFLOW %q, expected %s, %s or %s", promptOverflow, OverflowReject, OverflowTruncate, OverflowCompact)
+	}
+
+	compactModel := getEnv("GHCSD_COMPACT_MODEL", "gpt-4o")
+	if _, ok := GetModelInfo(compactModel); !ok {
+		return nil, fmt.Errorf("invalid GHCSD_COMPACT_MODEL: %s", compactModel)
+	}
+	compactKeep, err := getEnvInt("GHCSD_COMPACT_KEEP_MESSAGES", 6)
+	if err != nil {
+		return nil, err
+	}
+	if compactKeep < 1 {
+		return nil, fmt.Errorf("invalid GHCSD_COMPACT_KEEP_MESSAGES %d, expected at least 1", compactKeep)
+	}
+	compactThreshold, err := getEnvFloat("GHCSD_COMPACT_THRESHOLD", 100)
+	if err != nil {
+		return nil, err
+	}
+	if compactThreshold <= 0 || compactThreshold > 100 {
+		return nil, fmt.Errorf("invalid GHCSD_COMPACT_THRESHOLD %g, expected more than 0 and at most 100", compactThreshold)
+	}
+
+	smallModel := os.Getenv("GHCSD_SMALL_MODEL")
+	bigModel := os.Getenv("GHCSD_BIG_MODEL")
+	if (smallModel == "") != (bigModel == "") {
+		return nil, fmt.Errorf("GHCSD_SMALL_MODEL and GHCSD_BIG_MODEL must be set together")
+	}
+	if _, ok := GetModelInfo(smallModel); smallModel != "" && !ok {
+		return nil, fmt.Errorf("invalid GHCSD_SMALL_MODEL: %s", smallModel)
+	}
+	if _, ok := GetModelInfo(bigModel); bigModel != "" && !ok {
+		return nil, fmt.Errorf("invalid GHCSD_BIG_MODEL: %s", bigModel)
+	}
+	autoPromptTokens, err := getEnvInt("GHCSD_AUTO_PROMPT_TOKENS", 4000)
+	if err != nil {
+		return nil, err
+	}
+	if autoPromptTokens < 0 {
+		return nil, fmt.Errorf("invalid GHCSD_AUTO_PROMPT_TOKENS %d, expected at least 0", autoPromptTokens)
+	}
+	autoSystemPattern := os.Getenv("GHCSD_AUTO_SYSTEM_PATTERN")
+	if _, err := regexp.Compile(autoSystemPattern); err != nil {
+		return nil, fmt.Errorf("invalid GHCSD_AUTO_SYSTEM_PATTERN: %w", err)
+	}
+
+	enableOpenAI, err := getEnvBoolDefault("GHCSD_ENABLE_OPENAI", true)
+	if err != nil {
+		return nil, err
+	}
+	enableResponses, err := getEnvBoolDefault("GHCSD_ENABLE_RESPONSES", true)
+	if err != nil {
+		return nil, err
+	}
+	enableOllama, err := getEnvBoolDefault("GHCSD_ENABLE_OLLAMA", true)
+	if err != nil {
+		return nil, err
+	}
+	enableAnthropic, err := getEnvBoolDefault("GHCSD_ENABLE_ANTHROPIC", true)
+	if err != nil {
+		return nil, err
+	}
+	enableGRPC, err := getEnvBoolDefault("GHCSD_ENABLE_GRPC", false)
+	if err != nil {
+		return nil, err
+	}
+
+	cassetteMode := os.Getenv("GHCSD_CASSETTE_MODE")
+	if cassetteMode != "" && !cassette.ValidMode(cassetteMode) {
+		return nil, fmt.Errorf("invalid GHCSD_CASSETTE_MODE %q, expected %s or %s", cassetteMode, cassette.Record, cassette.Replay)
+	}
+
+	toolValidation := getEnv("GHCSD_TOOL_VALIDATION", ToolValidationOff)
+	if !ValidToolValidation(toolValidation) {
+		return nil, fmt.Errorf("invalid GHCSD_TOOL_VALIDATION %q, expected %s, %s or %s", toolValidation, ToolValidationOff, ToolValidationAnnotate, ToolValidationRetry)
+	}
+
+	defaultMaxTokens, err := getEnvInt("GHCSD_DEFAULT_MAX_TOKENS", copilot.DefaultMaxTokens)
+	if err != nil {
+		return nil, err
+	}
+	if defaultMaxTokens <= 0 {
+		return nil, fmt.Errorf("invalid GHCSD_DEFAULT_MAX_TOKENS %d, expected a positive number", defaultMaxTokens)
+	}
+
+	modelBudgets, err := parseModelBudgets(getEnvList("GHCSD_MODEL_BUDGETS"))
+	if err != nil {
+		return nil, err
+	}
+	modelCosts, err := parseModelCosts(getEnvList("GHCSD_MODEL_COSTS"))
+	if err != nil {
+		return nil, err
+	}
+
+	streamBufferKB, err := getEnvInt("GHCSD_STREAM_BUFFER_KB", 256)
+	if err != nil {
+		return nil, err
+	}
+	if streamBufferKB < 0 {
+		return nil, fmt.Errorf("invalid GHCSD_STREAM_BUFFER_KB %d, expected at least 0", streamBufferKB)
+	}
+	streamBufferPolicy, err := streambuf.ParsePolicy(getEnv("GHCSD_STREAM_BUFFER_POLICY", string(streambuf.Park)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid GHCSD_STREAM_BUFFER_POLICY: %w", err)
+	}
+
+	maxStreamDuration, err := getEnvDuration("GHCSD_MAX_STREAM_DURATION", 0)
+	if err != nil {
+		return nil, err
+	}
+	if maxStreamDuration < 0 {
+		return nil, fmt.Errorf("invalid GHCSD_MAX_STREAM_DURATION %s, expected a duration of at least 0", maxStreamDuration)
+	}
+	routeStreamDurations, err := parseRouteStreamDurations(getEnvList("GHCSD_ROUTE_STREAM_DURATIONS"))
+	if err != nil {
+		return nil, err
+	}
+
+	reauthWait, err := getEnvDuration("GHCSD_REAUTH_WAIT", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if reauthWait < 0 {
+		return nil, fmt.Errorf("invalid GHCSD_REAUTH_WAIT %s, expected a duration of at least 0", reauthWait)
+	}
+
+	githubToken := os.Getenv("GHCSD_GITHUB_TOKEN")
+	if path := os.Getenv("GHCSD_GITHUB_TOKEN_FILE"); path != "" && githubToken == "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read GHCSD_GITHUB_TOKEN_FILE: %w", err)
+		}
+		githubToken = strings.TrimSpace(string(data))
+		if githubToken == "" {
+			return nil, fmt.Errorf("GHCSD_GITHUB_TOKEN_FILE %s is empty", path)
+		}
+	}
+
+	copilotEndpoints, err := parseCopilotEndpoints(getEnvList("GHCSD_COPILOT_ENDPOINTS"))
+	if err != nil {
+		return nil, err
+	}
+	loadBalancing := getEnv("GHCSD_LOAD_BALANCING", upstream.RoundRobin)
+	if !upstream.ValidStrategy(loadBalancing) {
+		return nil, fmt.Errorf("invalid GHCSD_LOAD_BALANCING %q, expected %s or %s", loadBalancing, upstream.RoundRobin, upstream.LeastOutstanding)
+	}
+	upstreamHealthInterval, err := getEnvDuration("GHCSD_UPSTREAM_HEALTH_INTERVAL", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	dialTimeout, err := getEnvDuration("GHCSD_DIAL_TIMEOUT", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	retryQueueSize, err := getEnvInt("GHCSD_RETRY_QUEUE_SIZE", 0)
+	if err != nil {
+		return nil, err
+	}
+	retryMaxWait, err := getEnvDuration("GHCSD_RETRY_MAX_WAIT", 60*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	breakerThreshold, err := getEnvInt("GHCSD_CIRCUIT_BREAKER_THRESHOLD", 5)
+	if err != nil {
+		return nil, err
+	}
+	breakerCooldown, err := getEnvDuration("GHCSD_CIRCUIT_BREAKER_COOLDOWN", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	shadowModel := os.Getenv("GHCSD_SHADOW_MODEL")
+	if shadowModel != "" {
+		if _, ok := GetModelInfo(shadowModel); !ok {
+			return nil, fmt.Errorf("invalid GHCSD_SHADOW_MODEL: %s", shadowModel)
+		}
+	}
+	shadowPercent, err := getEnvFloat("GHCSD_SHADOW_PERCENT", 10)
+	if err != nil {
+		return nil, err
+	}
+	if shadowPercent < 0 || shadowPercent > 100 {
+		return nil, fmt.Errorf("invalid GHCSD_SHADOW_PERCENT %g, expected 0 to 100", shadowPercent)
+	}
+
+	transcriptFormat := getEnv("GHCSD_TRANSCRIPT_FORMAT", TranscriptJSONL)
+	if transcriptFormat != TranscriptJSONL && transcriptFormat != TranscriptMarkdown {
+		return nil, fmt.Errorf("invalid GHCSD_TRANSCRIPT_FORMAT %q, expected %s or %s", transcriptFormat, TranscriptJSONL, TranscriptMarkdown)
+	}
+
+	redisURL := os.Getenv("GHCSD_REDIS_URL")
+	if redisURL != "" {
+		u, err := url.Parse(redisURL)
+		if err != nil || (u.Scheme != "redis" && u.Scheme != "rediss") || u.Host == "" {
+			return nil, fmt.Errorf("invalid GHCSD_REDIS_URL, expected redis://[[user]:password@]host[:port][/db] or rediss://...")
+		}
+	}
+
+	hookTimeout, err := getEnvDuration("GHCSD_HOOK_TIMEOUT", 100*time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+	if hookTimeout <= 0 {
+		return nil, fmt.Errorf("invalid GHCSD_HOOK_TIMEOUT %s, expected a positive duration", hookTimeout)
+	}
+
+	responsesTTL, err := getEnvDuration("GHCSD_RESPONSES_TTL", 30*24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+
+	stickyModel := getEnvBool("GHCSD_STICKY_MODEL")
+	stickyModelTTL, err := getEnvDuration("GHCSD_STICKY_MODEL_TTL", time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	if stickyModelTTL <= 0 {
+		return nil, fmt.Errorf("invalid GHCSD_STICKY_MODEL_TTL %s, expected a positive duration", stickyModelTTL)
+	}
+
+	logMaxSize, err := getEnvInt("GHCSD_LOG_MAX_SIZE_MB", 100)
+	if err != nil {
+		return nil, err
+	}
+	logRotateInterval, err := getEnvDuration("GHCSD_LOG_ROTATE_INTERVAL", 0)
+	if err != nil {
+		return nil, err
+	}
+	logMaxFiles, err := getEnvInt("GHCSD_LOG_MAX_FILES", 10)
+	if err != nil {
+		return nil, err
+	}
+	logMaxAge, err := getEnvDuration("GHCSD_LOG_MAX_AGE", 0)
+	if err != nil {
+		return nil, err
+	}
+	if logMaxSize < 0 || logRotateInterval < 0 || logMaxFiles < 0 || logMaxAge < 0 {
+		return nil, fmt.Errorf("invalid log rotation settings, expected GHCSD_LOG_MAX_SIZE_MB, GHCSD_LOG_ROTATE_INTERVAL, GHCSD_LOG_MAX_FILES and GHCSD_LOG_MAX_AGE not to be negative")
+	}
+
+	auditMaxSize, err := getEnvInt("GHCSD_AUDIT_MAX_SIZE_MB", 100)
+	if err != nil {
+		return nil, err
+	}
+	auditMaxFiles, err := getEnvInt("GHCSD_AUDIT_MAX_FILES", 10)
+	if err != nil {
+		return nil, err
+	}
+
+	tracesEndpoint, tracesHeaders, err := otlpSettings()
+	if err != nil {
+		return nil, err
+	}
+
+	// DEBUG predates the log levels and still selects the debug level
+	defaultLogLevel := logging.Info
+	if getEnvBool("DEBUG") {
+		defaultLogLevel = logging.Debug
+	}
+	logLevel, err := logging.ParseLevel(getEnv("GHCSD_LOG_LEVEL", defaultLogLevel.String()))
+	if err != nil {
+		return nil, fmt.Errorf("invalid GHCSD_LOG_LEVEL: %w", err)
+	}
+	logComponents, err := parseLogComponents(getEnvList("GHCSD_LOG_COMPONENTS"))
+	if err != nil {
+		return nil, err
+	}
+
+	// Regular expressions may contain commas, so extra patterns are read from
+	// a file with one pattern per line
+	var auditRedact []string
+	if path := os.Getenv("GHCSD_AUDIT_REDACT_FILE"); path != "" {
+		auditRedact, err = readLines(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read audit redaction patterns: %w", err)
+		}
+	}
+
 	return &Config{
-		ServerAddr: ":8080",
-		Model:      realModelID,
-		ConfigDir:  configDir,
+		ServerAddr:     serverAddr,
+		Listen:         getEnvList("GHCSD_LISTEN"),
+		AdminListen:    getEnvList("GHCSD_ADMIN_LISTEN"),
+		Model:          realModelID,
+		ConfigDir:      configDir,
+		CacheDir:       cacheDir,
+		MachineID:      machineID,
+		SessionID:      os.Getenv("GHCSD_SESSION_ID"),
+		SessionHeader:  getEnv("GHCSD_SESSION_HEADER", "X-Session-Id"),
+		APIKeys:        getEnvList("GHCSD_API_KEYS"),
+		KeysFile:       os.Getenv("GHCSD_KEYS_FILE"),
+		AdminKeys:      getEnvList("GHCSD_ADMIN_KEYS"),
+		RateLimit:      rateLimit,
+		UserRateLimit:  userRateLimit,
+		PromptOverflow: promptOverflow,
+		ModelBudgets:   modelBudgets,
+		ModelCosts:     modelCosts,
+		CORSOrigins:    getEnvList("GHCSD_CORS_ORIGINS"),
+
+		EnableOpenAI:    enableOpenAI,
+		EnableResponses: enableResponses,
+		EnableOllama:    enableOllama,
+		EnableAnthropic: enableAnthropic,
+		EnableGRPC:      enableGRPC,
+
+		DefaultMaxTokens: defaultMaxTokens,
+		ToolValidation:   toolValidation,
+
+		CopilotBaseURL:         os.Getenv("GHCSD_COPILOT_BASE_URL"),
+		CopilotEndpoints:       copilotEndpoints,
+		LoadBalancing:          loadBalancing,
+		UpstreamHealthInterval: upstreamHealthInterval,
+		GitHubURL:              os.Getenv("GHCSD_GITHUB_URL"),
+		GitHubAPIURL:           os.Getenv("GHCSD_GITHUB_API_URL"),
+		GitHubToken:            githubToken,
+		ReauthWait:             reauthWait,
+		HeaderProfile:          headerProfile,
+
+		LogLevel:      logLevel,
+		LogComponents: logComponents,
+
+		CABundle:           os.Getenv("GHCSD_CA_BUNDLE"),
+		InsecureSkipVerify: getEnvBool("GHCSD_INSECURE_SKIP_VERIFY"),
+		DialTimeout:        dialTimeout,
+
+		RetryQueueSize: retryQueueSize,
+		RetryMaxWait:   retryMaxWait,
+
+		CircuitBreakerThreshold: breakerThreshold,
+		CircuitBreakerCooldown:  breakerCooldown,
+
+		ShadowModel:   shadowModel,
+		ShadowPercent: shadowPercent,
+		ShadowLog:     getEnv("GHCSD_SHADOW_LOG", filepath.Join(cacheDir, "shadow.jsonl")),
+
+		TranscriptDir:    os.Getenv("GHCSD_TRANSCRIPT_DIR"),
+		TranscriptFormat: transcriptFormat,
+
+		RedisURL: redisURL,
+
+		StickyModel:    stickyModel,
+		StickyModelTTL: stickyModelTTL,
+
+		WarmUp: getEnvBool("GHCSD_WARMUP"),
+
+		StreamMeter: getEnvBool("GHCSD_STREAM_METER"),
+
+		MaxStreamDuration:    maxStreamDuration,
+		RouteStreamDurations: routeStreamDurations,
+
+		CoalesceRequests: getEnvBool("GHCSD_COALESCE_REQUESTS"),
+
+		StreamBufferKB:     streamBufferKB,
+		StreamBufferPolicy: streamBufferPolicy,
+
+		IPRateLimit:    ipRateLimit,
+		AllowCIDRs:     allowCIDRs,
+		DenyCIDRs:      denyCIDRs,
+		TrustedProxies: trustedProxies,
+
+		CompactModel:        compactModel,
+		CompactKeepMessages: compactKeep,
+		CompactThreshold:    compactThreshold,
+
+		SmallModel:        smallModel,
+		BigModel:          bigModel,
+		AutoPromptTokens:  autoPromptTokens,
+		AutoSystemPattern: autoSystemPattern,
+
+		Mock:    getEnvBool("GHCSD_MOCK") || os.Getenv("GHCSD_MOCK_DIR") != "",
+		MockDir: os.Getenv("GHCSD_MOCK_DIR"),
+
+		CassetteMode: cassetteMode,
+		CassetteDir:  getEnv("GHCSD_CASSETTE_DIR", filepath.Join(cacheDir, "cassettes")),
+
+		FilterRulesFile:  os.Getenv("GHCSD_FILTER_RULES_FILE"),
+		SystemPromptFile: os.Getenv("GHCSD_SYSTEM_PROMPT_FILE"),
+
+		HookScript:  os.Getenv("GHCSD_HOOK_SCRIPT"),
+		HookTimeout: hookTimeout,
+
+		ResponseCleanupFile: os.Getenv("GHCSD_RESPONSE_CLEANUP_FILE"),
+
+		ResponsesDir: os.Getenv("GHCSD_RESPONSES_DIR"),
+		ResponsesTTL: responsesTTL,
+
+		CaptureDir: getEnv("GHCSD_CAPTURE_DIR", filepath.Join(cacheDir, "captures")),
+
+		TracesEndpoint: tracesEndpoint,
+		TracesHeaders:  tracesHeaders,
+		ServiceName:    getEnv("OTEL_SERVICE_NAME", "ghcsd"),
+
+		LogFile:           os.Getenv("GHCSD_LOG_FILE"),
+		AccessLogFile:     os.Getenv("GHCSD_ACCESS_LOG_FILE"),
+		LogMaxSizeMB:      logMaxSize,
+		LogRotateInterval: logRotateInterval,
+		LogMaxFiles:       logMaxFiles,
+		LogMaxAge:         logMaxAge,
+
+		AuditDir:            os.Getenv("GHCSD_AUDIT_DIR"),
+		AuditMaxSizeMB:      auditMaxSize,
+		AuditMaxFiles:       auditMaxFiles,
+		AuditRedactPatterns: auditRedact,
 	}, nil
 }
+
+// LogOptions returns the rotation settings of the server and access logs
+func (c *Config) LogOptions() logfile.Options {
+	return logfile.Options{
+		MaxSize:  int64(c.LogMaxSizeMB) * 1024 * 1024,
+		Interval: c.LogRotateInterval,
+		MaxFiles: c.LogMaxFiles,
+		MaxAge:   c.LogMaxAge,
+	}
+}
+
+// TransportOptions returns the settings for outbound HTTP clients
+func (c *Config) TransportOptions() transport.Options {
+	return transport.Options{
+		CABundle:           c.CABundle,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+		DialTimeout:        c.DialTimeout,
+	}
+}
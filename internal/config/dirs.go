@@ -0,0 +1,112 @@
+// internal/config/dirs.go
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// appName names the per-user directories of ghcsd
+const appName = "ghcsd"
+
+// migratedFiles are moved from the legacy config directory on first use of
+// the platform one
+var migratedFiles = []string{".copilot-auth-token", ".machine-id"}
+
+// resolveConfigDir returns the config directory: dir when set, else
+// GHCSD_CONFIG_DIR, else the platform's per-user config directory
+// ($XDG_CONFIG_HOME or ~/.config on Linux, ~/Library/Application Support
+// on macOS, %AppData% on Windows). The directory is created if needed.
+func resolveConfigDir(dir string) (string, error) {
+	if dir == "" {
+		dir = os.Getenv("GHCSD_CONFIG_DIR")
+	}
+	if dir == "" {
+		base, err := os.UserConfigDir()
+		if err != nil {
+			return "", fmt.Errorf("failed to locate config directory: %w", err)
+		}
+		dir = filepath.Join(base, appName)
+		migrateLegacyConfigDir(dir)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create config directory: %w", err)
+	}
+	return dir, nil
+}
+
+// resolveCacheDir returns the cache directory for files that can be
+// recreated: GHCSD_CACHE_DIR, else the platform's per-user cache directory
+func resolveCacheDir() (string, error) {
+	if dir := os.Getenv("GHCSD_CACHE_DIR"); dir != "" {
+		return dir, nil
+	}
+	base, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to locate cache directory: %w", err)
+	}
+	return filepath.Join(base, appName), nil
+}
+
+// migrateLegacyConfigDir moves the login and machine ID of earlier versions,
+// which always used ~/.config/ghcsd, to dir. Files already present in dir
+// are kept. Failures are logged and leave the old files in place.
+func migrateLegacyConfigDir(dir string) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return
+	}
+	legacy := filepath.Join(home, ".config", appName)
+	if legacy == dir {
+		return
+	}
+	for _, name := range migratedFiles {
+		from, to := filepath.Join(legacy, name), filepath.Join(dir, name)
+		if _, err := os.Stat(from); err != nil {
+			continue
+		}
+		if _, err := os.Stat(to); !errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			log.Printf("[Config] Failed to migrate %s: %v", from, err)
+			return
+		}
+		if err := moveFile(from, to); err != nil {
+			log.Printf("[Config] Failed to migrate %s: %v", from, err)
+			continue
+		}
+		log.Printf("[Config] Moved %s to %s", from, to)
+	}
+}
+
+// moveFile renames from to to, copying when they are on different devices
+func moveFile(from, to string) error {
+	if err := os.Rename(from, to); err == nil {
+		return nil
+	}
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(to, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		os.Remove(to)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(to)
+		return err
+	}
+	src.Close()
+	return os.Remove(from)
+}
@@ -0,0 +1,205 @@
+// internal/config/summary.go
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/acazau/ghcsd/pkg/streambuf"
+)
+
+// masked replaces secret values in the summary and settings
+const masked = "********"
+
+// Setting is a configuration field and its value, secrets masked
+type Setting struct {
+	Name  string
+	Value string
+}
+
+// Settings lists every field of the configuration in declaration order, with
+// API keys, tokens, passwords and header values masked
+func (c *Config) Settings() []Setting {
+	v := reflect.ValueOf(*c)
+	t := v.Type()
+	settings := make([]Setting, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Name
+		settings = append(settings, Setting{Name: name, Value: c.settingValue(name, v.Field(i))})
+	}
+	return settings
+}
+
+// settingValue formats a field value, masking the secret ones
+func (c *Config) settingValue(name string, value reflect.Value) string {
+	switch name {
+	case "APIKeys", "AdminKeys":
+		if value.Len() == 0 {
+			return ""
+		}
+		return fmt.Sprintf("%d keys (%s)", value.Len(), masked)
+	case "GitHubToken":
+		if value.String() == "" {
+			return ""
+		}
+		return masked
+	case "RedisURL":
+		return maskURL(c.RedisURL)
+	case "TracesHeaders":
+		names := make([]string, 0, len(c.TracesHeaders))
+		for header := range c.TracesHeaders {
+			names = append(names, header+"="+masked)
+		}
+		sort.Strings(names)
+		return strings.Join(names, ",")
+	}
+	return formatValue(value)
+}
+
+// formatValue formats a value the way the environment variables spell it
+func formatValue(value reflect.Value) string {
+	if d, ok := value.Interface().(time.Duration); ok {
+		return d.String()
+	}
+	switch value.Kind() {
+	case reflect.Slice:
+		items := make([]string, value.Len())
+		for i := range items {
+			items[i] = formatValue(value.Index(i))
+		}
+		return strings.Join(items, ",")
+	case reflect.Map:
+		items := make([]string, 0, value.Len())
+		for _, key := range value.MapKeys() {
+			items = append(items, fmt.Sprintf("%v=%s", key.Interface(), formatValue(value.MapIndex(key))))
+		}
+		sort.Strings(items)
+		return strings.Join(items, ",")
+	case reflect.Struct:
+		return fmt.Sprintf("%+v", value.Interface())
+	}
+	return fmt.Sprint(value.Interface())
+}
+
+// maskURL masks the password of a URL
+func maskURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	return u.Redacted()
+}
+
+// Summary describes the effective configuration on one line for the startup
+// log: listen addresses, default model, aliases, auth mode and the enabled
+// features. Secrets are never included.
+func (c *Config) Summary() string {
+	listen := c.Listen
+	if len(listen) == 0 {
+		listen = c.ServerAddr
+	}
+	fields := []string{
+		"listen=" + strings.Join(listen, ","),
+		"model=" + c.Model,
+	}
+	if len(c.AdminListen) > 0 {
+		fields = append(fields, "admin_listen="+strings.Join(c.AdminListen, ","))
+	}
+
+	var aliases []string
+	for _, id := range GetModelList() {
+		if info, _ := GetModelInfo(id); !strings.EqualFold(id, info.RealID) {
+			aliases = append(aliases, id+"->"+info.RealID)
+		}
+	}
+	fields = append(fields, "aliases="+strings.Join(aliases, ","), "auth="+c.authMode(), "frontends="+strings.Join(c.frontends(), ","))
+
+	fields = append(fields, "log_level="+c.LogLevel.String())
+	if len(c.LogComponents) > 0 {
+		fields = append(fields, "log_components="+formatValue(reflect.ValueOf(c.LogComponents)))
+	}
+
+	var features []string
+	flag := func(enabled bool, name string) {
+		if enabled {
+			features = append(features, name)
+		}
+	}
+	flag(c.Mock, "mock")
+	flag(c.CassetteMode != "", "cassette="+c.CassetteMode)
+	flag(c.GitHubToken != "", "github-token")
+	flag(c.HeaderProfile != "", "header-profile="+c.HeaderProfile)
+	flag(len(c.CopilotEndpoints) > 0, "load-balancing")
+	flag(c.RedisURL != "", "redis")
+	flag(c.RateLimit > 0, "rate-limit")
+	flag(c.UserRateLimit > 0, "user-rate-limit")
+	flag(c.IPRateLimit > 0, "ip-rate-limit")
+	flag(len(c.AllowCIDRs) > 0, "ip-allowlist")
+	flag(len(c.DenyCIDRs) > 0, "ip-denylist")
+	flag(len(c.TrustedProxies) > 0, "trusted-proxies")
+	flag(len(c.ModelBudgets) > 0, "model-budgets")
+	flag(len(c.ModelCosts) > 0, "model-costs")
+	flag(c.RetryQueueSize > 0, "retry-queue")
+	flag(c.CoalesceRequests, "coalesce-requests")
+	flag(c.CircuitBreakerThreshold > 0, "circuit-breaker")
+	flag(c.PromptOverflow != OverflowReject, "prompt-overflow="+c.PromptOverflow)
+	flag(c.ToolValidation != ToolValidationOff, "tool-validation="+c.ToolValidation)
+	flag(c.SmallModel != "", "auto-model")
+	flag(c.StickyModel, "sticky-model")
+	flag(c.ShadowModel != "", "shadow")
+	flag(c.TranscriptDir != "", "transcripts")
+	flag(c.WarmUp, "warmup")
+	flag(c.StreamMeter, "stream-meter")
+	flag(c.StreamBufferPolicy == streambuf.Drop && c.StreamBufferKB > 0, "stream-buffer=drop")
+	flag(c.MaxStreamDuration > 0 || len(c.RouteStreamDurations) > 0, "max-stream-duration")
+	flag(c.FilterRulesFile != "", "filters")
+	flag(c.SystemPromptFile != "", "system-prompts")
+	flag(c.ResponseCleanupFile != "", "response-cleanup")
+	flag(c.HookScript != "", "hooks")
+	flag(c.ResponsesDir != "", "responses-store")
+	flag(c.TracesEndpoint != "", "tracing")
+	flag(c.AuditDir != "", "audit")
+	flag(c.LogFile != "", "log-file")
+	flag(c.AccessLogFile != "", "access-log")
+	flag(c.InsecureSkipVerify, "insecure-skip-verify")
+	fields = append(fields, "features="+strings.Join(features, ","))
+	return strings.Join(fields, " ")
+}
+
+// frontends lists the enabled client APIs
+func (c *Config) frontends() []string {
+	var names []string
+	for _, frontend := range []struct {
+		name    string
+		enabled bool
+	}{
+		{"openai", c.EnableOpenAI},
+		{"responses", c.EnableResponses},
+		{"ollama", c.EnableOllama},
+		{"anthropic", c.EnableAnthropic},
+		{"grpc", c.EnableGRPC},
+	} {
+		if frontend.enabled {
+			names = append(names, frontend.name)
+		}
+	}
+	return names
+}
+
+// authMode describes how inbound requests are authenticated
+func (c *Config) authMode() string {
+	switch {
+	case c.KeysFile != "" && len(c.APIKeys) > 0:
+		return "keys-file+api-keys"
+	case c.KeysFile != "":
+		return "keys-file"
+	case len(c.APIKeys) > 0:
+		return "api-keys"
+	default:
+		return "none"
+	}
+}
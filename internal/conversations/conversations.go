@@ -0,0 +1,189 @@
+// internal/conversations/conversations.go
+package conversations
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/acazau/ghcsd/pkg/copilot"
+)
+
+// ErrNotFound is returned when no stored response has the requested ID, or
+// it has expired
+var ErrNotFound = errors.New("response not found")
+
+// Response is a stored turn of a conversation. It holds the complete
+// conversation up to and including the turn, so that a response stays
+// usable as a continuation point when earlier ones expire or are deleted.
+type Response struct {
+	ID         string `json:"id"`
+	PreviousID string `json:"previous_response_id,omitempty"`
+	// Owner is the name of the API key that created the response; only that
+	// key can read or continue it. Empty when created without a named key.
+	Owner     string    `json:"owner,omitempty"`
+	Model     string    `json:"model"`
+	CreatedAt time.Time `json:"created_at"`
+	// Messages is the conversation sent for this turn, without instructions
+	Messages []copilot.Message `json:"messages"`
+	// Output is the assistant's reply
+	Output copilot.Message `json:"output"`
+	// Body is the response object returned to the client
+	Body json.RawMessage `json:"body"`
+}
+
+// History returns the conversation including the response's reply, to be
+// continued by the next turn
+func (r *Response) History() []copilot.Message {
+	history := make([]copilot.Message, 0, len(r.Messages)+1)
+	history = append(history, r.Messages...)
+	return append(history, r.Output)
+}
+
+// Store persists responses as JSON files in a directory, one per response.
+// Responses are only looked up by ID, written once and expire by age, which
+// plain files serve without a database dependency, one that would not build
+// on every platform the server does.
+type Store struct {
+	mu  sync.Mutex
+	dir string
+	ttl time.Duration
+}
+
+// Open opens the store in dir, creating it if needed, and removes the
+// responses older than ttl. A zero ttl keeps responses forever. Expired
+// responses are never returned; Prune removes their files.
+func Open(dir string, ttl time.Duration) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create responses directory: %w", err)
+	}
+	s := &Store{dir: dir, ttl: ttl}
+	if _, err := s.Prune(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Get returns the response with the given ID
+func (s *Store) Get(id string) (*Response, error) {
+	path, ok := s.path(id)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	var resp Response
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, fmt.Errorf("failed to parse response %s: %w", id, err)
+	}
+	if s.expired(resp.CreatedAt) {
+		os.Remove(path)
+		return nil, ErrNotFound
+	}
+	return &resp, nil
+}
+
+// Save stores a response, replacing any response with the same ID
+func (s *Store) Save(resp *Response) error {
+	path, ok := s.path(resp.ID)
+	if !ok {
+		return fmt.Errorf("invalid response ID %q", resp.ID)
+	}
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return fmt.Errorf("failed to encode response: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write response: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write response: %w", err)
+	}
+	return nil
+}
+
+// Delete removes the response with the given ID
+func (s *Store) Delete(id string) error {
+	path, ok := s.path(id)
+	if !ok {
+		return ErrNotFound
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete response: %w", err)
+	}
+	return nil
+}
+
+// path returns the file of a response, rejecting IDs that are not safe to
+// use as file names
+func (s *Store) path(id string) (string, bool) {
+	if id == "" || len(id) > 128 {
+		return "", false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return "", false
+		}
+	}
+	return filepath.Join(s.dir, id+".json"), true
+}
+
+// expired reports whether a response created at createdAt has outlived the TTL
+func (s *Store) expired(createdAt time.Time) bool {
+	return s.ttl > 0 && time.Since(createdAt) > s.ttl
+}
+
+// TTL returns how long responses are kept, 0 when forever
+func (s *Store) TTL() time.Duration {
+	return s.ttl
+}
+
+// Prune removes expired responses and returns how many it removed. Files
+// are written once, so their modification time is the creation time of the
+// response.
+func (s *Store) Prune() (int, error) {
+	if s.ttl <= 0 {
+		return 0, nil
+	}
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read responses directory: %w", err)
+	}
+	removed := 0
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if s.expired(info.ModTime()) && os.Remove(filepath.Join(s.dir, entry.Name())) == nil {
+			removed++
+		}
+	}
+	return removed, nil
+}
@@ -0,0 +1,55 @@
+// internal/conversations/conversations_test.go
+package conversations
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/acazau/ghcsd/pkg/copilot"
+)
+
+func TestPruneRemovesExpiredResponses(t *testing.T) {
+	dir := t.TempDir()
+	store, err := Open(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"resp_old", "resp_new"} {
+		resp := &Response{ID: id, Model: "gpt-4o", CreatedAt: time.Now(), Output: copilot.Message{Role: "assistant", Content: "Hi"}}
+		if err := store.Save(resp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, "resp_old.json"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := store.Prune()
+	if err != nil || removed != 1 {
+		t.Fatalf("Prune() = %d, %v, want 1 removed", removed, err)
+	}
+	if _, err := store.Get("resp_old"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get(resp_old) = %v, want ErrNotFound", err)
+	}
+	if _, err := store.Get("resp_new"); err != nil {
+		t.Errorf("Get(resp_new) = %v", err)
+	}
+}
+
+func TestPruneKeepsResponsesWithoutTTL(t *testing.T) {
+	dir := t.TempDir()
+	store, err := Open(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(&Response{ID: "resp_1", CreatedAt: time.Now().Add(-24 * time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if removed, err := store.Prune(); err != nil || removed != 0 {
+		t.Errorf("Prune() = %d, %v, want nothing removed", removed, err)
+	}
+}
@@ -0,0 +1,107 @@
+// internal/events/events.go
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// Event types published by the proxy
+const (
+	TypeRequestStarted  = "request_started"
+	TypeRequestFinished = "request_finished"
+	TypeModelMapped     = "model_mapped"
+	TypeError           = "error"
+	TypeTokenExpiry     = "token_expiry"
+)
+
+// Event is a structured log event
+type Event struct {
+	Time      time.Time              `json:"time"`
+	Type      string                 `json:"type"`
+	RequestID string                 `json:"request_id,omitempty"`
+	Fields    map[string]interface{} `json:"fields,omitempty"`
+}
+
+// subscriberBuffer is the number of events buffered per subscriber. Slow
+// subscribers miss events rather than slowing down request handling.
+const subscriberBuffer = 256
+
+// Broker fans out events to subscribers and keeps a short history so that
+// new subscribers see recent activity
+type Broker struct {
+	mu          sync.Mutex
+	subscribers map[chan Event]struct{}
+	history     []Event
+	historySize int
+	next        int
+	dropped     int64
+}
+
+// NewBroker creates a broker retaining the last historySize events
+func NewBroker(historySize int) *Broker {
+	return &Broker{
+		subscribers: make(map[chan Event]struct{}),
+		history:     make([]Event, 0, historySize),
+		historySize: historySize,
+	}
+}
+
+// Publish sends an event to every subscriber without blocking
+func (b *Broker) Publish(event Event) {
+	if b == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.historySize > 0 {
+		if len(b.history) < b.historySize {
+			b.history = append(b.history, event)
+		} else {
+			b.history[b.next] = event
+			b.next = (b.next + 1) % b.historySize
+		}
+	}
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+			b.dropped++
+		}
+	}
+}
+
+// Subscribe returns the recent history and a channel receiving new events.
+// The returned function must be called to unsubscribe.
+func (b *Broker) Subscribe() ([]Event, <-chan Event, func()) {
+	ch := make(chan Event, subscriberBuffer)
+
+	b.mu.Lock()
+	history := make([]Event, 0, len(b.history))
+	history = append(history, b.history[b.next:]...)
+	history = append(history, b.history[:b.next]...)
+	b.subscribers[ch] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	return history, ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subscribers, ch)
+			b.mu.Unlock()
+		})
+	}
+}
+
+// Dropped returns the number of events not delivered to slow subscribers
+func (b *Broker) Dropped() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.dropped
+}
@@ -0,0 +1,231 @@
+// internal/filter/cleanup.go
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// fence opens and closes a markdown code block
+const fence = "```"
+
+// Cleanup strips model-specific artifacts from the text of completions
+type Cleanup struct {
+	// TrimPrefixes are removed, with the whitespace following them, from
+	// the start of the text, e.g. leading metadata some models emit
+	TrimPrefixes []string `json:"trim_prefixes,omitempty"`
+	// UnwrapFence removes the code fence around text that is nothing but a
+	// single fenced code block
+	UnwrapFence bool `json:"unwrap_fence,omitempty"`
+	// NormalizeNewlines turns CRLF and CR line endings into LF
+	NormalizeNewlines bool `json:"normalize_newlines,omitempty"`
+}
+
+// Cleanups is the content of a response cleanup file: a default cleanup and
+// cleanups for individual models, which take precedence over the default
+type Cleanups struct {
+	Default *Cleanup           `json:"default,omitempty"`
+	Models  map[string]Cleanup `json:"models,omitempty"`
+}
+
+// LoadCleanups reads response cleanups from a JSON file
+func LoadCleanups(path string) (*Cleanups, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response cleanups: %w", err)
+	}
+	var cleanups Cleanups
+	if err := json.Unmarshal(data, &cleanups); err != nil {
+		return nil, fmt.Errorf("failed to parse response cleanups: %w", err)
+	}
+	if cleanups.Default != nil {
+		if err := cleanups.Default.validate(); err != nil {
+			return nil, fmt.Errorf("default response cleanup: %w", err)
+		}
+	}
+	for model, cleanup := range cleanups.Models {
+		if err := cleanup.validate(); err != nil {
+			return nil, fmt.Errorf("response cleanup for %s: %w", model, err)
+		}
+	}
+	return &cleanups, nil
+}
+
+func (c Cleanup) validate() error {
+	for _, prefix := range c.TrimPrefixes {
+		if strings.TrimSpace(prefix) == "" {
+			return fmt.Errorf("trim_prefixes must not contain blank prefixes")
+		}
+	}
+	return nil
+}
+
+// Enabled reports whether the cleanup changes anything
+func (c Cleanup) Enabled() bool {
+	return len(c.TrimPrefixes) > 0 || c.UnwrapFence || c.NormalizeNewlines
+}
+
+// Clean applies the cleanup to a complete text
+func (c Cleanup) Clean(text string) string {
+	cleaner := c.NewCleaner()
+	return cleaner.Write(text) + cleaner.Flush()
+}
+
+// Cleaner applies a cleanup to a text streamed in pieces. Text that may
+// still turn out to be an artifact is held back until it can be decided; a
+// response made of a single code block is therefore held back until it ends.
+type Cleaner struct {
+	cleanup Cleanup
+
+	// lastCR is set when the previous piece ended with a CR, which a
+	// following LF belongs to
+	lastCR bool
+
+	prefixDone bool
+	prefixBuf  string
+	// trimSpace is set while the whitespace after a trimmed prefix is removed
+	trimSpace bool
+
+	fenceDone bool
+	fenceBuf  string
+}
+
+// NewCleaner returns a cleaner for one streamed text
+func (c Cleanup) NewCleaner() *Cleaner {
+	return &Cleaner{
+		cleanup:    c,
+		prefixDone: len(c.TrimPrefixes) == 0,
+		fenceDone:  !c.UnwrapFence,
+	}
+}
+
+// Write takes the next piece of the text and returns the cleaned text that
+// can be relayed now
+func (c *Cleaner) Write(text string) string {
+	if c.cleanup.NormalizeNewlines {
+		text = c.normalizeNewlines(text)
+	}
+	text = c.trimPrefix(text)
+	return c.unwrapFence(text)
+}
+
+// Flush returns the text still held back once the text has ended
+func (c *Cleaner) Flush() string {
+	text := c.prefixBuf
+	c.prefixBuf, c.prefixDone = "", true
+	text = c.unwrapFence(text)
+	if !c.fenceDone {
+		text = unwrapSingleFence(c.fenceBuf)
+		c.fenceBuf, c.fenceDone = "", true
+	}
+	return text
+}
+
+func (c *Cleaner) normalizeNewlines(text string) string {
+	if c.lastCR {
+		text = strings.TrimPrefix(text, "\n")
+	}
+	if text == "" {
+		return text
+	}
+	c.lastCR = strings.HasSuffix(text, "\r")
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	return strings.ReplaceAll(text, "\r", "\n")
+}
+
+// trimPrefix holds back the start of the text until it is known whether it
+// begins with one of the prefixes
+func (c *Cleaner) trimPrefix(text string) string {
+	if c.trimSpace {
+		text = strings.TrimLeft(text, " \t\r\n")
+		c.trimSpace = text == ""
+	}
+	if c.prefixDone {
+		return text
+	}
+	c.prefixBuf += text
+	start := strings.TrimLeft(c.prefixBuf, " \t\r\n")
+	if start == "" {
+		return ""
+	}
+	undecided := false
+	for _, prefix := range c.cleanup.TrimPrefixes {
+		if rest, ok := strings.CutPrefix(start, prefix); ok {
+			c.prefixBuf, c.prefixDone = "", true
+			rest = strings.TrimLeft(rest, " \t\r\n")
+			c.trimSpace = rest == ""
+			return rest
+		}
+		if strings.HasPrefix(prefix, start) {
+			undecided = true
+		}
+	}
+	if undecided {
+		return ""
+	}
+	text, c.prefixBuf, c.prefixDone = c.prefixBuf, "", true
+	return text
+}
+
+// unwrapFence holds back text that starts with a code fence until it is
+// known whether the fenced block is all there is
+func (c *Cleaner) unwrapFence(text string) string {
+	if c.fenceDone {
+		return text
+	}
+	c.fenceBuf += text
+	start := strings.TrimLeft(c.fenceBuf, " \t\r\n")
+	if start == "" || (len(start) < len(fence) && strings.HasPrefix(fence, start)) {
+		return ""
+	}
+	if strings.HasPrefix(start, fence) {
+		_, rest, closed := splitFence(start)
+		if !closed || strings.TrimSpace(rest) == "" {
+			return ""
+		}
+	}
+	// Not a single code block: relay everything unchanged
+	text, c.fenceBuf, c.fenceDone = c.fenceBuf, "", true
+	return text
+}
+
+// splitFence splits text starting with a code fence into the content of the
+// block and what follows its closing fence
+func splitFence(text string) (content, rest string, closed bool) {
+	_, body, ok := strings.Cut(text, "\n")
+	if !ok {
+		return "", "", false
+	}
+	var lines []string
+	for {
+		line, tail, more := strings.Cut(body, "\n")
+		if strings.TrimSpace(line) == fence {
+			return strings.Join(lines, "\n"), tail, true
+		}
+		if !more {
+			return "", "", false
+		}
+		lines = append(lines, line)
+		body = tail
+	}
+}
+
+// unwrapSingleFence returns the content of text when it is a single code
+// block, or text unchanged
+func unwrapSingleFence(text string) string {
+	start := strings.TrimLeft(text, " \t\r\n")
+	if !strings.HasPrefix(start, fence) {
+		return text
+	}
+	opener, _, _ := strings.Cut(start, "\n")
+	if strings.Contains(strings.TrimPrefix(opener, fence), "`") {
+		return text
+	}
+	content, rest, closed := splitFence(start)
+	if !closed || strings.TrimSpace(rest) != "" {
+		return text
+	}
+	return content
+}
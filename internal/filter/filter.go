@@ -0,0 +1,174 @@
+// internal/filter/filter.go
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+
+	"github.com/acazau/ghcsd/pkg/copilot"
+)
+
+// Action is what a rule does when its pattern matches
+type Action string
+
+const (
+	// ActionRedact replaces matches before the prompt is forwarded
+	ActionRedact Action = "redact"
+	// ActionBlock rejects the whole request
+	ActionBlock Action = "block"
+	// ActionWarn forwards the prompt unchanged but records the trigger
+	ActionWarn Action = "warn"
+)
+
+// Trigger records that a rule matched a request
+type Trigger struct {
+	Rule    string `json:"rule"`
+	Action  Action `json:"action"`
+	Matches int    `json:"matches"`
+}
+
+// Result is the outcome of running filters over a request
+type Result struct {
+	Triggers []Trigger
+	// BlockedBy names the rule that blocked the request, empty if allowed
+	BlockedBy string
+}
+
+// Blocked reports whether a rule blocked the request
+func (r Result) Blocked() bool {
+	return r.BlockedBy != ""
+}
+
+// Filter inspects and may modify an outgoing request
+type Filter interface {
+	Apply(req *copilot.CompletionRequest) Result
+}
+
+// Chain runs filters in order, stopping at the first one that blocks
+type Chain []Filter
+
+// Apply runs every filter of the chain and merges their results
+func (c Chain) Apply(req *copilot.CompletionRequest) Result {
+	var result Result
+	for _, f := range c {
+		r := f.Apply(req)
+		result.Triggers = append(result.Triggers, r.Triggers...)
+		if r.Blocked() {
+			result.BlockedBy = r.BlockedBy
+			return result
+		}
+	}
+	return result
+}
+
+// Rule matches a regular expression in prompt text
+type Rule struct {
+	Name        string `json:"name"`
+	Pattern     string `json:"pattern"`
+	Action      Action `json:"action"`
+	Replacement string `json:"replacement,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// RuleFilter applies a list of regex rules to the text of every message
+type RuleFilter struct {
+	rules []Rule
+}
+
+// NewRuleFilter compiles and validates the rules
+func NewRuleFilter(rules []Rule) (*RuleFilter, error) {
+	compiled := make([]Rule, 0, len(rules))
+	for i, rule := range rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i+1)
+		}
+		switch rule.Action {
+		case ActionRedact, ActionBlock, ActionWarn:
+		case "":
+			rule.Action = ActionRedact
+		default:
+			return nil, fmt.Errorf("rule %s: unknown action %q", rule.Name, rule.Action)
+		}
+		if rule.Replacement == "" {
+			rule.Replacement = "[REDACTED]"
+		}
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: invalid pattern: %w", rule.Name, err)
+		}
+		rule.re = re
+		compiled = append(compiled, rule)
+	}
+	return &RuleFilter{rules: compiled}, nil
+}
+
+// LoadRules reads rules from a JSON file containing an array of rules
+func LoadRules(path string) ([]Rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read filter rules: %w", err)
+	}
+	var rules []Rule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("failed to parse filter rules: %w", err)
+	}
+	return rules, nil
+}
+
+// Apply runs every rule over the message text. Redactions are applied in
+// place; a block rule stops processing immediately.
+func (f *RuleFilter) Apply(req *copilot.CompletionRequest) Result {
+	var result Result
+	for _, rule := range f.rules {
+		matches := 0
+		for i := range req.Messages {
+			rewriteText(&req.Messages[i], func(text string) string {
+				found := len(rule.re.FindAllStringIndex(text, -1))
+				if found == 0 {
+					return text
+				}
+				matches += found
+				if rule.Action == ActionRedact {
+					return rule.re.ReplaceAllString(text, rule.Replacement)
+				}
+				return text
+			})
+		}
+		if matches == 0 {
+			continue
+		}
+
+		result.Triggers = append(result.Triggers, Trigger{Rule: rule.Name, Action: rule.Action, Matches: matches})
+		if rule.Action == ActionBlock {
+			result.BlockedBy = rule.Name
+			return result
+		}
+	}
+	return result
+}
+
+// rewriteText passes every piece of text in the message through fn and stores
+// the result. It handles string content as well as text content parts.
+func rewriteText(msg *copilot.Message, fn func(string) string) {
+	switch content := msg.Content.(type) {
+	case string:
+		msg.Content = fn(content)
+	case []copilot.MessageContent:
+		for i := range content {
+			if content[i].Type == "text" {
+				content[i].Text = fn(content[i].Text)
+			}
+		}
+	case []interface{}:
+		for _, item := range content {
+			if part, ok := item.(map[string]interface{}); ok {
+				if text, ok := part["text"].(string); ok {
+					part["text"] = fn(text)
+				}
+			}
+		}
+	}
+}
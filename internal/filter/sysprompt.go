@@ -0,0 +1,130 @@
+// internal/filter/sysprompt.go
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/acazau/ghcsd/pkg/copilot"
+)
+
+// PromptMode decides how an operator system prompt combines with the
+// system prompt sent by the client
+type PromptMode string
+
+const (
+	// PromptPrepend places the operator prompt before the client's system messages
+	PromptPrepend PromptMode = "prepend"
+	// PromptAppend places the operator prompt after the client's system messages
+	PromptAppend PromptMode = "append"
+	// PromptReplace drops the client's system messages
+	PromptReplace PromptMode = "replace"
+	// PromptFallback only applies when the client sent no system message
+	PromptFallback PromptMode = "fallback"
+)
+
+// SystemPrompt is an operator-defined system prompt
+type SystemPrompt struct {
+	Prompt string     `json:"prompt"`
+	Mode   PromptMode `json:"mode,omitempty"`
+}
+
+// SystemPrompts is the content of a system prompt file: a default prompt and
+// prompts for individual models, which take precedence over the default
+type SystemPrompts struct {
+	Default *SystemPrompt           `json:"default,omitempty"`
+	Models  map[string]SystemPrompt `json:"models,omitempty"`
+}
+
+// LoadSystemPrompts reads system prompts from a JSON file
+func LoadSystemPrompts(path string) (*SystemPrompts, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read system prompts: %w", err)
+	}
+	var prompts SystemPrompts
+	if err := json.Unmarshal(data, &prompts); err != nil {
+		return nil, fmt.Errorf("failed to parse system prompts: %w", err)
+	}
+	return &prompts, nil
+}
+
+// SystemPromptFilter adds operator system prompts to outgoing requests
+type SystemPromptFilter struct {
+	defaultPrompt *SystemPrompt
+	models        map[string]SystemPrompt
+}
+
+// NewSystemPromptFilter validates the prompts. Model prompts are keyed by
+// the model ID sent upstream.
+func NewSystemPromptFilter(defaultPrompt *SystemPrompt, models map[string]SystemPrompt) (*SystemPromptFilter, error) {
+	f := &SystemPromptFilter{models: make(map[string]SystemPrompt, len(models))}
+	if defaultPrompt != nil {
+		normalized, err := normalizePrompt(*defaultPrompt)
+		if err != nil {
+			return nil, fmt.Errorf("default system prompt: %w", err)
+		}
+		f.defaultPrompt = &normalized
+	}
+	for model, prompt := range models {
+		normalized, err := normalizePrompt(prompt)
+		if err != nil {
+			return nil, fmt.Errorf("system prompt for %s: %w", model, err)
+		}
+		f.models[model] = normalized
+	}
+	return f, nil
+}
+
+func normalizePrompt(prompt SystemPrompt) (SystemPrompt, error) {
+	switch prompt.Mode {
+	case PromptPrepend, PromptAppend, PromptReplace, PromptFallback:
+	case "":
+		prompt.Mode = PromptPrepend
+	default:
+		return prompt, fmt.Errorf("unknown mode %q", prompt.Mode)
+	}
+	return prompt, nil
+}
+
+// Apply adds the system prompt configured for the request's model, or the
+// default one, according to its mode
+func (f *SystemPromptFilter) Apply(req *copilot.CompletionRequest) Result {
+	prompt, ok := f.models[req.Model]
+	if !ok {
+		if f.defaultPrompt == nil {
+			return Result{}
+		}
+		prompt = *f.defaultPrompt
+	}
+
+	// Client system messages are the leading run of system messages
+	leading := 0
+	for leading < len(req.Messages) && req.Messages[leading].Role == "system" {
+		leading++
+	}
+
+	system := copilot.Message{Role: "system", Content: prompt.Prompt}
+	var messages []copilot.Message
+	switch prompt.Mode {
+	case PromptPrepend:
+		messages = append(messages, system)
+		messages = append(messages, req.Messages...)
+	case PromptAppend:
+		messages = append(messages, req.Messages[:leading]...)
+		messages = append(messages, system)
+		messages = append(messages, req.Messages[leading:]...)
+	case PromptReplace:
+		messages = append(messages, system)
+		messages = append(messages, req.Messages[leading:]...)
+	case PromptFallback:
+		if leading > 0 {
+			return Result{}
+		}
+		messages = append(messages, system)
+		messages = append(messages, req.Messages...)
+	}
+	req.Messages = messages
+	return Result{}
+}
@@ -0,0 +1,379 @@
+// internal/hook/hook.go
+package hook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+
+	"github.com/acazau/ghcsd/pkg/copilot"
+)
+
+// The functions a script may define, each optional
+const (
+	onRequest  = "on_request"
+	onResponse = "on_response"
+	onChunk    = "on_chunk"
+)
+
+// arrayType marks the tables converted from JSON arrays, so that an emptied
+// array is not turned into an object on the way back
+const arrayType = "array"
+
+// Rejection is returned when a script rejects a request with ghcsd.reject
+type Rejection struct {
+	Message string
+}
+
+func (r *Rejection) Error() string {
+	return r.Message
+}
+
+// Info describes the request a hook runs for. Scripts receive it as their
+// second argument, and may add string tags to it in on_request.
+type Info struct {
+	RequestID string
+	Endpoint  string
+	Model     string
+	APIKey    string
+	User      string
+	Caller    string
+	Tags      map[string]string
+}
+
+// Script is a compiled Lua script run on requests and responses. Each
+// concurrent call runs in its own Lua state, taken from a pool.
+type Script struct {
+	path    string
+	proto   *lua.FunctionProto
+	timeout time.Duration
+	defined map[string]bool
+	pool    sync.Pool
+}
+
+// state is a Lua state with the script loaded
+type state struct {
+	L *lua.LState
+	// rejection is set by ghcsd.reject during a call
+	rejection *Rejection
+}
+
+// Load compiles the script at path. Every call is stopped after timeout.
+func Load(path string, timeout time.Duration) (*Script, error) {
+	source, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hook script: %w", err)
+	}
+	chunk, err := parse.Parse(bytes.NewReader(source), path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse hook script: %w", err)
+	}
+	proto, err := lua.Compile(chunk, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile hook script: %w", err)
+	}
+	s := &Script{path: path, proto: proto, timeout: timeout, defined: make(map[string]bool)}
+	st, err := s.newState()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range []string{onRequest, onResponse, onChunk} {
+		s.defined[name] = st.L.GetGlobal(name).Type() == lua.LTFunction
+	}
+	if !s.HasRequest() && !s.HasResponse() && !s.HasChunk() {
+		return nil, fmt.Errorf("hook script %s defines none of %s, %s or %s", path, onRequest, onResponse, onChunk)
+	}
+	s.pool.Put(st)
+	return s, nil
+}
+
+// HasRequest reports whether the script defines on_request
+func (s *Script) HasRequest() bool {
+	return s != nil && s.defined[onRequest]
+}
+
+// HasResponse reports whether the script defines on_response
+func (s *Script) HasResponse() bool {
+	return s != nil && s.defined[onResponse]
+}
+
+// HasChunk reports whether the script defines on_chunk
+func (s *Script) HasChunk() bool {
+	return s != nil && s.defined[onChunk]
+}
+
+// newState creates a sandboxed Lua state, without file or OS access, and
+// runs the script in it
+func (s *Script) newState() (*state, error) {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for name, open := range map[string]lua.LGFunction{
+		lua.BaseLibName:   lua.OpenBase,
+		lua.TabLibName:    lua.OpenTable,
+		lua.StringLibName: lua.OpenString,
+		lua.MathLibName:   lua.OpenMath,
+	} {
+		L.Push(L.NewFunction(open))
+		L.Push(lua.LString(name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "require", "module"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+
+	st := &state{L: L}
+	api := L.NewTable()
+	L.SetField(api, "reject", L.NewFunction(func(L *lua.LState) int {
+		st.rejection = &Rejection{Message: L.OptString(1, "Request rejected by policy")}
+		L.RaiseError("%s", st.rejection.Message)
+		return 0
+	}))
+	L.SetGlobal("ghcsd", api)
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	L.SetContext(ctx)
+	defer L.RemoveContext()
+	L.Push(L.NewFunctionFromProto(s.proto))
+	if err := L.PCall(0, 0, nil); err != nil {
+		L.Close()
+		return nil, fmt.Errorf("failed to run hook script %s: %w", s.path, err)
+	}
+	return st, nil
+}
+
+// call runs the script function name with the JSON document doc and info,
+// returning the document as the function left or returned it
+func (s *Script) call(ctx context.Context, name string, doc []byte, info *Info) ([]byte, error) {
+	var value interface{}
+	if err := json.Unmarshal(doc, &value); err != nil {
+		return nil, err
+	}
+	st, _ := s.pool.Get().(*state)
+	if st == nil {
+		var err error
+		if st, err = s.newState(); err != nil {
+			return nil, err
+		}
+	}
+	L := st.L
+	st.rejection = nil
+
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	L.SetContext(ctx)
+	defer L.RemoveContext()
+
+	table := toLua(L, value)
+	infoTable := infoToLua(L, info)
+	L.Push(L.GetGlobal(name))
+	L.Push(table)
+	L.Push(infoTable)
+	if err := L.PCall(2, 1, nil); err != nil {
+		// A state stopped mid-call may be left inconsistent
+		L.Close()
+		if st.rejection != nil {
+			return nil, st.rejection
+		}
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, fmt.Errorf("%s did not finish within %s", name, s.timeout)
+		}
+		return nil, fmt.Errorf("%s failed: %w", name, err)
+	}
+	result := L.Get(-1)
+	L.Pop(1)
+	if result != lua.LNil {
+		table = result
+	}
+	if info != nil {
+		info.Tags = tagsFromLua(infoTable)
+	}
+	out, err := json.Marshal(fromLua(L, table))
+	s.pool.Put(st)
+	if err != nil {
+		return nil, fmt.Errorf("%s returned an invalid document: %w", name, err)
+	}
+	return out, nil
+}
+
+// Request runs on_request on a completion request, which the script may
+// modify in place or replace by returning a new table. It returns a
+// *Rejection when the script rejects the request.
+func (s *Script) Request(ctx context.Context, req *copilot.CompletionRequest, info *Info) error {
+	if !s.HasRequest() {
+		return nil
+	}
+	doc, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	out, err := s.call(ctx, onRequest, doc, info)
+	if err != nil {
+		return err
+	}
+	var modified copilot.CompletionRequest
+	if err := json.Unmarshal(out, &modified); err != nil {
+		return fmt.Errorf("%s returned an invalid request: %w", onRequest, err)
+	}
+	*req = modified
+	return nil
+}
+
+// Response runs on_response on the JSON body of a completion response
+func (s *Script) Response(ctx context.Context, body []byte, info *Info) ([]byte, error) {
+	if !s.HasResponse() {
+		return body, nil
+	}
+	return s.call(ctx, onResponse, body, info)
+}
+
+// Chunk runs on_chunk on the JSON data of a streamed completion chunk
+func (s *Script) Chunk(ctx context.Context, data []byte, info *Info) ([]byte, error) {
+	if !s.HasChunk() {
+		return data, nil
+	}
+	return s.call(ctx, onChunk, data, info)
+}
+
+// toLua converts a decoded JSON value to a Lua value
+func toLua(L *lua.LState, value interface{}) lua.LValue {
+	switch v := value.(type) {
+	case nil:
+		return lua.LNil
+	case bool:
+		return lua.LBool(v)
+	case float64:
+		return lua.LNumber(v)
+	case string:
+		return lua.LString(v)
+	case []interface{}:
+		table := L.CreateTable(len(v), 0)
+		for _, item := range v {
+			table.Append(toLua(L, item))
+		}
+		mt := L.NewTable()
+		L.SetField(mt, "__jsontype", lua.LString(arrayType))
+		L.SetMetatable(table, mt)
+		return table
+	case map[string]interface{}:
+		table := L.CreateTable(0, len(v))
+		for key, item := range v {
+			table.RawSetString(key, toLua(L, item))
+		}
+		return table
+	}
+	return lua.LNil
+}
+
+// fromLua converts a Lua value back to a JSON value. Tables are arrays when
+// they were arrays in the JSON document or have only sequential keys.
+func fromLua(L *lua.LState, value lua.LValue) interface{} {
+	switch v := value.(type) {
+	case lua.LBool:
+		return bool(v)
+	case lua.LNumber:
+		return float64(v)
+	case lua.LString:
+		return string(v)
+	case *lua.LTable:
+		isArray := false
+		if mt, ok := L.GetMetatable(v).(*lua.LTable); ok {
+			isArray = mt.RawGetString("__jsontype") == lua.LString(arrayType)
+		}
+		n := v.Len()
+		if !isArray && n > 0 {
+			count := 0
+			v.ForEach(func(lua.LValue, lua.LValue) { count++ })
+			isArray = count == n
+		}
+		if isArray {
+			items := make([]interface{}, 0, n)
+			for i := 1; i <= n; i++ {
+				items = append(items, fromLua(L, v.RawGetInt(i)))
+			}
+			return items
+		}
+		object := make(map[string]interface{})
+		v.ForEach(func(key, item lua.LValue) {
+			if key, ok := key.(lua.LString); ok {
+				object[string(key)] = fromLua(L, item)
+			}
+		})
+		return object
+	}
+	return nil
+}
+
+// infoToLua converts the request info to the table passed to scripts
+func infoToLua(L *lua.LState, info *Info) *lua.LTable {
+	table := L.NewTable()
+	tags := L.NewTable()
+	if info != nil {
+		for key, value := range map[string]string{
+			"request_id": info.RequestID,
+			"endpoint":   info.Endpoint,
+			"model":      info.Model,
+			"api_key":    info.APIKey,
+			"user":       info.User,
+			"caller":     info.Caller,
+		} {
+			if value != "" {
+				table.RawSetString(key, lua.LString(value))
+			}
+		}
+		for key, value := range info.Tags {
+			tags.RawSetString(key, lua.LString(value))
+		}
+	}
+	table.RawSetString("tags", tags)
+	return table
+}
+
+// tagsFromLua reads the tags a script left in the info table, keeping the
+// string and number values
+func tagsFromLua(info *lua.LTable) map[string]string {
+	table, ok := info.RawGetString("tags").(*lua.LTable)
+	if !ok {
+		return nil
+	}
+	var tags map[string]string
+	table.ForEach(func(key, value lua.LValue) {
+		name, ok := key.(lua.LString)
+		if !ok {
+			return
+		}
+		switch value.(type) {
+		case lua.LString, lua.LNumber, lua.LBool:
+			if tags == nil {
+				tags = make(map[string]string)
+			}
+			tags[string(name)] = value.String()
+		}
+	})
+	return tags
+}
+
+// FormatTags formats tags as sorted key=value pairs for the logs
+func FormatTags(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	for i, key := range keys {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		fmt.Fprintf(&buf, "%s=%s", key, tags[key])
+	}
+	return buf.String()
+}
@@ -0,0 +1,576 @@
+// internal/jsonschema/jsonschema.go
+package jsonschema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxErrors bounds the problems reported for one document
+const maxErrors = 10
+
+// Schema is a compiled JSON schema. It supports the keywords tool schemas
+// use in practice: type, enum, const, properties, required,
+// additionalProperties, items, prefixItems, the numeric, length and count
+// bounds, pattern, allOf, anyOf, oneOf, not and local $ref. Other keywords,
+// such as format, are ignored. Recursive references must descend into the
+// value, through properties or items, for the schema to compile.
+type Schema struct {
+	root *node
+}
+
+// node is a compiled subschema
+type node struct {
+	// always is set for the boolean schemas true and false
+	always *bool
+
+	types    []string
+	enum     []interface{}
+	constant *interface{}
+
+	properties           map[string]*node
+	required             []string
+	additionalProperties *node
+	items                *node
+	prefixItems          []*node
+
+	minimum, maximum                   *float64
+	exclusiveMinimum, exclusiveMaximum *float64
+	multipleOf                         *float64
+	minLength, maxLength               *int
+	minItems, maxItems                 *int
+	minProperties, maxProperties       *int
+	uniqueItems                        bool
+	pattern                            *regexp.Regexp
+
+	allOf, anyOf, oneOf []*node
+	not                 *node
+
+	// resolved is the target of $ref
+	resolved *node
+}
+
+// compiler resolves local references while compiling a document
+type compiler struct {
+	document map[string]interface{}
+	refs     map[string]*node
+}
+
+// Compile parses a JSON schema
+func Compile(data []byte) (*Schema, error) {
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid schema: %w", err)
+	}
+	c := &compiler{refs: make(map[string]*node)}
+	c.document, _ = doc.(map[string]interface{})
+	root, err := c.compile(doc, "#")
+	if err != nil {
+		return nil, err
+	}
+	if err := checkCycles(root); err != nil {
+		return nil, err
+	}
+	return &Schema{root: root}, nil
+}
+
+func (c *compiler) compile(v interface{}, path string) (*node, error) {
+	switch s := v.(type) {
+	case bool:
+		return &node{always: &s}, nil
+	case map[string]interface{}:
+		return c.compileObject(s, path)
+	}
+	return nil, fmt.Errorf("invalid schema at %s: expected an object or a boolean", path)
+}
+
+func (c *compiler) compileObject(s map[string]interface{}, path string) (*node, error) {
+	n := &node{}
+	var err error
+
+	switch t := s["type"].(type) {
+	case string:
+		n.types = []string{t}
+	case []interface{}:
+		for _, item := range t {
+			if name, ok := item.(string); ok {
+				n.types = append(n.types, name)
+			}
+		}
+	}
+	if enum, ok := s["enum"].([]interface{}); ok {
+		n.enum = enum
+	}
+	if constant, ok := s["const"]; ok {
+		n.constant = &constant
+	}
+	if ref, ok := s["$ref"].(string); ok {
+		if !strings.HasPrefix(ref, "#") {
+			return nil, fmt.Errorf("unsupported $ref %q at %s: only local references are supported", ref, path)
+		}
+		if n.resolved, err = c.resolve(ref); err != nil {
+			return nil, err
+		}
+	}
+
+	if props, ok := s["properties"].(map[string]interface{}); ok {
+		n.properties = make(map[string]*node, len(props))
+		for name, sub := range props {
+			if n.properties[name], err = c.compile(sub, path+"/properties/"+name); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if required, ok := s["required"].([]interface{}); ok {
+		for _, name := range required {
+			if name, ok := name.(string); ok {
+				n.required = append(n.required, name)
+			}
+		}
+	}
+	if sub, ok := s["additionalProperties"]; ok {
+		if n.additionalProperties, err = c.compile(sub, path+"/additionalProperties"); err != nil {
+			return nil, err
+		}
+	}
+	if prefix, ok := s["prefixItems"].([]interface{}); ok {
+		if n.prefixItems, err = c.compileList(prefix, path+"/prefixItems"); err != nil {
+			return nil, err
+		}
+	}
+	switch items := s["items"].(type) {
+	case []interface{}:
+		// Draft 7 tuple form
+		if n.prefixItems, err = c.compileList(items, path+"/items"); err != nil {
+			return nil, err
+		}
+	case nil:
+	default:
+		if n.items, err = c.compile(items, path+"/items"); err != nil {
+			return nil, err
+		}
+	}
+
+	n.minimum = number(s, "minimum")
+	n.maximum = number(s, "maximum")
+	n.exclusiveMinimum = number(s, "exclusiveMinimum")
+	n.exclusiveMaximum = number(s, "exclusiveMaximum")
+	n.multipleOf = number(s, "multipleOf")
+	n.minLength = count(s, "minLength")
+	n.maxLength = count(s, "maxLength")
+	n.minItems = count(s, "minItems")
+	n.maxItems = count(s, "maxItems")
+	n.minProperties = count(s, "minProperties")
+	n.maxProperties = count(s, "maxProperties")
+	n.uniqueItems, _ = s["uniqueItems"].(bool)
+	if pattern, ok := s["pattern"].(string); ok {
+		if n.pattern, err = regexp.Compile(pattern); err != nil {
+			return nil, fmt.Errorf("invalid pattern at %s: %w", path, err)
+		}
+	}
+
+	for _, keyword := range []string{"allOf", "anyOf", "oneOf"} {
+		list, ok := s[keyword].([]interface{})
+		if !ok {
+			continue
+		}
+		compiled, err := c.compileList(list, path+"/"+keyword)
+		if err != nil {
+			return nil, err
+		}
+		switch keyword {
+		case "allOf":
+			n.allOf = compiled
+		case "anyOf":
+			n.anyOf = compiled
+		case "oneOf":
+			n.oneOf = compiled
+		}
+	}
+	if sub, ok := s["not"]; ok {
+		if n.not, err = c.compile(sub, path+"/not"); err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+func (c *compiler) compileList(list []interface{}, path string) ([]*node, error) {
+	nodes := make([]*node, len(list))
+	for i, sub := range list {
+		var err error
+		if nodes[i], err = c.compile(sub, fmt.Sprintf("%s/%d", path, i)); err != nil {
+			return nil, err
+		}
+	}
+	return nodes, nil
+}
+
+// resolve compiles the target of a local reference such as "#/$defs/Item"
+func (c *compiler) resolve(ref string) (*node, error) {
+	if n, ok := c.refs[ref]; ok {
+		return n, nil
+	}
+	var target interface{} = c.document
+	for _, token := range strings.Split(strings.TrimPrefix(strings.TrimPrefix(ref, "#"), "/"), "/") {
+		if token == "" {
+			continue
+		}
+		token = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+		obj, ok := target.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("unresolvable $ref %q", ref)
+		}
+		if target, ok = obj[token]; !ok {
+			return nil, fmt.Errorf("unresolvable $ref %q", ref)
+		}
+	}
+	// Registered before compiling so that recursive schemas terminate
+	n := &node{}
+	c.refs[ref] = n
+	compiled, err := c.compile(target, ref)
+	if err != nil {
+		return nil, err
+	}
+	*n = *compiled
+	return n, nil
+}
+
+// checkCycles rejects schemas whose references lead back to themselves
+// without descending into the value, such as {"$ref": "#"}, which no
+// validation would finish
+func checkCycles(root *node) error {
+	const (
+		visiting = iota + 1
+		done
+	)
+	state := make(map[*node]int)
+	var visit func(n *node) error
+	visit = func(n *node) error {
+		switch state[n] {
+		case visiting:
+			return fmt.Errorf("invalid schema: $ref cycle applies a schema to the value it validates")
+		case done:
+			return nil
+		}
+		state[n] = visiting
+		for _, next := range n.inPlace() {
+			if err := visit(next); err != nil {
+				return err
+			}
+		}
+		state[n] = done
+		return nil
+	}
+	seen := map[*node]bool{root: true}
+	queue := []*node{root}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		if err := visit(n); err != nil {
+			return err
+		}
+		for _, next := range append(n.inPlace(), n.children()...) {
+			if !seen[next] {
+				seen[next] = true
+				queue = append(queue, next)
+			}
+		}
+	}
+	return nil
+}
+
+// inPlace returns the subschemas n applies to the value it validates
+func (n *node) inPlace() []*node {
+	next := append(append(append([]*node{}, n.allOf...), n.anyOf...), n.oneOf...)
+	if n.not != nil {
+		next = append(next, n.not)
+	}
+	if n.resolved != nil {
+		next = append(next, n.resolved)
+	}
+	return next
+}
+
+// children returns the subschemas n applies to the members of the value
+func (n *node) children() []*node {
+	next := append([]*node{}, n.prefixItems...)
+	for _, sub := range n.properties {
+		next = append(next, sub)
+	}
+	if n.additionalProperties != nil {
+		next = append(next, n.additionalProperties)
+	}
+	if n.items != nil {
+		next = append(next, n.items)
+	}
+	return next
+}
+
+func number(s map[string]interface{}, key string) *float64 {
+	if v, ok := s[key].(float64); ok {
+		return &v
+	}
+	return nil
+}
+
+func count(s map[string]interface{}, key string) *int {
+	if v, ok := s[key].(float64); ok {
+		n := int(v)
+		return &n
+	}
+	return nil
+}
+
+// ValidationError lists the ways a document does not match a schema
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return strings.Join(e.Problems, "; ")
+}
+
+// Validate checks a JSON document against the schema, returning a
+// *ValidationError when it does not match
+func (s *Schema) Validate(data []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return &ValidationError{Problems: []string{fmt.Sprintf("invalid JSON: %v", err)}}
+	}
+	if decoder.More() {
+		return &ValidationError{Problems: []string{"invalid JSON: unexpected data after the document"}}
+	}
+	var v validator
+	v.check(s.root, doc, "$")
+	if len(v.problems) == 0 {
+		return nil
+	}
+	return &ValidationError{Problems: v.problems}
+}
+
+// validator collects the problems found in a document
+type validator struct {
+	problems []string
+}
+
+func (v *validator) report(path, format string, args ...interface{}) {
+	if len(v.problems) < maxErrors {
+		v.problems = append(v.problems, path+": "+fmt.Sprintf(format, args...))
+	}
+}
+
+// matches reports whether value matches n, without reporting problems
+func matches(n *node, value interface{}) bool {
+	var v validator
+	v.check(n, value, "$")
+	return len(v.problems) == 0
+}
+
+func (v *validator) check(n *node, value interface{}, path string) {
+	if n.always != nil {
+		if !*n.always {
+			v.report(path, "no value is allowed")
+		}
+		return
+	}
+	if n.resolved != nil {
+		v.check(n.resolved, value, path)
+	}
+
+	if len(n.types) > 0 && !hasType(n.types, value) {
+		v.report(path, "expected %s, got %s", strings.Join(n.types, " or "), typeOf(value))
+		// The remaining keywords would only repeat the type mismatch
+		return
+	}
+	if n.enum != nil && !contains(n.enum, value) {
+		v.report(path, "must be one of %s", encode(n.enum))
+	}
+	if n.constant != nil && !equal(*n.constant, value) {
+		v.report(path, "must be %s", encode(*n.constant))
+	}
+
+	switch value := value.(type) {
+	case map[string]interface{}:
+		v.checkObject(n, value, path)
+	case []interface{}:
+		v.checkArray(n, value, path)
+	case string:
+		length := utf8.RuneCountInString(value)
+		if n.minLength != nil && length < *n.minLength {
+			v.report(path, "must be at least %d characters long", *n.minLength)
+		}
+		if n.maxLength != nil && length > *n.maxLength {
+			v.report(path, "must be at most %d characters long", *n.maxLength)
+		}
+		if n.pattern != nil && !n.pattern.MatchString(value) {
+			v.report(path, "must match the pattern %s", n.pattern)
+		}
+	case float64:
+		if n.minimum != nil && value < *n.minimum {
+			v.report(path, "must be at least %g", *n.minimum)
+		}
+		if n.maximum != nil && value > *n.maximum {
+			v.report(path, "must be at most %g", *n.maximum)
+		}
+		if n.exclusiveMinimum != nil && value <= *n.exclusiveMinimum {
+			v.report(path, "must be greater than %g", *n.exclusiveMinimum)
+		}
+		if n.exclusiveMaximum != nil && value >= *n.exclusiveMaximum {
+			v.report(path, "must be less than %g", *n.exclusiveMaximum)
+		}
+		if n.multipleOf != nil && *n.multipleOf > 0 {
+			if q := value / *n.multipleOf; q != math.Trunc(q) {
+				v.report(path, "must be a multiple of %g", *n.multipleOf)
+			}
+		}
+	}
+
+	for _, sub := range n.allOf {
+		v.check(sub, value, path)
+	}
+	if len(n.anyOf) > 0 {
+		matched := false
+		for _, sub := range n.anyOf {
+			if matches(sub, value) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			v.report(path, "does not match any of the allowed schemas")
+		}
+	}
+	if len(n.oneOf) > 0 {
+		matched := 0
+		for _, sub := range n.oneOf {
+			if matches(sub, value) {
+				matched++
+			}
+		}
+		if matched != 1 {
+			v.report(path, "must match exactly one of the allowed schemas, matches %d", matched)
+		}
+	}
+	if n.not != nil && matches(n.not, value) {
+		v.report(path, "matches a disallowed schema")
+	}
+}
+
+func (v *validator) checkObject(n *node, obj map[string]interface{}, path string) {
+	for _, name := range n.required {
+		if _, ok := obj[name]; !ok {
+			v.report(path, "missing required property %q", name)
+		}
+	}
+	if n.minProperties != nil && len(obj) < *n.minProperties {
+		v.report(path, "must have at least %d properties", *n.minProperties)
+	}
+	if n.maxProperties != nil && len(obj) > *n.maxProperties {
+		v.report(path, "must have at most %d properties", *n.maxProperties)
+	}
+	names := make([]string, 0, len(obj))
+	for name := range obj {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if sub, ok := n.properties[name]; ok {
+			v.check(sub, obj[name], path+"."+name)
+			continue
+		}
+		if n.additionalProperties == nil {
+			continue
+		}
+		if always := n.additionalProperties.always; always != nil && !*always {
+			v.report(path, "unexpected property %q", name)
+			continue
+		}
+		v.check(n.additionalProperties, obj[name], path+"."+name)
+	}
+}
+
+func (v *validator) checkArray(n *node, arr []interface{}, path string) {
+	if n.minItems != nil && len(arr) < *n.minItems {
+		v.report(path, "must have at least %d items", *n.minItems)
+	}
+	if n.maxItems != nil && len(arr) > *n.maxItems {
+		v.report(path, "must have at most %d items", *n.maxItems)
+	}
+	for i, item := range arr {
+		itemPath := fmt.Sprintf("%s[%d]", path, i)
+		if i < len(n.prefixItems) {
+			v.check(n.prefixItems[i], item, itemPath)
+		} else if n.items != nil {
+			v.check(n.items, item, itemPath)
+		}
+	}
+	if n.uniqueItems {
+		for i := range arr {
+			for j := i + 1; j < len(arr); j++ {
+				if equal(arr[i], arr[j]) {
+					v.report(path, "items %d and %d are equal", i, j)
+					return
+				}
+			}
+		}
+	}
+}
+
+// typeOf returns the JSON schema type name of a decoded value
+func typeOf(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if value == math.Trunc(value) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+func hasType(types []string, value interface{}) bool {
+	actual := typeOf(value)
+	for _, t := range types {
+		if t == actual || t == "number" && actual == "integer" {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(values []interface{}, value interface{}) bool {
+	for _, v := range values {
+		if equal(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func equal(a, b interface{}) bool {
+	return reflect.DeepEqual(a, b)
+}
+
+func encode(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
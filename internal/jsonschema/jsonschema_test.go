@@ -0,0 +1,56 @@
+// internal/jsonschema/jsonschema_test.go
+package jsonschema
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCompileRejectsRefCycles(t *testing.T) {
+	schemas := []string{
+		`{"$ref": "#"}`,
+		`{"$defs": {"a": {"$ref": "#/$defs/a"}}, "$ref": "#/$defs/a"}`,
+		`{"$defs": {"a": {"$ref": "#/$defs/b"}, "b": {"allOf": [{"$ref": "#/$defs/a"}]}}, "$ref": "#/$defs/a"}`,
+		`{"properties": {"x": {"$defs": {}, "not": {"$ref": "#/properties/x"}}}}`,
+		`{"anyOf": [{"type": "string"}, {"$ref": "#"}]}`,
+	}
+	for _, schema := range schemas {
+		if _, err := Compile([]byte(schema)); err == nil || !strings.Contains(err.Error(), "cycle") {
+			t.Errorf("Compile(%s) = %v, want a cycle error", schema, err)
+		}
+	}
+}
+
+func TestRecursiveSchemas(t *testing.T) {
+	schema, err := Compile([]byte(`{
+		"$defs": {
+			"tree": {
+				"type": "object",
+				"properties": {
+					"name": {"type": "string"},
+					"children": {"type": "array", "items": {"$ref": "#/$defs/tree"}}
+				},
+				"required": ["name"]
+			}
+		},
+		"$ref": "#/$defs/tree"
+	}`))
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+	tests := []struct {
+		doc   string
+		valid bool
+	}{
+		{`{"name": "root"}`, true},
+		{`{"name": "root", "children": [{"name": "leaf", "children": []}]}`, true},
+		{`{"name": "root", "children": [{"children": []}]}`, false},
+		{`{"name": "root", "children": [{"name": 1}]}`, false},
+	}
+	for _, tt := range tests {
+		err := schema.Validate([]byte(tt.doc))
+		if (err == nil) != tt.valid {
+			t.Errorf("Validate(%s) = %v, want valid %v", tt.doc, err, tt.valid)
+		}
+	}
+}
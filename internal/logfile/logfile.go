@@ -0,0 +1,157 @@
+// internal/logfile/logfile.go
+package logfile
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Options configures when a File is rotated and how long rotated files are
+// kept. Zero fields disable the corresponding limit.
+type Options struct {
+	// MaxSize is the size in bytes beyond which the file is rotated
+	MaxSize int64
+	// Interval rotates the file when a write falls into a new period, e.g.
+	// every day at midnight UTC for 24h
+	Interval time.Duration
+	// MaxFiles is the number of rotated files kept
+	MaxFiles int
+	// MaxAge removes rotated files older than it
+	MaxAge time.Duration
+}
+
+// File is an io.Writer that appends to a file and rotates it by size or
+// time, renaming it with a timestamp suffix and pruning old rotated files
+type File struct {
+	mu        sync.Mutex
+	dir       string
+	name      string
+	opts      Options
+	file      *os.File
+	size      int64
+	lastWrite time.Time
+}
+
+// Open opens (or creates) the file at path for appending, creating its
+// directory if needed
+func Open(path string, opts Options) (*File, error) {
+	dir, name := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create log directory: %w", err)
+	}
+	f := &File{dir: dir, name: name, opts: opts}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *File) path() string {
+	return filepath.Join(f.dir, f.name)
+}
+
+func (f *File) open() error {
+	file, err := os.OpenFile(f.path(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat log file: %w", err)
+	}
+	f.file = file
+	f.size = info.Size()
+	f.lastWrite = info.ModTime()
+	return nil
+}
+
+// Write appends p to the current file, rotating first if p would not fit or
+// starts a new period
+func (f *File) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	if f.size > 0 && f.due(now, len(p)) {
+		if err := f.rotate(now); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	f.lastWrite = now
+	return n, err
+}
+
+// due reports whether the file must be rotated before writing n bytes
+func (f *File) due(now time.Time, n int) bool {
+	if f.opts.MaxSize > 0 && f.size+int64(n) > f.opts.MaxSize {
+		return true
+	}
+	return f.opts.Interval > 0 && !f.lastWrite.Truncate(f.opts.Interval).Equal(now.Truncate(f.opts.Interval))
+}
+
+// rotate renames the current file with a timestamp suffix, opens a fresh
+// file and removes the rotated files beyond the retention limits
+func (f *File) rotate(now time.Time) error {
+	if err := f.file.Close(); err != nil {
+		return fmt.Errorf("failed to close log file: %w", err)
+	}
+
+	ext := filepath.Ext(f.name)
+	base := strings.TrimSuffix(f.name, ext)
+	rotated := filepath.Join(f.dir, fmt.Sprintf("%s-%s%s", base, now.UTC().Format("20060102T150405.000"), ext))
+	if err := os.Rename(f.path(), rotated); err != nil {
+		return fmt.Errorf("failed to rotate log file: %w", err)
+	}
+
+	if err := f.open(); err != nil {
+		return err
+	}
+	f.prune(base, ext, now)
+	return nil
+}
+
+// prune removes the rotated files older than MaxAge and the oldest ones
+// beyond MaxFiles
+func (f *File) prune(base, ext string, now time.Time) {
+	if f.opts.MaxFiles <= 0 && f.opts.MaxAge <= 0 {
+		return
+	}
+	matches, err := filepath.Glob(filepath.Join(f.dir, base+"-*"+ext))
+	if err != nil {
+		return
+	}
+	// The timestamp suffix sorts chronologically
+	sort.Strings(matches)
+	if f.opts.MaxFiles > 0 && len(matches) > f.opts.MaxFiles {
+		for _, old := range matches[:len(matches)-f.opts.MaxFiles] {
+			os.Remove(old)
+		}
+		matches = matches[len(matches)-f.opts.MaxFiles:]
+	}
+	if f.opts.MaxAge > 0 {
+		for _, old := range matches {
+			if info, err := os.Stat(old); err == nil && now.Sub(info.ModTime()) > f.opts.MaxAge {
+				os.Remove(old)
+			}
+		}
+	}
+}
+
+// Close closes the current file
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
@@ -0,0 +1,252 @@
+// internal/proxy/admin.go
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/acazau/ghcsd/internal/apikeys"
+	"github.com/acazau/ghcsd/internal/events"
+	"github.com/acazau/ghcsd/pkg/logging"
+)
+
+// logStreamHeartbeat is how often a comment is sent to keep idle log
+// streams open through proxies
+const logStreamHeartbeat = 15 * time.Second
+
+// handleLogStream serves GET /admin/logs/stream, streaming structured log
+// events as server-sent events. Recent events are replayed first.
+func (h *Handler) handleLogStream(w http.ResponseWriter, r *http.Request) {
+	controller := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	history, ch, unsubscribe := h.events.Subscribe()
+	defer unsubscribe()
+
+	for _, event := range history {
+		if err := writeLogEvent(w, event); err != nil {
+			return
+		}
+	}
+	controller.Flush()
+
+	heartbeat := time.NewTicker(logStreamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-ch:
+			if err := writeLogEvent(w, event); err != nil {
+				return
+			}
+			controller.Flush()
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			controller.Flush()
+		}
+	}
+}
+
+func writeLogEvent(w http.ResponseWriter, event events.Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+	return err
+}
+
+// keyStore returns the API key store, answering with an error when none is
+// configured
+func (h *Handler) keyStore(w http.ResponseWriter) *apikeys.Store {
+	if h.keys == nil {
+		writeJSONError(w, "API key store is not enabled, set GHCSD_KEYS_FILE", "not_found_error", http.StatusNotFound)
+	}
+	return h.keys
+}
+
+// handleListKeys serves GET /admin/keys. Secrets are masked.
+func (h *Handler) handleListKeys(w http.ResponseWriter, r *http.Request) {
+	store := h.keyStore(w)
+	if store == nil {
+		return
+	}
+	keys := store.List()
+	for i := range keys {
+		keys[i] = keys[i].Masked()
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"keys": keys})
+}
+
+// handleCreateKey serves POST /admin/keys. The response is the only one that
+// includes the full secret.
+func (h *Handler) handleCreateKey(w http.ResponseWriter, r *http.Request) {
+	store := h.keyStore(w)
+	if store == nil {
+		return
+	}
+	var key apikeys.Key
+	if err := json.NewDecoder(r.Body).Decode(&key); err != nil {
+		writeJSONError(w, "Invalid request body", "invalid_request_error", http.StatusBadRequest)
+		return
+	}
+	created, err := store.Create(key)
+	if err != nil {
+		writeKeyStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, created)
+}
+
+// handleGetKey serves GET /admin/keys/{name}
+func (h *Handler) handleGetKey(w http.ResponseWriter, r *http.Request) {
+	store := h.keyStore(w)
+	if store == nil {
+		return
+	}
+	key, err := store.Get(r.PathValue("name"))
+	if err != nil {
+		writeKeyStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, key.Masked())
+}
+
+// handleUpdateKey serves PUT /admin/keys/{name}, replacing the attributes of
+// the key. Its secret cannot be changed; delete and recreate the key instead.
+func (h *Handler) handleUpdateKey(w http.ResponseWriter, r *http.Request) {
+	store := h.keyStore(w)
+	if store == nil {
+		return
+	}
+	var key apikeys.Key
+	if err := json.NewDecoder(r.Body).Decode(&key); err != nil {
+		writeJSONError(w, "Invalid request body", "invalid_request_error", http.StatusBadRequest)
+		return
+	}
+	key.Name = r.PathValue("name")
+	updated, err := store.Update(key)
+	if err != nil {
+		writeKeyStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, updated.Masked())
+}
+
+// handleDeleteKey serves DELETE /admin/keys/{name}
+func (h *Handler) handleDeleteKey(w http.ResponseWriter, r *http.Request) {
+	store := h.keyStore(w)
+	if store == nil {
+		return
+	}
+	if err := store.Delete(r.PathValue("name")); err != nil {
+		writeKeyStoreError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeKeyStoreError maps key store errors to HTTP errors
+func writeKeyStoreError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, apikeys.ErrNotFound):
+		writeJSONError(w, err.Error(), "not_found_error", http.StatusNotFound)
+	case errors.Is(err, apikeys.ErrExists):
+		writeJSONError(w, err.Error(), "invalid_request_error", http.StatusConflict)
+	case errors.Is(err, apikeys.ErrInvalid):
+		writeJSONError(w, err.Error(), "invalid_request_error", http.StatusBadRequest)
+	default:
+		writeJSONError(w, err.Error(), "api_error", http.StatusInternalServerError)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// handleListRequests serves GET /admin/requests, listing the completions
+// currently being served
+func (h *Handler) handleListRequests(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{"requests": h.inflight.list()})
+}
+
+// handleCancelRequest serves DELETE /admin/requests/{id}, cancelling an
+// in-flight completion and its upstream request
+func (h *Handler) handleCancelRequest(w http.ResponseWriter, r *http.Request) {
+	if !h.inflight.cancel(r.PathValue("id")) {
+		writeJSONError(w, "No in-flight request with this ID", "not_found_error", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleListUpstreams serves GET /admin/upstreams, reporting the health and
+// load of the balanced Copilot endpoints
+func (h *Handler) handleListUpstreams(w http.ResponseWriter, r *http.Request) {
+	if h.balancer == nil {
+		writeJSONError(w, "Load balancing is not enabled, set GHCSD_COPILOT_ENDPOINTS", "not_found_error", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"strategy":  h.balancer.Strategy(),
+		"endpoints": h.balancer.Status(),
+	})
+}
+
+// handleGetLogging serves GET /admin/logging, reporting the log level and
+// the components logged at another level
+func (h *Handler) handleGetLogging(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, logging.Current())
+}
+
+// loggingUpdate changes the log settings. Components set to "" or "default"
+// go back to the global level.
+type loggingUpdate struct {
+	Level      *logging.Level    `json:"level"`
+	Components map[string]string `json:"components"`
+}
+
+// handleUpdateLogging serves PUT /admin/logging, changing the log level or
+// the level of single components until the next restart
+func (h *Handler) handleUpdateLogging(w http.ResponseWriter, r *http.Request) {
+	var update loggingUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		writeJSONError(w, fmt.Sprintf("Invalid request body: %v", err), "invalid_request_error", http.StatusBadRequest)
+		return
+	}
+	settings, err := logging.Update(func(s *logging.Settings) error {
+		if update.Level != nil {
+			s.Level = *update.Level
+		}
+		for component, name := range update.Components {
+			if name == "" || name == "default" {
+				delete(s.Components, component)
+				continue
+			}
+			level, err := logging.ParseLevel(name)
+			if err != nil {
+				return fmt.Errorf("component %s: %w", component, err)
+			}
+			s.Components[component] = level
+		}
+		return nil
+	})
+	if err != nil {
+		writeJSONError(w, err.Error(), "invalid_request_error", http.StatusBadRequest)
+		return
+	}
+	proxyLog.Infof("[Admin] Log level set to %s, components %v, by %s", settings.Level, settings.Components, callerFromRequest(r))
+	writeJSON(w, http.StatusOK, settings)
+}
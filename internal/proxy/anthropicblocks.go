@@ -0,0 +1,94 @@
+// internal/proxy/anthropicblocks.go
+
+//go:build !ghcsd_minimal && !ghcsd_no_anthropic
+
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// anthropicBlockConverter flattens a content block to the text it adds to
+// the prompt; an empty text adds nothing
+type anthropicBlockConverter func(block anthropicBlock) string
+
+// anthropicBlockConverters are the converters by block type. Blocks of other
+// types, such as new server tool blocks, are passed through as their JSON.
+var anthropicBlockConverters = map[string]anthropicBlockConverter{}
+
+// registerAnthropicBlock sets the converter of a block type
+func registerAnthropicBlock(blockType string, convert anthropicBlockConverter) {
+	anthropicBlockConverters[blockType] = convert
+}
+
+func init() {
+	registerAnthropicBlock("text", func(block anthropicBlock) string { return block.Text })
+	registerAnthropicBlock("tool_use", toolUseText)
+	registerAnthropicBlock("server_tool_use", toolUseText)
+	registerAnthropicBlock("mcp_tool_use", toolUseText)
+	registerAnthropicBlock("tool_result", toolResultText)
+	registerAnthropicBlock("mcp_tool_result", toolResultText)
+	registerAnthropicBlock("web_search_tool_result", webSearchResultText)
+	registerAnthropicBlock("thinking", func(block anthropicBlock) string {
+		var thinking struct {
+			Thinking string `json:"thinking"`
+		}
+		json.Unmarshal(block.raw, &thinking)
+		return thinking.Thinking
+	})
+	// Redacted thinking is encrypted, and images and documents are not
+	// counted as text
+	for _, blockType := range []string{"redacted_thinking", "image", "document"} {
+		registerAnthropicBlock(blockType, func(anthropicBlock) string { return "" })
+	}
+}
+
+// text converts the block with the converter of its type, or passes it
+// through as JSON so that unknown blocks still count
+func (b anthropicBlock) text() string {
+	if convert, ok := anthropicBlockConverters[b.Type]; ok {
+		return convert(b)
+	}
+	anthropicLog.Debugf("[Warning] Passing through Anthropic content block of unknown type %q as JSON", b.Type)
+	return string(b.raw)
+}
+
+// toolUseText flattens a call of a client, server or MCP tool
+func toolUseText(block anthropicBlock) string {
+	return block.Name + "\n" + string(block.Input)
+}
+
+// toolResultText flattens the result of a client or MCP tool, a string or
+// a list of content blocks
+func toolResultText(block anthropicBlock) string {
+	var result anthropicContent
+	if len(block.Content) == 0 || json.Unmarshal(block.Content, &result) != nil {
+		return ""
+	}
+	return result.text()
+}
+
+// webSearchResultText flattens the results of the web search server tool
+// to their titles and URLs; their encrypted content cannot be read
+func webSearchResultText(block anthropicBlock) string {
+	var results []struct {
+		Title string `json:"title"`
+		URL   string `json:"url"`
+	}
+	if err := json.Unmarshal(block.Content, &results); err != nil {
+		var failure struct {
+			ErrorCode string `json:"error_code"`
+		}
+		if json.Unmarshal(block.Content, &failure) == nil && failure.ErrorCode != "" {
+			return fmt.Sprintf("Web search failed: %s", failure.ErrorCode)
+		}
+		return string(block.raw)
+	}
+	lines := make([]string, 0, 2*len(results))
+	for _, result := range results {
+		lines = append(lines, result.Title, result.URL)
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,18 @@
+// internal/proxy/apikeys.go
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/acazau/ghcsd/internal/apikeys"
+)
+
+// apiKeyKey is the context key holding the named API key of a request
+type apiKeyKey struct{}
+
+// apiKeyFrom returns the named API key the request authenticated with, or nil
+// when it used a plain key or auth is disabled
+func apiKeyFrom(r *http.Request) *apikeys.Key {
+	key, _ := r.Context().Value(apiKeyKey{}).(*apikeys.Key)
+	return key
+}
@@ -0,0 +1,64 @@
+// internal/proxy/audit.go
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/acazau/ghcsd/internal/audit"
+	"github.com/acazau/ghcsd/pkg/copilot"
+)
+
+// auditEntryKey is the context key holding the audit entry of a request
+type auditEntryKey struct{}
+
+// auditEntryFrom returns the audit entry of the request, or nil when auditing is disabled
+func auditEntryFrom(r *http.Request) *audit.Entry {
+	entry, _ := r.Context().Value(auditEntryKey{}).(*audit.Entry)
+	return entry
+}
+
+// summarizeResponse fills the response text and token usage of an audit entry
+// from the body sent to the client, which is either a JSON completion or an
+// SSE stream of completion chunks
+func summarizeResponse(entry *audit.Entry, body []byte, stream bool) {
+	if !stream {
+		var resp copilot.CompletionResponse
+		if err := json.Unmarshal(body, &resp); err != nil {
+			entry.Response = string(body)
+			return
+		}
+		var content strings.Builder
+		for _, choice := range resp.Choices {
+			content.WriteString(choice.Message.Content)
+		}
+		entry.Response = content.String()
+		entry.PromptTokens = resp.Usage.PromptTokens
+		entry.CompletionTokens = resp.Usage.CompletionTokens
+		return
+	}
+
+	var content strings.Builder
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		data, ok := bytes.CutPrefix(bytes.TrimSpace(line), []byte("data: "))
+		if !ok {
+			continue
+		}
+		var chunk copilot.CompletionResponse
+		if err := json.Unmarshal(data, &chunk); err != nil {
+			continue
+		}
+		for _, choice := range chunk.Choices {
+			if text, ok := choice.Delta.Content.(string); ok {
+				content.WriteString(text)
+			}
+		}
+		if chunk.Usage.TotalTokens > 0 {
+			entry.PromptTokens = chunk.Usage.PromptTokens
+			entry.CompletionTokens = chunk.Usage.CompletionTokens
+		}
+	}
+	entry.Response = content.String()
+}
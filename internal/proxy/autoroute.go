@@ -0,0 +1,84 @@
+// internal/proxy/autoroute.go
+package proxy
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/acazau/ghcsd/internal/config"
+	"github.com/acazau/ghcsd/pkg/copilot"
+	"github.com/acazau/ghcsd/pkg/upstream"
+)
+
+// autoModel is the model name routed by the auto router
+const autoModel = "auto"
+
+// autoRouter picks the model of requests made to the auto model from their
+// tools, images, prompt length and system prompt
+type autoRouter struct {
+	small         string
+	big           string
+	promptTokens  int
+	systemPattern *regexp.Regexp
+}
+
+// newAutoRouter creates the router of the auto model, or returns nil when
+// no small and big models are configured
+func newAutoRouter(cfg *config.Config) *autoRouter {
+	if cfg.SmallModel == "" || cfg.BigModel == "" {
+		return nil
+	}
+	router := &autoRouter{
+		small:        cfg.SmallModel,
+		big:          cfg.BigModel,
+		promptTokens: cfg.AutoPromptTokens,
+	}
+	if cfg.AutoSystemPattern != "" {
+		// Validated when the configuration was loaded
+		router.systemPattern = regexp.MustCompile(cfg.AutoSystemPattern)
+	}
+	return router
+}
+
+// route returns the model serving a request and the rule that chose it.
+// Agentic, image, long and matching requests go to the big model, and the
+// rest to the small one.
+func (a *autoRouter) route(req copilot.CompletionRequest) (string, string) {
+	if len(req.Tools) > 0 {
+		return a.big, "tools"
+	}
+	if req.HasImages() {
+		// The big model is preferred, unless only the small one can see
+		if big, _ := config.GetModelInfo(a.big); !big.Vision {
+			if small, _ := config.GetModelInfo(a.small); small.Vision {
+				return a.small, "images"
+			}
+		}
+		return a.big, "images"
+	}
+	if a.promptTokens > 0 && upstream.EstimateTokens(req) >= a.promptTokens {
+		return a.big, "prompt_length"
+	}
+	if a.systemPattern != nil && a.systemPattern.MatchString(systemPrompt(req.Messages)) {
+		return a.big, "system_prompt"
+	}
+	return a.small, "default"
+}
+
+// systemPrompt joins the text of the system and developer messages
+func systemPrompt(messages []copilot.Message) string {
+	var parts []string
+	for i := range messages {
+		if messages[i].Role != "system" && messages[i].Role != "developer" {
+			continue
+		}
+		if messages[i].IsStringContent() {
+			parts = append(parts, messages[i].GetStringContent())
+			continue
+		}
+		for _, part := range messages[i].GetComplexContent() {
+			parts = append(parts, part.Text)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
@@ -0,0 +1,147 @@
+// internal/proxy/breaker.go
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/acazau/ghcsd/pkg/copilot"
+)
+
+// circuitBreaker fails requests to a model fast once its upstream has failed
+// repeatedly, instead of letting every request wait for its own timeout.
+// After the cooldown a single request probes the model: success closes the
+// circuit, failure keeps it open for another cooldown.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu     sync.Mutex
+	models map[string]*modelCircuit
+
+	trips    atomic.Int64
+	rejected atomic.Int64
+}
+
+// modelCircuit is the circuit of one model
+type modelCircuit struct {
+	failures int
+	// retryAt is when the next probe is let through while the circuit is open
+	retryAt time.Time
+}
+
+// open reports whether the circuit has tripped
+func (c *modelCircuit) open(threshold int) bool {
+	return c.failures >= threshold
+}
+
+// newCircuitBreaker creates a breaker opening after threshold consecutive
+// failures, or returns nil when threshold is 0
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown, models: make(map[string]*modelCircuit)}
+}
+
+// allow admits a request to model, or rejects it while the circuit is open.
+// Once the cooldown has elapsed the request is admitted as the probe, and
+// others are rejected for another cooldown unless it succeeds.
+func (b *circuitBreaker) allow(model string) *requestError {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	circuit, ok := b.models[model]
+	if !ok || !circuit.open(b.threshold) {
+		return nil
+	}
+	now := time.Now()
+	if !now.Before(circuit.retryAt) {
+		circuit.retryAt = now.Add(b.cooldown)
+		proxyLog.Infof("[Circuit] Probing %s", model)
+		return nil
+	}
+
+	b.rejected.Add(1)
+	retryAfter := circuit.retryAt.Sub(now)
+	return &requestError{
+		status: http.StatusServiceUnavailable,
+		message: fmt.Sprintf("Model %s is temporarily unavailable after %d consecutive upstream failures; retry in %ds",
+			model, circuit.failures, int(math.Ceil(retryAfter.Seconds()))),
+		retryAfter: retryAfter,
+	}
+}
+
+// record updates the circuit of model with the outcome of a request. Errors
+// caused by the request or the client leave the circuit unchanged.
+func (b *circuitBreaker) record(model string, err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	circuit, ok := b.models[model]
+	if err == nil {
+		if ok && circuit.open(b.threshold) {
+			proxyLog.Infof("[Circuit] Closed for %s", model)
+		}
+		delete(b.models, model)
+		return
+	}
+	if !isUpstreamFailure(err) {
+		return
+	}
+	if !ok {
+		circuit = &modelCircuit{}
+		b.models[model] = circuit
+	}
+	circuit.failures++
+	if circuit.failures == b.threshold {
+		b.trips.Add(1)
+		proxyLog.Warnf("[Circuit] Opened for %s after %d consecutive failures: %v", model, circuit.failures, err)
+	}
+	if circuit.open(b.threshold) {
+		circuit.retryAt = time.Now().Add(b.cooldown)
+	}
+}
+
+// openCircuits returns the number of models whose circuit is open
+func (b *circuitBreaker) openCircuits() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var open int64
+	for _, circuit := range b.models {
+		if circuit.open(b.threshold) {
+			open++
+		}
+	}
+	return open
+}
+
+// isUpstreamFailure reports whether err means the upstream could not serve
+// the model: network errors, timeouts, server errors and overload. Rate
+// limits are left to the retry queue, and rejected requests say nothing
+// about the upstream.
+func isUpstreamFailure(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, errCancelledByAdmin) {
+		return false
+	}
+	var queueFull *queueFullError
+	if errors.As(err, &queueFull) {
+		return false
+	}
+	var apiErr *copilot.APIError
+	if !errors.As(err, &apiErr) {
+		return true
+	}
+	kind := apiErr.Kind()
+	return kind == copilot.ErrorKindServer || kind == copilot.ErrorKindOverloaded
+}
@@ -0,0 +1,216 @@
+// internal/proxy/budget.go
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/acazau/ghcsd/internal/config"
+)
+
+// budgetWindow is the sliding window model budgets are measured over
+const budgetWindow = time.Minute
+
+// concurrencyRetryAfter is suggested to clients rejected because a model has
+// too many requests in flight, which gives no better hint of when one ends
+const concurrencyRetryAfter = time.Second
+
+// budgetLimiter enforces the per-model request, token and concurrency budgets
+type budgetLimiter struct {
+	mu     sync.Mutex
+	models map[string]*modelUsage
+}
+
+// modelUsage tracks the recent usage of one budgeted model
+type modelUsage struct {
+	budget   config.ModelBudget
+	requests []time.Time
+	tokens   []*tokenUsage
+	inFlight int
+}
+
+// tokenUsage is the number of tokens a request used, recorded at its start
+type tokenUsage struct {
+	at     time.Time
+	tokens int
+}
+
+// newBudgetLimiter creates a limiter for the given budgets, or returns nil
+// when no model has a budget
+func newBudgetLimiter(budgets map[string]config.ModelBudget) *budgetLimiter {
+	if len(budgets) == 0 {
+		return nil
+	}
+	models := make(map[string]*modelUsage, len(budgets))
+	for model, budget := range budgets {
+		models[model] = &modelUsage{budget: budget}
+	}
+	return &budgetLimiter{models: models}
+}
+
+// budgetLease is held by an admitted request until it completes
+type budgetLease struct {
+	limiter *budgetLimiter
+	model   *modelUsage
+	usage   *tokenUsage
+	once    sync.Once
+}
+
+// release ends the request, replacing its estimated token usage with the
+// tokens it actually used. Only the first call has an effect.
+func (l *budgetLease) release(tokens int) {
+	if l == nil {
+		return
+	}
+	l.once.Do(func() {
+		l.limiter.mu.Lock()
+		defer l.limiter.mu.Unlock()
+		l.usage.tokens = tokens
+		l.model.inFlight--
+	})
+}
+
+// budgetExceeded describes why a request was rejected and the state of the
+// model's budget at that time
+type budgetExceeded struct {
+	model             string
+	reason            string
+	budget            config.ModelBudget
+	remainingRequests int
+	remainingTokens   int
+	resetRequests     time.Duration
+	resetTokens       time.Duration
+	retryAfter        time.Duration
+}
+
+// acquire admits a request to model that is estimated to use tokens. Models
+// without a budget are always admitted with a nil lease.
+func (b *budgetLimiter) acquire(model string, tokens int) (*budgetLease, *budgetExceeded) {
+	if b == nil {
+		return nil, nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	usage, ok := b.models[model]
+	if !ok {
+		return nil, nil
+	}
+	now := time.Now()
+	usage.prune(now)
+
+	budget := usage.budget
+	status := &budgetExceeded{
+		model:             model,
+		budget:            budget,
+		remainingRequests: budget.RequestsPerMinute - len(usage.requests),
+		remainingTokens:   budget.TokensPerMinute - usage.tokensUsed(),
+	}
+	if len(usage.requests) > 0 {
+		status.resetRequests = usage.requests[0].Add(budgetWindow).Sub(now)
+	}
+	if len(usage.tokens) > 0 {
+		status.resetTokens = usage.tokens[0].at.Add(budgetWindow).Sub(now)
+	}
+
+	switch {
+	case budget.MaxConcurrent > 0 && usage.inFlight >= budget.MaxConcurrent:
+		status.reason = fmt.Sprintf("%d concurrent requests", budget.MaxConcurrent)
+		status.retryAfter = concurrencyRetryAfter
+		return nil, status
+	case budget.RequestsPerMinute > 0 && status.remainingRequests <= 0:
+		status.reason = fmt.Sprintf("%d requests per minute", budget.RequestsPerMinute)
+		status.retryAfter = status.resetRequests
+		return nil, status
+	case budget.TokensPerMinute > 0 && tokens > budget.TokensPerMinute:
+		status.reason = fmt.Sprintf("%d tokens per minute, which this request alone exceeds", budget.TokensPerMinute)
+		return nil, status
+	case budget.TokensPerMinute > 0 && tokens > status.remainingTokens:
+		status.reason = fmt.Sprintf("%d tokens per minute", budget.TokensPerMinute)
+		status.retryAfter = usage.tokensFreedIn(now, tokens-status.remainingTokens)
+		return nil, status
+	}
+
+	lease := &budgetLease{
+		limiter: b,
+		model:   usage,
+		usage:   &tokenUsage{at: now, tokens: tokens},
+	}
+	usage.requests = append(usage.requests, now)
+	usage.tokens = append(usage.tokens, lease.usage)
+	usage.inFlight++
+	return lease, nil
+}
+
+// prune drops the usage that has left the sliding window
+func (u *modelUsage) prune(now time.Time) {
+	cutoff := now.Add(-budgetWindow)
+	i := 0
+	for i < len(u.requests) && !u.requests[i].After(cutoff) {
+		i++
+	}
+	u.requests = u.requests[i:]
+
+	i = 0
+	for i < len(u.tokens) && !u.tokens[i].at.After(cutoff) {
+		i++
+	}
+	u.tokens = u.tokens[i:]
+}
+
+// tokensUsed returns the tokens used within the window
+func (u *modelUsage) tokensUsed() int {
+	used := 0
+	for _, usage := range u.tokens {
+		used += usage.tokens
+	}
+	return used
+}
+
+// tokensFreedIn returns how long until at least needed tokens leave the window
+func (u *modelUsage) tokensFreedIn(now time.Time, needed int) time.Duration {
+	freed := 0
+	for _, usage := range u.tokens {
+		freed += usage.tokens
+		if freed >= needed {
+			return usage.at.Add(budgetWindow).Sub(now)
+		}
+	}
+	return budgetWindow
+}
+
+// requestError converts the rejection into a 429 carrying the budget details
+// in OpenAI-style rate limit headers
+func (e *budgetExceeded) requestError() *requestError {
+	headers := http.Header{}
+	if e.budget.RequestsPerMinute > 0 {
+		headers.Set("X-Ratelimit-Limit-Requests", strconv.Itoa(e.budget.RequestsPerMinute))
+		headers.Set("X-Ratelimit-Remaining-Requests", strconv.Itoa(max(e.remainingRequests, 0)))
+		headers.Set("X-Ratelimit-Reset-Requests", formatReset(e.resetRequests))
+	}
+	if e.budget.TokensPerMinute > 0 {
+		headers.Set("X-Ratelimit-Limit-Tokens", strconv.Itoa(e.budget.TokensPerMinute))
+		headers.Set("X-Ratelimit-Remaining-Tokens", strconv.Itoa(max(e.remainingTokens, 0)))
+		headers.Set("X-Ratelimit-Reset-Tokens", formatReset(e.resetTokens))
+	}
+	if e.budget.MaxConcurrent > 0 {
+		headers.Set("X-Ratelimit-Limit-Concurrent", strconv.Itoa(e.budget.MaxConcurrent))
+	}
+
+	return &requestError{
+		status:     http.StatusTooManyRequests,
+		message:    fmt.Sprintf("Budget exceeded for model %s: limited to %s", e.model, e.reason),
+		code:       "budget_exceeded",
+		retryAfter: e.retryAfter,
+		headers:    headers,
+	}
+}
+
+// formatReset formats a reset delay the way OpenAI does, e.g. "1.5s"
+func formatReset(d time.Duration) string {
+	return strconv.FormatFloat(math.Ceil(d.Seconds()*10)/10, 'f', -1, 64) + "s"
+}
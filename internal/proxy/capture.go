@@ -0,0 +1,262 @@
+// internal/proxy/capture.go
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// captureHeader is the request header asking for a debug capture bundle
+const captureHeader = "X-Ghcsd-Debug"
+
+// redactedHeaders are replaced in captured requests and responses
+var redactedHeaders = []string{"Authorization", "X-Api-Key", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// captureBundle stores everything exchanged for a single request in its own
+// directory: the incoming request, each upstream request and raw response,
+// and the response sent to the client
+type captureBundle struct {
+	dir string
+
+	mu       sync.Mutex
+	upstream int
+}
+
+type captureKey struct{}
+
+// captureFrom returns the capture bundle of the request in ctx, if any
+func captureFrom(ctx context.Context) *captureBundle {
+	bundle, _ := ctx.Value(captureKey{}).(*captureBundle)
+	return bundle
+}
+
+// newCaptureBundle creates a timestamped bundle directory under root
+func newCaptureBundle(root, requestID string) (*captureBundle, error) {
+	name := time.Now().UTC().Format("20060102T150405.000Z") + "-" + sanitizeFileName(requestID)
+	dir := filepath.Join(root, name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create capture directory: %w", err)
+	}
+	return &captureBundle{dir: dir}, nil
+}
+
+// create opens a new file of the bundle
+func (b *captureBundle) create(name string) (*os.File, error) {
+	return os.OpenFile(filepath.Join(b.dir, name), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+}
+
+// write stores data as a file of the bundle, logging failures
+func (b *captureBundle) write(name string, data []byte) {
+	if err := os.WriteFile(filepath.Join(b.dir, name), data, 0600); err != nil {
+		auditLog.Errorf("[Capture] Failed to write %s: %v", name, err)
+	}
+}
+
+// nextUpstream numbers the upstream exchanges of the request, which may be
+// several with retries and failover
+func (b *captureBundle) nextUpstream() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.upstream++
+	return b.upstream
+}
+
+// CaptureMiddleware stores a debug capture bundle under dir for requests
+// carrying "X-Ghcsd-Debug: capture". Captures hold prompts and completions,
+// so only callers authorized for the admin endpoints may ask for one.
+func CaptureMiddleware(dir string, adminKeys []string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !strings.EqualFold(strings.TrimSpace(r.Header.Get(captureHeader)), "capture") {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if !isAdminRequest(r, adminKeys) {
+				writeJSONError(w, "Debug capture requires an admin key", "permission_error", http.StatusForbidden)
+				return
+			}
+
+			bundle, err := newCaptureBundle(dir, requestIDFrom(r.Context()))
+			if err != nil {
+				auditLog.Errorf("[Capture] %v", err)
+				next.ServeHTTP(w, r)
+				return
+			}
+			dump, err := dumpRequest(r, false)
+			if err != nil {
+				auditLog.Errorf("[Capture] Failed to dump request: %v", err)
+				next.ServeHTTP(w, r)
+				return
+			}
+			bundle.write("request.txt", dump)
+
+			out, err := bundle.create("response.txt")
+			if err != nil {
+				auditLog.Errorf("[Capture] Failed to create response capture: %v", err)
+				next.ServeHTTP(w, r)
+				return
+			}
+			defer out.Close()
+			tee := &captureWriter{ResponseWriter: w, out: out, status: http.StatusOK}
+			next.ServeHTTP(tee, r.WithContext(context.WithValue(r.Context(), captureKey{}, bundle)))
+			tee.writeHead()
+			auditLog.Infof("[Capture] Stored %s %s in %s", r.Method, r.URL.Path, bundle.dir)
+		})
+	}
+}
+
+// captureWriter copies the response sent to the client to a file
+type captureWriter struct {
+	http.ResponseWriter
+	out         io.Writer
+	status      int
+	wroteHeader bool
+}
+
+// writeHead records the status line and headers once
+func (cw *captureWriter) writeHead() {
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+	fmt.Fprintf(cw.out, "HTTP/1.1 %d %s\r\n", cw.status, http.StatusText(cw.status))
+	redactHeader(cw.Header().Clone()).Write(cw.out)
+	fmt.Fprint(cw.out, "\r\n")
+}
+
+func (cw *captureWriter) WriteHeader(code int) {
+	if !cw.wroteHeader {
+		cw.status = code
+		cw.writeHead()
+	}
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *captureWriter) Write(b []byte) (int, error) {
+	cw.writeHead()
+	cw.out.Write(b)
+	return cw.ResponseWriter.Write(b)
+}
+
+func (cw *captureWriter) Flush() {
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (cw *captureWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// captureTransport records the upstream requests and raw responses of
+// requests being captured
+type captureTransport struct {
+	next http.RoundTripper
+}
+
+// newCaptureTransport wraps next so that captured requests record their
+// upstream exchanges
+func newCaptureTransport(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &captureTransport{next: next}
+}
+
+func (t *captureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	bundle := captureFrom(req.Context())
+	if bundle == nil {
+		return t.next.RoundTrip(req)
+	}
+	n := bundle.nextUpstream()
+
+	dump, err := dumpRequest(req, true)
+	if err != nil {
+		return nil, err
+	}
+	bundle.write(fmt.Sprintf("upstream-%d-request.txt", n), dump)
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		bundle.write(fmt.Sprintf("upstream-%d-error.txt", n), []byte(err.Error()+"\n"))
+		return nil, err
+	}
+	out, createErr := bundle.create(fmt.Sprintf("upstream-%d-response.txt", n))
+	if createErr != nil {
+		auditLog.Errorf("[Capture] Failed to create upstream response capture: %v", createErr)
+		return resp, nil
+	}
+	head := *resp
+	head.Header = redactHeader(resp.Header.Clone())
+	if dump, err := httputil.DumpResponse(&head, false); err == nil {
+		out.Write(dump)
+	}
+	// The body is recorded as it is read, chunk by chunk for streams
+	resp.Body = &teeReadCloser{Reader: io.TeeReader(resp.Body, out), body: resp.Body, out: out}
+	return resp, nil
+}
+
+// teeReadCloser closes both the copied body and its copy
+type teeReadCloser struct {
+	io.Reader
+	body io.Closer
+	out  io.Closer
+}
+
+func (t *teeReadCloser) Close() error {
+	t.out.Close()
+	return t.body.Close()
+}
+
+// dumpRequest renders r, with its credentials redacted, as received by a
+// server or, with outgoing, as sent by a client. The body of r is replaced
+// by an identical one.
+func dumpRequest(r *http.Request, outgoing bool) ([]byte, error) {
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		var err error
+		body, err = io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	clone := r.Clone(r.Context())
+	clone.Header = redactHeader(r.Header.Clone())
+	clone.Body = io.NopCloser(bytes.NewReader(body))
+	if outgoing {
+		return httputil.DumpRequestOut(clone, true)
+	}
+	return httputil.DumpRequest(clone, true)
+}
+
+// redactHeader replaces the credentials of h
+func redactHeader(h http.Header) http.Header {
+	for _, name := range redactedHeaders {
+		if h.Get(name) != "" {
+			h.Set(name, "[REDACTED]")
+		}
+	}
+	return h
+}
+
+// sanitizeFileName keeps the characters of s that are safe in a file name
+func sanitizeFileName(s string) string {
+	return strings.Map(func(c rune) rune {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' {
+			return c
+		}
+		return -1
+	}, s)
+}
@@ -0,0 +1,43 @@
+// internal/proxy/cassette_ollama_test.go
+
+//go:build !ghcsd_minimal && !ghcsd_no_ollama
+
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestReplayOllamaStreamUsage(t *testing.T) {
+	server := replayServer(t)
+	resp, body := post(t, server, "/api/chat", `{"model":"gpt-4o","messages":[{"role":"user","content":"Count to three"}]}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, body %s", resp.StatusCode, body)
+	}
+	var text string
+	var final ollamaResponse
+	scanner := bufio.NewScanner(strings.NewReader(string(body)))
+	for scanner.Scan() {
+		var chunk ollamaResponse
+		if err := json.Unmarshal(scanner.Bytes(), &chunk); err != nil {
+			t.Fatalf("invalid line %s: %v", scanner.Text(), err)
+		}
+		if chunk.Message != nil {
+			text += chunk.Message.Content
+		}
+		if chunk.Done {
+			final = chunk
+		}
+	}
+	if text != "One, two, three." || final.DoneReason != "stop" {
+		t.Errorf("text = %q, done reason %q", text, final.DoneReason)
+	}
+	// The usage comes from the chunk upstream sends without choices
+	if final.PromptEvalCount != 13 || final.EvalCount != 7 {
+		t.Errorf("eval counts = %d and %d, want the recorded 13 and 7", final.PromptEvalCount, final.EvalCount)
+	}
+}
@@ -0,0 +1,179 @@
+// internal/proxy/cassette_test.go
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/acazau/ghcsd/internal/cassette"
+	"github.com/acazau/ghcsd/internal/config"
+	"github.com/acazau/ghcsd/pkg/copilot"
+)
+
+// replayServer serves the API from the upstream interactions recorded in
+// testdata/cassettes. The recordings are sanitized Copilot responses; record
+// new ones with GHCSD_CASSETTE_MODE=record against Copilot.
+func replayServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	dir, err := filepath.Abs(filepath.Join("testdata", "cassettes"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GHCSD_CACHE_DIR", t.TempDir())
+	t.Setenv("GHCSD_CASSETTE_MODE", cassette.Replay)
+	t.Setenv("GHCSD_CASSETTE_DIR", dir)
+	cfg, err := config.Load(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	api, _, shutdown, err := NewRouter(cfg, "tid=replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(shutdown)
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// post sends a JSON body to the server and returns the response, whose body
+// is read in full
+func post(t *testing.T, server *httptest.Server, path, body string) (*http.Response, []byte) {
+	t.Helper()
+	resp, err := http.Post(server.URL+path, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, data
+}
+
+// streamedChoices collects the text and finish reason of every choice of an
+// SSE completion stream, checking that it ends with the closing chunk giving
+// each choice its finish reason
+func streamedChoices(t *testing.T, stream []byte) (texts, finishReasons map[int]string) {
+	t.Helper()
+	texts, finishReasons = map[int]string{}, map[int]string{}
+	var last copilot.CompletionResponse
+	scanner := bufio.NewScanner(strings.NewReader(string(stream)))
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var chunk copilot.CompletionResponse
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatalf("invalid chunk %s: %v", data, err)
+		}
+		if chunk.Error != nil {
+			t.Fatalf("error chunk: %s", data)
+		}
+		for _, choice := range chunk.Choices {
+			texts[choice.Index] += deltaText(choice)
+			if choice.FinishReason != "" {
+				finishReasons[choice.Index] = choice.FinishReason
+			}
+		}
+		last = chunk
+	}
+	if len(last.Choices) != len(texts) {
+		t.Errorf("stream does not end with a closing chunk for each choice: %s", stream)
+	}
+	for _, choice := range last.Choices {
+		if choice.FinishReason == "" {
+			t.Errorf("closing chunk lacks the finish reason of choice %d: %s", choice.Index, stream)
+		}
+	}
+	return texts, finishReasons
+}
+
+func TestReplayCompletion(t *testing.T) {
+	server := replayServer(t)
+	resp, body := post(t, server, "/v1/chat/completions", `{"model":"gpt-4o","messages":[{"role":"user","content":"Say hello"}]}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, body %s", resp.StatusCode, body)
+	}
+	var completion copilot.CompletionResponse
+	if err := json.Unmarshal(body, &completion); err != nil {
+		t.Fatal(err)
+	}
+	if len(completion.Choices) != 1 {
+		t.Fatalf("got %d choices, want 1: %s", len(completion.Choices), body)
+	}
+	if choice := completion.Choices[0]; choice.Message.Content != "Hello! How can I help you today?" || choice.FinishReason != "stop" {
+		t.Errorf("choice = %+v", choice)
+	}
+	if usage := completion.Usage; usage.PromptTokens != 10 || usage.CompletionTokens != 9 || usage.TotalTokens != 19 {
+		t.Errorf("usage = %+v, want the recorded 10 + 9 tokens", usage)
+	}
+}
+
+func TestReplayStream(t *testing.T) {
+	server := replayServer(t)
+	resp, body := post(t, server, "/v1/chat/completions", `{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"Count to three"}]}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, body %s", resp.StatusCode, body)
+	}
+	if contentType := resp.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "text/event-stream") {
+		t.Errorf("Content-Type = %q, want an event stream", contentType)
+	}
+	texts, finishReasons := streamedChoices(t, body)
+	if len(texts) != 1 || texts[0] != "One, two, three." || finishReasons[0] != "stop" {
+		t.Errorf("choices = %q, finish reasons %q", texts, finishReasons)
+	}
+}
+
+func TestReplayMultipleChoices(t *testing.T) {
+	server := replayServer(t)
+	resp, body := post(t, server, "/v1/chat/completions", `{"model":"gpt-4o","stream":true,"n":2,"max_tokens":2,"messages":[{"role":"user","content":"Name a color"}]}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, body %s", resp.StatusCode, body)
+	}
+	texts, finishReasons := streamedChoices(t, body)
+	if texts[0] != "Red" || texts[1] != "Deep blue" {
+		t.Errorf("choices = %q, want Red and Deep blue", texts)
+	}
+	// Each choice keeps its own finish reason, including the truncated one
+	if finishReasons[0] != "stop" || finishReasons[1] != "length" {
+		t.Errorf("finish reasons = %q, want stop and length", finishReasons)
+	}
+}
+
+func TestReplayUpstreamError(t *testing.T) {
+	server := replayServer(t)
+	resp, body := post(t, server, "/v1/chat/completions", `{"model":"gpt-4o","messages":[{"role":"user","content":"This prompt exceeds the limit"}]}`)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400, body %s", resp.StatusCode, body)
+	}
+	var errResp struct {
+		Error struct {
+			Message string `json:"message"`
+			Type    string `json:"type"`
+			Code    string `json:"code"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &errResp); err != nil {
+		t.Fatal(err)
+	}
+	if errResp.Error.Code != "model_max_prompt_tokens_exceeded" || errResp.Error.Type != "invalid_request_error" || !strings.Contains(errResp.Error.Message, "exceeds the limit") {
+		t.Errorf("error = %+v", errResp.Error)
+	}
+}
+
+func TestReplayUnrecordedRequest(t *testing.T) {
+	server := replayServer(t)
+	resp, body := post(t, server, "/v1/chat/completions", `{"model":"gpt-4o","messages":[{"role":"user","content":"Never recorded"}]}`)
+	if resp.StatusCode < 500 || !strings.Contains(string(body), "no recorded interaction") {
+		t.Errorf("status = %d, body %s, want an upstream error naming the missing recording", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,176 @@
+// internal/proxy/cleanup.go
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/acazau/ghcsd/internal/config"
+	"github.com/acazau/ghcsd/internal/filter"
+	"github.com/acazau/ghcsd/pkg/copilot"
+)
+
+// responseCleanups holds the cleanup applied to the completions of each
+// model, keyed by the model ID sent upstream
+type responseCleanups struct {
+	fallback *filter.Cleanup
+	models   map[string]filter.Cleanup
+}
+
+// newResponseCleanups loads the cleanups of path, or returns nil when path
+// is empty
+func newResponseCleanups(path string) (*responseCleanups, error) {
+	if path == "" {
+		return nil, nil
+	}
+	cleanups, err := filter.LoadCleanups(path)
+	if err != nil {
+		return nil, err
+	}
+	// Cleanups may name aliases; calls carry the real model ID
+	c := &responseCleanups{fallback: cleanups.Default, models: make(map[string]filter.Cleanup, len(cleanups.Models))}
+	for name, cleanup := range cleanups.Models {
+		modelID, ok := config.ValidateModel(name)
+		if !ok {
+			return nil, fmt.Errorf("response cleanup for unknown model: %s", name)
+		}
+		c.models[modelID] = cleanup
+	}
+	return c, nil
+}
+
+// forModel returns the cleanup of model, reporting whether it changes anything
+func (c *responseCleanups) forModel(model string) (filter.Cleanup, bool) {
+	if c == nil {
+		return filter.Cleanup{}, false
+	}
+	cleanup, ok := c.models[model]
+	if !ok {
+		if c.fallback == nil {
+			return filter.Cleanup{}, false
+		}
+		cleanup = *c.fallback
+	}
+	return cleanup, cleanup.Enabled()
+}
+
+// clean applies the cleanup of model to the messages of a non-streamed
+// completion
+func (c *responseCleanups) clean(model string, resp *copilot.CompletionResponse) {
+	cleanup, ok := c.forModel(model)
+	if !ok {
+		return
+	}
+	for i := range resp.Choices {
+		resp.Choices[i].Message.Content = cleanup.Clean(resp.Choices[i].Message.Content)
+	}
+}
+
+// stream applies the cleanup of model to the deltas of a streamed
+// completion. Text held back by the cleanup is added to the chunk finishing
+// its choice, or sent in a chunk of its own before the stream ends.
+func (c *responseCleanups) stream(model string, body io.ReadCloser) io.ReadCloser {
+	cleanup, ok := c.forModel(model)
+	if !ok {
+		return body
+	}
+	s := &cleanupStream{cleanup: cleanup, cleaners: make(map[int]*filter.Cleaner)}
+	return &lineStream{ReadCloser: body, rewrite: s.rewrite, finish: s.flush}
+}
+
+// cleanupStream cleans the deltas of each choice of a stream
+type cleanupStream struct {
+	cleanup  filter.Cleanup
+	cleaners map[int]*filter.Cleaner
+	// envelope holds the id, created and model of the latest chunk, repeated
+	// in the chunk flushing the held back text
+	envelope map[string]interface{}
+}
+
+func (s *cleanupStream) rewrite(line []byte) []byte {
+	data, ok := bytes.CutPrefix(line, []byte("data: "))
+	if !ok {
+		return line
+	}
+	if bytes.Equal(bytes.TrimSpace(data), []byte("[DONE]")) {
+		return append(s.flush(), line...)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var chunk map[string]interface{}
+	if err := decoder.Decode(&chunk); err != nil {
+		return line
+	}
+	s.envelope = map[string]interface{}{"id": chunk["id"], "object": "chat.completion.chunk", "created": chunk["created"], "model": chunk["model"]}
+
+	changed := false
+	choices, _ := chunk["choices"].([]interface{})
+	for _, item := range choices {
+		choice, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		number, _ := choice["index"].(json.Number)
+		index, _ := number.Int64()
+		cleaner := s.cleaners[int(index)]
+		if cleaner == nil {
+			cleaner = s.cleanup.NewCleaner()
+			s.cleaners[int(index)] = cleaner
+		}
+		delta, _ := choice["delta"].(map[string]interface{})
+		if content, ok := delta["content"].(string); ok {
+			delta["content"] = cleaner.Write(content)
+			changed = true
+		}
+		if reason, _ := choice["finish_reason"].(string); reason != "" {
+			delete(s.cleaners, int(index))
+			if rest := cleaner.Flush(); rest != "" {
+				if delta == nil {
+					delta = make(map[string]interface{})
+					choice["delta"] = delta
+				}
+				content, _ := delta["content"].(string)
+				delta["content"] = content + rest
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return line
+	}
+	rewritten, err := json.Marshal(chunk)
+	if err != nil {
+		return line
+	}
+	return append([]byte("data: "), rewritten...)
+}
+
+// flush returns a chunk with the text still held back for choices that
+// were not finished, or nil when there is none
+func (s *cleanupStream) flush() []byte {
+	indexes := make([]int, 0, len(s.cleaners))
+	for index := range s.cleaners {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	var choices []interface{}
+	for _, index := range indexes {
+		if rest := s.cleaners[index].Flush(); rest != "" {
+			choices = append(choices, map[string]interface{}{"index": index, "delta": map[string]interface{}{"content": rest}})
+		}
+		delete(s.cleaners, index)
+	}
+	if len(choices) == 0 || s.envelope == nil {
+		return nil
+	}
+	chunk := s.envelope
+	chunk["choices"] = choices
+	data, err := json.Marshal(chunk)
+	if err != nil {
+		return nil
+	}
+	return append(append([]byte("data: "), data...), "\n\n"...)
+}
@@ -0,0 +1,134 @@
+// internal/proxy/clientip.go
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/acazau/ghcsd/internal/state"
+)
+
+// ClientIPMiddleware resolves the IP of clients behind trusted reverse
+// proxies from X-Forwarded-For and replaces RemoteAddr with it, so that
+// logs, audit entries, admin checks and rate limits see the real client.
+// Clients in deny, or outside allow when it is not empty, are rejected.
+// Unix socket peers count as trusted proxies when any are configured.
+func ClientIPMiddleware(trusted, allow, deny []netip.Prefix) Middleware {
+	return func(next http.Handler) http.Handler {
+		if len(trusted) == 0 && len(allow) == 0 && len(deny) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			addr, ok := remoteIP(r.RemoteAddr)
+			if (ok && prefixesContain(trusted, addr)) || (!ok && len(trusted) > 0) {
+				forwarded, err := forwardedClient(r.Header.Values("X-Forwarded-For"), trusted)
+				if err != nil {
+					// Falling back to the proxy's address could pass it off as localhost
+					writeJSONError(w, err.Error(), "invalid_request_error", http.StatusBadRequest)
+					return
+				}
+				if forwarded.IsValid() {
+					addr, ok = forwarded, true
+					r.RemoteAddr = addr.String()
+				}
+			}
+			if ok && (prefixesContain(deny, addr) || (len(allow) > 0 && !prefixesContain(allow, addr))) {
+				writeJSONError(w, fmt.Sprintf("Client IP %s is not allowed", addr), "permission_error", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// IPRateLimitMiddleware limits each client IP to perMinute requests per
+// minute, counted in limits. Unix socket peers without a forwarded IP are
+// not limited. A non-positive limit disables it.
+func IPRateLimitMiddleware(limits state.RateLimitStore, perMinute int, publicPaths ...string) Middleware {
+	return func(next http.Handler) http.Handler {
+		if perMinute <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, path := range publicPaths {
+				if r.URL.Path == path {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			ip := clientIP(r)
+			if ip == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if ok, wait := takeRequest(r.Context(), limits, "ip:"+ip, perMinute); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				writeAPIError(w, fmt.Sprintf("Rate limit exceeded for client %s", ip),
+					"rate_limit_error", "rate_limit_exceeded", http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// clientIP returns the IP of the client of a request, or "" for a Unix
+// socket peer
+func clientIP(r *http.Request) string {
+	if addr, ok := remoteIP(r.RemoteAddr); ok {
+		return addr.String()
+	}
+	return ""
+}
+
+// remoteIP parses the IP of a remote address with or without a port. It
+// fails for Unix socket peers.
+func remoteIP(remoteAddr string) (netip.Addr, bool) {
+	host := remoteAddr
+	if h, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		host = h
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// forwardedClient returns the client IP of X-Forwarded-For headers: the
+// rightmost address that is not a trusted proxy, since addresses further
+// left were supplied by the untrusted client. It returns the zero address
+// when there is no header.
+func forwardedClient(headers []string, trusted []netip.Prefix) (netip.Addr, error) {
+	var hops []string
+	for _, header := range headers {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	var client netip.Addr
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, ok := remoteIP(strings.Trim(strings.TrimSpace(hops[i]), "[]"))
+		if !ok {
+			return netip.Addr{}, fmt.Errorf("invalid X-Forwarded-For address %q", strings.TrimSpace(hops[i]))
+		}
+		client = addr
+		if !prefixesContain(trusted, addr) {
+			break
+		}
+	}
+	return client, nil
+}
+
+// prefixesContain reports whether addr is in one of prefixes
+func prefixesContain(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,172 @@
+// internal/proxy/coalesce.go
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+
+	"github.com/acazau/ghcsd/internal/tracing"
+	"github.com/acazau/ghcsd/pkg/copilot"
+)
+
+// coalescer merges identical non-streaming completions that are served at
+// the same time into one upstream call, whose response every caller gets
+type coalescer struct {
+	mu    sync.Mutex
+	calls map[string]*coalescedCall
+	// coalesced counts the completions answered by another caller's call
+	coalesced atomic.Int64
+	tracer    *tracing.Tracer
+	limits    *upstreamLimits
+}
+
+// coalescedCall is an upstream call shared by the callers waiting for it
+type coalescedCall struct {
+	done chan struct{}
+	body []byte
+	err  error
+	// waiters is the number of callers still waiting; the call is cancelled
+	// when all of them are gone
+	waiters int
+	cancel  context.CancelFunc
+	// claimed is set once a caller took the response as its own
+	claimed bool
+	// rateLimit is the rate limit state of the upstream response
+	rateLimit *copilot.RateLimit
+}
+
+// newCoalescer returns a coalescer, or nil when coalescing is disabled
+func newCoalescer(enabled bool, tracer *tracing.Tracer, limits *upstreamLimits) *coalescer {
+	if !enabled {
+		return nil
+	}
+	return &coalescer{calls: make(map[string]*coalescedCall), tracer: tracer, limits: limits}
+}
+
+// coalesceKey identifies identical completions: the same request, sent to
+// the same upstream with the same headers, for the same API key
+func coalesceKey(call *completionCall) (string, error) {
+	data, err := json.Marshal(call.request)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	for _, part := range []string{call.provider.Name(), call.profile, call.keyName} {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+	hash.Write(data)
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// complete sends the request of call upstream, or waits for the identical
+// request already in flight. Each caller gets its own copy of the response.
+// The first caller to get it accounts for the upstream call; shared is set
+// for the others.
+func (c *coalescer) complete(ctx context.Context, call *completionCall) (resp *copilot.CompletionResponse, shared bool, err error) {
+	if c == nil {
+		resp, err = call.provider.Complete(ctx, call.request)
+		return resp, false, err
+	}
+	key, err := coalesceKey(call)
+	if err != nil {
+		resp, err = call.provider.Complete(ctx, call.request)
+		return resp, false, err
+	}
+
+	c.mu.Lock()
+	pending, ok := c.calls[key]
+	if ok {
+		pending.waiters++
+	} else {
+		// The call belongs to no caller, so that it outlives the one starting
+		// it as long as others wait, and is cancelled with the last of them
+		callCtx, cancel := context.WithCancel(context.Background())
+		pending = &coalescedCall{done: make(chan struct{}), waiters: 1, cancel: cancel}
+		c.calls[key] = pending
+		go c.run(callCtx, key, pending, call)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-pending.done:
+	case <-ctx.Done():
+		c.leave(key, pending)
+		return nil, false, context.Cause(ctx)
+	}
+	c.mu.Lock()
+	shared, pending.claimed = pending.claimed, true
+	c.mu.Unlock()
+	c.leave(key, pending)
+	if pending.rateLimit != nil {
+		call.rateLimit.Store(pending.rateLimit)
+	}
+	if pending.err != nil {
+		return nil, shared, pending.err
+	}
+	if shared {
+		c.coalesced.Add(1)
+		proxyLog.Debugf("[Coalesce] Answered %s for %s with the response of an identical request", call.model, call.caller)
+	}
+	resp = &copilot.CompletionResponse{}
+	if err := json.Unmarshal(pending.body, resp); err != nil {
+		return nil, shared, err
+	}
+	return resp, shared, nil
+}
+
+// run makes the shared upstream call, in a trace of its own, with the
+// session and header profile of the identical calls
+func (c *coalescer) run(ctx context.Context, key string, pending *coalescedCall, call *completionCall) {
+	ctx = copilot.WithSessionID(ctx, call.sessionID)
+	if call.profile != "" {
+		ctx = copilot.WithHeaderProfile(ctx, call.profile)
+	}
+	ctx = copilot.WithRateLimitObserver(ctx, func(limit copilot.RateLimit) {
+		c.limits.observe(limit)
+		pending.rateLimit = &limit
+	})
+	ctx, span := c.tracer.Start(ctx, "coalesced upstream completion", tracing.KindInternal)
+	span.SetAttribute("gen_ai.request.model", call.model)
+	span.SetAttribute("ghcsd.upstream", call.provider.Name())
+
+	resp, err := call.provider.Complete(ctx, call.request)
+	if err == nil {
+		pending.body, err = json.Marshal(resp)
+	}
+	if err != nil {
+		span.SetError(err)
+	}
+	span.End()
+	pending.err = err
+	c.mu.Lock()
+	c.forget(key, pending)
+	c.mu.Unlock()
+	close(pending.done)
+}
+
+// leave removes a caller from the waiters of a call, cancelling the call
+// once nobody waits for it anymore. A cancelled call is forgotten at once, so
+// that identical requests arriving meanwhile make a call of their own instead
+// of sharing the cancellation.
+func (c *coalescer) leave(key string, pending *coalescedCall) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pending.waiters--
+	if pending.waiters == 0 {
+		c.forget(key, pending)
+		pending.cancel()
+	}
+}
+
+// forget removes pending from the calls in flight, unless a newer call for
+// the same key replaced it. The caller holds c.mu.
+func (c *coalescer) forget(key string, pending *coalescedCall) {
+	if c.calls[key] == pending {
+		delete(c.calls, key)
+	}
+}
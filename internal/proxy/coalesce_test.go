@@ -0,0 +1,111 @@
+// internal/proxy/coalesce_test.go
+package proxy
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/acazau/ghcsd/pkg/copilot"
+	"github.com/acazau/ghcsd/pkg/upstream"
+)
+
+// blockingProvider answers completions once release is closed, failing
+// those whose context was cancelled meanwhile
+type blockingProvider struct {
+	upstream.Provider
+	release chan struct{}
+	started chan struct{}
+	calls   atomic.Int32
+}
+
+func (p *blockingProvider) Name() string { return "blocking" }
+
+func (p *blockingProvider) Complete(ctx context.Context, req copilot.CompletionRequest) (*copilot.CompletionResponse, error) {
+	p.calls.Add(1)
+	p.started <- struct{}{}
+	<-p.release
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return &copilot.CompletionResponse{ID: "chatcmpl-test", Model: req.Model}, nil
+}
+
+func TestCoalescerSharesIdenticalCalls(t *testing.T) {
+	provider := &blockingProvider{release: make(chan struct{}), started: make(chan struct{}, 2)}
+	c := newCoalescer(true, nil, newUpstreamLimits())
+	call := func() *completionCall {
+		return &completionCall{provider: provider, request: copilot.CompletionRequest{Model: "gpt-4o"}, model: "gpt-4o"}
+	}
+
+	results := make(chan bool, 2)
+	for range 2 {
+		go func() {
+			_, shared, err := c.complete(context.Background(), call())
+			if err != nil {
+				t.Errorf("complete: %v", err)
+			}
+			results <- shared
+		}()
+	}
+	<-provider.started
+	// Wait for the second caller to join the call in flight
+	for {
+		c.mu.Lock()
+		waiters := 0
+		for _, pending := range c.calls {
+			waiters = pending.waiters
+		}
+		c.mu.Unlock()
+		if waiters == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(provider.release)
+
+	if first, second := <-results, <-results; first == second {
+		t.Errorf("shared = %v and %v, want exactly one caller to share the response", first, second)
+	}
+	if calls := provider.calls.Load(); calls != 1 {
+		t.Errorf("upstream calls = %d, want 1", calls)
+	}
+}
+
+func TestCoalescerDoesNotShareCancelledCalls(t *testing.T) {
+	provider := &blockingProvider{release: make(chan struct{}), started: make(chan struct{}, 2)}
+	c := newCoalescer(true, nil, newUpstreamLimits())
+	call := func() *completionCall {
+		return &completionCall{provider: provider, request: copilot.CompletionRequest{Model: "gpt-4o"}, model: "gpt-4o"}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := make(chan error)
+	go func() {
+		_, _, err := c.complete(ctx, call())
+		cancelled <- err
+	}()
+	<-provider.started
+	cancel()
+	if err := <-cancelled; !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled caller got %v, want context.Canceled", err)
+	}
+
+	// The cancelled call has not returned yet; an identical request must not
+	// inherit its cancellation
+	done := make(chan error)
+	go func() {
+		_, _, err := c.complete(context.Background(), call())
+		done <- err
+	}()
+	<-provider.started
+	close(provider.release)
+	if err := <-done; err != nil {
+		t.Errorf("later caller got %v, want a response", err)
+	}
+	if calls := provider.calls.Load(); calls != 2 {
+		t.Errorf("upstream calls = %d, want 2", calls)
+	}
+}
@@ -0,0 +1,132 @@
+// internal/proxy/compaction.go
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/acazau/ghcsd/internal/config"
+	"github.com/acazau/ghcsd/pkg/copilot"
+	"github.com/acazau/ghcsd/pkg/upstream"
+)
+
+const (
+	// compactMaxTokens caps the length of a summary
+	compactMaxTokens = 1024
+	// compactCharsPerToken converts the summary model's context window into
+	// the transcript characters it is given
+	compactCharsPerToken = 3
+)
+
+// compactPrompt instructs the compaction model
+const compactPrompt = `You compress the beginning of a conversation between a user and an AI assistant so that it can continue without it. Write a concise summary of the transcript you are given: the user's goals and requests, decisions made, facts, names, file paths, code and tool results that later turns may rely on, and open questions. Write it in the third person, without preamble.`
+
+// compactor replaces the oldest messages of long prompts with a summary
+type compactor struct {
+	model     string
+	keep      int
+	threshold float64
+	providers *upstream.Registry
+}
+
+func newCompactor(cfg *config.Config, providers *upstream.Registry) *compactor {
+	return &compactor{
+		model:     cfg.CompactModel,
+		keep:      cfg.CompactKeepMessages,
+		threshold: cfg.CompactThreshold,
+		providers: providers,
+	}
+}
+
+// compact summarizes the messages between the leading system messages and
+// the latest ones kept verbatim, when the estimated prompt exceeds the
+// threshold share of the model's context window. It returns the number of
+// messages replaced by the summary and the tokens the summary used.
+func (c *compactor) compact(ctx context.Context, req *copilot.CompletionRequest, model config.Model) (int, int, error) {
+	if model.ContextWindow <= 0 {
+		return 0, 0, nil
+	}
+	if float64(upstream.EstimateTokens(*req)) <= float64(model.ContextWindow)*c.threshold/100 {
+		return 0, 0, nil
+	}
+
+	leading := 0
+	for leading < len(req.Messages) && req.Messages[leading].Role == "system" {
+		leading++
+	}
+	split := len(req.Messages) - c.keep
+	// Tool results cannot start the kept messages without their tool call
+	for split > leading && req.Messages[split].Role == "tool" {
+		split--
+	}
+	if split <= leading {
+		return 0, 0, nil
+	}
+	old := req.Messages[leading:split]
+
+	info, _ := config.GetModelInfo(c.model)
+	provider, err := c.providers.Get(info.Upstream)
+	if err != nil {
+		return 0, 0, err
+	}
+	transcript := compactTranscript(old)
+	if info.ContextWindow > 0 {
+		// Keep the end of an oversized transcript, which later turns rely on most
+		limit := (info.ContextWindow - compactMaxTokens) * compactCharsPerToken
+		if limit > 0 && len(transcript) > limit {
+			transcript = transcript[len(transcript)-limit:]
+		}
+	}
+	summaryReq := copilot.NewCompletionRequest(info.RealID)
+	summaryReq.MaxTokens = compactMaxTokens
+	summaryReq.Messages = []copilot.Message{
+		{Role: "system", Content: compactPrompt},
+		{Role: "user", Content: transcript},
+	}
+	resp, err := provider.Complete(ctx, summaryReq)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(resp.Choices) == 0 || strings.TrimSpace(resp.Choices[0].Message.Content) == "" {
+		return 0, 0, errors.New("the compaction model returned an empty summary")
+	}
+
+	summary := copilot.Message{
+		Role: "system",
+		Content: fmt.Sprintf("[Summary of the %d earlier messages of this conversation, compacted to fit the model's context window]\n%s",
+			len(old), strings.TrimSpace(resp.Choices[0].Message.Content)),
+	}
+	messages := make([]copilot.Message, 0, leading+1+len(req.Messages)-split)
+	messages = append(messages, req.Messages[:leading]...)
+	messages = append(messages, summary)
+	messages = append(messages, req.Messages[split:]...)
+	req.Messages = messages
+	return len(old), resp.Usage.TotalTokens, nil
+}
+
+// compactTranscript renders messages as the plain text transcript summarized
+func compactTranscript(messages []copilot.Message) string {
+	var b strings.Builder
+	for _, msg := range messages {
+		text := msg.GetStringContent()
+		if !msg.IsStringContent() {
+			var parts []string
+			for _, part := range msg.GetComplexContent() {
+				if part.Type == "text" {
+					parts = append(parts, part.Text)
+				} else {
+					parts = append(parts, "["+part.Type+"]")
+				}
+			}
+			text = strings.Join(parts, "\n")
+		}
+		fmt.Fprintf(&b, "%s: %s\n", msg.Role, text)
+		for _, call := range msg.ToolCalls {
+			fmt.Fprintf(&b, "%s called tool %s(%s)\n", msg.Role, call.Function.Name, call.Function.Arguments)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
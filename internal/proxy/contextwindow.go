@@ -0,0 +1,69 @@
+// internal/proxy/contextwindow.go
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/acazau/ghcsd/internal/config"
+	"github.com/acazau/ghcsd/pkg/copilot"
+	"github.com/acazau/ghcsd/pkg/upstream"
+)
+
+// fitContextWindow checks the estimated prompt tokens of req against the
+// model's context window. Depending on the overflow policy an oversized
+// prompt is rejected, or its oldest messages are dropped until it fits.
+// It returns the number of messages dropped.
+func fitContextWindow(req *copilot.CompletionRequest, model config.Model, policy string) (int, *requestError) {
+	if model.ContextWindow <= 0 {
+		return 0, nil
+	}
+	tokens := upstream.EstimateTokens(*req)
+	if tokens <= model.ContextWindow {
+		return 0, nil
+	}
+	overflow := &requestError{
+		status: http.StatusBadRequest,
+		message: fmt.Sprintf("This model's maximum context length is %d tokens. However, your messages resulted in an estimated %d tokens. Please reduce the length of the messages.",
+			model.ContextWindow, tokens),
+		code: "context_length_exceeded",
+	}
+	if policy != config.OverflowTruncate {
+		return 0, overflow
+	}
+
+	// Keep the leading system messages and the latest message, dropping the
+	// oldest messages in between
+	leading := 0
+	for leading < len(req.Messages) && req.Messages[leading].Role == "system" {
+		leading++
+	}
+	history := req.Messages[leading:]
+	dropped := 0
+	for len(history) > 1 {
+		history = history[1:]
+		dropped++
+		// Tool results cannot start the history without their tool call
+		for len(history) > 1 && history[0].Role == "tool" {
+			history = history[1:]
+			dropped++
+		}
+
+		notice := copilot.Message{
+			Role:    "system",
+			Content: fmt.Sprintf("[%d earlier messages of this conversation were omitted to fit the model's context window]", dropped),
+		}
+		messages := make([]copilot.Message, 0, leading+1+len(history))
+		messages = append(messages, req.Messages[:leading]...)
+		messages = append(messages, notice)
+		messages = append(messages, history...)
+
+		candidate := *req
+		candidate.Messages = messages
+		if upstream.EstimateTokens(candidate) <= model.ContextWindow {
+			req.Messages = messages
+			return dropped, nil
+		}
+	}
+	return 0, overflow
+}
@@ -0,0 +1,98 @@
+// internal/proxy/convert.go
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/acazau/ghcsd/pkg/copilot"
+)
+
+// dryRunKey is the context key marking a completion that is built but never
+// sent, so that building it leaves no trace in the shared state
+type dryRunKey struct{}
+
+// isDryRun reports whether the completion built with ctx is a dry run
+func isDryRun(ctx context.Context) bool {
+	dryRun, _ := ctx.Value(dryRunKey{}).(bool)
+	return dryRun
+}
+
+// convertFormat decodes a request body of a client API into a completion
+// request
+type convertFormat func(body io.Reader) (copilot.CompletionRequest, error)
+
+// convertFormats are the request formats accepted by POST /debug/convert,
+// extended by the optional frontends
+var convertFormats = map[string]convertFormat{
+	"openai": func(body io.Reader) (copilot.CompletionRequest, error) {
+		var req copilot.CompletionRequest
+		err := json.NewDecoder(body).Decode(&req)
+		return req, err
+	},
+}
+
+// convertResult is the response of POST /debug/convert
+type convertResult struct {
+	Requested string `json:"requested_model"`
+	Model     string `json:"model"`
+	Route     string `json:"auto_route,omitempty"`
+	Upstream  string `json:"upstream"`
+	Profile   string `json:"header_profile,omitempty"`
+	Priority  string `json:"priority"`
+	// Vision reports whether the request is flagged as carrying images
+	Vision  bool                      `json:"vision"`
+	Request copilot.CompletionRequest `json:"request"`
+}
+
+// handleConvert serves POST /debug/convert, running a completion request
+// through the same conversion and normalization as a real one and returning
+// the request that would be sent upstream, without sending it. The body is
+// an OpenAI chat completion, or an Anthropic message with ?format=anthropic.
+func (h *Handler) handleConvert(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "openai"
+	}
+	decode, ok := convertFormats[format]
+	if !ok {
+		formats := make([]string, 0, len(convertFormats))
+		for name := range convertFormats {
+			formats = append(formats, name)
+		}
+		sort.Strings(formats)
+		writeJSONError(w, fmt.Sprintf("Unknown format %q, expected one of %s", format, strings.Join(formats, ", ")), "invalid_request_error", http.StatusBadRequest)
+		return
+	}
+	req, err := decode(r.Body)
+	if err != nil {
+		writeJSONError(w, "Invalid request body", "invalid_request_error", http.StatusBadRequest)
+		return
+	}
+
+	r = r.WithContext(context.WithValue(r.Context(), dryRunKey{}, true))
+	call, reqErr := h.buildCompletion(r, req)
+	if reqErr != nil {
+		h.sendRequestError(w, reqErr)
+		return
+	}
+	// The cap of the API key is applied when the call starts
+	if call.maxTokens > 0 && call.request.MaxTokens > call.maxTokens {
+		call.request.MaxTokens = call.maxTokens
+	}
+	writeJSON(w, http.StatusOK, convertResult{
+		Requested: call.requested,
+		Model:     call.model,
+		Route:     call.route,
+		Upstream:  call.provider.Name(),
+		Profile:   call.profile,
+		Priority:  call.priority.String(),
+		Vision:    call.request.HasImages(),
+		Request:   call.request,
+	})
+}
@@ -0,0 +1,197 @@
+// internal/proxy/devicelogin.go
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/acazau/ghcsd/internal/state"
+	"github.com/acazau/ghcsd/pkg/copilot"
+)
+
+// Device login states reported by /auth/status
+const (
+	loginAuthenticated   = "authenticated"
+	loginPending         = "pending"
+	loginUnauthenticated = "unauthenticated"
+	loginFailed          = "failed"
+)
+
+// deviceLogin runs the GitHub device flow on behalf of an operator talking to
+// the server over HTTP, for daemons started without a stored token and no
+// terminal to show the prompt on
+type deviceLogin struct {
+	auth *copilot.AuthManager
+	// cache shares the token with the other replicas
+	cache state.TokenCache
+	// clients are the clients sharing the login; the first is the server's own
+	clients []*copilot.Client
+
+	mu        sync.Mutex
+	code      *copilot.DeviceCode
+	expiresAt time.Time
+	err       string
+	// done is closed when the pending flow ends
+	done chan struct{}
+}
+
+// deviceLoginStatus is the response of the /auth endpoints
+type deviceLoginStatus struct {
+	Status          string     `json:"status"`
+	VerificationURI string     `json:"verification_uri,omitempty"`
+	UserCode        string     `json:"user_code,omitempty"`
+	ExpiresAt       *time.Time `json:"expires_at,omitempty"`
+	Interval        int        `json:"interval,omitempty"`
+	Error           string     `json:"error,omitempty"`
+	TokenExpiresAt  *time.Time `json:"token_expires_at,omitempty"`
+}
+
+func newDeviceLogin(auth *copilot.AuthManager, cache state.TokenCache, clients ...*copilot.Client) *deviceLogin {
+	return &deviceLogin{auth: auth, cache: cache, clients: clients}
+}
+
+// status reports the state of the login. A pending flow takes precedence
+// over an existing token, which stays in use until the flow completes.
+func (d *deviceLogin) status() deviceLoginStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.statusLocked()
+}
+
+func (d *deviceLogin) statusLocked() deviceLoginStatus {
+	if d.code != nil && time.Now().Before(d.expiresAt) {
+		expiresAt := d.expiresAt
+		return deviceLoginStatus{
+			Status:          loginPending,
+			VerificationURI: d.code.VerificationURI,
+			UserCode:        d.code.UserCode,
+			ExpiresAt:       &expiresAt,
+			Interval:        d.code.Interval,
+		}
+	}
+	token := d.clients[0].GetToken()
+	if token == "" {
+		if d.err != "" {
+			return deviceLoginStatus{Status: loginFailed, Error: d.err}
+		}
+		return deviceLoginStatus{Status: loginUnauthenticated}
+	}
+	// A failed new login leaves the previous token in use
+	status := deviceLoginStatus{Status: loginAuthenticated, Error: d.err}
+	if expiresAt, ok := copilot.TokenExpiry(token); ok {
+		status.TokenExpiresAt = &expiresAt
+	}
+	return status
+}
+
+// start begins a device flow, or returns the one already pending, and
+// completes it in the background
+func (d *deviceLogin) start() (deviceLoginStatus, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.code != nil && time.Now().Before(d.expiresAt) {
+		return d.statusLocked(), nil
+	}
+
+	code, err := d.auth.RequestDeviceCode()
+	if err != nil {
+		return deviceLoginStatus{}, err
+	}
+	d.begin(code)
+	authLog.Infof("[Auth] Device login started: visit %s and enter code %s", code.VerificationURI, code.UserCode)
+	return d.statusLocked(), nil
+}
+
+// resume continues the device flow that the previous run of the server
+// started and did not finish
+func (d *deviceLogin) resume() {
+	code := d.auth.PendingDeviceCode()
+	if code == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.begin(code)
+	authLog.Infof("[Auth] Device login resumed: visit %s and enter code %s before %s", code.VerificationURI, code.UserCode, d.expiresAt.Format(time.RFC3339))
+}
+
+// begin makes code the pending flow and completes it in the background;
+// d.mu must be held
+func (d *deviceLogin) begin(code *copilot.DeviceCode) {
+	d.code = code
+	d.expiresAt = time.Now().Add(time.Duration(code.ExpiresIn) * time.Second)
+	d.err = ""
+	d.done = make(chan struct{})
+	go d.complete(code, d.done)
+}
+
+// pending returns a channel closed when the pending flow ends, or nil when
+// no flow is pending
+func (d *deviceLogin) pending() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.code == nil || !time.Now().Before(d.expiresAt) {
+		return nil
+	}
+	return d.done
+}
+
+// complete waits for the user to authorize the device code and installs the
+// resulting Copilot token
+func (d *deviceLogin) complete(code *copilot.DeviceCode, done chan struct{}) {
+	defer close(done)
+	token, err := d.auth.PollDeviceCode(code)
+	if err == nil {
+		token, err = d.auth.ExchangeToken(token)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// An expired flow may have been replaced by a newer one meanwhile
+	current := d.code == code
+	if current {
+		d.code = nil
+	}
+	if err != nil {
+		authLog.Errorf("[Auth] Device login failed: %v", err)
+		if current {
+			d.err = err.Error()
+		}
+		return
+	}
+	d.install(token)
+	authLog.Infof("[Auth] Device login completed")
+}
+
+// install makes the clients sharing the login use a new Copilot token and
+// shares it with the other replicas
+func (d *deviceLogin) install(token string) {
+	for _, client := range d.clients {
+		client.SetToken(token)
+	}
+	if expiresAt, ok := copilot.TokenExpiry(token); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), stateTimeout)
+		defer cancel()
+		if err := d.cache.SetToken(ctx, token, expiresAt); err != nil {
+			authLog.Warnf("[Auth] Failed to cache the Copilot token: %v", err)
+		}
+	}
+}
+
+// handleDeviceLogin serves POST /auth/device, starting a device flow and
+// returning the verification URI and user code to enter there
+func (h *Handler) handleDeviceLogin(w http.ResponseWriter, r *http.Request) {
+	status, err := h.login.start()
+	if err != nil {
+		writeJSONError(w, "Failed to start device login: "+err.Error(), "api_error", http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, status)
+}
+
+// handleLoginStatus serves GET /auth/status
+func (h *Handler) handleLoginStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.login.status())
+}
@@ -0,0 +1,118 @@
+// internal/proxy/errors.go
+package proxy
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/acazau/ghcsd/internal/hook"
+	"github.com/acazau/ghcsd/pkg/copilot"
+)
+
+// upstreamError describes how an upstream failure is presented to the client
+type upstreamError struct {
+	Status     int
+	Type       string
+	Code       string
+	Message    string
+	RetryAfter string
+}
+
+// contentFilterCode is the error code of prompts and completions blocked by
+// the Copilot content filter, as the OpenAI API reports them
+const contentFilterCode = "content_filter"
+
+// errorType returns the OpenAI error type of a status code
+func errorType(status int) string {
+	switch {
+	case status == http.StatusUnauthorized:
+		return "authentication_error"
+	case status == http.StatusForbidden:
+		return "permission_error"
+	case status == http.StatusNotFound:
+		return "not_found_error"
+	case status == http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case status >= http.StatusInternalServerError:
+		return "server_error"
+	default:
+		return "invalid_request_error"
+	}
+}
+
+// translateError maps an error returned by the Copilot client to the status
+// code and error type used by the OpenAI API
+func translateError(err error) upstreamError {
+	var queueErr *queueFullError
+	if errors.As(err, &queueErr) {
+		return upstreamError{
+			Status:     http.StatusServiceUnavailable,
+			Type:       "server_error",
+			Message:    queueErr.Error(),
+			RetryAfter: strconv.Itoa(int(math.Ceil(queueErr.retryAfter.Seconds()))),
+		}
+	}
+
+	var reauthErr *reauthPendingError
+	if errors.As(err, &reauthErr) {
+		result := upstreamError{Status: http.StatusServiceUnavailable, Type: "server_error", Code: "reauthentication_required", Message: reauthErr.Error()}
+		if reauthErr.status.Status == loginPending {
+			result.RetryAfter = strconv.Itoa(max(reauthErr.status.Interval, 1))
+		}
+		return result
+	}
+
+	var rejection *hook.Rejection
+	if errors.As(err, &rejection) {
+		return upstreamError{Status: http.StatusForbidden, Type: "permission_error", Code: "rejected_by_policy", Message: rejection.Message}
+	}
+
+	// A stream can end with an error payload, such as a policy violation
+	var streamErr *copilot.StreamError
+	if errors.As(err, &streamErr) {
+		if streamErr.Kind() == copilot.ErrorKindContentFilter {
+			return upstreamError{Status: http.StatusBadRequest, Type: "invalid_request_error", Code: contentFilterCode, Message: streamErr.Message}
+		}
+		return upstreamError{Status: http.StatusBadGateway, Type: "server_error", Code: streamErr.Code, Message: streamErr.Message}
+	}
+
+	var apiErr *copilot.APIError
+	if !errors.As(err, &apiErr) {
+		return upstreamError{
+			Status:  http.StatusBadGateway,
+			Type:    "server_error",
+			Message: err.Error(),
+		}
+	}
+
+	result := upstreamError{
+		Code:       apiErr.Code,
+		Message:    apiErr.Message,
+		RetryAfter: apiErr.RetryAfter,
+	}
+	if result.Message == "" {
+		result.Message = apiErr.Error()
+	}
+
+	switch apiErr.Kind() {
+	case copilot.ErrorKindInvalidRequest:
+		result.Status, result.Type = http.StatusBadRequest, "invalid_request_error"
+	case copilot.ErrorKindContentFilter:
+		result.Status, result.Type, result.Code = http.StatusBadRequest, "invalid_request_error", contentFilterCode
+	case copilot.ErrorKindAuthentication:
+		result.Status, result.Type = http.StatusUnauthorized, "authentication_error"
+	case copilot.ErrorKindPermission:
+		result.Status, result.Type = http.StatusForbidden, "permission_error"
+	case copilot.ErrorKindNotFound:
+		result.Status, result.Type = http.StatusNotFound, "not_found_error"
+	case copilot.ErrorKindRateLimit:
+		result.Status, result.Type = http.StatusTooManyRequests, "rate_limit_error"
+	case copilot.ErrorKindOverloaded:
+		result.Status, result.Type = http.StatusServiceUnavailable, "server_error"
+	default:
+		result.Status, result.Type = http.StatusBadGateway, "server_error"
+	}
+	return result
+}
@@ -0,0 +1,95 @@
+// internal/proxy/frontends.go
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/acazau/ghcsd/internal/config"
+)
+
+// grpcPrefix is the path prefix of the methods of the ghcsd.v1.Proxy service
+const grpcPrefix = "/ghcsd.v1.Proxy/"
+
+// frontend is an optional client API. Each one is compiled from files
+// excluded by its build tag, or by ghcsd_minimal, and registers the handlers
+// of its routes from there.
+type frontend struct {
+	name    string
+	setting string
+	tag     string
+	enabled func(cfg *config.Config) bool
+	routes  []string
+}
+
+// optionalFrontends are the frontends that can be left out of the binary.
+// The OpenAI chat completions API is always compiled in.
+var optionalFrontends = []frontend{
+	{
+		name:    "Responses",
+		setting: "GHCSD_ENABLE_RESPONSES",
+		tag:     "ghcsd_no_responses",
+		enabled: func(cfg *config.Config) bool { return cfg.EnableResponses },
+		routes:  []string{"POST /v1/responses", "GET /v1/responses/{id}", "DELETE /v1/responses/{id}"},
+	},
+	{
+		name:    "Anthropic",
+		setting: "GHCSD_ENABLE_ANTHROPIC",
+		tag:     "ghcsd_no_anthropic",
+		enabled: func(cfg *config.Config) bool { return cfg.EnableAnthropic },
+		routes:  []string{"POST /v1/messages/count_tokens"},
+	},
+	{
+		name:    "Ollama",
+		setting: "GHCSD_ENABLE_OLLAMA",
+		tag:     "ghcsd_no_ollama",
+		enabled: func(cfg *config.Config) bool { return cfg.EnableOllama },
+		routes:  []string{"POST /api/chat", "POST /api/generate", "GET /api/tags"},
+	},
+	{
+		name:    "gRPC",
+		setting: "GHCSD_ENABLE_GRPC",
+		tag:     "ghcsd_no_grpc",
+		enabled: func(cfg *config.Config) bool { return cfg.EnableGRPC },
+		routes:  []string{"POST " + grpcPrefix},
+	},
+}
+
+// frontendHandlers are the handlers of the routes of the compiled in
+// frontends, by route pattern
+var frontendHandlers = map[string]func(h *Handler) http.HandlerFunc{}
+
+// registerFrontendRoute sets the handler of a route of an optional frontend
+func registerFrontendRoute(pattern string, handler func(h *Handler) http.HandlerFunc) {
+	frontendHandlers[pattern] = handler
+}
+
+// routeFrontends adds the routes of the optional frontends to mux. The routes
+// of a frontend left out of the binary answer how to build it in.
+func routeFrontends(mux *http.ServeMux, h *Handler, cfg *config.Config) {
+	for _, f := range optionalFrontends {
+		if _, compiled := frontendHandlers[f.routes[0]]; !compiled {
+			proxyLog.Debugf("[Frontends] The %s API is left out of this binary", f.name)
+			for _, pattern := range f.routes {
+				mux.HandleFunc(pattern, notCompiledRoute(f))
+			}
+			continue
+		}
+		enabled := f.enabled(cfg)
+		for _, pattern := range f.routes {
+			var route http.HandlerFunc
+			if enabled {
+				route = frontendHandlers[pattern](h)
+			}
+			mux.HandleFunc(pattern, frontendRoute(enabled, f.name, f.setting, route))
+		}
+	}
+}
+
+// notCompiledRoute answers requests for a frontend left out of the binary
+func notCompiledRoute(f frontend) http.HandlerFunc {
+	message := fmt.Sprintf("Not found; the %s API is not built into this server, rebuild it without the %s and ghcsd_minimal build tags", f.name, f.tag)
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSONError(w, message, "not_found_error", http.StatusNotFound)
+	}
+}
@@ -0,0 +1,336 @@
+// internal/proxy/grpc.go
+
+//go:build !ghcsd_minimal && !ghcsd_no_grpc
+
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/acazau/ghcsd/internal/config"
+	"github.com/acazau/ghcsd/pkg/copilot"
+	"github.com/acazau/ghcsd/pkg/ghcsdpb"
+)
+
+// grpcRequestKey is the context key of the HTTP request carrying a gRPC call
+type grpcRequestKey struct{}
+
+func init() {
+	registerFrontendRoute("POST "+grpcPrefix, (*Handler).grpcHandler)
+}
+
+// grpcService implements the gRPC API on top of the handler. Calls arrive as
+// HTTP/2 requests through the middleware stack, so they are authorized and
+// limited like the HTTP API, and the service reuses their HTTP request to
+// build completions.
+type grpcService struct {
+	ghcsdpb.UnimplementedProxyServer
+	h *Handler
+}
+
+// grpcHandler returns the HTTP handler serving the gRPC API
+func (h *Handler) grpcHandler() http.HandlerFunc {
+	server := grpc.NewServer()
+	ghcsdpb.RegisterProxyServer(server, &grpcService{h: h})
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			h.sendError(w, "The gRPC API requires HTTP/2 and the application/grpc content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		server.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), grpcRequestKey{}, r)))
+	}
+}
+
+// request returns the HTTP request of the call in ctx, bound to ctx so that
+// the deadline of the call applies
+func (s *grpcService) request(ctx context.Context) (*http.Request, error) {
+	r, ok := ctx.Value(grpcRequestKey{}).(*http.Request)
+	if !ok {
+		return nil, status.Error(codes.Internal, "gRPC call without an HTTP request")
+	}
+	return r.WithContext(ctx), nil
+}
+
+func (s *grpcService) Complete(ctx context.Context, in *ghcsdpb.CompleteRequest) (*ghcsdpb.CompleteResponse, error) {
+	body, err := s.start(ctx, in, false)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	var completion copilot.CompletionResponse
+	if err := json.NewDecoder(body).Decode(&completion); err != nil {
+		return nil, grpcError(ctx, fmt.Errorf("failed to decode completion: %w", err))
+	}
+	out := &ghcsdpb.CompleteResponse{
+		Id:                completion.ID,
+		Model:             completion.Model,
+		Created:           completion.Created,
+		Usage:             usageToProto(&completion),
+		SystemFingerprint: completion.SystemFingerprint,
+	}
+	for _, choice := range completion.Choices {
+		out.Choices = append(out.Choices, &ghcsdpb.Choice{
+			Index:        int32(choice.Index),
+			Message:      messageToProto(choice.Message.Role, choice.Message.Content, choice.Message.ToolCalls),
+			FinishReason: choice.FinishReason,
+		})
+	}
+	return out, nil
+}
+
+func (s *grpcService) CompleteStream(in *ghcsdpb.CompleteRequest, stream ghcsdpb.Proxy_CompleteStreamServer) error {
+	// Cancelled once sending to the client fails, aborting the upstream request
+	ctx, disconnect := context.WithCancelCause(stream.Context())
+	defer disconnect(nil)
+	body, err := s.start(ctx, in, true)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	err = forEachChunk(body, func(chunk *copilot.CompletionResponse) error {
+		out := &ghcsdpb.CompleteChunk{Id: chunk.ID, Model: chunk.Model, Created: chunk.Created}
+		if chunk.Usage.TotalTokens > 0 {
+			out.Usage = usageToProto(chunk)
+		}
+		for _, choice := range chunk.Choices {
+			role, _ := choice.Delta.Role.(string)
+			out.Choices = append(out.Choices, &ghcsdpb.ChunkChoice{
+				Index:        int32(choice.Index),
+				Delta:        messageToProto(role, deltaText(choice), choice.Delta.ToolCalls),
+				FinishReason: choice.FinishReason,
+			})
+		}
+		if err := stream.Send(out); err != nil {
+			disconnect(errClientDisconnected)
+			return fmt.Errorf("%w: %v", errClientDisconnected, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return grpcError(ctx, err)
+	}
+	return nil
+}
+
+// start builds the completion of a call and starts it upstream
+func (s *grpcService) start(ctx context.Context, in *ghcsdpb.CompleteRequest, stream bool) (io.ReadCloser, error) {
+	r, err := s.request(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req, err := completionFromProto(in)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	req.Stream = stream
+	call, reqErr := s.h.buildCompletion(r, req)
+	if reqErr != nil {
+		if reqErr.retryAfter > 0 {
+			retryAfter := strconv.Itoa(int(math.Ceil(reqErr.retryAfter.Seconds())))
+			grpc.SetTrailer(ctx, metadata.Pairs("retry-after", retryAfter))
+		}
+		return nil, status.Error(grpcCode(reqErr.status), reqErr.message)
+	}
+	if stream {
+		call.request.StreamOptions = &copilot.StreamOptions{IncludeUsage: true}
+	}
+
+	body, err := s.h.startCompletion(ctx, call)
+	// Reported like the model headers of the HTTP API
+	grpc.SetHeader(ctx, metadata.Pairs(
+		strings.ToLower(headerRequestedModel), call.requested,
+		strings.ToLower(headerServedModel), call.model,
+		strings.ToLower(headerUpstream), call.provider.Name(),
+	))
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return body, nil
+}
+
+func (s *grpcService) CountTokens(ctx context.Context, in *ghcsdpb.CountTokensRequest) (*ghcsdpb.CountTokensResponse, error) {
+	r, err := s.request(ctx)
+	if err != nil {
+		return nil, err
+	}
+	model := s.h.defaultModel
+	if in.Model != "" {
+		model = in.Model
+	}
+	modelInfo, valid := config.GetModelInfo(model)
+	if !valid {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid model requested: %s", model)
+	}
+	if key := apiKeyFrom(r); key != nil && !key.AllowsModel(model, modelInfo.RealID) {
+		return nil, status.Errorf(codes.PermissionDenied, "API key %s is not allowed to use model %s", key.Name, model)
+	}
+	provider, err := s.h.providers.Get(modelInfo.Upstream)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	req, err := completionFromProto(&ghcsdpb.CompleteRequest{Messages: in.Messages, Tools: in.Tools})
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	req.Model = modelInfo.RealID
+	tokens, err := provider.CountTokens(ctx, req)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return &ghcsdpb.CountTokensResponse{InputTokens: int32(tokens)}, nil
+}
+
+func (s *grpcService) ListModels(ctx context.Context, in *ghcsdpb.ListModelsRequest) (*ghcsdpb.ListModelsResponse, error) {
+	r, err := s.request(ctx)
+	if err != nil {
+		return nil, err
+	}
+	out := &ghcsdpb.ListModelsResponse{}
+	for _, id := range visibleModels(r) {
+		info, _ := config.GetModelInfo(id)
+		model := s.h.describeModel(ctx, id, info)
+		out.Models = append(out.Models, &ghcsdpb.Model{
+			Id:              model.ID,
+			RealId:          model.Model,
+			OwnedBy:         model.OwnedBy,
+			Upstream:        model.Upstream,
+			ContextWindow:   int32(model.ContextWindow),
+			MaxOutputTokens: int32(model.MaxOutputTokens),
+			Vision:          model.Capabilities.Vision,
+			Tools:           model.Capabilities.Tools,
+			Reasoning:       model.Capabilities.Reasoning,
+			Available:       model.Available,
+		})
+	}
+	return out, nil
+}
+
+// completionFromProto converts a gRPC completion request to the chat format
+func completionFromProto(in *ghcsdpb.CompleteRequest) (copilot.CompletionRequest, error) {
+	req := copilot.CompletionRequest{
+		Model:     in.Model,
+		N:         int(in.N),
+		MaxTokens: int(in.MaxTokens),
+		Stop:      in.Stop,
+		Seed:      in.Seed,
+		User:      in.User,
+		TopP:      in.GetTopP(),
+	}
+	req.Temperature = in.GetTemperature()
+	req.PresencePenalty = in.PresencePenalty
+	req.FrequencyPenalty = in.FrequencyPenalty
+
+	for _, msg := range in.Messages {
+		converted := copilot.Message{Role: msg.Role, Content: msg.Content, Name: msg.Name, ToolCallID: msg.ToolCallId}
+		for _, call := range msg.ToolCalls {
+			converted.ToolCalls = append(converted.ToolCalls, copilot.ToolCall{
+				ID:       call.Id,
+				Type:     "function",
+				Function: copilot.ToolCallFunction{Name: call.Name, Arguments: call.Arguments},
+			})
+		}
+		req.Messages = append(req.Messages, converted)
+	}
+	for _, tool := range in.Tools {
+		function := copilot.ToolFunction{Name: tool.Name, Description: tool.Description}
+		if tool.ParametersJson != "" {
+			if !json.Valid([]byte(tool.ParametersJson)) {
+				return req, fmt.Errorf("parameters_json of tool %s is not valid JSON", tool.Name)
+			}
+			function.Parameters = json.RawMessage(tool.ParametersJson)
+		}
+		req.Tools = append(req.Tools, copilot.Tool{Type: "function", Function: function})
+	}
+	switch in.ToolChoice {
+	case "":
+	case copilot.ToolChoiceAuto, copilot.ToolChoiceNone, copilot.ToolChoiceRequired:
+		req.ToolChoice = &copilot.ToolChoice{Mode: in.ToolChoice}
+	default:
+		req.ToolChoice = &copilot.ToolChoice{Mode: copilot.ToolChoiceFunction, FunctionName: in.ToolChoice}
+	}
+	return req, nil
+}
+
+// messageToProto converts a generated message or delta to the gRPC format
+func messageToProto(role, content string, calls []copilot.ToolCall) *ghcsdpb.Message {
+	msg := &ghcsdpb.Message{Role: role, Content: content}
+	for i, call := range calls {
+		index := i
+		if call.Index != nil {
+			index = *call.Index
+		}
+		msg.ToolCalls = append(msg.ToolCalls, &ghcsdpb.ToolCall{
+			Id:        call.ID,
+			Name:      call.Function.Name,
+			Arguments: call.Function.Arguments,
+			Index:     int32(index),
+		})
+	}
+	return msg
+}
+
+func usageToProto(completion *copilot.CompletionResponse) *ghcsdpb.Usage {
+	return &ghcsdpb.Usage{
+		PromptTokens:     int32(completion.Usage.PromptTokens),
+		CompletionTokens: int32(completion.Usage.CompletionTokens),
+		TotalTokens:      int32(completion.Usage.TotalTokens),
+	}
+}
+
+// grpcError converts an upstream error to a gRPC status, reporting calls
+// that ended with their context as cancelled or past their deadline
+func grpcError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		if errors.Is(context.Cause(ctx), errClientDisconnected) {
+			return status.Error(codes.Canceled, "client disconnected")
+		}
+		return status.FromContextError(ctx.Err()).Err()
+	}
+	translated := translateError(err)
+	if translated.RetryAfter != "" {
+		grpc.SetTrailer(ctx, metadata.Pairs("retry-after", translated.RetryAfter))
+	}
+	return status.Error(grpcCode(translated.Status), translated.Message)
+}
+
+// grpcCode maps an HTTP status to the gRPC status code of the same meaning
+func grpcCode(httpStatus int) codes.Code {
+	switch httpStatus {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusRequestTimeout, http.StatusGatewayTimeout:
+		return codes.DeadlineExceeded
+	case http.StatusNotImplemented:
+		return codes.Unimplemented
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		return codes.Unavailable
+	}
+	if httpStatus >= 500 {
+		return codes.Internal
+	}
+	return codes.FailedPrecondition
+}
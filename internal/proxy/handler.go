@@ -3,52 +3,466 @@ package proxy
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"math"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/acazau/ghcsd/internal/apikeys"
+	"github.com/acazau/ghcsd/internal/audit"
+	"github.com/acazau/ghcsd/internal/cassette"
 	"github.com/acazau/ghcsd/internal/config"
-	"github.com/acazau/ghcsd/internal/copilot"
+	"github.com/acazau/ghcsd/internal/conversations"
+	"github.com/acazau/ghcsd/internal/events"
+	"github.com/acazau/ghcsd/internal/filter"
+	"github.com/acazau/ghcsd/internal/hook"
+	"github.com/acazau/ghcsd/internal/state"
+	"github.com/acazau/ghcsd/internal/tracing"
+	"github.com/acazau/ghcsd/internal/transport"
+	"github.com/acazau/ghcsd/pkg/copilot"
+	"github.com/acazau/ghcsd/pkg/logging"
+	"github.com/acazau/ghcsd/pkg/streambuf"
+	"github.com/acazau/ghcsd/pkg/upstream"
+)
+
+// maxChoices is the largest n accepted, matching the OpenAI API limit
+const maxChoices = 128
+
+// eventHistorySize is the number of log events replayed to new log stream subscribers
+const eventHistorySize = 200
+
+// stateTimeout bounds the state store operations made outside of a request
+const stateTimeout = 2 * time.Second
+
+// conversationPruneInterval is how often expired stored responses are removed
+const conversationPruneInterval = time.Hour
+
+// The loggers of the components served by the handler
+var (
+	proxyLog     = logging.For(logging.Proxy)
+	authLog      = logging.For(logging.Auth)
+	anthropicLog = logging.For(logging.Anthropic)
+	ollamaLog    = logging.For(logging.Ollama)
+	upstreamLog  = logging.For(logging.Upstream)
+	auditLog     = logging.For(logging.Audit)
 )
 
 type Handler struct {
-	client       *copilot.Client
-	defaultModel string
-	debug        bool
+	client        *copilot.Client
+	providers     *upstream.Registry
+	balancer      *upstream.Balancer
+	defaultModel  string
+	sessionHeader string
+	// pinTTL is how long an idle conversation stays pinned to its model; 0
+	// disables pinning
+	pinTTL        time.Duration
+	audit         *audit.Logger
+	filters       filter.Chain
+	hooks         *hook.Script
+	cleanups      *responseCleanups
+	events        *events.Broker
+	retryQueue    *retryQueue
+	userLimiter   *userLimiter
+	budgets       *budgetLimiter
+	costs         map[string]config.ModelCost
+	limits        *upstreamLimits
+	breaker       *circuitBreaker
+	shadow        *shadowMirror
+	toolCheck     *toolChecker
+	transcripts   *transcriptWriter
+	shared        state.Store
+	keys          *apikeys.Store
+	inflight      *inflightRegistry
+	stats         *modelStats
+	login         *deviceLogin
+	reauth        *reauthenticator
+	conversations *conversations.Store
+	overflow      string
+	compactor     *compactor
+	autoRouter    *autoRouter
+	maxTokens     int
+	startedAt     time.Time
+	readiness     readinessCache
+	catalog       modelCatalog
+	availability  modelAvailability
+	tracer        *tracing.Tracer
+	expiry        tokenExpiry
+	streamMeter   bool
+	streamLimits  *streamLimits
+	coalescer     *coalescer
+	streamBuffer  streambuf.Options
+	// corsOrigins are the browser origins allowed besides the server's own
+	corsOrigins []string
+
+	// stop cancels the background work, which tasks tracks until it ends
+	stop  context.CancelFunc
+	tasks sync.WaitGroup
 }
 
-func NewHandler(token string, defaultModel string, debug bool) (*Handler, error) {
+func NewHandler(token string, cfg *config.Config) (*Handler, error) {
+	httpClient, err := transport.NewClient(cfg.TransportOptions())
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.CassetteMode != "" {
+		// Innermost, so that debug captures show the replayed responses
+		recorder, err := cassette.NewTransport(cfg.CassetteDir, cfg.CassetteMode, httpClient.Transport)
+		if err != nil {
+			return nil, err
+		}
+		httpClient.Transport = recorder
+		proxyLog.Infof("[Cassette] Upstream interactions are %sed in %s", cfg.CassetteMode, cfg.CassetteDir)
+	}
+	httpClient.Transport = newCaptureTransport(httpClient.Transport)
+
+	var tracer *tracing.Tracer
+	if cfg.TracesEndpoint != "" {
+		// The exporter gets its own client so that exports are not traced
+		exportClient, err := transport.NewClient(cfg.TransportOptions())
+		if err != nil {
+			return nil, err
+		}
+		tracer = tracing.NewTracer(tracing.NewExporter(tracing.ExporterOptions{
+			Endpoint:    cfg.TracesEndpoint,
+			Headers:     cfg.TracesHeaders,
+			ServiceName: cfg.ServiceName,
+			Client:      exportClient,
+		}))
+		httpClient.Transport = tracer.Transport(httpClient.Transport)
+	}
+
 	// Validate default model using the new validation function
-	realModelID, valid := config.ValidateModel(defaultModel)
+	realModelID, valid := config.ValidateModel(cfg.Model)
 	if !valid {
-		return nil, fmt.Errorf("invalid default model: %s", defaultModel)
+		return nil, fmt.Errorf("invalid default model: %s", cfg.Model)
 	}
 
-	client, err := copilot.NewClient(token, realModelID, "")
+	client, err := copilot.NewClient(token, realModelID, cfg.CopilotBaseURL)
 	if err != nil {
 		return nil, err
 	}
-	client.SetDebug(debug)
+	client.SetHTTPClient(httpClient)
+	client.SetMachineID(cfg.MachineID)
+	client.SetSessionID(cfg.SessionID)
+	client.SetHeaderProfile(cfg.HeaderProfile)
+
+	authManager := copilot.NewAuthManager(httpClient, cfg.ConfigDir)
+	authManager.SetEndpoints(cfg.GitHubURL, cfg.GitHubAPIURL)
+	authManager.SetPersonalAccessToken(cfg.GitHubToken)
+
+	shared, err := state.Open(cfg.RedisURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var auditLogger *audit.Logger
+	if cfg.AuditDir != "" {
+		auditLogger, err = audit.NewLogger(audit.Options{
+			Dir:            cfg.AuditDir,
+			MaxSizeMB:      cfg.AuditMaxSizeMB,
+			MaxFiles:       cfg.AuditMaxFiles,
+			RedactPatterns: cfg.AuditRedactPatterns,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var filters filter.Chain
+	if cfg.FilterRulesFile != "" {
+		rules, err := filter.LoadRules(cfg.FilterRulesFile)
+		if err != nil {
+			return nil, err
+		}
+		ruleFilter, err := filter.NewRuleFilter(rules)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, ruleFilter)
+	}
+	if cfg.SystemPromptFile != "" {
+		prompts, err := filter.LoadSystemPrompts(cfg.SystemPromptFile)
+		if err != nil {
+			return nil, err
+		}
+		// Model prompts may name aliases; requests carry the real model ID
+		modelPrompts := make(map[string]filter.SystemPrompt, len(prompts.Models))
+		for name, prompt := range prompts.Models {
+			modelID, ok := config.ValidateModel(name)
+			if !ok {
+				return nil, fmt.Errorf("system prompt for unknown model: %s", name)
+			}
+			modelPrompts[modelID] = prompt
+		}
+		promptFilter, err := filter.NewSystemPromptFilter(prompts.Default, modelPrompts)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, promptFilter)
+	}
+
+	cleanups, err := newResponseCleanups(cfg.ResponseCleanupFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var hooks *hook.Script
+	if cfg.HookScript != "" {
+		hooks, err = hook.Load(cfg.HookScript, cfg.HookTimeout)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var keyStore *apikeys.Store
+	if cfg.KeysFile != "" {
+		keyStore, err = apikeys.Open(cfg.KeysFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var conversationStore *conversations.Store
+	if cfg.ResponsesDir != "" {
+		conversationStore, err = conversations.Open(cfg.ResponsesDir, cfg.ResponsesTTL)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Clients sharing the server's login, updated by the device login
+	loginClients := []*copilot.Client{client}
+	copilotProvider := upstream.Provider(upstream.NewCopilotProvider(client))
+	var balancer *upstream.Balancer
+	if len(cfg.CopilotEndpoints) > 0 {
+		endpoints := make([]upstream.Endpoint, 0, len(cfg.CopilotEndpoints))
+		for _, endpoint := range cfg.CopilotEndpoints {
+			endpointToken := token
+			if endpoint.TokenFile != "" {
+				endpointToken, err = exchangeTokenFile(authManager, endpoint.TokenFile)
+				if err != nil {
+					return nil, fmt.Errorf("copilot endpoint %s: %w", endpoint.URL, err)
+				}
+			}
+			endpointClient, err := copilot.NewClient(endpointToken, realModelID, endpoint.URL)
+			if err != nil {
+				return nil, err
+			}
+			endpointClient.SetHTTPClient(httpClient)
+			endpointClient.SetMachineID(cfg.MachineID)
+			endpointClient.SetSessionID(client.GetSessionID())
+			endpointClient.SetHeaderProfile(cfg.HeaderProfile)
+			if endpoint.TokenFile == "" {
+				loginClients = append(loginClients, endpointClient)
+			}
+			endpoints = append(endpoints, upstream.Endpoint{
+				Name:     endpoint.URL,
+				Provider: upstream.NewCopilotProvider(endpointClient),
+				Weight:   endpoint.Weight,
+			})
+		}
+		balancer, err = upstream.NewBalancer(upstream.DefaultProvider, cfg.LoadBalancing, endpoints)
+		if err != nil {
+			return nil, err
+		}
+		copilotProvider = balancer
+	}
+
+	if cfg.Mock {
+		var fixtures []upstream.MockFixture
+		if cfg.MockDir != "" {
+			fixtures, err = upstream.LoadMockFixtures(cfg.MockDir)
+			if err != nil {
+				return nil, err
+			}
+		}
+		proxyLog.Infof("[Mock] Answering completions from %d fixture(s) instead of Copilot", len(fixtures))
+		copilotProvider = upstream.NewMockProvider(fixtures)
+	}
+
+	providers := upstream.NewRegistry(copilotProvider)
+	for _, modelID := range config.GetModelList() {
+		modelInfo, _ := config.GetModelInfo(modelID)
+		if _, err := providers.Get(modelInfo.Upstream); err != nil {
+			return nil, fmt.Errorf("model %s: %w", modelID, err)
+		}
+	}
+
+	shadow, err := newShadowMirror(cfg.ShadowModel, cfg.ShadowPercent, cfg.ShadowLog, providers)
+	if err != nil {
+		return nil, err
+	}
+	transcripts, err := newTranscriptWriter(cfg.TranscriptDir, cfg.TranscriptFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	var pinTTL time.Duration
+	if cfg.StickyModel {
+		pinTTL = cfg.StickyModelTTL
+	}
+
+	limits := newUpstreamLimits()
+	login := newDeviceLogin(authManager, shared, loginClients...)
+	if !cfg.Mock {
+		login.resume()
+	}
+	h := &Handler{
+		client:        client,
+		providers:     providers,
+		balancer:      balancer,
+		defaultModel:  cfg.Model,
+		sessionHeader: cfg.SessionHeader,
+		pinTTL:        pinTTL,
+		audit:         auditLogger,
+		filters:       filters,
+		hooks:         hooks,
+		cleanups:      cleanups,
+		events:        events.NewBroker(eventHistorySize),
+		retryQueue:    newRetryQueue(cfg.RetryQueueSize, cfg.RetryMaxWait),
+		userLimiter:   newUserLimiter(shared, cfg.UserRateLimit),
+		budgets:       newBudgetLimiter(cfg.ModelBudgets),
+		costs:         cfg.ModelCosts,
+		limits:        limits,
+		breaker:       newCircuitBreaker(cfg.CircuitBreakerThreshold, cfg.CircuitBreakerCooldown),
+		shadow:        shadow,
+		toolCheck:     newToolChecker(cfg.ToolValidation),
+		transcripts:   transcripts,
+		shared:        shared,
+		keys:          keyStore,
+		inflight:      newInflightRegistry(),
+		stats:         newModelStats(),
+		login:         login,
+		reauth:        newReauthenticator(login, cfg.ReauthWait),
+		conversations: conversationStore,
+		overflow:      cfg.PromptOverflow,
+		compactor:     newCompactor(cfg, providers),
+		autoRouter:    newAutoRouter(cfg),
+		maxTokens:     cfg.DefaultMaxTokens,
+		startedAt:     time.Now(),
+		tracer:        tracer,
+		streamMeter:   cfg.StreamMeter,
+		streamLimits:  newStreamLimits(cfg.MaxStreamDuration, cfg.RouteStreamDurations),
+		coalescer:     newCoalescer(cfg.CoalesceRequests, tracer, limits),
+		streamBuffer:  streambuf.Options{Size: cfg.StreamBufferKB * 1024, Policy: cfg.StreamBufferPolicy, Stats: &streambuf.Stats{}},
+
+		corsOrigins: cfg.CORSOrigins,
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	h.stop = stop
+	if balancer != nil && cfg.UpstreamHealthInterval > 0 {
+		balancer.StartHealthChecks(ctx, cfg.UpstreamHealthInterval)
+	}
+	if cfg.WarmUp {
+		h.background(ctx, h.warmUp)
+	}
+	h.background(ctx, h.watchTokenExpiry)
+	if conversationStore != nil && conversationStore.TTL() > 0 {
+		interval := min(conversationStore.TTL(), conversationPruneInterval)
+		h.background(ctx, func(ctx context.Context) { h.pruneConversations(ctx, interval) })
+	}
+	return h, nil
+}
 
-	return &Handler{
-		client:       client,
-		defaultModel: defaultModel,
-		debug:        debug,
-	}, nil
+// background runs task in a goroutine until Close
+func (h *Handler) background(ctx context.Context, task func(ctx context.Context)) {
+	h.tasks.Add(1)
+	go func() {
+		defer h.tasks.Done()
+		task(ctx)
+	}()
 }
 
+// Close stops the background work of the handler, such as the warm-up and
+// the token expiry checks, and waits for it to end. Requests still being
+// served are not interrupted.
+func (h *Handler) Close() {
+	h.stop()
+	h.tasks.Wait()
+	h.tracer.Close()
+}
+
+// pruneConversations removes the expired responses of the conversation store
+// every interval, so that they do not pile up until the next restart
+func (h *Handler) pruneConversations(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		removed, err := h.conversations.Prune()
+		if err != nil {
+			proxyLog.Errorf("[Error] Failed to remove expired responses: %v", err)
+		} else if removed > 0 {
+			proxyLog.Debugf("[Responses] Removed %d expired responses", removed)
+		}
+	}
+}
+
+// exchangeTokenFile reads the GitHub token stored in path and exchanges it
+// for a Copilot token
+func exchangeTokenFile(authManager *copilot.AuthManager, path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read GitHub token: %w", err)
+	}
+	githubToken := strings.TrimSpace(string(data))
+	if githubToken == "" {
+		return "", fmt.Errorf("GitHub token file %s is empty", path)
+	}
+	return authManager.ExchangeToken(githubToken)
+}
+
+// sessionIDFor returns the Copilot session ID for a request. Requests carrying
+// the configured session header are grouped under a session derived from it,
+// all others share the process-wide session.
+func (h *Handler) sessionIDFor(r *http.Request) string {
+	if h.sessionHeader != "" {
+		if key := strings.TrimSpace(r.Header.Get(h.sessionHeader)); key != "" {
+			return copilot.SessionIDFromKey(key)
+		}
+	}
+	return h.client.GetSessionID()
+}
+
+// ErrorResponse is an error body in the format of the OpenAI API
 type ErrorResponse struct {
-	Message string `json:"message"`
-	Error   string `json:"error,omitempty"`
+	Error ErrorDetail `json:"error"`
 }
 
-func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if h.debug {
-		h.logRequest("Client Request", r)
+// ErrorDetail describes the error of an ErrorResponse. Param and Code are
+// null when unknown, as in the OpenAI API.
+type ErrorDetail struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Param   *string `json:"param"`
+	Code    *string `json:"code"`
+}
+
+// newErrorResponse builds an error body; an empty code is sent as null
+func newErrorResponse(message, errType, code string) ErrorResponse {
+	response := ErrorResponse{Error: ErrorDetail{Message: message, Type: errType}}
+	if code != "" {
+		response.Error.Code = &code
 	}
+	return response
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.logRequest(proxyLog, "Client Request", r)
 
 	// Normalize the path by trimming leading '/v1'
 	path := strings.TrimPrefix(r.URL.Path, "/v1")
@@ -59,6 +473,12 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Handle the WebSocket streaming transport
+	if path == "/chat/completions/ws" {
+		h.handleWebSocket(w, r)
+		return
+	}
+
 	if r.Method != http.MethodPost || path != "/chat/completions" {
 		h.sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -71,14 +491,205 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	r.Body = io.NopCloser(bytes.NewReader(body))
 
-	if h.debug {
-		h.logWithPrefix("Client Request", string(body))
+	if h.audit != nil {
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		entry := &audit.Entry{
+			Time:      time.Now(),
+			RequestID: requestIDFrom(r.Context()),
+			Caller:    callerFromRequest(r),
+			ClientIP:  clientIP(r),
+			Endpoint:  r.URL.Path,
+			Request:   string(body),
+		}
+		defer func() {
+			entry.Status = rec.status
+			entry.LatencyMs = time.Since(entry.Time).Milliseconds()
+			h.audit.Log(*entry)
+		}()
+		w = rec
+		r = r.WithContext(context.WithValue(r.Context(), auditEntryKey{}, entry))
+	}
+
+	h.logWithPrefix(proxyLog, logging.Debug, "Client Request", string(body))
+
+	call, reqErr := h.prepareCompletion(r, body)
+	if reqErr != nil {
+		h.sendRequestError(w, reqErr)
+		return
+	}
+
+	upstreamStart := time.Now()
+	responseBody, disconnect, err := h.startForClient(r, call)
+	defer disconnect(nil)
+	setModelHeaders(w, call, time.Since(upstreamStart))
+	if entry := auditEntryFrom(r); entry != nil {
+		entry.Model = call.model
+		entry.Stream = call.request.Stream
+		if err != nil {
+			entry.Error = err.Error()
+		}
+	}
+
+	if err != nil {
+		h.logWithPrefix(proxyLog, logging.Debug, "Error", fmt.Sprintf("Completion failed: %v", err))
+		h.sendUpstreamError(w, err)
+		return
+	}
+	defer responseBody.Close()
+
+	// Set appropriate headers for the response
+	ndjson := call.request.Stream && wantsNDJSON(r)
+	if call.request.Stream {
+		contentType := "text/event-stream"
+		if ndjson {
+			contentType = ndjsonContentType
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+
+	rw := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK, flush: call.request.Stream}
+	var buf bytes.Buffer
+	reader := io.TeeReader(responseBody, &buf)
+	if ndjson {
+		reader = newNDJSONStream(reader)
+	}
+	_, err = io.Copy(rw, reader)
+	// The meter is an SSE comment, which NDJSON has no room for
+	if err == nil && call.request.Stream && !ndjson && h.wantsStreamMeter(r) {
+		writeStreamMeter(rw, call)
+	}
+	if rw.writeErr != nil {
+		disconnect(errClientDisconnected)
+	}
+	if entry := auditEntryFrom(r); entry != nil {
+		summarizeResponse(entry, buf.Bytes(), call.request.Stream)
+		if err != nil {
+			entry.Error = err.Error()
+		}
+	}
+	if err != nil {
+		h.logWithPrefix(proxyLog, logging.Debug, "Error", fmt.Sprintf("Error copying response: %v", err))
+		return
+	}
+
+	h.logResponse(proxyLog, "Client Response", rw, buf.String())
+}
+
+// requestError is a client error detected while preparing a completion
+type requestError struct {
+	status     int
+	message    string
+	code       string
+	retryAfter time.Duration
+	headers    http.Header
+}
+
+// writeHeaders sets the response headers that accompany the error
+func (e *requestError) writeHeaders(w http.ResponseWriter) {
+	for name, values := range e.headers {
+		w.Header()[name] = values
+	}
+	if e.retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(e.retryAfter.Seconds()))))
+	}
+}
+
+// completionCall is a validated completion request ready to be sent upstream
+type completionCall struct {
+	provider  upstream.Provider
+	request   copilot.CompletionRequest
+	model     string
+	requested string
+	route     string
+	sessionID string
+	caller    string
+	// keyName is the named API key the call is made with, charged its spend
+	keyName string
+	// profile is the Copilot header profile the call is sent with, empty for
+	// the client's
+	profile string
+	// budget is held while the call counts against its model's budget
+	budget       *budgetLease
+	promptTokens int
+	// maxTokens caps max_tokens for the caller's API key; 0 for no cap
+	maxTokens int
+	// rateLimit is the rate limit state of the latest upstream response
+	rateLimit atomic.Pointer[copilot.RateLimit]
+	// hookInfo describes the call to the hook script, with the tags it set
+	hookInfo *hook.Info
+	// coalesced is set when an identical request's upstream call served it
+	coalesced bool
+	// maxDuration is how long the stream may run; 0 for no limit
+	maxDuration time.Duration
+	// speed is the speed of a streamed completion, set once fully relayed
+	speed atomic.Pointer[completionSample]
+	// priority orders the call in the retry queue, set by its service tier
+	priority priority
+}
+
+// Response headers reporting how a completion was served
+const (
+	headerRequestedModel  = "X-Ghcsd-Requested-Model"
+	headerServedModel     = "X-Ghcsd-Served-Model"
+	headerUpstream        = "X-Ghcsd-Upstream"
+	headerUpstreamLatency = "X-Ghcsd-Upstream-Latency-Ms"
+	headerAutoRoute       = "X-Ghcsd-Auto-Route"
+)
+
+// headerProfileHeader selects the Copilot header profile of a request
+const headerProfileHeader = "X-Ghcsd-Header-Profile"
+
+// setModelHeaders reports the model a completion was requested with, the
+// model and upstream that served it and how long the upstream took to
+// answer, until the first byte for streams. Requests to the auto model also
+// report the rule that chose the served model.
+func setModelHeaders(w http.ResponseWriter, call *completionCall, latency time.Duration) {
+	w.Header().Set(headerRequestedModel, call.requested)
+	w.Header().Set(headerServedModel, call.model)
+	if call.route != "" {
+		w.Header().Set(headerAutoRoute, call.route)
 	}
+	w.Header().Set(headerUpstream, call.provider.Name())
+	w.Header().Set(headerUpstreamLatency, strconv.FormatInt(latency.Milliseconds(), 10))
+	setRateLimitHeaders(w, call.rateLimit.Load())
+}
 
+// prepareCompletion parses and validates an OpenAI chat completion request
+// body and builds the Copilot client and request that will serve it
+func (h *Handler) prepareCompletion(r *http.Request, body []byte) (*completionCall, *requestError) {
 	var req copilot.CompletionRequest
 	if err := json.Unmarshal(body, &req); err != nil {
-		h.sendError(w, "Invalid request body", http.StatusBadRequest)
-		return
+		return nil, &requestError{status: http.StatusBadRequest, message: "Invalid request body"}
+	}
+	return h.buildCompletion(r, req)
+}
+
+// buildCompletion validates a parsed completion request, resolves its model
+// and upstream provider and builds the request sent upstream
+func (h *Handler) buildCompletion(r *http.Request, req copilot.CompletionRequest) (*completionCall, *requestError) {
+	_, span := h.tracer.Start(r.Context(), "build completion request", tracing.KindInternal)
+	defer span.End()
+	call, reqErr := h.buildCompletionCall(r, req)
+	if reqErr != nil {
+		span.SetAttribute("http.response.status_code", reqErr.status)
+		span.SetError(errors.New(reqErr.message))
+		return nil, reqErr
+	}
+	span.SetAttribute("gen_ai.request.model", call.model)
+	span.SetAttribute("ghcsd.upstream", call.provider.Name())
+	return call, nil
+}
+
+// buildCompletionCall does the work of buildCompletion
+func (h *Handler) buildCompletionCall(r *http.Request, req copilot.CompletionRequest) (*completionCall, *requestError) {
+	// The hook runs first, so that what it changes is validated like the rest
+	hookInfo, reqErr := h.runRequestHook(r, &req)
+	if reqErr != nil {
+		return nil, reqErr
 	}
 
 	// Validate and use requested model if provided, otherwise use default
@@ -86,71 +697,453 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if req.Model != "" {
 		modelToUse = req.Model
 	}
+	requested := modelToUse
+	var route string
+	if h.autoRouter != nil && strings.EqualFold(modelToUse, autoModel) {
+		modelToUse, route = h.autoRouter.route(req)
+		proxyLog.Infof("[Routing] Routed %s to %s by rule %s for %s", requested, modelToUse, route, callerFromRequest(r))
+	}
 
-	// Get the real model ID using our new validation function
-	realModelID, valid := config.ValidateModel(modelToUse)
+	// Resolve the real model ID and the upstream serving it
+	modelInfo, valid := config.GetModelInfo(modelToUse)
 	if !valid {
-		h.sendError(w, fmt.Sprintf("Invalid model requested: %s", modelToUse), http.StatusBadRequest)
-		return
+		return nil, &requestError{status: http.StatusBadRequest, message: fmt.Sprintf("Invalid model requested: %s", modelToUse), code: "model_not_found"}
 	}
+	dryRun := isDryRun(r.Context())
+	// Pinning would record the model of the session
+	if !dryRun {
+		if pinned := h.pinModel(r, modelInfo); pinned.RealID != modelInfo.RealID {
+			modelInfo, modelToUse = pinned, pinned.ID
+		}
+	}
+	realModelID := modelInfo.RealID
 
-	// Create a new client instance with the selected model
-	client, err := copilot.NewClient(h.client.GetToken(), realModelID, "")
+	key := apiKeyFrom(r)
+	if key != nil && !key.AllowsModel(modelToUse, realModelID) {
+		return nil, &requestError{status: http.StatusForbidden, message: fmt.Sprintf("API key %s is not allowed to use model %s", key.Name, modelToUse)}
+	}
+	if reqErr := h.checkSpend(r.Context(), key); reqErr != nil {
+		return nil, reqErr
+	}
+
+	provider, err := h.providers.Get(modelInfo.Upstream)
 	if err != nil {
-		h.sendError(w, "Failed to create client", http.StatusInternalServerError)
-		return
+		return nil, &requestError{status: http.StatusInternalServerError, message: err.Error()}
+	}
+	if !dryRun && provider.Name() == upstream.DefaultProvider && h.client.GetToken() == "" {
+		return nil, &requestError{status: http.StatusServiceUnavailable, message: "Not logged in to GitHub Copilot; complete the device login started with POST /auth/device"}
 	}
-	client.SetDebug(h.debug)
 
-	var responseBody io.ReadCloser
-	if req.Stream {
-		responseBody, err = client.CompleteStream(r.Context(), req.Messages)
-	} else {
-		var resp *copilot.CompletionResponse
-		resp, err = client.Complete(r.Context(), req.Messages)
-		if err == nil {
-			respBytes, err := json.Marshal(resp)
-			if err == nil {
-				responseBody = io.NopCloser(bytes.NewReader(respBytes))
+	profile := modelInfo.HeaderProfile
+	if requested := r.Header.Get(headerProfileHeader); requested != "" {
+		if _, ok := copilot.LookupHeaderProfile(requested); !ok {
+			return nil, &requestError{
+				status:  http.StatusBadRequest,
+				message: fmt.Sprintf("Unknown %s %q, expected one of %s", headerProfileHeader, requested, strings.Join(copilot.HeaderProfileNames(), ", ")),
 			}
 		}
+		profile = requested
+	}
+
+	if req.N < 0 || req.N > maxChoices {
+		return nil, &requestError{status: http.StatusBadRequest, message: fmt.Sprintf("n must be between 1 and %d", maxChoices)}
 	}
 
+	if err := req.ValidateSampling(); err != nil {
+		return nil, &requestError{status: http.StatusBadRequest, message: err.Error()}
+	}
+	class, err := parseServiceTier(req.ServiceTier)
 	if err != nil {
-		if h.debug {
-			h.logWithPrefix("Error", fmt.Sprintf("Completion failed: %v", err))
+		return nil, &requestError{status: http.StatusBadRequest, message: err.Error()}
+	}
+	if req.ResponseFormat != nil {
+		if err := req.ResponseFormat.Validate(); err != nil {
+			return nil, &requestError{status: http.StatusBadRequest, message: err.Error()}
+		}
+	}
+
+	upstreamReq := copilot.NewCompletionRequest(realModelID)
+	if req.N > 0 {
+		upstreamReq.N = req.N
+	}
+	upstreamReq.Stream = req.Stream
+	upstreamReq.Temperature = req.Temperature
+	if req.TopP > 0 {
+		upstreamReq.TopP = req.TopP
+	}
+	upstreamReq.MaxTokens = h.maxTokens
+	if req.MaxTokens > 0 {
+		upstreamReq.MaxTokens = req.MaxTokens
+	}
+	// Copilot rejects max_tokens above the model's output limit
+	if limit := modelInfo.MaxOutputTokens; limit > 0 && upstreamReq.MaxTokens > limit {
+		if req.MaxTokens > limit {
+			proxyLog.Warnf("[Warning] Clamping max_tokens=%d to %d, the output limit of model %s", req.MaxTokens, limit, realModelID)
+		}
+		upstreamReq.MaxTokens = limit
+	}
+	upstreamReq.PresencePenalty = req.PresencePenalty
+	upstreamReq.FrequencyPenalty = req.FrequencyPenalty
+	upstreamReq.LogitBias = req.LogitBias
+	if req.Logprobs && !modelInfo.SupportsLogprobs() {
+		return nil, &requestError{status: http.StatusBadRequest, message: fmt.Sprintf("logprobs is not supported by model %s", realModelID), code: "unsupported_parameter"}
+	}
+	upstreamReq.Logprobs = req.Logprobs
+	upstreamReq.TopLogprobs = req.TopLogprobs
+	upstreamReq.Seed = req.Seed
+	if req.TopK != nil {
+		proxyLog.Warnf("[Warning] Dropping top_k=%d for model %s: not supported by the Copilot API", *req.TopK, realModelID)
+	}
+	upstreamReq.Messages = req.Messages
+	if err := upstreamReq.NormalizeRoles(); err != nil {
+		return nil, &requestError{status: http.StatusBadRequest, message: err.Error()}
+	}
+	upstreamReq.MoveToolImages(modelInfo.Vision)
+	upstreamReq.NormalizeContent(modelInfo.Vision)
+	upstreamReq.Stop = req.Stop
+	upstreamReq.Tools = req.Tools
+	upstreamReq.ToolChoice = req.ToolChoice
+	upstreamReq.ParallelToolCalls = req.ParallelToolCalls
+	upstreamReq.User = req.User
+	upstreamReq.ApplyToolChoice()
+
+	// The dry run does not count against the limit of the user
+	if !dryRun {
+		if ok, wait := h.userLimiter.allow(r.Context(), req.User); !ok {
+			return nil, &requestError{
+				status:     http.StatusTooManyRequests,
+				message:    fmt.Sprintf("Rate limit exceeded for user %s", req.User),
+				code:       "rate_limit_exceeded",
+				retryAfter: wait,
+			}
+		}
+	}
+	if entry := auditEntryFrom(r); entry != nil {
+		entry.EndUser = req.User
+	}
+
+	if reqErr := h.applyFilters(r, &upstreamReq); reqErr != nil {
+		return nil, reqErr
+	}
+	// Applied after the filters so that a JSON instruction follows any
+	// operator system prompt
+	upstreamReq.ResponseFormat = req.ResponseFormat
+	upstreamReq.ApplyResponseFormat(modelInfo.SupportsResponseFormat())
+
+	overflow := h.overflow
+	if key != nil && key.PromptOverflow != "" {
+		overflow = key.PromptOverflow
+	}
+	if overflow == config.OverflowCompact && dryRun {
+		// Compacting calls the summary model upstream
+		overflow = config.OverflowTruncate
+	}
+	if overflow == config.OverflowCompact {
+		// Truncation remains the fallback when the summary is not enough
+		overflow = config.OverflowTruncate
+		compacted, tokens, err := h.compactor.compact(r.Context(), &upstreamReq, modelInfo)
+		if err != nil {
+			proxyLog.Warnf("[Warning] Compacting the prompt for %s failed, truncating instead: %v", callerFromRequest(r), err)
+		} else if compacted > 0 {
+			proxyLog.Infof("[Context] Compacted %d oldest messages into a summary by %s for %s", compacted, h.compactor.model, callerFromRequest(r))
+			compactModel, _ := config.GetModelInfo(h.compactor.model)
+			h.recordTokens(compactModel.RealID, tokens)
+		}
+	}
+	dropped, reqErr := fitContextWindow(&upstreamReq, modelInfo, overflow)
+	if reqErr != nil {
+		return nil, reqErr
+	}
+	if dropped > 0 {
+		proxyLog.Infof("[Context] Dropped %d oldest messages to fit the %s context window for %s", dropped, realModelID, callerFromRequest(r))
+	}
+
+	promptTokens := upstream.EstimateTokens(upstreamReq)
+	var budget *budgetLease
+	if !dryRun {
+		// The dry run is never sent, so it leaves the circuit breaker and
+		// the budgets alone
+		if reqErr := h.breaker.allow(realModelID); reqErr != nil {
+			return nil, reqErr
+		}
+
+		var exceeded *budgetExceeded
+		budget, exceeded = h.budgets.acquire(realModelID, promptTokens)
+		if exceeded != nil {
+			return nil, exceeded.requestError()
+		}
+
+		h.events.Publish(events.Event{
+			Type:      events.TypeModelMapped,
+			RequestID: requestIDFrom(r.Context()),
+			Fields: map[string]interface{}{
+				"requested": requested,
+				"model":     realModelID,
+				"upstream":  provider.Name(),
+				"user":      upstreamReq.User,
+				"stream":    upstreamReq.Stream,
+			},
+		})
+	}
+
+	call := &completionCall{
+		provider:     provider,
+		request:      upstreamReq,
+		model:        realModelID,
+		requested:    requested,
+		route:        route,
+		sessionID:    h.sessionIDFor(r),
+		caller:       callerFromRequest(r),
+		profile:      profile,
+		budget:       budget,
+		promptTokens: promptTokens,
+		hookInfo:     hookInfo,
+		priority:     class,
+	}
+	if upstreamReq.Stream {
+		call.maxDuration = h.streamLimits.limit(r.URL.Path)
+	}
+	if hookInfo != nil {
+		hookInfo.Model = realModelID
+	}
+	if key != nil {
+		call.keyName = key.Name
+		call.maxTokens = key.MaxTokens
+	}
+	return call, nil
+}
+
+// AddFilter appends a filter to the stage run on every outgoing request
+func (h *Handler) AddFilter(f filter.Filter) {
+	h.filters = append(h.filters, f)
+}
+
+// applyFilters runs the content filters over an outgoing request, logging
+// and auditing every triggered rule. It returns an error if a rule blocks it.
+func (h *Handler) applyFilters(r *http.Request, req *copilot.CompletionRequest) *requestError {
+	if len(h.filters) == 0 {
+		return nil
+	}
+	result := h.filters.Apply(req)
+	for _, trigger := range result.Triggers {
+		proxyLog.Infof("[Filter] Rule %s (%s) matched %d time(s) for %s", trigger.Rule, trigger.Action, trigger.Matches, callerFromRequest(r))
+		if entry := auditEntryFrom(r); entry != nil {
+			entry.FilterTriggers = append(entry.FilterTriggers, fmt.Sprintf("%s:%s", trigger.Rule, trigger.Action))
 		}
-		h.sendError(w, err.Error(), http.StatusInternalServerError)
+	}
+	if result.Blocked() {
+		return &requestError{status: http.StatusBadRequest, message: fmt.Sprintf("Request blocked by content policy rule: %s", result.BlockedBy), code: "content_policy_violation"}
+	}
+	return nil
+}
+
+// recordTokens adds the tokens a completion used to the usage of its model,
+// in the background so that a slow state store does not delay the response
+func (h *Handler) recordTokens(model string, tokens int) {
+	if tokens <= 0 {
 		return
 	}
-	defer responseBody.Close()
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), stateTimeout)
+		defer cancel()
+		if err := h.shared.AddTokens(ctx, model, int64(tokens)); err != nil {
+			proxyLog.Errorf("[State] Failed to record the token usage of %s: %v", model, err)
+		}
+	}()
+}
 
-	// Set appropriate headers for the response
-	if req.Stream {
-		w.Header().Set("Content-Type", "text/event-stream")
-		w.Header().Set("Cache-Control", "no-cache")
-		w.Header().Set("Connection", "keep-alive")
-	} else {
-		w.Header().Set("Content-Type", "application/json")
+// tokenUsage returns the tokens used per model, shared by all replicas when
+// the state is kept in Redis
+func (h *Handler) tokenUsage() map[string]int64 {
+	ctx, cancel := context.WithTimeout(context.Background(), stateTimeout)
+	defer cancel()
+	tokens, err := h.shared.Tokens(ctx)
+	if err != nil {
+		proxyLog.Errorf("[State] Failed to read the token usage: %v", err)
 	}
+	return tokens
+}
 
-	rw := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
-	var buf bytes.Buffer
-	reader := io.TeeReader(responseBody, &buf)
-	_, err = io.Copy(rw, reader)
+// startForClient starts the completion of call for the client of r. The
+// returned disconnect aborts the upstream request once writing to the client
+// fails, and must be called when the response is done.
+func (h *Handler) startForClient(r *http.Request, call *completionCall) (io.ReadCloser, context.CancelCauseFunc, error) {
+	ctx, disconnect := context.WithCancelCause(r.Context())
+	body, err := h.startCompletion(ctx, call)
+	return body, disconnect, err
+}
+
+// startCompletion sends the call upstream, retrying through the retry queue,
+// and returns the body to relay to the client: an SSE stream for streaming
+// requests and a JSON completion otherwise. The call is listed as in flight,
+// and holds its budget lease, until the completion is done.
+func (h *Handler) startCompletion(ctx context.Context, call *completionCall) (io.ReadCloser, error) {
+	// The hooks outlive the registration of the call, which ends before a
+	// non-streamed response is returned
+	hookCtx := ctx
+	ctx = copilot.WithSessionID(ctx, call.sessionID)
+	ctx = copilot.WithRateLimitObserver(ctx, func(limit copilot.RateLimit) {
+		h.limits.observe(limit)
+		call.rateLimit.Store(&limit)
+	})
+	if call.profile != "" {
+		ctx = copilot.WithHeaderProfile(ctx, call.profile)
+	}
+	if call.maxTokens > 0 && call.request.MaxTokens > call.maxTokens {
+		call.request.MaxTokens = call.maxTokens
+	}
+	shadow := h.shadow.start(ctx, call)
+	start := time.Now()
+	ctx, inflight, done := h.inflight.add(ctx, call)
+	requestCtx := ctx
+	ctx, span := h.tracer.Start(ctx, "upstream completion", tracing.KindInternal)
+	span.SetAttribute("gen_ai.request.model", call.model)
+	span.SetAttribute("ghcsd.upstream", call.provider.Name())
+	span.SetAttribute("ghcsd.stream", call.request.Stream)
+	// Cancels the upstream request of a stream running longer than allowed
+	expire := context.CancelCauseFunc(func(error) {})
+	if call.maxDuration > 0 {
+		ctx, expire = context.WithCancelCause(ctx)
+	}
+
+	var responseBody io.ReadCloser
+	var primary *copilot.CompletionResponse
+	token := h.client.GetToken()
+	attempt := func() error {
+		if call.request.Stream {
+			var streamErr error
+			responseBody, streamErr = call.provider.CompleteStream(ctx, call.request)
+			return streamErr
+		}
+		resp, shared, completeErr := h.coalescer.complete(ctx, call)
+		if completeErr != nil {
+			return completeErr
+		}
+		call.coalesced = shared
+		h.cleanups.clean(call.model, resp)
+		if shared {
+			call.budget.release(0)
+		} else if resp.Usage.TotalTokens > 0 {
+			call.budget.release(resp.Usage.TotalTokens)
+		}
+		respBytes, marshalErr := json.Marshal(h.toolCheck.checkCompletion(ctx, call, resp))
+		if marshalErr != nil {
+			return marshalErr
+		}
+		primary = resp
+		responseBody = io.NopCloser(bytes.NewReader(respBytes))
+		return nil
+	}
+	err := h.retryQueue.Do(ctx, call.priority, attempt)
+	if isUnauthorized(err) && call.provider.Name() == upstream.DefaultProvider {
+		// Retried once the login's token is renewed
+		if err = h.reauth.recover(ctx, token); err == nil {
+			err = h.retryQueue.Do(ctx, call.priority, attempt)
+		}
+	}
 	if err != nil {
-		if h.debug {
-			h.logWithPrefix("Error", fmt.Sprintf("Error copying response: %v", err))
+		if cause := context.Cause(ctx); errors.Is(cause, errCancelledByAdmin) {
+			err = cause
 		}
-		return
+		h.breaker.record(call.model, err)
+		// Cancelled requests are not failures of the model
+		if context.Cause(ctx) == nil {
+			h.stats.record(call.model, completionSample{failed: true})
+		}
+		shadow.complete(false, nil, time.Since(start), err)
+		span.SetError(err)
+		span.End()
+		expire(nil)
+		done()
+		call.budget.release(0)
+		h.events.Publish(events.Event{
+			Type:      events.TypeError,
+			RequestID: requestIDFrom(ctx),
+			Fields: map[string]interface{}{
+				"model": call.model,
+				"error": err.Error(),
+			},
+		})
+		return nil, err
 	}
 
-	if h.debug {
-		h.logResponse("Client Response", rw, buf.String())
+	h.breaker.record(call.model, nil)
+	span.End()
+	if !call.request.Stream {
+		expire(nil)
+		done()
+		call.budget.release(call.promptTokens)
+		shadow.complete(false, primary, time.Since(start), nil)
+		if primary != nil {
+			h.transcripts.write(requestIDFrom(requestCtx), call, primary)
+		}
+		// A coalesced completion was served, and accounted for, by the
+		// identical request it waited for
+		if primary != nil && !call.coalesced {
+			// The first token arrives with the whole response
+			h.stats.record(call.model, completionSample{
+				ttft:             time.Since(start),
+				completionTokens: primary.Usage.CompletionTokens,
+				generation:       time.Since(start),
+			})
+			total := primary.Usage.TotalTokens
+			if total == 0 {
+				total = call.promptTokens
+			}
+			h.recordTokens(call.model, total)
+			prompt := primary.Usage.PromptTokens
+			if primary.Usage.TotalTokens == 0 {
+				prompt = call.promptTokens
+			}
+			h.recordSpend(call, prompt, primary.Usage.CompletionTokens)
+		}
+		return h.hookResponse(hookCtx, call, responseBody)
+	}
+	_, relaySpan := h.tracer.Start(requestCtx, "relay stream", tracing.KindInternal)
+	// Streams stay registered, and hold their budget, until fully relayed
+	var firstToken time.Time
+	stream := &countingStream{
+		ReadCloser:   h.toolCheck.checkStream(h.cleanups.stream(call.model, h.bufferStream(call, h.limitStream(ctx, call, responseBody, expire))), call),
+		promptTokens: call.promptTokens,
+		onChunk: func(completionTokens int) {
+			inflight.tokensStreamed.Store(int64(completionTokens))
+			if firstToken.IsZero() {
+				firstToken = time.Now()
+			}
+		},
 	}
+	if shadow != nil || h.transcripts != nil {
+		stream.transcript = &strings.Builder{}
+	}
+	stream.onFinish = func(totalTokens int) {
+		expire(nil)
+		done()
+		call.budget.release(totalTokens)
+		h.recordTokens(call.model, totalTokens)
+		h.recordSpend(call, totalTokens-stream.completionTokens(), stream.completionTokens())
+		sample := completionSample{completionTokens: stream.completionTokens()}
+		if !firstToken.IsZero() {
+			sample.ttft = firstToken.Sub(start)
+			sample.generation = time.Since(firstToken)
+		}
+		h.stats.record(call.model, sample)
+		call.speed.Store(&sample)
+		relaySpan.SetAttribute("gen_ai.usage.total_tokens", totalTokens)
+		relaySpan.End()
+		resp := stream.response()
+		shadow.complete(false, resp, time.Since(start), nil)
+		h.transcripts.write(requestIDFrom(requestCtx), call, resp)
+	}
+	return h.hookStream(hookCtx, call, stream), nil
 }
 
+// handleHealth reports that the server is up. With ?deep=1 it runs the
+// readiness checks instead.
 func (h *Handler) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if deep, _ := strconv.ParseBool(r.URL.Query().Get("deep")); deep {
+		h.handleReady(w, r)
+		return
+	}
 	response := struct {
 		Status  string `json:"status"`
 		Message string `json:"message"`
@@ -164,20 +1157,34 @@ func (h *Handler) handleHealth(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Handler) sendError(w http.ResponseWriter, message string, status int) {
-	if h.debug {
-		h.logWithPrefix("Error", fmt.Sprintf("%d: %s", status, message))
-	}
-	response := ErrorResponse{
-		Message: message,
+	h.logWithPrefix(proxyLog, logging.Debug, "Error", fmt.Sprintf("%d: %s", status, message))
+	writeAPIError(w, message, errorType(status), "", status)
+}
+
+// sendRequestError writes a request error with its headers and code
+func (h *Handler) sendRequestError(w http.ResponseWriter, reqErr *requestError) {
+	h.logWithPrefix(proxyLog, logging.Debug, "Error", fmt.Sprintf("%d: %s", reqErr.status, reqErr.message))
+	reqErr.writeHeaders(w)
+	writeAPIError(w, reqErr.message, errorType(reqErr.status), reqErr.code, reqErr.status)
+}
+
+// sendUpstreamError translates a Copilot client error into an OpenAI-style error response
+func (h *Handler) sendUpstreamError(w http.ResponseWriter, err error) {
+	translated := translateError(err)
+	h.logWithPrefix(proxyLog, logging.Debug, "Error", fmt.Sprintf("%d %s: %s", translated.Status, translated.Type, translated.Message))
+	if translated.RetryAfter != "" {
+		w.Header().Set("Retry-After", translated.RetryAfter)
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	json.NewEncoder(w).Encode(response)
+	writeAPIError(w, translated.Message, translated.Type, translated.Code, translated.Status)
 }
 
 type responseWriter struct {
 	http.ResponseWriter
 	statusCode int
+	// flush sends every write to the client at once, as streams require
+	flush bool
+	// writeErr is the first error writing to the client
+	writeErr error
 }
 
 func (rw *responseWriter) WriteHeader(code int) {
@@ -185,22 +1192,40 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.ResponseWriter.WriteHeader(code)
 }
 
-func (h *Handler) logRequest(prefix string, r *http.Request) {
-	if !h.debug {
+func (rw *responseWriter) Write(p []byte) (int, error) {
+	n, err := rw.ResponseWriter.Write(p)
+	if err == nil && rw.flush {
+		if flushErr := http.NewResponseController(rw.ResponseWriter).Flush(); !errors.Is(flushErr, http.ErrNotSupported) {
+			err = flushErr
+		}
+	}
+	if err != nil && rw.writeErr == nil {
+		rw.writeErr = err
+	}
+	return n, err
+}
+
+// logRequest logs the method and URL of r at debug level and its headers
+// at trace level
+func (h *Handler) logRequest(logger logging.Logger, prefix string, r *http.Request) {
+	if !logger.Enabled(logging.Debug) {
 		return
 	}
-	h.logWithPrefix(prefix, fmt.Sprintf("Method: %s", r.Method))
-	h.logWithPrefix(prefix, fmt.Sprintf("URL: %s", r.URL.String()))
-	h.logWithPrefix(prefix, "Headers:")
+	h.logWithPrefix(logger, logging.Debug, prefix, fmt.Sprintf("Method: %s", r.Method))
+	h.logWithPrefix(logger, logging.Debug, prefix, fmt.Sprintf("URL: %s", r.URL.String()))
+	if !logger.Enabled(logging.Trace) {
+		return
+	}
+	h.logWithPrefix(logger, logging.Trace, prefix, "Headers:")
 	for name, values := range r.Header {
 		for _, value := range values {
-			h.logWithPrefix(prefix, fmt.Sprintf("  %s: %s", name, value))
+			h.logWithPrefix(logger, logging.Trace, prefix, fmt.Sprintf("  %s: %s", name, value))
 		}
 	}
 }
 
-func (h *Handler) logWithPrefix(prefix, message string) {
-	if !h.debug {
+func (h *Handler) logWithPrefix(logger logging.Logger, level logging.Level, prefix, message string) {
+	if !logger.Enabled(level) {
 		return
 	}
 	// Mask bearer tokens in the message
@@ -215,17 +1240,21 @@ func (h *Handler) logWithPrefix(prefix, message string) {
 			}
 		}
 	}
-	log.Printf("[%s] %s\n", prefix, maskedMessage)
+	logger.Logf(level, "[%s] %s\n", prefix, maskedMessage)
 }
 
-func (h *Handler) logResponse(prefix string, w *responseWriter, body string) {
-	h.logWithPrefix(prefix, fmt.Sprintf("Status: %d %s", w.statusCode, http.StatusText(w.statusCode)))
-	h.logWithPrefix(prefix, "Headers:")
-	for name, values := range w.Header() {
-		for _, value := range values {
-			h.logWithPrefix(prefix, fmt.Sprintf("  %s: %s", name, value))
+// logResponse logs the status and body of a response at debug level and
+// its headers at trace level
+func (h *Handler) logResponse(logger logging.Logger, prefix string, w *responseWriter, body string) {
+	h.logWithPrefix(logger, logging.Debug, prefix, fmt.Sprintf("Status: %d %s", w.statusCode, http.StatusText(w.statusCode)))
+	if logger.Enabled(logging.Trace) {
+		h.logWithPrefix(logger, logging.Trace, prefix, "Headers:")
+		for name, values := range w.Header() {
+			for _, value := range values {
+				h.logWithPrefix(logger, logging.Trace, prefix, fmt.Sprintf("  %s: %s", name, value))
+			}
 		}
 	}
-	h.logWithPrefix(prefix, "Body:")
-	h.logWithPrefix(prefix, body)
+	h.logWithPrefix(logger, logging.Debug, prefix, "Body:")
+	h.logWithPrefix(logger, logging.Debug, prefix, body)
 }
@@ -0,0 +1,117 @@
+// internal/proxy/health.go
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/acazau/ghcsd/pkg/copilot"
+	"github.com/acazau/ghcsd/pkg/upstream"
+)
+
+const (
+	// readinessTimeout bounds the upstream call made by a deep health check
+	readinessTimeout = 5 * time.Second
+	// readinessCacheTTL is how long a deep health result is reused, so that
+	// frequent probes do not each call upstream
+	readinessCacheTTL = 10 * time.Second
+)
+
+// healthCheck is the result of a single deep health check
+type healthCheck struct {
+	Status           string     `json:"status"`
+	Error            string     `json:"error,omitempty"`
+	ExpiresAt        *time.Time `json:"expires_at,omitempty"`
+	ExpiresInSeconds *int64     `json:"expires_in_seconds,omitempty"`
+	LatencyMs        *int64     `json:"latency_ms,omitempty"`
+}
+
+// readinessReport is the response of a deep health check
+type readinessReport struct {
+	Status        string                 `json:"status"`
+	Message       string                 `json:"message"`
+	UptimeSeconds int64                  `json:"uptime_seconds"`
+	Checks        map[string]healthCheck `json:"checks"`
+}
+
+// readinessCache holds the last upstream reachability result
+type readinessCache struct {
+	mu      sync.Mutex
+	checked time.Time
+	result  healthCheck
+}
+
+// handleReady serves GET /healthz/ready and deep /health checks. It verifies
+// that the Copilot token has not expired and that the Copilot API accepts
+// it, answering 503 when either fails.
+func (h *Handler) handleReady(w http.ResponseWriter, r *http.Request) {
+	report := readinessReport{
+		Status:        "ok",
+		Message:       "Service is ready",
+		UptimeSeconds: int64(time.Since(h.startedAt).Seconds()),
+		Checks: map[string]healthCheck{
+			"token":    h.checkToken(),
+			"upstream": h.checkUpstream(r.Context()),
+		},
+	}
+
+	status := http.StatusOK
+	for _, check := range report.Checks {
+		if check.Status != "ok" {
+			report.Status = "unavailable"
+			report.Message = "Service is not ready"
+			status = http.StatusServiceUnavailable
+		}
+	}
+	writeJSON(w, status, report)
+}
+
+// checkToken reports the expiry of the Copilot token
+func (h *Handler) checkToken() healthCheck {
+	token := h.client.GetToken()
+	if token == "" {
+		return healthCheck{Status: "missing", Error: "Not logged in; complete the device login at /auth/device"}
+	}
+	expiresAt, ok := copilot.TokenExpiry(token)
+	if !ok {
+		// Tokens without an expiry are validated by the upstream check
+		return healthCheck{Status: "ok"}
+	}
+	expiresIn := int64(time.Until(expiresAt).Seconds())
+	check := healthCheck{Status: "ok", ExpiresAt: &expiresAt, ExpiresInSeconds: &expiresIn}
+	if expiresIn <= 0 {
+		check.Status = "expired"
+		check.Error = "Copilot token has expired"
+	}
+	return check
+}
+
+// checkUpstream verifies that the Copilot API is reachable and accepts the
+// token by listing the models of the default provider, reusing a recent result
+func (h *Handler) checkUpstream(ctx context.Context) healthCheck {
+	h.readiness.mu.Lock()
+	defer h.readiness.mu.Unlock()
+	if time.Since(h.readiness.checked) < readinessCacheTTL {
+		return h.readiness.result
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, readinessTimeout)
+	defer cancel()
+	start := time.Now()
+	provider, err := h.providers.Get(upstream.DefaultProvider)
+	if err == nil {
+		_, err = provider.ListModels(ctx)
+	}
+	latency := time.Since(start).Milliseconds()
+
+	result := healthCheck{Status: "ok", LatencyMs: &latency}
+	if err != nil {
+		result.Status = "unreachable"
+		result.Error = err.Error()
+	}
+	h.readiness.checked = time.Now()
+	h.readiness.result = result
+	return result
+}
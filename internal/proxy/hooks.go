@@ -0,0 +1,93 @@
+// internal/proxy/hooks.go
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/acazau/ghcsd/internal/hook"
+	"github.com/acazau/ghcsd/pkg/copilot"
+)
+
+// runRequestHook runs the on_request function of the hook script on a
+// client request, before it is validated, and returns the info passed to
+// the response hooks of the call
+func (h *Handler) runRequestHook(r *http.Request, req *copilot.CompletionRequest) (*hook.Info, *requestError) {
+	if h.hooks == nil {
+		return nil, nil
+	}
+	info := &hook.Info{
+		RequestID: requestIDFrom(r.Context()),
+		Endpoint:  r.URL.Path,
+		Model:     req.Model,
+		User:      req.User,
+		Caller:    callerFromRequest(r),
+	}
+	if key := apiKeyFrom(r); key != nil {
+		info.APIKey = key.Name
+	}
+	if err := h.hooks.Request(r.Context(), req, info); err != nil {
+		var rejection *hook.Rejection
+		if errors.As(err, &rejection) {
+			proxyLog.Infof("[Hook] Request rejected for %s: %s", info.Caller, rejection.Message)
+			return nil, &requestError{status: http.StatusForbidden, message: rejection.Message, code: "rejected_by_policy"}
+		}
+		proxyLog.Warnf("[Hook] Request hook failed for %s: %v", info.Caller, err)
+		return nil, &requestError{status: http.StatusInternalServerError, message: fmt.Sprintf("Request hook failed: %v", err)}
+	}
+	if len(info.Tags) > 0 {
+		proxyLog.Infof("[Hook] Tagged request of %s: %s", info.Caller, hook.FormatTags(info.Tags))
+		if entry := auditEntryFrom(r); entry != nil {
+			entry.Tags = info.Tags
+		}
+	}
+	return info, nil
+}
+
+// hookResponse runs the on_response function of the hook script on the
+// body of a non-streamed completion
+func (h *Handler) hookResponse(ctx context.Context, call *completionCall, body io.ReadCloser) (io.ReadCloser, error) {
+	if !h.hooks.HasResponse() {
+		return body, nil
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	data, err = h.hooks.Response(ctx, data, call.hookInfo)
+	if err != nil {
+		proxyLog.Warnf("[Hook] Response hook failed for %s: %v", call.caller, err)
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// hookStream runs the on_chunk function of the hook script on every chunk
+// of a streamed completion. Chunks the script fails on are relayed
+// unchanged, since the stream has already started, and chunks it returns
+// false for are dropped.
+func (h *Handler) hookStream(ctx context.Context, call *completionCall, body io.ReadCloser) io.ReadCloser {
+	if !h.hooks.HasChunk() {
+		return body
+	}
+	return &lineStream{ReadCloser: body, rewrite: func(line []byte) []byte {
+		data, ok := bytes.CutPrefix(line, []byte("data: "))
+		if !ok || !bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+			return line
+		}
+		rewritten, err := h.hooks.Chunk(ctx, data, call.hookInfo)
+		switch {
+		case err != nil:
+			proxyLog.Warnf("[Hook] Chunk hook failed for %s, relaying the chunk unchanged: %v", call.caller, err)
+			return line
+		case string(rewritten) == "false":
+			return nil
+		}
+		return append([]byte("data: "), rewritten...)
+	}}
+}
@@ -0,0 +1,161 @@
+// internal/proxy/inflight.go
+package proxy
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// errCancelledByAdmin is the cancellation cause of requests cancelled
+// through DELETE /admin/requests/{id}
+var errCancelledByAdmin = errors.New("request cancelled by an administrator")
+
+// errClientDisconnected is the cancellation cause of completions whose
+// client went away, noticed when writing to it failed
+var errClientDisconnected = errors.New("client disconnected")
+
+// inflightRequest is a completion currently being served
+type inflightRequest struct {
+	id             string
+	requestID      string
+	model          string
+	caller         string
+	user           string
+	stream         bool
+	started        time.Time
+	tokensStreamed atomic.Int64
+	cancel         context.CancelCauseFunc
+}
+
+// inflightInfo is the admin API view of an in-flight request
+type inflightInfo struct {
+	ID             string    `json:"id"`
+	RequestID      string    `json:"request_id,omitempty"`
+	Model          string    `json:"model"`
+	Caller         string    `json:"caller"`
+	User           string    `json:"user,omitempty"`
+	Stream         bool      `json:"stream"`
+	StartedAt      time.Time `json:"started_at"`
+	DurationMs     int64     `json:"duration_ms"`
+	TokensStreamed int64     `json:"tokens_streamed"`
+}
+
+// inflightRegistry tracks the completions being served so that they can be
+// listed and cancelled
+type inflightRegistry struct {
+	mu       sync.Mutex
+	requests map[string]*inflightRequest
+
+	// cancelledByClient and cancelledByAdmin count the requests cancelled
+	// before they finished
+	cancelledByClient atomic.Int64
+	cancelledByAdmin  atomic.Int64
+}
+
+func newInflightRegistry() *inflightRegistry {
+	return &inflightRegistry{requests: make(map[string]*inflightRequest)}
+}
+
+// add registers a call and returns a context that is cancelled when the
+// request is cancelled through the registry, with a function removing it
+// again. Requests are registered under their request ID unless it is
+// already in use, e.g. by an earlier request on the same WebSocket.
+func (r *inflightRegistry) add(ctx context.Context, call *completionCall) (context.Context, *inflightRequest, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	req := &inflightRequest{
+		requestID: requestIDFrom(ctx),
+		model:     call.model,
+		caller:    call.caller,
+		user:      call.request.User,
+		stream:    call.request.Stream,
+		started:   time.Now(),
+		cancel:    cancel,
+	}
+
+	r.mu.Lock()
+	req.id = req.requestID
+	if _, taken := r.requests[req.id]; taken || req.id == "" {
+		req.id = uuid.New().String()
+	}
+	r.requests[req.id] = req
+	r.mu.Unlock()
+
+	var once sync.Once
+	return ctx, req, func() {
+		once.Do(func() {
+			r.mu.Lock()
+			delete(r.requests, req.id)
+			r.mu.Unlock()
+			r.countCancelled(context.Cause(ctx))
+			cancel(nil)
+		})
+	}
+}
+
+// list returns the in-flight requests, oldest first
+func (r *inflightRegistry) list() []inflightInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	infos := make([]inflightInfo, 0, len(r.requests))
+	for _, req := range r.requests {
+		infos = append(infos, inflightInfo{
+			ID:             req.id,
+			RequestID:      req.requestID,
+			Model:          req.model,
+			Caller:         req.caller,
+			User:           req.user,
+			Stream:         req.stream,
+			StartedAt:      req.started,
+			DurationMs:     now.Sub(req.started).Milliseconds(),
+			TokensStreamed: req.tokensStreamed.Load(),
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].StartedAt.Before(infos[j].StartedAt) })
+	return infos
+}
+
+// cancel cancels the request with the given ID, reporting whether it existed
+func (r *inflightRegistry) cancel(id string) bool {
+	r.mu.Lock()
+	req, ok := r.requests[id]
+	r.mu.Unlock()
+	if ok {
+		req.cancel(errCancelledByAdmin)
+	}
+	return ok
+}
+
+// countCancelled counts a request that ended with the cancellation cause,
+// nil when it was not cancelled
+func (r *inflightRegistry) countCancelled(cause error) {
+	switch {
+	case cause == nil:
+	case errors.Is(cause, errCancelledByAdmin):
+		r.cancelledByAdmin.Add(1)
+	case errors.Is(cause, errClientDisconnected), errors.Is(cause, context.Canceled):
+		// The server cancels the request context when the client disconnects
+		r.cancelledByClient.Add(1)
+	}
+}
+
+// cancelled returns the number of cancelled requests by who cancelled them
+func (r *inflightRegistry) cancelled() map[string]int64 {
+	return map[string]int64{
+		"client": r.cancelledByClient.Load(),
+		"admin":  r.cancelledByAdmin.Load(),
+	}
+}
+
+// len returns the number of in-flight requests
+func (r *inflightRegistry) len() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return int64(len(r.requests))
+}
@@ -0,0 +1,164 @@
+// internal/proxy/metrics.go
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics collects in-memory request metrics and serves them in the
+// Prometheus text exposition format
+type Metrics struct {
+	mu              sync.Mutex
+	inFlight        int64
+	requests        map[metricKey]int64
+	durationSeconds map[string]float64
+	durationCount   map[string]int64
+	collectors      []collector
+}
+
+// collector is a metric whose value is read when metrics are served. A
+// collector with a label reports one value per label value instead.
+type collector struct {
+	name       string
+	help       string
+	metricType string
+	value      func() int64
+	label      string
+	values     func() map[string]int64
+	floats     func() map[string]float64
+}
+
+type metricKey struct {
+	path   string
+	status int
+}
+
+// NewMetrics creates an empty metrics registry
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests:        make(map[metricKey]int64),
+		durationSeconds: make(map[string]float64),
+		durationCount:   make(map[string]int64),
+	}
+}
+
+// RegisterGauge adds a gauge whose value is read from fn on every scrape
+func (m *Metrics) RegisterGauge(name, help string, fn func() int64) {
+	m.register(collector{name: name, help: help, metricType: "gauge", value: fn})
+}
+
+// RegisterCounter adds a counter whose value is read from fn on every scrape
+func (m *Metrics) RegisterCounter(name, help string, fn func() int64) {
+	m.register(collector{name: name, help: help, metricType: "counter", value: fn})
+}
+
+// RegisterCounterVec adds a counter with one value per value of label,
+// read from fn on every scrape
+func (m *Metrics) RegisterCounterVec(name, help, label string, fn func() map[string]int64) {
+	m.register(collector{name: name, help: help, metricType: "counter", label: label, values: fn})
+}
+
+// RegisterGaugeVec adds a gauge with one fractional value per value of
+// label, read from fn on every scrape
+func (m *Metrics) RegisterGaugeVec(name, help, label string, fn func() map[string]float64) {
+	m.register(collector{name: name, help: help, metricType: "gauge", label: label, floats: fn})
+}
+
+func (m *Metrics) register(c collector) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.collectors = append(m.collectors, c)
+}
+
+func (m *Metrics) requestStarted() {
+	m.mu.Lock()
+	m.inFlight++
+	m.mu.Unlock()
+}
+
+func (m *Metrics) requestFinished(path string, status int, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inFlight--
+	m.requests[metricKey{path: path, status: status}]++
+	m.durationSeconds[path] += duration.Seconds()
+	m.durationCount[path]++
+}
+
+// ServeHTTP writes the collected metrics
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var b strings.Builder
+	b.WriteString("# HELP ghcsd_requests_in_flight Requests currently being served.\n")
+	b.WriteString("# TYPE ghcsd_requests_in_flight gauge\n")
+	fmt.Fprintf(&b, "ghcsd_requests_in_flight %d\n", m.inFlight)
+
+	keys := make([]metricKey, 0, len(m.requests))
+	for key := range m.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].path != keys[j].path {
+			return keys[i].path < keys[j].path
+		}
+		return keys[i].status < keys[j].status
+	})
+	b.WriteString("# HELP ghcsd_requests_total Requests served by route and status.\n")
+	b.WriteString("# TYPE ghcsd_requests_total counter\n")
+	for _, key := range keys {
+		fmt.Fprintf(&b, "ghcsd_requests_total{path=%q,status=\"%d\"} %d\n", key.path, key.status, m.requests[key])
+	}
+
+	paths := make([]string, 0, len(m.durationCount))
+	for path := range m.durationCount {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	b.WriteString("# HELP ghcsd_request_duration_seconds Time spent serving requests.\n")
+	b.WriteString("# TYPE ghcsd_request_duration_seconds summary\n")
+	for _, path := range paths {
+		fmt.Fprintf(&b, "ghcsd_request_duration_seconds_sum{path=%q} %f\n", path, m.durationSeconds[path])
+		fmt.Fprintf(&b, "ghcsd_request_duration_seconds_count{path=%q} %d\n", path, m.durationCount[path])
+	}
+
+	for _, c := range m.collectors {
+		fmt.Fprintf(&b, "# HELP %s %s\n", c.name, c.help)
+		fmt.Fprintf(&b, "# TYPE %s %s\n", c.name, c.metricType)
+		if c.floats != nil {
+			values := c.floats()
+			labels := make([]string, 0, len(values))
+			for label := range values {
+				labels = append(labels, label)
+			}
+			sort.Strings(labels)
+			for _, label := range labels {
+				fmt.Fprintf(&b, "%s{%s=%q} %s\n", c.name, c.label, label, strconv.FormatFloat(values[label], 'f', -1, 64))
+			}
+			continue
+		}
+		if c.values == nil {
+			fmt.Fprintf(&b, "%s %d\n", c.name, c.value())
+			continue
+		}
+		values := c.values()
+		labels := make([]string, 0, len(values))
+		for label := range values {
+			labels = append(labels, label)
+		}
+		sort.Strings(labels)
+		for _, label := range labels {
+			fmt.Fprintf(&b, "%s{%s=%q} %d\n", c.name, c.label, label, values[label])
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write([]byte(b.String()))
+}
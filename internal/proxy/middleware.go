@@ -0,0 +1,435 @@
+// internal/proxy/middleware.go
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/acazau/ghcsd/internal/apikeys"
+	"github.com/acazau/ghcsd/internal/events"
+	"github.com/acazau/ghcsd/internal/state"
+	"github.com/acazau/ghcsd/internal/tracing"
+	"github.com/google/uuid"
+)
+
+// Middleware wraps an http.Handler with cross-cutting behavior
+type Middleware func(http.Handler) http.Handler
+
+// Chain applies the middlewares to h so that the first middleware is the outermost
+func Chain(h http.Handler, middlewares ...Middleware) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+// statusRecorder captures the status code written by a handler while still
+// supporting streaming through http.Flusher
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	if !sr.wroteHeader {
+		sr.status = code
+		sr.wroteHeader = true
+	}
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if !sr.wroteHeader {
+		sr.status = http.StatusOK
+		sr.wroteHeader = true
+	}
+	return sr.ResponseWriter.Write(b)
+}
+
+func (sr *statusRecorder) Flush() {
+	if flusher, ok := sr.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+// writeJSONError writes an error body in the same shape as Handler.sendError
+func writeJSONError(w http.ResponseWriter, message, errType string, status int) {
+	writeAPIError(w, message, errType, "", status)
+}
+
+// writeAPIError writes an error body in the OpenAI format with an error code
+func writeAPIError(w http.ResponseWriter, message, errType, code string, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(newErrorResponse(message, errType, code))
+}
+
+// LoggingMiddleware writes one access log line per request to logger, or to
+// the standard logger at the info level of the proxy when it is nil
+func LoggingMiddleware(logger *log.Logger) Middleware {
+	logf := proxyLog.Infof
+	if logger != nil {
+		logf = logger.Printf
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rec, r)
+			logf("[Access] %s %s %d %s", r.Method, r.URL.Path, rec.status, time.Since(start).Round(time.Millisecond))
+		})
+	}
+}
+
+// RecoveryMiddleware turns handler panics into a JSON 500 response instead of
+// dropping the connection
+func RecoveryMiddleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			defer func() {
+				if err := recover(); err != nil {
+					if err == http.ErrAbortHandler {
+						panic(err)
+					}
+					proxyLog.Errorf("[Recovery] panic serving %s %s: %v\n%s", r.Method, r.URL.Path, err, debug.Stack())
+					if !rec.wroteHeader {
+						writeJSONError(rec, "Internal server error", "server_error", http.StatusInternalServerError)
+					}
+				}
+			}()
+			next.ServeHTTP(rec, r)
+		})
+	}
+}
+
+// AuthMiddleware requires one of the configured API keys on every request
+// except the public paths. Keys are accepted as a bearer token or in x-api-key.
+// Named keys from the store are also accepted unless expired, and are rate
+// limited by their rate limit class, counted in limits. With no keys and no store all requests
+// are allowed.
+func AuthMiddleware(keys []string, store *apikeys.Store, limits state.RateLimitStore, publicPaths ...string) Middleware {
+	return func(next http.Handler) http.Handler {
+		if len(keys) == 0 && store == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, path := range publicPaths {
+				if r.URL.Path == path {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+
+			provided := requestAPIKey(r)
+			for _, key := range keys {
+				if subtle.ConstantTimeCompare([]byte(provided), []byte(key)) == 1 {
+					ctx := context.WithValue(r.Context(), callerKey{}, keyFingerprint(key))
+					next.ServeHTTP(w, r.WithContext(ctx))
+					return
+				}
+			}
+
+			if key, ok := store.Lookup(provided); ok {
+				if key.Expired(time.Now()) {
+					writeJSONError(w, "API key has expired", "authentication_error", http.StatusUnauthorized)
+					return
+				}
+				if ok, wait := takeRequest(r.Context(), limits, "key:"+key.Name, store.RateLimit(key.RateLimitClass)); !ok {
+					w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+					writeAPIError(w, fmt.Sprintf("Rate limit exceeded for API key %s", key.Name),
+						"rate_limit_error", "rate_limit_exceeded", http.StatusTooManyRequests)
+					return
+				}
+				ctx := context.WithValue(r.Context(), callerKey{}, "key:"+key.Name)
+				ctx = context.WithValue(ctx, apiKeyKey{}, key)
+				next.ServeHTTP(w, r.WithContext(ctx))
+				return
+			}
+			writeAPIError(w, "Invalid or missing API key", "authentication_error", "invalid_api_key", http.StatusUnauthorized)
+		})
+	}
+}
+
+// requestIDKey is the context key holding the request ID
+type requestIDKey struct{}
+
+// requestIDFrom returns the ID assigned to the request by RequestIDMiddleware
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// RequestIDMiddleware assigns every request an ID, returned in the
+// X-Request-Id response header. A well-formed client-supplied ID is kept.
+func RequestIDMiddleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get("X-Request-Id")
+			if id == "" || len(id) > 128 || strings.ContainsAny(id, " \t\r\n") {
+				id = uuid.New().String()
+			}
+			w.Header().Set("X-Request-Id", id)
+			ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// TracingMiddleware starts a server span for every request, continuing the
+// trace of a W3C traceparent header when present. A nil tracer disables it.
+func TracingMiddleware(tracer *tracing.Tracer) Middleware {
+	return func(next http.Handler) http.Handler {
+		if tracer == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := tracing.Extract(r.Context(), r.Header)
+			ctx, span := tracer.Start(ctx, r.Method, tracing.KindServer)
+			defer span.End()
+			span.SetAttribute("http.request.method", r.Method)
+			span.SetAttribute("url.path", r.URL.Path)
+			span.SetAttribute("ghcsd.request_id", requestIDFrom(ctx))
+			span.SetAttribute("client.address", r.RemoteAddr)
+
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rec, r.WithContext(ctx))
+			span.SetAttribute("http.response.status_code", rec.status)
+			if rec.status >= 500 {
+				span.SetError(fmt.Errorf("HTTP %d", rec.status))
+			}
+		})
+	}
+}
+
+// EventsMiddleware publishes request started and finished events to broker
+func EventsMiddleware(broker *events.Broker) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Do not report the log stream to itself
+			if strings.HasPrefix(r.URL.Path, "/admin/logs") {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			start := time.Now()
+			requestID := requestIDFrom(r.Context())
+			broker.Publish(events.Event{
+				Type:      events.TypeRequestStarted,
+				RequestID: requestID,
+				Fields: map[string]interface{}{
+					"method": r.Method,
+					"path":   r.URL.Path,
+					"caller": callerFromRequest(r),
+				},
+			})
+
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			defer func() {
+				broker.Publish(events.Event{
+					Type:      events.TypeRequestFinished,
+					RequestID: requestID,
+					Fields: map[string]interface{}{
+						"method":      r.Method,
+						"path":        r.URL.Path,
+						"status":      rec.status,
+						"duration_ms": time.Since(start).Milliseconds(),
+					},
+				})
+			}()
+			next.ServeHTTP(rec, r)
+		})
+	}
+}
+
+// AdminMiddleware protects the admin endpoints. When admin keys are
+// configured one of them is required; otherwise only loopback clients are
+// allowed.
+func AdminMiddleware(adminKeys []string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isAdminRequest(r, adminKeys) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if len(adminKeys) == 0 {
+				writeJSONError(w, "Admin endpoints are only available from localhost", "permission_error", http.StatusForbidden)
+				return
+			}
+			writeJSONError(w, "Admin key required", "permission_error", http.StatusForbidden)
+		})
+	}
+}
+
+// isAdminRequest reports whether r carries one of adminKeys or, when there
+// are none, comes from localhost
+func isAdminRequest(r *http.Request, adminKeys []string) bool {
+	if len(adminKeys) == 0 {
+		return isLoopback(r.RemoteAddr)
+	}
+	provided := requestAPIKey(r)
+	for _, key := range adminKeys {
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(key)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// isLoopback reports whether a remote address is a loopback address or a
+// Unix socket peer
+func isLoopback(remoteAddr string) bool {
+	if remoteAddr == "" || remoteAddr == "@" {
+		return true
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// callerKey is the context key holding the authenticated caller identity
+type callerKey struct{}
+
+// keyFingerprint returns a short, non-reversible identifier for an API key
+func keyFingerprint(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return "key:" + hex.EncodeToString(sum[:4])
+}
+
+// callerFromRequest identifies the caller of a request: the fingerprint of the
+// API key it authenticated with, or its remote address when auth is disabled
+func callerFromRequest(r *http.Request) string {
+	if caller, ok := r.Context().Value(callerKey{}).(string); ok {
+		return caller
+	}
+	return r.RemoteAddr
+}
+
+// requestAPIKey extracts the caller's API key from the request headers
+func requestAPIKey(r *http.Request) string {
+	if key := r.Header.Get("X-Api-Key"); key != "" {
+		return key
+	}
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// takeRequest consumes a request from the rate limit bucket named key,
+// returning how long to wait when it is empty. A non-positive limit allows
+// every request, and so does a failing store rather than taking the proxy
+// down with it.
+func takeRequest(ctx context.Context, limits state.RateLimitStore, key string, perMinute int) (bool, time.Duration) {
+	if perMinute <= 0 {
+		return true, 0
+	}
+	ok, wait, err := limits.Take(ctx, key, perMinute)
+	if err != nil {
+		proxyLog.Warnf("[RateLimit] Failed to check the rate limit of %s, allowing the request: %v", key, err)
+		return true, 0
+	}
+	return ok, wait
+}
+
+// RateLimitMiddleware limits the proxy to perMinute requests per minute across
+// all callers, counted in limits. A non-positive limit disables rate limiting.
+func RateLimitMiddleware(limits state.RateLimitStore, perMinute int, publicPaths ...string) Middleware {
+	return func(next http.Handler) http.Handler {
+		if perMinute <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, path := range publicPaths {
+				if r.URL.Path == path {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			if ok, wait := takeRequest(r.Context(), limits, "global", perMinute); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				writeAPIError(w, fmt.Sprintf("Rate limit of %d requests per minute exceeded", perMinute),
+					"rate_limit_error", "rate_limit_exceeded", http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// CORSMiddleware adds CORS headers for the allowed origins and answers
+// preflight requests. "*" allows any origin; no origins disables CORS.
+func CORSMiddleware(origins []string) Middleware {
+	return func(next http.Handler) http.Handler {
+		if len(origins) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if origin != "" && originAllowed(origins, origin) {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+				w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, X-Api-Key")
+				w.Header().Set("Access-Control-Expose-Headers", strings.Join([]string{
+					"X-Request-Id", "Retry-After", headerRequestedModel, headerServedModel, headerUpstream, headerUpstreamLatency, headerAutoRoute,
+					headerUpstreamRateLimit + "Limit", headerUpstreamRateLimit + "Remaining", headerUpstreamRateLimit + "Reset",
+				}, ", "))
+				w.Header().Add("Vary", "Origin")
+				if r.Method == http.MethodOptions {
+					w.WriteHeader(http.StatusNoContent)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func originAllowed(origins []string, origin string) bool {
+	for _, allowed := range origins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// MetricsMiddleware records request counts and latencies in m, by the route
+// that route matches each request to rather than by its path, so that
+// arbitrary paths cannot add series without bound
+func MetricsMiddleware(m *Metrics, route func(r *http.Request) string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			m.requestStarted()
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			label := route(r)
+			defer func() {
+				m.requestFinished(label, rec.status, time.Since(start))
+			}()
+			next.ServeHTTP(rec, r)
+		})
+	}
+}
@@ -0,0 +1,188 @@
+// internal/proxy/models.go
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/acazau/ghcsd/internal/config"
+	"github.com/acazau/ghcsd/pkg/copilot"
+	"github.com/acazau/ghcsd/pkg/upstream"
+)
+
+const (
+	// modelCatalogTTL is how long the models listed by a provider are reused
+	modelCatalogTTL = 10 * time.Minute
+	// modelCatalogRetry is how long a provider that failed to list its
+	// models is not asked again
+	modelCatalogRetry = time.Minute
+	// modelCatalogTimeout bounds fetching the models of a provider
+	modelCatalogTimeout = 5 * time.Second
+)
+
+// modelCapabilities are the features a model supports
+type modelCapabilities struct {
+	Vision            bool `json:"vision"`
+	Tools             bool `json:"tools"`
+	ParallelToolCalls bool `json:"parallel_tool_calls"`
+	Reasoning         bool `json:"reasoning"`
+	Streaming         bool `json:"streaming"`
+}
+
+// modelObject is an entry of the /v1/models listing: the OpenAI model object
+// extended with the capability metadata clients use to configure features
+type modelObject struct {
+	ID              string            `json:"id"`
+	Object          string            `json:"object"`
+	Created         int64             `json:"created"`
+	OwnedBy         string            `json:"owned_by"`
+	Model           string            `json:"model"`
+	Upstream        string            `json:"upstream"`
+	ContextWindow   int               `json:"context_window,omitempty"`
+	MaxOutputTokens int               `json:"max_output_tokens,omitempty"`
+	Capabilities    modelCapabilities `json:"capabilities"`
+	// Available is false for models the warm-up found the account cannot use
+	Available   bool   `json:"available"`
+	Unavailable string `json:"unavailable_reason,omitempty"`
+}
+
+// modelCatalog caches the models listed by each upstream provider
+type modelCatalog struct {
+	mu        sync.Mutex
+	providers map[string]*catalogEntry
+}
+
+// catalogEntry holds the models of one provider keyed by ID
+type catalogEntry struct {
+	expires time.Time
+	models  map[string]copilot.ModelInfo
+}
+
+// providerModels returns the models listed by a provider keyed by ID. When
+// the provider cannot be reached the last known models, possibly none, are
+// returned and the configured capabilities apply.
+func (h *Handler) providerModels(ctx context.Context, name string) map[string]copilot.ModelInfo {
+	if name == "" {
+		name = upstream.DefaultProvider
+	}
+	h.catalog.mu.Lock()
+	defer h.catalog.mu.Unlock()
+	if h.catalog.providers == nil {
+		h.catalog.providers = make(map[string]*catalogEntry)
+	}
+	entry, ok := h.catalog.providers[name]
+	if ok && time.Now().Before(entry.expires) {
+		return entry.models
+	}
+	if !ok {
+		entry = &catalogEntry{}
+		h.catalog.providers[name] = entry
+	}
+
+	provider, err := h.providers.Get(name)
+	if err != nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, modelCatalogTimeout)
+	defer cancel()
+	listed, err := provider.ListModels(ctx)
+	if err != nil {
+		upstreamLog.Warnf("[Warning] Failed to list the models of upstream %s: %v", name, err)
+		entry.expires = time.Now().Add(modelCatalogRetry)
+		return entry.models
+	}
+	entry.models = make(map[string]copilot.ModelInfo, len(listed))
+	for _, model := range listed {
+		entry.models[model.ID] = model
+	}
+	entry.expires = time.Now().Add(modelCatalogTTL)
+	return entry.models
+}
+
+// describeModel builds the listing entry of a configured model, preferring
+// the limits and capabilities reported by its upstream over the configured ones
+func (h *Handler) describeModel(ctx context.Context, id string, info config.Model) modelObject {
+	upstreamName := info.Upstream
+	if upstreamName == "" {
+		upstreamName = upstream.DefaultProvider
+	}
+	model := modelObject{
+		ID:              id,
+		Object:          "model",
+		Created:         h.startedAt.Unix(),
+		OwnedBy:         strings.ToLower(info.Provider),
+		Model:           info.RealID,
+		Upstream:        upstreamName,
+		ContextWindow:   info.ContextWindow,
+		MaxOutputTokens: info.MaxOutputTokens,
+		Capabilities: modelCapabilities{
+			Vision:            info.Vision,
+			Tools:             true,
+			ParallelToolCalls: true,
+			Reasoning:         info.Reasoning,
+			Streaming:         true,
+		},
+		Available: true,
+	}
+	if reason := h.availability.reason(upstreamName, info.RealID); reason != "" {
+		model.Available = false
+		model.Unavailable = reason
+	}
+
+	listed, ok := h.providerModels(ctx, upstreamName)[info.RealID]
+	if !ok {
+		return model
+	}
+	limits := listed.Capabilities.Limits
+	if limits.MaxContextWindowTokens > 0 {
+		model.ContextWindow = limits.MaxContextWindowTokens
+	}
+	if limits.MaxOutputTokens > 0 {
+		model.MaxOutputTokens = limits.MaxOutputTokens
+	}
+	supports := listed.Capabilities.Supports
+	model.Capabilities.Vision = supports.Vision
+	model.Capabilities.Tools = supports.ToolCalls
+	model.Capabilities.ParallelToolCalls = supports.ParallelToolCalls
+	model.Capabilities.Streaming = supports.Streaming
+	return model
+}
+
+// visibleModels returns the configured model IDs the caller may use
+func visibleModels(r *http.Request) []string {
+	key := apiKeyFrom(r)
+	var ids []string
+	for _, id := range config.GetModelList() {
+		info, _ := config.GetModelInfo(id)
+		if key == nil || key.AllowsModel(id, info.RealID) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// handleListModels serves GET /v1/models
+func (h *Handler) handleListModels(w http.ResponseWriter, r *http.Request) {
+	models := []modelObject{}
+	for _, id := range visibleModels(r) {
+		info, _ := config.GetModelInfo(id)
+		models = append(models, h.describeModel(r.Context(), id, info))
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"object": "list", "data": models})
+}
+
+// handleGetModel serves GET /v1/models/{model}
+func (h *Handler) handleGetModel(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("model")
+	for _, visible := range visibleModels(r) {
+		if strings.EqualFold(visible, id) {
+			info, _ := config.GetModelInfo(visible)
+			writeJSON(w, http.StatusOK, h.describeModel(r.Context(), visible, info))
+			return
+		}
+	}
+	h.sendRequestError(w, &requestError{status: http.StatusNotFound, message: "The model '" + id + "' does not exist", code: "model_not_found"})
+}
@@ -0,0 +1,159 @@
+// internal/proxy/modelstats.go
+package proxy
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// statsBucket is the resolution of the rolling model statistics
+	statsBucket = time.Minute
+	// statsBuckets is the number of buckets kept, covering the longest window
+	statsBuckets = 60
+)
+
+// statsWindows are the windows the model statistics are reported over
+var statsWindows = []struct {
+	name   string
+	length time.Duration
+}{
+	{"last_5m", 5 * time.Minute},
+	{"last_1h", time.Hour},
+}
+
+// modelStats keeps rolling latency, throughput and error statistics of the
+// completions of each model, so that models can be compared empirically
+type modelStats struct {
+	mu     sync.Mutex
+	models map[string]*[statsBuckets]statsCounts
+}
+
+// statsCounts accumulates the completions of one model in one bucket
+type statsCounts struct {
+	// start identifies the bucket, which is reset when reused
+	start     int64
+	requests  int64
+	errors    int64
+	ttft      time.Duration
+	ttftCount int64
+	tokens    int64
+	// generation is the time spent producing the counted tokens
+	generation time.Duration
+}
+
+// completionSample is the outcome of one completion
+type completionSample struct {
+	failed bool
+	// ttft is the time until the first token, zero when none arrived
+	ttft             time.Duration
+	completionTokens int
+	generation       time.Duration
+}
+
+func newModelStats() *modelStats {
+	return &modelStats{models: make(map[string]*[statsBuckets]statsCounts)}
+}
+
+// record adds the outcome of a completion of model
+func (s *modelStats) record(model string, sample completionSample) {
+	start := time.Now().Truncate(statsBucket).Unix()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	buckets, ok := s.models[model]
+	if !ok {
+		buckets = new([statsBuckets]statsCounts)
+		s.models[model] = buckets
+	}
+	bucket := &buckets[(start/int64(statsBucket.Seconds()))%statsBuckets]
+	if bucket.start != start {
+		*bucket = statsCounts{start: start}
+	}
+	bucket.requests++
+	if sample.failed {
+		bucket.errors++
+		return
+	}
+	if sample.ttft > 0 {
+		bucket.ttft += sample.ttft
+		bucket.ttftCount++
+	}
+	if sample.completionTokens > 0 && sample.generation > 0 {
+		bucket.tokens += int64(sample.completionTokens)
+		bucket.generation += sample.generation
+	}
+}
+
+// modelStatsWindow summarizes the completions of a model over a window
+type modelStatsWindow struct {
+	Requests  int64   `json:"requests"`
+	Errors    int64   `json:"errors"`
+	ErrorRate float64 `json:"error_rate"`
+	// TTFTMs is the mean time to the first token of successful completions
+	TTFTMs float64 `json:"ttft_ms"`
+	// TokensPerSecond is the completion tokens produced per second of
+	// generation
+	TokensPerSecond float64 `json:"tokens_per_second"`
+}
+
+// modelStatsEntry is the statistics of one model by window
+type modelStatsEntry struct {
+	Model   string                      `json:"model"`
+	Windows map[string]modelStatsWindow `json:"windows"`
+}
+
+// snapshot summarizes every model with completions in the longest window
+func (s *modelStats) snapshot() []modelStatsEntry {
+	now := time.Now().Truncate(statsBucket)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := []modelStatsEntry{}
+	for model, buckets := range s.models {
+		entry := modelStatsEntry{Model: model, Windows: make(map[string]modelStatsWindow, len(statsWindows))}
+		for _, window := range statsWindows {
+			// The current, partial bucket counts towards every window
+			since := now.Add(-window.length + statsBucket).Unix()
+			var total statsCounts
+			for _, bucket := range buckets {
+				if bucket.start < since || bucket.requests == 0 {
+					continue
+				}
+				total.requests += bucket.requests
+				total.errors += bucket.errors
+				total.ttft += bucket.ttft
+				total.ttftCount += bucket.ttftCount
+				total.tokens += bucket.tokens
+				total.generation += bucket.generation
+			}
+			entry.Windows[window.name] = total.summary()
+		}
+		if entry.Windows[statsWindows[len(statsWindows)-1].name].Requests > 0 {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Model < entries[j].Model })
+	return entries
+}
+
+// summary turns accumulated counts into rates and means
+func (c statsCounts) summary() modelStatsWindow {
+	window := modelStatsWindow{Requests: c.requests, Errors: c.errors}
+	if c.requests > 0 {
+		window.ErrorRate = float64(c.errors) / float64(c.requests)
+	}
+	if c.ttftCount > 0 {
+		window.TTFTMs = float64(c.ttft) / float64(time.Millisecond) / float64(c.ttftCount)
+	}
+	if c.generation > 0 {
+		window.TokensPerSecond = float64(c.tokens) / c.generation.Seconds()
+	}
+	return window
+}
+
+// handleStats serves GET /admin/stats, reporting the time to first token,
+// throughput and error rate of each model over the last 5 minutes and hour
+func (h *Handler) handleStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{"models": h.stats.snapshot()})
+}
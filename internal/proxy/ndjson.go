@@ -0,0 +1,72 @@
+// internal/proxy/ndjson.go
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ndjsonContentType is the streaming format clients can ask for with their
+// Accept header instead of SSE: one JSON event per line
+const ndjsonContentType = "application/x-ndjson"
+
+// wantsNDJSON reports whether the client of r prefers newline delimited JSON
+// streams to SSE. SSE wins ties, being the format of the OpenAI API.
+func wantsNDJSON(r *http.Request) bool {
+	var ndjson, sse float64
+	for _, accept := range r.Header.Values("Accept") {
+		for _, part := range strings.Split(accept, ",") {
+			mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+			if err != nil {
+				continue
+			}
+			q := 1.0
+			if value, ok := params["q"]; ok {
+				if q, err = strconv.ParseFloat(value, 64); err != nil {
+					continue
+				}
+			}
+			switch mediaType {
+			case ndjsonContentType:
+				ndjson = max(ndjson, q)
+			case "text/event-stream":
+				sse = max(sse, q)
+			}
+		}
+	}
+	return ndjson > 0 && ndjson > sse
+}
+
+// ndjsonStream rewrites an SSE stream of completion chunks as one chunk per
+// line. Comments and the final [DONE] are dropped; the stream simply ends.
+type ndjsonStream struct {
+	src     *bufio.Reader
+	pending []byte
+	err     error
+}
+
+func newNDJSONStream(src io.Reader) *ndjsonStream {
+	return &ndjsonStream{src: bufio.NewReader(src)}
+}
+
+func (s *ndjsonStream) Read(p []byte) (int, error) {
+	for len(s.pending) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		var line []byte
+		line, s.err = s.src.ReadBytes('\n')
+		data, ok := bytes.CutPrefix(bytes.TrimRight(line, "\r\n"), []byte("data: "))
+		if ok && len(data) > 0 && !bytes.Equal(data, []byte("[DONE]")) {
+			s.pending = append(append(s.pending, data...), '\n')
+		}
+	}
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
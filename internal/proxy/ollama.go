@@ -0,0 +1,301 @@
+// internal/proxy/ollama.go
+
+//go:build !ghcsd_minimal && !ghcsd_no_ollama
+
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/acazau/ghcsd/internal/config"
+	"github.com/acazau/ghcsd/pkg/copilot"
+	"github.com/acazau/ghcsd/pkg/logging"
+)
+
+func init() {
+	registerFrontendRoute("POST /api/chat", func(h *Handler) http.HandlerFunc { return h.handleOllamaChat })
+	registerFrontendRoute("POST /api/generate", func(h *Handler) http.HandlerFunc { return h.handleOllamaGenerate })
+	registerFrontendRoute("GET /api/tags", func(h *Handler) http.HandlerFunc { return h.handleOllamaTags })
+}
+
+// ollamaMessage is a chat message in the Ollama API
+type ollamaMessage struct {
+	Role    string   `json:"role"`
+	Content string   `json:"content"`
+	Images  []string `json:"images,omitempty"`
+}
+
+// ollamaOptions holds the Ollama model options that map to Copilot parameters
+type ollamaOptions struct {
+	Temperature      *float32 `json:"temperature,omitempty"`
+	TopP             float32  `json:"top_p,omitempty"`
+	TopK             *int     `json:"top_k,omitempty"`
+	PresencePenalty  *float32 `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float32 `json:"frequency_penalty,omitempty"`
+	NumPredict       int      `json:"num_predict,omitempty"`
+	Stop             []string `json:"stop,omitempty"`
+	Seed             *int64   `json:"seed,omitempty"`
+}
+
+// ollamaChatRequest is the body of POST /api/chat
+type ollamaChatRequest struct {
+	Model    string          `json:"model"`
+	Messages []ollamaMessage `json:"messages"`
+	Stream   *bool           `json:"stream,omitempty"`
+	Options  ollamaOptions   `json:"options"`
+}
+
+// ollamaGenerateRequest is the body of POST /api/generate
+type ollamaGenerateRequest struct {
+	Model   string        `json:"model"`
+	Prompt  string        `json:"prompt"`
+	System  string        `json:"system,omitempty"`
+	Images  []string      `json:"images,omitempty"`
+	Stream  *bool         `json:"stream,omitempty"`
+	Options ollamaOptions `json:"options"`
+}
+
+// ollamaResponse is a response line of /api/chat or /api/generate. Chat
+// responses carry Message, generate responses carry Response.
+type ollamaResponse struct {
+	Model           string         `json:"model"`
+	CreatedAt       string         `json:"created_at"`
+	Message         *ollamaMessage `json:"message,omitempty"`
+	Response        *string        `json:"response,omitempty"`
+	Done            bool           `json:"done"`
+	DoneReason      string         `json:"done_reason,omitempty"`
+	TotalDuration   int64          `json:"total_duration,omitempty"`
+	PromptEvalCount int            `json:"prompt_eval_count,omitempty"`
+	EvalCount       int            `json:"eval_count,omitempty"`
+}
+
+// ollamaModel is an entry of the GET /api/tags response
+type ollamaModel struct {
+	Name       string `json:"name"`
+	Model      string `json:"model"`
+	ModifiedAt string `json:"modified_at"`
+	Size       int64  `json:"size"`
+	Digest     string `json:"digest"`
+	Details    struct {
+		Format string `json:"format"`
+		Family string `json:"family"`
+	} `json:"details"`
+}
+
+// ollamaModelName strips the ":latest" tag Ollama clients append to model names
+func ollamaModelName(name string) string {
+	return strings.TrimSuffix(name, ":latest")
+}
+
+// toCopilotMessage converts an Ollama message, turning attached base64
+// images into image_url content parts
+func (m ollamaMessage) toCopilotMessage() copilot.Message {
+	if len(m.Images) == 0 {
+		return copilot.Message{Role: m.Role, Content: m.Content}
+	}
+	parts := []interface{}{map[string]interface{}{"type": "text", "text": m.Content}}
+	for _, image := range m.Images {
+		parts = append(parts, map[string]interface{}{
+			"type":      "image_url",
+			"image_url": map[string]string{"url": "data:image/png;base64," + image},
+		})
+	}
+	return copilot.Message{Role: m.Role, Content: parts}
+}
+
+// handleOllamaChat serves POST /api/chat
+func (h *Handler) handleOllamaChat(w http.ResponseWriter, r *http.Request) {
+	var req ollamaChatRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.sendOllamaError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	messages := make([]copilot.Message, 0, len(req.Messages))
+	for _, msg := range req.Messages {
+		messages = append(messages, msg.toCopilotMessage())
+	}
+	h.serveOllama(w, r, req.Model, messages, req.Stream, req.Options, true)
+}
+
+// handleOllamaGenerate serves POST /api/generate
+func (h *Handler) handleOllamaGenerate(w http.ResponseWriter, r *http.Request) {
+	var req ollamaGenerateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.sendOllamaError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var messages []copilot.Message
+	if req.System != "" {
+		messages = append(messages, copilot.Message{Role: "system", Content: req.System})
+	}
+	prompt := ollamaMessage{Role: "user", Content: req.Prompt, Images: req.Images}
+	messages = append(messages, prompt.toCopilotMessage())
+	h.serveOllama(w, r, req.Model, messages, req.Stream, req.Options, false)
+}
+
+// serveOllama runs a completion and writes it in the Ollama format, either as
+// a single JSON object or as newline-delimited JSON when streaming.
+// Ollama streams by default, so a missing stream field means true.
+func (h *Handler) serveOllama(w http.ResponseWriter, r *http.Request, model string, messages []copilot.Message,
+	stream *bool, options ollamaOptions, chat bool) {
+	start := time.Now()
+
+	req := copilot.CompletionRequest{
+		Model:            ollamaModelName(model),
+		Messages:         messages,
+		Stop:             options.Stop,
+		Stream:           stream == nil || *stream,
+		TopP:             options.TopP,
+		TopK:             options.TopK,
+		PresencePenalty:  options.PresencePenalty,
+		FrequencyPenalty: options.FrequencyPenalty,
+		Seed:             options.Seed,
+	}
+	if options.Temperature != nil {
+		req.Temperature = *options.Temperature
+	}
+	// Ollama uses negative values for unlimited generation
+	if options.NumPredict > 0 {
+		req.MaxTokens = options.NumPredict
+	}
+	call, reqErr := h.buildCompletion(r, req)
+	if reqErr != nil {
+		reqErr.writeHeaders(w)
+		h.sendOllamaError(w, reqErr.message, reqErr.status)
+		return
+	}
+	if call.request.Stream {
+		call.request.StreamOptions = &copilot.StreamOptions{IncludeUsage: true}
+	}
+
+	upstreamStart := time.Now()
+	body, disconnect, err := h.startForClient(r, call)
+	defer disconnect(nil)
+	setModelHeaders(w, call, time.Since(upstreamStart))
+	if err != nil {
+		translated := translateError(err)
+		if translated.RetryAfter != "" {
+			w.Header().Set("Retry-After", translated.RetryAfter)
+		}
+		h.sendOllamaError(w, translated.Message, translated.Status)
+		return
+	}
+	defer body.Close()
+
+	newResponse := func(content string) ollamaResponse {
+		resp := ollamaResponse{Model: model, CreatedAt: time.Now().UTC().Format(time.RFC3339Nano)}
+		if chat {
+			resp.Message = &ollamaMessage{Role: "assistant", Content: content}
+		} else {
+			resp.Response = &content
+		}
+		return resp
+	}
+
+	if !call.request.Stream {
+		var completion copilot.CompletionResponse
+		if err := json.NewDecoder(body).Decode(&completion); err != nil {
+			h.sendOllamaError(w, fmt.Sprintf("Failed to decode completion: %v", err), http.StatusBadGateway)
+			return
+		}
+		content, doneReason := "", "stop"
+		if len(completion.Choices) > 0 {
+			content = completion.Choices[0].Message.Content
+			if completion.Choices[0].FinishReason != "" {
+				doneReason = completion.Choices[0].FinishReason
+			}
+		}
+		resp := newResponse(content)
+		resp.Done = true
+		resp.DoneReason = doneReason
+		resp.TotalDuration = time.Since(start).Nanoseconds()
+		resp.PromptEvalCount = completion.Usage.PromptTokens
+		resp.EvalCount = completion.Usage.CompletionTokens
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	controller := http.NewResponseController(w)
+	encoder := json.NewEncoder(w)
+	doneReason := "stop"
+	var usage copilot.CompletionResponse
+
+	err = forEachChunk(body, func(chunk *copilot.CompletionResponse) error {
+		if chunk.Usage.TotalTokens > 0 {
+			usage.Usage = chunk.Usage
+		}
+		for _, choice := range chunk.Choices {
+			if choice.Index != 0 {
+				continue
+			}
+			if choice.FinishReason != "" {
+				doneReason = choice.FinishReason
+			}
+			if text := deltaText(choice); text != "" {
+				if err := encoder.Encode(newResponse(text)); err != nil {
+					disconnect(errClientDisconnected)
+					return fmt.Errorf("%w: %v", errClientDisconnected, err)
+				}
+				controller.Flush()
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		h.logWithPrefix(ollamaLog, logging.Debug, "Error", fmt.Sprintf("Ollama stream failed: %v", err))
+		if errors.Is(err, errClientDisconnected) {
+			return
+		}
+		// Ollama reports errors mid-stream as a line holding only an error field
+		encoder.Encode(map[string]string{"error": err.Error()})
+		controller.Flush()
+		return
+	}
+
+	final := newResponse("")
+	final.Done = true
+	final.DoneReason = doneReason
+	final.TotalDuration = time.Since(start).Nanoseconds()
+	final.PromptEvalCount = usage.Usage.PromptTokens
+	final.EvalCount = usage.Usage.CompletionTokens
+	encoder.Encode(final)
+	controller.Flush()
+}
+
+// handleOllamaTags serves GET /api/tags with the configured models
+func (h *Handler) handleOllamaTags(w http.ResponseWriter, r *http.Request) {
+	modifiedAt := time.Now().UTC().Format(time.RFC3339)
+	models := []ollamaModel{}
+	for _, id := range config.GetModelList() {
+		info, _ := config.GetModelInfo(id)
+		model := ollamaModel{
+			Name:       id + ":latest",
+			Model:      id + ":latest",
+			ModifiedAt: modifiedAt,
+			Digest:     info.RealID,
+		}
+		model.Details.Format = "copilot"
+		model.Details.Family = info.Provider
+		models = append(models, model)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"models": models})
+}
+
+// sendOllamaError writes an error in the Ollama format
+func (h *Handler) sendOllamaError(w http.ResponseWriter, message string, status int) {
+	h.logWithPrefix(ollamaLog, logging.Debug, "Error", fmt.Sprintf("%d: %s", status, message))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
@@ -0,0 +1,39 @@
+// internal/proxy/pin.go
+package proxy
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/acazau/ghcsd/internal/config"
+)
+
+// pinModel returns the model a request is served by when conversations are
+// pinned: the model the first request of its conversation was served by.
+// Requests without the session header, and all requests when pinning is
+// disabled, keep model. A failing state store lets the request through with
+// model.
+func (h *Handler) pinModel(r *http.Request, model config.Model) config.Model {
+	if h.pinTTL <= 0 || h.sessionHeader == "" {
+		return model
+	}
+	session := strings.TrimSpace(r.Header.Get(h.sessionHeader))
+	if session == "" {
+		return model
+	}
+	pinned, err := h.shared.PinModel(r.Context(), session, model.RealID, h.pinTTL)
+	if err != nil {
+		proxyLog.Warnf("[Warning] Failed to pin the model of session %s: %v", session, err)
+		return model
+	}
+	if pinned == model.RealID {
+		return model
+	}
+	pinnedInfo, ok := config.GetModelInfo(pinned)
+	if !ok {
+		// Pinned by a replica knowing other models
+		return model
+	}
+	proxyLog.Infof("[Routing] Serving %s with %s, the model session %s is pinned to", model.RealID, pinned, session)
+	return pinnedInfo
+}
@@ -0,0 +1,55 @@
+// internal/proxy/priority.go
+package proxy
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// priority is the class of a completion in the retry queue. While upstream
+// is rate limited, the requests of a higher class are retried first.
+type priority int
+
+const (
+	priorityBatch priority = iota
+	priorityStandard
+	priorityInteractive
+	// priorityClasses is the number of classes
+	priorityClasses
+)
+
+// priorityNames are the names of the classes in metrics and logs
+var priorityNames = [priorityClasses]string{"batch", "standard", "interactive"}
+
+func (p priority) String() string {
+	return priorityNames[p]
+}
+
+// serviceTiers maps the service_tier values of the OpenAI and Anthropic APIs
+// to classes. Requests without one are standard.
+var serviceTiers = map[string]priority{
+	"":              priorityStandard,
+	"auto":          priorityStandard,
+	"default":       priorityStandard,
+	"standard_only": priorityStandard,
+	"priority":      priorityInteractive,
+	"scale":         priorityInteractive,
+	"flex":          priorityBatch,
+	"batch":         priorityBatch,
+}
+
+// parseServiceTier returns the class of a request by its service tier
+func parseServiceTier(tier string) (priority, error) {
+	if class, ok := serviceTiers[tier]; ok {
+		return class, nil
+	}
+	tiers := make([]string, 0, len(serviceTiers))
+	for name := range serviceTiers {
+		if name != "" {
+			tiers = append(tiers, name)
+		}
+	}
+	sort.Strings(tiers)
+	return 0, fmt.Errorf("service_tier must be one of %s", strings.Join(tiers, ", "))
+}
@@ -0,0 +1,204 @@
+// internal/proxy/queue.go
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/acazau/ghcsd/pkg/copilot"
+)
+
+// queueFullError is returned when a rate limited request cannot be queued
+type queueFullError struct {
+	retryAfter time.Duration
+}
+
+func (e *queueFullError) Error() string {
+	return "upstream is rate limited and the retry queue is full"
+}
+
+// retryQueue holds requests that were rate limited by Copilot and retries
+// them after a delay, as long as their total wait stays within the budget.
+// At most size requests wait at the same time, and the requests of a lower
+// priority let those of a higher one retry first.
+type retryQueue struct {
+	size     int
+	maxWait  time.Duration
+	retried  atomic.Int64
+	rejected atomic.Int64
+	// yielded counts the retries held back for requests of a higher priority
+	yielded atomic.Int64
+
+	mu      sync.Mutex
+	waiting [priorityClasses]int
+	// changed is closed, and replaced, whenever a request leaves the queue
+	changed chan struct{}
+}
+
+// newRetryQueue creates a queue, or returns nil when size is not positive
+func newRetryQueue(size int, maxWait time.Duration) *retryQueue {
+	if size <= 0 {
+		return nil
+	}
+	return &retryQueue{
+		size:    size,
+		maxWait: maxWait,
+		changed: make(chan struct{}),
+	}
+}
+
+// Depth returns the number of requests currently waiting for a retry
+func (q *retryQueue) Depth() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return int64(q.queued())
+}
+
+// waitingByPriority returns the number of requests waiting for a retry by
+// priority
+func (q *retryQueue) waitingByPriority() map[string]float64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	waiting := make(map[string]float64, priorityClasses)
+	for class, n := range q.waiting {
+		waiting[priority(class).String()] = float64(n)
+	}
+	return waiting
+}
+
+// queued returns the number of requests in the queue; q.mu must be held
+func (q *retryQueue) queued() int {
+	total := 0
+	for _, n := range q.waiting {
+		total += n
+	}
+	return total
+}
+
+// enter adds a request to the queue unless it is full. Batch requests leave
+// a quarter of the slots to the others.
+func (q *retryQueue) enter(class priority) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	size := q.size
+	if class == priorityBatch {
+		size -= q.size / 4
+	}
+	if q.queued() >= size {
+		return false
+	}
+	q.waiting[class]++
+	return true
+}
+
+// leave removes a request from the queue
+func (q *retryQueue) leave(class priority) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.waiting[class]--
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
+
+// ahead returns a channel closed once a request leaves the queue when
+// requests of a higher priority than class wait in it, or nil when none do
+func (q *retryQueue) ahead(class priority) <-chan struct{} {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for higher := class + 1; higher < priorityClasses; higher++ {
+		if q.waiting[higher] > 0 {
+			return q.changed
+		}
+	}
+	return nil
+}
+
+// Do calls fn and, while it fails with an upstream 429, waits in the queue and
+// retries it. A nil queue calls fn exactly once.
+func (q *retryQueue) Do(ctx context.Context, class priority, fn func() error) error {
+	err := fn()
+	if q == nil || !isRateLimited(err) {
+		return err
+	}
+
+	if !q.enter(class) {
+		q.rejected.Add(1)
+		return &queueFullError{retryAfter: retryDelay(err, 0)}
+	}
+	defer q.leave(class)
+
+	deadline := time.Now().Add(q.maxWait)
+	for attempt := 0; isRateLimited(err); attempt++ {
+		delay := retryDelay(err, attempt)
+		if time.Now().Add(delay).After(deadline) {
+			return err
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+
+		// The requests of a higher priority retry first
+		if changed := q.ahead(class); changed != nil {
+			q.yielded.Add(1)
+			timer := time.NewTimer(time.Until(deadline))
+			for changed != nil {
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return ctx.Err()
+				case <-timer.C:
+					return err
+				case <-changed:
+					changed = q.ahead(class)
+				}
+			}
+			timer.Stop()
+		}
+
+		q.retried.Add(1)
+		err = fn()
+	}
+	return err
+}
+
+// isRateLimited reports whether err is an upstream 429
+func isRateLimited(err error) bool {
+	var apiErr *copilot.APIError
+	return errors.As(err, &apiErr) && apiErr.Kind() == copilot.ErrorKindRateLimit
+}
+
+// retryDelay uses the upstream Retry-After header when present and falls back
+// to exponential backoff starting at one second. The backoff is also the
+// floor of the header, so that a Retry-After of 0 or in the past does not
+// retry without pause.
+func retryDelay(err error, attempt int) time.Duration {
+	if attempt > 5 {
+		attempt = 5
+	}
+	backoff := time.Second << attempt
+	var apiErr *copilot.APIError
+	if errors.As(err, &apiErr) && apiErr.RetryAfter != "" {
+		if seconds, convErr := strconv.Atoi(apiErr.RetryAfter); convErr == nil && seconds >= 0 {
+			return max(time.Duration(seconds)*time.Second, backoff)
+		}
+		if when, parseErr := time.Parse(time.RFC1123, apiErr.RetryAfter); parseErr == nil {
+			return max(time.Until(when), backoff)
+		}
+	}
+	return backoff
+}
+
+// String describes the queue configuration for logging
+func (q *retryQueue) String() string {
+	return fmt.Sprintf("retry queue (size %d, max wait %s)", q.size, q.maxWait)
+}
@@ -0,0 +1,121 @@
+// internal/proxy/reauth.go
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/acazau/ghcsd/pkg/copilot"
+)
+
+// reauthenticator recovers from Copilot rejecting the token of the server's
+// login while it runs. The token is first renewed from the stored GitHub
+// token; when GitHub rejects that too, e.g. because it was revoked, a device
+// login is started as with POST /auth/device. Requests rejected meanwhile
+// wait for the renewal, up to a limit, and are then retried.
+type reauthenticator struct {
+	login *deviceLogin
+	// wait bounds how long a request waits for the renewal
+	wait time.Duration
+
+	mu      sync.Mutex
+	current *renewal
+}
+
+// renewal is a token renewal shared by the requests waiting for it
+type renewal struct {
+	done chan struct{}
+	err  error
+}
+
+// reauthPendingError is returned when a request gave up waiting for the
+// device login of a renewal
+type reauthPendingError struct {
+	status deviceLoginStatus
+}
+
+func (e *reauthPendingError) Error() string {
+	if e.status.Status == loginPending {
+		return fmt.Sprintf("Copilot rejected the token and GitHub requires a new login: visit %s and enter code %s, then retry",
+			e.status.VerificationURI, e.status.UserCode)
+	}
+	return "Copilot rejected the token and GitHub requires a new login; start it with POST /auth/device"
+}
+
+func newReauthenticator(login *deviceLogin, wait time.Duration) *reauthenticator {
+	return &reauthenticator{login: login, wait: wait}
+}
+
+// isUnauthorized reports whether err is Copilot rejecting the token
+func isUnauthorized(err error) bool {
+	var apiErr *copilot.APIError
+	return errors.As(err, &apiErr) && apiErr.Kind() == copilot.ErrorKindAuthentication
+}
+
+// recover renews the token after Copilot rejected rejected, or waits for
+// the renewal already running. It returns nil once a new token is in use.
+func (a *reauthenticator) recover(ctx context.Context, rejected string) error {
+	a.mu.Lock()
+	if current := a.login.clients[0].GetToken(); current != "" && current != rejected {
+		// Renewed since the request was sent
+		a.mu.Unlock()
+		return nil
+	}
+	r := a.current
+	if r == nil {
+		r = &renewal{done: make(chan struct{})}
+		a.current = r
+		go a.renew(r, rejected)
+	}
+	a.mu.Unlock()
+
+	timer := time.NewTimer(a.wait)
+	defer timer.Stop()
+	select {
+	case <-r.done:
+		return r.err
+	case <-timer.C:
+		return &reauthPendingError{status: a.login.status()}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// renew obtains a new token for r, falling back to a device login
+func (a *reauthenticator) renew(r *renewal, rejected string) {
+	defer func() {
+		a.mu.Lock()
+		a.current = nil
+		a.mu.Unlock()
+		close(r.done)
+	}()
+
+	authLog.Infof("[Auth] Copilot rejected the token, renewing it")
+	token, err := a.login.auth.RenewToken()
+	if err == nil {
+		a.login.install(token)
+		authLog.Infof("[Auth] Copilot token renewed")
+		return
+	}
+	if !errors.Is(err, copilot.ErrLoginRequired) {
+		authLog.Errorf("[Auth] Failed to renew the Copilot token: %v", err)
+		r.err = err
+		return
+	}
+
+	authLog.Warnf("[Auth] GitHub rejected the stored login, starting a device login: %v", err)
+	if _, err := a.login.start(); err != nil {
+		authLog.Errorf("[Auth] Failed to start the device login: %v", err)
+		r.err = fmt.Errorf("failed to start the device login: %w", err)
+		return
+	}
+	if done := a.login.pending(); done != nil {
+		<-done
+	}
+	if current := a.login.clients[0].GetToken(); current == "" || current == rejected {
+		r.err = &reauthPendingError{status: a.login.status()}
+	}
+}
@@ -0,0 +1,507 @@
+// internal/proxy/responses.go
+
+//go:build !ghcsd_minimal && !ghcsd_no_responses
+
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/acazau/ghcsd/internal/conversations"
+	"github.com/acazau/ghcsd/pkg/copilot"
+	"github.com/acazau/ghcsd/pkg/logging"
+	"github.com/google/uuid"
+)
+
+func init() {
+	registerFrontendRoute("POST /v1/responses", func(h *Handler) http.HandlerFunc { return h.handleCreateResponse })
+	registerFrontendRoute("GET /v1/responses/{id}", func(h *Handler) http.HandlerFunc { return h.handleGetResponse })
+	registerFrontendRoute("DELETE /v1/responses/{id}", func(h *Handler) http.HandlerFunc { return h.handleDeleteResponse })
+}
+
+// responsesRequest is the body of POST /v1/responses
+type responsesRequest struct {
+	Model              string            `json:"model"`
+	Input              json.RawMessage   `json:"input"`
+	Instructions       string            `json:"instructions,omitempty"`
+	PreviousResponseID string            `json:"previous_response_id,omitempty"`
+	Store              *bool             `json:"store,omitempty"`
+	Stream             bool              `json:"stream,omitempty"`
+	Temperature        *float32          `json:"temperature,omitempty"`
+	TopP               float32           `json:"top_p,omitempty"`
+	MaxOutputTokens    int               `json:"max_output_tokens,omitempty"`
+	User               string            `json:"user,omitempty"`
+	ServiceTier        string            `json:"service_tier,omitempty"`
+	Metadata           map[string]string `json:"metadata,omitempty"`
+}
+
+// responseInputItem is a message in the input of a responses request
+type responseInputItem struct {
+	Type    string          `json:"type,omitempty"`
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"`
+}
+
+// responseInputPart is a content part of an input message
+type responseInputPart struct {
+	Type     string `json:"type"`
+	Text     string `json:"text,omitempty"`
+	ImageURL string `json:"image_url,omitempty"`
+}
+
+// responseContentPart is a content part of an output message
+type responseContentPart struct {
+	Type        string        `json:"type"`
+	Text        string        `json:"text"`
+	Annotations []interface{} `json:"annotations"`
+}
+
+// responseOutputItem is a message in the output of a response
+type responseOutputItem struct {
+	Type    string                `json:"type"`
+	ID      string                `json:"id"`
+	Status  string                `json:"status"`
+	Role    string                `json:"role"`
+	Content []responseContentPart `json:"content"`
+}
+
+// responseObject is a response of the Responses API
+type responseObject struct {
+	ID                 string               `json:"id"`
+	Object             string               `json:"object"`
+	CreatedAt          int64                `json:"created_at"`
+	Status             string               `json:"status"`
+	IncompleteDetails  *incompleteDetails   `json:"incomplete_details,omitempty"`
+	Model              string               `json:"model"`
+	PreviousResponseID string               `json:"previous_response_id,omitempty"`
+	Instructions       string               `json:"instructions,omitempty"`
+	Output             []responseOutputItem `json:"output"`
+	Usage              *responseUsage       `json:"usage,omitempty"`
+	Store              bool                 `json:"store"`
+	Metadata           map[string]string    `json:"metadata,omitempty"`
+}
+
+type incompleteDetails struct {
+	Reason string `json:"reason"`
+}
+
+type responseUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+	TotalTokens  int `json:"total_tokens"`
+}
+
+// newResponseID returns a new ID with the given prefix, e.g. "resp"
+func newResponseID(prefix string) string {
+	return prefix + "_" + strings.ReplaceAll(uuid.New().String(), "-", "")
+}
+
+// parseResponseInput converts the input of a responses request, a string or
+// a list of messages, into chat messages
+func parseResponseInput(raw json.RawMessage) ([]copilot.Message, error) {
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		if text == "" {
+			return nil, errors.New("input must not be empty")
+		}
+		return []copilot.Message{{Role: "user", Content: text}}, nil
+	}
+
+	var items []responseInputItem
+	if err := json.Unmarshal(raw, &items); err != nil {
+		return nil, errors.New("input must be a string or a list of messages")
+	}
+	if len(items) == 0 {
+		return nil, errors.New("input must not be empty")
+	}
+	messages := make([]copilot.Message, 0, len(items))
+	for i, item := range items {
+		if item.Type != "" && item.Type != "message" {
+			return nil, fmt.Errorf("input[%d]: unsupported item type %q", i, item.Type)
+		}
+		switch item.Role {
+		case "user", "assistant", "system", "developer":
+		default:
+			return nil, fmt.Errorf("input[%d]: unsupported role %q", i, item.Role)
+		}
+		content, err := parseResponseContent(item.Content)
+		if err != nil {
+			return nil, fmt.Errorf("input[%d]: %w", i, err)
+		}
+		// Developer messages become system messages with the chat roles
+		messages = append(messages, copilot.Message{Role: item.Role, Content: content})
+	}
+	return messages, nil
+}
+
+// parseResponseContent converts message content, a string or a list of
+// input parts, into chat message content
+func parseResponseContent(raw json.RawMessage) (interface{}, error) {
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return text, nil
+	}
+	var parts []responseInputPart
+	if err := json.Unmarshal(raw, &parts); err != nil {
+		return nil, errors.New("content must be a string or a list of parts")
+	}
+	converted := make([]interface{}, 0, len(parts))
+	for _, part := range parts {
+		switch part.Type {
+		case "input_text", "output_text":
+			converted = append(converted, map[string]interface{}{"type": "text", "text": part.Text})
+		case "input_image":
+			converted = append(converted, map[string]interface{}{
+				"type":      "image_url",
+				"image_url": map[string]string{"url": part.ImageURL},
+			})
+		default:
+			return nil, fmt.Errorf("unsupported content part type %q", part.Type)
+		}
+	}
+	return converted, nil
+}
+
+// finishStatus maps a chat finish reason to the status of a response
+func finishStatus(finishReason string) (string, *incompleteDetails) {
+	switch finishReason {
+	case "length":
+		return "incomplete", &incompleteDetails{Reason: "max_output_tokens"}
+	case "content_filter":
+		return "incomplete", &incompleteDetails{Reason: "content_filter"}
+	case finishMaxDuration:
+		return "incomplete", &incompleteDetails{Reason: finishMaxDuration}
+	}
+	return "completed", nil
+}
+
+// handleCreateResponse serves POST /v1/responses. With a stored previous
+// response, clients send only the new turn and the conversation so far is
+// restored from the conversation store.
+func (h *Handler) handleCreateResponse(w http.ResponseWriter, r *http.Request) {
+	var req responsesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.sendError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	input, err := parseResponseInput(req.Input)
+	if err != nil {
+		h.sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	owner := ""
+	if key := apiKeyFrom(r); key != nil {
+		owner = key.Name
+	}
+
+	var history []copilot.Message
+	if req.PreviousResponseID != "" {
+		if h.conversations == nil {
+			h.sendError(w, "previous_response_id requires the conversation store (GHCSD_RESPONSES_DIR)", http.StatusBadRequest)
+			return
+		}
+		previous, err := h.conversations.Get(req.PreviousResponseID)
+		if err == nil && previous.Owner != owner {
+			err = conversations.ErrNotFound
+		}
+		if errors.Is(err, conversations.ErrNotFound) {
+			h.sendError(w, fmt.Sprintf("Previous response with id '%s' not found", req.PreviousResponseID), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			h.sendError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		history = previous.History()
+		if req.Model == "" {
+			req.Model = previous.Model
+		}
+	}
+	conversation := append(history, input...)
+
+	// Instructions apply to this turn only and are not stored. The messages
+	// sent are a copy, so that filters do not alter the stored conversation.
+	var messages []copilot.Message
+	if req.Instructions != "" {
+		messages = append(messages, copilot.Message{Role: "system", Content: req.Instructions})
+	}
+	messages = append(messages, conversation...)
+
+	completionReq := copilot.CompletionRequest{
+		Model:     req.Model,
+		Messages:  messages,
+		Stream:    req.Stream,
+		TopP:      req.TopP,
+		MaxTokens: req.MaxOutputTokens,
+		User:      req.User,
+	}
+	if req.Temperature != nil {
+		completionReq.Temperature = *req.Temperature
+	}
+	completionReq.ServiceTier = req.ServiceTier
+	call, reqErr := h.buildCompletion(r, completionReq)
+	if reqErr != nil {
+		h.sendRequestError(w, reqErr)
+		return
+	}
+	if call.request.Stream {
+		call.request.StreamOptions = &copilot.StreamOptions{IncludeUsage: true}
+	}
+
+	resp := &responseObject{
+		ID:                 newResponseID("resp"),
+		Object:             "response",
+		CreatedAt:          time.Now().Unix(),
+		Status:             "in_progress",
+		Model:              call.model,
+		PreviousResponseID: req.PreviousResponseID,
+		Instructions:       req.Instructions,
+		Output:             []responseOutputItem{},
+		Store:              h.conversations != nil && (req.Store == nil || *req.Store),
+		Metadata:           req.Metadata,
+	}
+	item := responseOutputItem{
+		Type:    "message",
+		ID:      newResponseID("msg"),
+		Status:  "completed",
+		Role:    "assistant",
+		Content: []responseContentPart{},
+	}
+
+	upstreamStart := time.Now()
+	body, disconnect, err := h.startForClient(r, call)
+	defer disconnect(nil)
+	setModelHeaders(w, call, time.Since(upstreamStart))
+	if err != nil {
+		h.sendUpstreamError(w, err)
+		return
+	}
+	defer body.Close()
+
+	// save stores the finished response so that it can be continued
+	save := func() {
+		if !resp.Store {
+			return
+		}
+		data, err := json.Marshal(resp)
+		if err != nil {
+			return
+		}
+		text := ""
+		if len(resp.Output) > 0 && len(resp.Output[0].Content) > 0 {
+			text = resp.Output[0].Content[0].Text
+		}
+		err = h.conversations.Save(&conversations.Response{
+			ID:         resp.ID,
+			PreviousID: resp.PreviousResponseID,
+			Owner:      owner,
+			Model:      resp.Model,
+			CreatedAt:  time.Unix(resp.CreatedAt, 0),
+			Messages:   conversation,
+			Output:     copilot.Message{Role: "assistant", Content: text},
+			Body:       data,
+		})
+		if err != nil {
+			proxyLog.Errorf("[Error] Failed to store response %s: %v", resp.ID, err)
+		}
+	}
+
+	if !call.request.Stream {
+		var completion copilot.CompletionResponse
+		if err := json.NewDecoder(body).Decode(&completion); err != nil {
+			h.sendError(w, fmt.Sprintf("Failed to decode completion: %v", err), http.StatusBadGateway)
+			return
+		}
+		text, finishReason := "", ""
+		if len(completion.Choices) > 0 {
+			text = completion.Choices[0].Message.Content
+			finishReason = completion.Choices[0].FinishReason
+		}
+		resp.Status, resp.IncompleteDetails = finishStatus(finishReason)
+		item.Content = append(item.Content, responseContentPart{Type: "output_text", Text: text, Annotations: []interface{}{}})
+		resp.Output = append(resp.Output, item)
+		resp.Usage = &responseUsage{
+			InputTokens:  completion.Usage.PromptTokens,
+			OutputTokens: completion.Usage.CompletionTokens,
+			TotalTokens:  completion.Usage.TotalTokens,
+		}
+		save()
+		writeJSON(w, http.StatusOK, resp)
+		return
+	}
+
+	ndjson := wantsNDJSON(r)
+	if ndjson {
+		w.Header().Set("Content-Type", ndjsonContentType)
+	} else {
+		w.Header().Set("Content-Type", "text/event-stream")
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	controller := http.NewResponseController(w)
+	sequence := 0
+	// emit sends one event, as SSE or as a line of NDJSON. Once a write fails
+	// the client is gone, so the upstream request is cancelled rather than
+	// relayed to nobody.
+	emit := func(eventType string, fields map[string]interface{}) error {
+		fields["type"] = eventType
+		fields["sequence_number"] = sequence
+		sequence++
+		data, _ := json.Marshal(fields)
+		var err error
+		if ndjson {
+			_, err = fmt.Fprintf(w, "%s\n", data)
+		} else {
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventType, data)
+		}
+		if err == nil {
+			if err = controller.Flush(); errors.Is(err, http.ErrNotSupported) {
+				err = nil
+			}
+		}
+		if err != nil {
+			disconnect(errClientDisconnected)
+			return fmt.Errorf("%w: %v", errClientDisconnected, err)
+		}
+		return nil
+	}
+
+	inProgress := item
+	inProgress.Status = "in_progress"
+	err = emit("response.created", map[string]interface{}{"response": resp})
+	if err == nil {
+		err = emit("response.output_item.added", map[string]interface{}{"output_index": 0, "item": inProgress})
+	}
+	if err == nil {
+		err = emit("response.content_part.added", map[string]interface{}{
+			"item_id": item.ID, "output_index": 0, "content_index": 0,
+			"part": responseContentPart{Type: "output_text", Annotations: []interface{}{}},
+		})
+	}
+	if err != nil {
+		h.logWithPrefix(proxyLog, logging.Debug, "Error", fmt.Sprintf("Responses stream failed: %v", err))
+		return
+	}
+
+	var text strings.Builder
+	finishReason := ""
+	var usage copilot.CompletionResponse
+	err = forEachChunk(body, func(chunk *copilot.CompletionResponse) error {
+		if chunk.Usage.TotalTokens > 0 {
+			usage.Usage = chunk.Usage
+		}
+		for _, choice := range chunk.Choices {
+			if choice.Index != 0 {
+				continue
+			}
+			if choice.FinishReason != "" {
+				finishReason = choice.FinishReason
+			}
+			if delta := deltaText(choice); delta != "" {
+				text.WriteString(delta)
+				err := emit("response.output_text.delta", map[string]interface{}{
+					"item_id": item.ID, "output_index": 0, "content_index": 0, "delta": delta,
+				})
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		h.logWithPrefix(proxyLog, logging.Debug, "Error", fmt.Sprintf("Responses stream failed: %v", err))
+		if errors.Is(err, errClientDisconnected) {
+			return
+		}
+		translated := translateError(err)
+		emit("error", map[string]interface{}{"code": translated.Type, "message": translated.Message})
+		return
+	}
+
+	part := responseContentPart{Type: "output_text", Text: text.String(), Annotations: []interface{}{}}
+	item.Content = append(item.Content, part)
+	emit("response.output_text.done", map[string]interface{}{
+		"item_id": item.ID, "output_index": 0, "content_index": 0, "text": part.Text,
+	})
+	emit("response.content_part.done", map[string]interface{}{
+		"item_id": item.ID, "output_index": 0, "content_index": 0, "part": part,
+	})
+	emit("response.output_item.done", map[string]interface{}{"output_index": 0, "item": item})
+
+	resp.Status, resp.IncompleteDetails = finishStatus(finishReason)
+	resp.Output = append(resp.Output, item)
+	resp.Usage = &responseUsage{
+		InputTokens:  usage.Usage.PromptTokens,
+		OutputTokens: usage.Usage.CompletionTokens,
+		TotalTokens:  usage.Usage.TotalTokens,
+	}
+	save()
+	eventType := "response.completed"
+	if resp.Status == "incomplete" {
+		eventType = "response.incomplete"
+	}
+	emit(eventType, map[string]interface{}{"response": resp})
+}
+
+// storedResponse returns the stored response named in the request path,
+// writing an error when it does not exist or belongs to another API key
+func (h *Handler) storedResponse(w http.ResponseWriter, r *http.Request) (*conversations.Response, bool) {
+	id := r.PathValue("id")
+	if h.conversations == nil {
+		h.sendError(w, "The conversation store is not enabled (GHCSD_RESPONSES_DIR)", http.StatusNotFound)
+		return nil, false
+	}
+	resp, err := h.conversations.Get(id)
+	if err == nil {
+		owner := ""
+		if key := apiKeyFrom(r); key != nil {
+			owner = key.Name
+		}
+		if resp.Owner != owner {
+			err = conversations.ErrNotFound
+		}
+	}
+	if errors.Is(err, conversations.ErrNotFound) {
+		h.sendError(w, fmt.Sprintf("Response with id '%s' not found", id), http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		h.sendError(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	return resp, true
+}
+
+// handleGetResponse serves GET /v1/responses/{id}
+func (h *Handler) handleGetResponse(w http.ResponseWriter, r *http.Request) {
+	resp, ok := h.storedResponse(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp.Body)
+}
+
+// handleDeleteResponse serves DELETE /v1/responses/{id}
+func (h *Handler) handleDeleteResponse(w http.ResponseWriter, r *http.Request) {
+	resp, ok := h.storedResponse(w, r)
+	if !ok {
+		return
+	}
+	if err := h.conversations.Delete(resp.ID); err != nil && !errors.Is(err, conversations.ErrNotFound) {
+		h.sendError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"id":      resp.ID,
+		"object":  "response.deleted",
+		"deleted": true,
+	})
+}
@@ -0,0 +1,230 @@
+// internal/proxy/router.go
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/acazau/ghcsd/internal/config"
+	"github.com/acazau/ghcsd/internal/logfile"
+	"github.com/acazau/ghcsd/internal/version"
+)
+
+// publicPaths are reachable without an API key and are not rate limited
+var publicPaths = []string{"/health", "/v1/health", "/healthz/ready", "/version"}
+
+// otherRoute is the metrics label of requests matching no route
+const otherRoute = "other"
+
+// routeLabel returns a function labeling requests, for the request metrics,
+// with the path pattern of the first of muxes with a route for them. The
+// completion paths served by the catch-all handler keep their own label.
+func routeLabel(muxes ...*http.ServeMux) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		for _, mux := range muxes {
+			_, pattern := mux.Handler(r)
+			if pattern == "" || pattern == "/" {
+				continue
+			}
+			if _, path, ok := strings.Cut(pattern, " "); ok {
+				pattern = path
+			}
+			return pattern
+		}
+		switch strings.TrimPrefix(r.URL.Path, "/v1") {
+		case "/health", "/chat/completions", "/chat/completions/ws":
+			return r.URL.Path
+		}
+		return otherRoute
+	}
+}
+
+// NewRouter builds the HTTP handlers of the server wrapped in the middleware
+// stack configured by cfg. When cfg.AdminListen is set, the admin, login and
+// metrics endpoints are returned in a separate control handler; otherwise
+// control is nil and api serves them as well. shutdown stops the background
+// work of the handlers once the servers using them are closed.
+func NewRouter(cfg *config.Config, token string) (api, control http.Handler, shutdown func(), err error) {
+	handler, err := NewHandler(token, cfg)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	shutdown = handler.Close
+	separateControl := len(cfg.AdminListen) > 0
+
+	accessLog := log.Default()
+	if cfg.AccessLogFile != "" {
+		file, err := logfile.Open(cfg.AccessLogFile, cfg.LogOptions())
+		if err != nil {
+			handler.Close()
+			return nil, nil, nil, fmt.Errorf("failed to open access log: %w", err)
+		}
+		accessLog = log.New(file, "", log.LstdFlags)
+		shutdown = func() {
+			handler.Close()
+			file.Close()
+		}
+	}
+
+	metrics := NewMetrics()
+	if queue := handler.retryQueue; queue != nil {
+		metrics.RegisterGauge("ghcsd_retry_queue_depth", "Rate limited requests waiting for a retry.", queue.Depth)
+		metrics.RegisterCounter("ghcsd_retry_queue_retries_total", "Upstream retries made from the retry queue.", queue.retried.Load)
+		metrics.RegisterCounter("ghcsd_retry_queue_rejected_total", "Rate limited requests rejected because the queue was full.", queue.rejected.Load)
+		metrics.RegisterGaugeVec("ghcsd_retry_queue_waiting", "Rate limited requests waiting for a retry by priority.", "priority", queue.waitingByPriority)
+		metrics.RegisterCounter("ghcsd_retry_queue_yielded_total", "Retries held back for requests of a higher priority.", queue.yielded.Load)
+	}
+
+	metrics.RegisterGauge("ghcsd_inflight_requests", "Completions currently being served.", handler.inflight.len)
+	metrics.RegisterCounterVec("ghcsd_requests_cancelled_total", "Completions cancelled before they finished, by the client or an administrator.", "reason", handler.inflight.cancelled)
+	metrics.RegisterGauge("ghcsd_stream_buffer_bytes", "Bytes of streamed responses read ahead of their clients.", handler.streamBuffer.Stats.Buffered)
+	metrics.RegisterCounter("ghcsd_stream_buffer_full_total", "Times the buffer of a stream filled up because its client fell behind.", handler.streamBuffer.Stats.Full)
+	metrics.RegisterCounter("ghcsd_streams_dropped_total", "Streams dropped because their client fell behind by more than the buffer.", handler.streamBuffer.Stats.Dropped)
+	metrics.RegisterCounter("ghcsd_streams_max_duration_total", "Streams ended for running longer than the maximum stream duration.", handler.streamLimits.ended.Load)
+	metrics.RegisterCounterVec("ghcsd_tokens_total", "Prompt and completion tokens used by model.", "model", handler.tokenUsage)
+	metrics.RegisterGaugeVec("ghcsd_upstream_ratelimit", "Numeric rate limit headers of the latest Copilot responses by header suffix, the lowest across endpoints.", "header", handler.limits.rateLimitValues)
+	metrics.RegisterGaugeVec("ghcsd_upstream_quota_remaining_percent", "Remaining share of each limited Copilot quota, the lowest across endpoints.", "quota", handler.limits.quotaRemaining)
+	metrics.RegisterGaugeVec("ghcsd_copilot_token_expires_in_seconds", "Seconds until the Copilot token of the login expires, negative once expired.", "endpoint", handler.tokenExpiresIn)
+	metrics.RegisterCounter("ghcsd_copilot_token_expiry_warnings_total", "Warnings that the Copilot token is due for renewal, about to expire or expired.", handler.expiry.warnings.Load)
+	if coalescer := handler.coalescer; coalescer != nil {
+		metrics.RegisterCounter("ghcsd_requests_coalesced_total", "Completions answered by the upstream call of an identical concurrent request.", coalescer.coalesced.Load)
+	}
+	if breaker := handler.breaker; breaker != nil {
+		metrics.RegisterGauge("ghcsd_circuit_breaker_open", "Models whose circuit breaker is open.", breaker.openCircuits)
+		metrics.RegisterCounter("ghcsd_circuit_breaker_trips_total", "Times a model's circuit breaker opened.", breaker.trips.Load)
+		metrics.RegisterCounter("ghcsd_circuit_breaker_rejected_total", "Requests rejected by an open circuit breaker.", breaker.rejected.Load)
+	}
+	if toolCheck := handler.toolCheck; toolCheck != nil {
+		metrics.RegisterCounter("ghcsd_tool_calls_invalid_total", "Tool calls returned with arguments not matching their schema.", toolCheck.invalid.Load)
+		metrics.RegisterCounter("ghcsd_tool_call_corrections_total", "Completions sent back to the model to correct invalid tool calls.", toolCheck.retried.Load)
+	}
+	if shadow := handler.shadow; shadow != nil {
+		metrics.RegisterCounter("ghcsd_shadow_requests_total", "Completions mirrored to the shadow model.", shadow.mirrored.Load)
+		metrics.RegisterCounter("ghcsd_shadow_failures_total", "Mirrored completions that failed.", shadow.failed.Load)
+		metrics.RegisterCounter("ghcsd_shadow_skipped_total", "Sampled completions not mirrored because too many mirrors were running.", shadow.skipped.Load)
+	}
+
+	mux := http.NewServeMux()
+	if !separateControl {
+		mux.Handle("GET /metrics", metrics)
+	}
+	mux.HandleFunc("GET /version", handleVersion)
+	mux.HandleFunc("GET /healthz/ready", handler.handleReady)
+	// Both OpenAI frontends list models in the OpenAI format
+	models := cfg.EnableOpenAI || cfg.EnableResponses
+	mux.HandleFunc("GET /v1/models", frontendRoute(models, "OpenAI", "GHCSD_ENABLE_OPENAI", handler.handleListModels))
+	mux.HandleFunc("GET /v1/models/{model}", frontendRoute(models, "OpenAI", "GHCSD_ENABLE_OPENAI", handler.handleGetModel))
+	mux.HandleFunc("GET /models", frontendRoute(models, "OpenAI", "GHCSD_ENABLE_OPENAI", handler.handleListModels))
+	mux.HandleFunc("GET /models/{model}", frontendRoute(models, "OpenAI", "GHCSD_ENABLE_OPENAI", handler.handleGetModel))
+	routeFrontends(mux, handler, cfg)
+
+	mux.Handle("/", handler)
+	if !cfg.EnableOpenAI {
+		// The handler serves chat completions; these patterns take precedence
+		for _, pattern := range []string{"/v1/chat/completions", "/chat/completions", "/v1/chat/completions/ws", "/chat/completions/ws"} {
+			mux.HandleFunc(pattern, frontendRoute(false, "OpenAI", "GHCSD_ENABLE_OPENAI", nil))
+		}
+	}
+
+	// Admin keys are also valid API keys
+	keys := append(append([]string{}, cfg.APIKeys...), cfg.AdminKeys...)
+	if len(cfg.APIKeys) == 0 && handler.keys == nil {
+		keys = nil
+	}
+	apiRoutes := Chain(mux,
+		AuthMiddleware(keys, handler.keys, handler.shared, publicPaths...),
+		EventsMiddleware(handler.events),
+		RateLimitMiddleware(handler.shared, cfg.RateLimit, publicPaths...),
+		IPRateLimitMiddleware(handler.shared, cfg.IPRateLimit, publicPaths...),
+		CaptureMiddleware(cfg.CaptureDir, cfg.AdminKeys),
+	)
+
+	// The admin endpoints are authorized by AdminMiddleware alone, so that
+	// they stay reachable to create the first named API key
+	admin := http.NewServeMux()
+	admin.HandleFunc("GET /admin/logs/stream", handler.handleLogStream)
+	admin.HandleFunc("GET /admin/requests", handler.handleListRequests)
+	admin.HandleFunc("DELETE /admin/requests/{id}", handler.handleCancelRequest)
+	admin.HandleFunc("GET /admin/keys", handler.handleListKeys)
+	admin.HandleFunc("POST /admin/keys", handler.handleCreateKey)
+	admin.HandleFunc("GET /admin/keys/{name}", handler.handleGetKey)
+	admin.HandleFunc("PUT /admin/keys/{name}", handler.handleUpdateKey)
+	admin.HandleFunc("DELETE /admin/keys/{name}", handler.handleDeleteKey)
+	admin.HandleFunc("GET /admin/upstreams", handler.handleListUpstreams)
+	admin.HandleFunc("GET /admin/stats", handler.handleStats)
+	admin.HandleFunc("GET /admin/usage", handler.handleUsage)
+	admin.HandleFunc("GET /admin/status", handler.handleStatus)
+	admin.HandleFunc("GET /admin/logging", handler.handleGetLogging)
+	admin.HandleFunc("PUT /admin/logging", handler.handleUpdateLogging)
+
+	// Logging in replaces the account all requests are served with, so the
+	// device login is restricted like the admin endpoints
+	login := http.NewServeMux()
+	login.HandleFunc("POST /auth/device", handler.handleDeviceLogin)
+	login.HandleFunc("GET /auth/status", handler.handleLoginStatus)
+
+	// The dry run reveals the operator's prompts, filters and hook changes
+	debug := http.NewServeMux()
+	debug.HandleFunc("POST /debug/convert", handler.handleConvert)
+
+	root := http.NewServeMux()
+	root.Handle("/", apiRoutes)
+	controlRoutes := root
+	if separateControl {
+		// The control listeners are trusted by network placement, but the
+		// admin keys still apply when configured
+		controlRoutes = http.NewServeMux()
+		controlRoutes.Handle("GET /metrics", Chain(metrics, AdminMiddleware(cfg.AdminKeys)))
+
+		for _, pattern := range []string{"/admin/", "/auth/", "/debug/", "/metrics"} {
+			root.HandleFunc(pattern, handleControlOnly)
+		}
+	}
+	controlRoutes.Handle("/admin/", Chain(admin, AdminMiddleware(cfg.AdminKeys)))
+	controlRoutes.Handle("/auth/", Chain(login, AdminMiddleware(cfg.AdminKeys)))
+	controlRoutes.Handle("/debug/", Chain(debug, AdminMiddleware(cfg.AdminKeys)))
+
+	middlewares := []Middleware{
+		RecoveryMiddleware(),
+		RequestIDMiddleware(),
+		ClientIPMiddleware(cfg.TrustedProxies, cfg.AllowCIDRs, cfg.DenyCIDRs),
+		TracingMiddleware(handler.tracer),
+		LoggingMiddleware(accessLog),
+		MetricsMiddleware(metrics, routeLabel(admin, login, debug, mux, controlRoutes)),
+		CORSMiddleware(cfg.CORSOrigins),
+	}
+	api = Chain(root, middlewares...)
+	if separateControl {
+		// The control plane is not called from browsers, so no CORS
+		control = Chain(controlRoutes, middlewares[:len(middlewares)-1]...)
+	}
+	return api, control, shutdown, nil
+}
+
+// frontendRoute returns the handler of a route of a frontend, or one
+// answering that the frontend is disabled and how to enable it
+func frontendRoute(enabled bool, frontend, setting string, h http.HandlerFunc) http.HandlerFunc {
+	if enabled {
+		return h
+	}
+	flagName := strings.ToLower(strings.ReplaceAll(strings.TrimPrefix(setting, "GHCSD_"), "_", "-"))
+	message := fmt.Sprintf("Not found; the %s API is disabled on this server, enable it with %s=true or -%s", frontend, setting, flagName)
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSONError(w, message, "not_found_error", http.StatusNotFound)
+	}
+}
+
+// handleControlOnly answers requests for control plane endpoints reaching
+// the API listeners when they are served separately
+func handleControlOnly(w http.ResponseWriter, r *http.Request) {
+	writeJSONError(w, "Not found; this endpoint is served on the admin listener", "not_found_error", http.StatusNotFound)
+}
+
+// handleVersion reports the build information of the running binary
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(version.Get())
+}
@@ -0,0 +1,204 @@
+// internal/proxy/shadow.go
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/acazau/ghcsd/internal/config"
+	"github.com/acazau/ghcsd/pkg/copilot"
+	"github.com/acazau/ghcsd/pkg/upstream"
+)
+
+const (
+	// shadowTimeout bounds a mirrored request
+	shadowTimeout = 5 * time.Minute
+	// maxShadowInflight bounds the mirrored requests running at once;
+	// completions beyond it are not mirrored
+	maxShadowInflight = 16
+)
+
+// shadowMirror sends a copy of a share of the completions to another model
+// and logs both responses for offline comparison. Mirrored requests run in
+// the background and never affect the response sent to the client.
+type shadowMirror struct {
+	model     string
+	percent   float64
+	providers *upstream.Registry
+	slots     chan struct{}
+
+	mu  sync.Mutex
+	out *os.File
+
+	mirrored atomic.Int64
+	skipped  atomic.Int64
+	failed   atomic.Int64
+}
+
+// newShadowMirror creates a mirror of percent of the completions to model,
+// logged as JSON lines to path, or returns nil when model is empty
+func newShadowMirror(model string, percent float64, path string, providers *upstream.Registry) (*shadowMirror, error) {
+	if model == "" || percent <= 0 {
+		return nil, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create shadow log directory: %w", err)
+	}
+	out, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open shadow log: %w", err)
+	}
+	proxyLog.Infof("[Shadow] Mirroring %g%% of completions to %s, logged to %s", percent, model, path)
+	return &shadowMirror{
+		model:     model,
+		percent:   percent,
+		providers: providers,
+		slots:     make(chan struct{}, maxShadowInflight),
+		out:       out,
+	}, nil
+}
+
+// shadowResult is the response of one side of a comparison
+type shadowResult struct {
+	Model            string             `json:"model"`
+	Upstream         string             `json:"upstream"`
+	Content          string             `json:"content"`
+	ToolCalls        []copilot.ToolCall `json:"tool_calls,omitempty"`
+	FinishReason     string             `json:"finish_reason,omitempty"`
+	PromptTokens     int                `json:"prompt_tokens,omitempty"`
+	CompletionTokens int                `json:"completion_tokens,omitempty"`
+	LatencyMS        int64              `json:"latency_ms"`
+	Error            string             `json:"error,omitempty"`
+}
+
+// setResponse fills the result from a completion response
+func (r *shadowResult) setResponse(resp *copilot.CompletionResponse) {
+	if len(resp.Choices) > 0 {
+		choice := resp.Choices[0]
+		r.Content = choice.Message.Content
+		r.ToolCalls = choice.Message.ToolCalls
+		r.FinishReason = choice.FinishReason
+	}
+	r.PromptTokens = resp.Usage.PromptTokens
+	r.CompletionTokens = resp.Usage.CompletionTokens
+}
+
+// shadowRecord is a line of the shadow log
+type shadowRecord struct {
+	Time      time.Time    `json:"time"`
+	RequestID string       `json:"request_id,omitempty"`
+	Primary   shadowResult `json:"primary"`
+	Shadow    shadowResult `json:"shadow"`
+}
+
+// shadowRun pairs the results of a mirrored completion. The record is
+// written once both the primary and the shadow response are in.
+type shadowRun struct {
+	mirror *shadowMirror
+
+	mu      sync.Mutex
+	record  shadowRecord
+	pending int
+}
+
+// start mirrors call with the configured probability and returns the run
+// the primary result is reported to, or nil when call is not mirrored
+func (m *shadowMirror) start(ctx context.Context, call *completionCall) *shadowRun {
+	if m == nil || rand.Float64()*100 >= m.percent {
+		return nil
+	}
+	model, ok := config.GetModelInfo(m.model)
+	if !ok {
+		return nil
+	}
+	provider, err := m.providers.Get(model.Upstream)
+	if err != nil {
+		proxyLog.Warnf("[Shadow] %v", err)
+		return nil
+	}
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		m.skipped.Add(1)
+		return nil
+	}
+	m.mirrored.Add(1)
+
+	req := call.request
+	req.Model = model.RealID
+	req.Stream = false
+	req.StreamOptions = nil
+	if limit := model.MaxOutputTokens; limit > 0 && req.MaxTokens > limit {
+		req.MaxTokens = limit
+	}
+	run := &shadowRun{
+		mirror:  m,
+		pending: 2,
+		record: shadowRecord{
+			Time:      time.Now().UTC(),
+			RequestID: requestIDFrom(ctx),
+			Primary:   shadowResult{Model: call.model, Upstream: call.provider.Name()},
+			Shadow:    shadowResult{Model: model.RealID, Upstream: provider.Name()},
+		},
+	}
+
+	// The mirror outlives the client request, so it must not be cancelled
+	// with it
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), shadowTimeout)
+	go func() {
+		defer cancel()
+		defer func() { <-m.slots }()
+		start := time.Now()
+		resp, err := provider.Complete(ctx, req)
+		if err != nil {
+			m.failed.Add(1)
+		}
+		run.complete(true, resp, time.Since(start), err)
+	}()
+	return run
+}
+
+// complete records the primary, or with shadow the mirrored, result of the
+// run and writes the record once both are in. It is a no-op on a nil run.
+func (r *shadowRun) complete(shadow bool, resp *copilot.CompletionResponse, latency time.Duration, err error) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	result := &r.record.Primary
+	if shadow {
+		result = &r.record.Shadow
+	}
+	result.LatencyMS = latency.Milliseconds()
+	if err != nil {
+		result.Error = err.Error()
+	} else if resp != nil {
+		result.setResponse(resp)
+	}
+	r.pending--
+	if r.pending == 0 {
+		r.mirror.write(r.record)
+	}
+}
+
+// write appends a record to the shadow log
+func (m *shadowMirror) write(record shadowRecord) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		proxyLog.Errorf("[Shadow] Failed to encode record: %v", err)
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, err := m.out.Write(append(line, '\n')); err != nil {
+		proxyLog.Errorf("[Shadow] Failed to write record: %v", err)
+	}
+}
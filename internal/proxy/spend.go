@@ -0,0 +1,158 @@
+// internal/proxy/spend.go
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/acazau/ghcsd/internal/apikeys"
+)
+
+// spendPeriods returns the periods spend is counted in at now: the UTC day
+// and calendar month
+func spendPeriods(now time.Time) (day, month string) {
+	now = now.UTC()
+	return "day:" + now.Format("2006-01-02"), "month:" + now.Format("2006-01")
+}
+
+// completionCost estimates the cost of a completion of model from the cost
+// table; models without a price cost nothing
+func (h *Handler) completionCost(model string, promptTokens, completionTokens int) float64 {
+	cost, ok := h.costs[model]
+	if !ok {
+		return 0
+	}
+	return (float64(promptTokens)*cost.Input + float64(completionTokens)*cost.Output) / 1000
+}
+
+// checkSpend rejects the requests of an API key whose estimated spend has
+// reached its daily or monthly limit. The limits are not enforced when the
+// spend cannot be read, like the rate limits.
+func (h *Handler) checkSpend(ctx context.Context, key *apikeys.Key) *requestError {
+	if key == nil || (key.DailySpendLimit == 0 && key.MonthlySpendLimit == 0) {
+		return nil
+	}
+	now := time.Now().UTC()
+	day, month := spendPeriods(now)
+	limits := []struct {
+		period string
+		name   string
+		limit  float64
+		reset  time.Time
+	}{
+		{day, "daily", key.DailySpendLimit, now.Truncate(24 * time.Hour).Add(24 * time.Hour)},
+		{month, "monthly", key.MonthlySpendLimit, time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, l := range limits {
+		if l.limit == 0 {
+			continue
+		}
+		spend, err := h.shared.Spend(ctx, l.period)
+		if err != nil {
+			proxyLog.Warnf("[Spend] Failed to check the spend of API key %s, allowing the request: %v", key.Name, err)
+			return nil
+		}
+		if spend[key.Name] >= l.limit {
+			return &requestError{
+				status:     http.StatusTooManyRequests,
+				message:    fmt.Sprintf("Budget exceeded for API key %s: estimated %s spend of %.4f reached its limit of %.4f", key.Name, l.name, spend[key.Name], l.limit),
+				code:       "budget_exceeded",
+				retryAfter: l.reset.Sub(now),
+			}
+		}
+	}
+	return nil
+}
+
+// recordSpend adds the estimated cost of a completion to the spend of the
+// API key it was made with, in the background like recordTokens
+func (h *Handler) recordSpend(call *completionCall, promptTokens, completionTokens int) {
+	if call.keyName == "" {
+		return
+	}
+	cost := h.completionCost(call.model, promptTokens, completionTokens)
+	if cost <= 0 {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), stateTimeout)
+		defer cancel()
+		day, month := spendPeriods(time.Now())
+		for _, period := range []string{day, month} {
+			if err := h.shared.AddSpend(ctx, period, call.keyName, cost); err != nil {
+				proxyLog.Errorf("[State] Failed to record the spend of API key %s: %v", call.keyName, err)
+				return
+			}
+		}
+	}()
+}
+
+// keySpend is the estimated spend of an API key in the usage report
+type keySpend struct {
+	Name              string  `json:"name"`
+	DailySpend        float64 `json:"daily_spend"`
+	DailySpendLimit   float64 `json:"daily_spend_limit,omitempty"`
+	MonthlySpend      float64 `json:"monthly_spend"`
+	MonthlySpendLimit float64 `json:"monthly_spend_limit,omitempty"`
+}
+
+// handleUsage serves GET /admin/usage, reporting the tokens used per model
+// and the estimated spend of each API key today and this month
+func (h *Handler) handleUsage(w http.ResponseWriter, r *http.Request) {
+	day, month := spendPeriods(time.Now())
+	daily, err := h.shared.Spend(r.Context(), day)
+	var monthly map[string]float64
+	if err == nil {
+		monthly, err = h.shared.Spend(r.Context(), month)
+	}
+	if err != nil {
+		writeJSONError(w, fmt.Sprintf("Failed to read the spend: %v", err), "api_error", http.StatusInternalServerError)
+		return
+	}
+	h.writeUsage(w, day, month, daily, monthly)
+}
+
+// writeUsage writes the usage report from the spend of each key in the
+// current day and month
+func (h *Handler) writeUsage(w http.ResponseWriter, day, month string, daily, monthly map[string]float64) {
+	keys := make(map[string]*keySpend)
+	entry := func(name string) *keySpend {
+		if keys[name] == nil {
+			keys[name] = &keySpend{Name: name}
+		}
+		return keys[name]
+	}
+	if h.keys != nil {
+		for _, key := range h.keys.List() {
+			spend := entry(key.Name)
+			spend.DailySpendLimit = key.DailySpendLimit
+			spend.MonthlySpendLimit = key.MonthlySpendLimit
+		}
+	}
+	var dailyTotal, monthlyTotal float64
+	for name, amount := range daily {
+		entry(name).DailySpend = amount
+		dailyTotal += amount
+	}
+	for name, amount := range monthly {
+		entry(name).MonthlySpend = amount
+		monthlyTotal += amount
+	}
+
+	report := make([]keySpend, 0, len(keys))
+	for _, spend := range keys {
+		report = append(report, *spend)
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].Name < report[j].Name })
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"day":           day[len("day:"):],
+		"month":         month[len("month:"):],
+		"tokens":        h.tokenUsage(),
+		"daily_spend":   dailyTotal,
+		"monthly_spend": monthlyTotal,
+		"keys":          report,
+	})
+}
@@ -0,0 +1,248 @@
+// internal/proxy/stream.go
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+
+	"github.com/acazau/ghcsd/pkg/copilot"
+)
+
+// forEachChunk decodes the SSE stream returned by a provider and calls fn for
+// every completion chunk until the stream ends or fn returns an error
+func forEachChunk(stream io.Reader, fn func(chunk *copilot.CompletionResponse) error) error {
+	scanner := bufio.NewScanner(stream)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		data, ok := bytes.CutPrefix(scanner.Bytes(), []byte("data: "))
+		if !ok || len(data) == 0 || bytes.Equal(data, []byte("[DONE]")) {
+			continue
+		}
+		var chunk copilot.CompletionResponse
+		if err := json.Unmarshal(data, &chunk); err != nil {
+			continue
+		}
+		if chunk.Error != nil {
+			return chunk.Error
+		}
+		if err := fn(&chunk); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// deltaText returns the text content of a streamed choice delta
+func deltaText(choice copilot.Choice) string {
+	text, _ := choice.Delta.Content.(string)
+	return text
+}
+
+// countingStream tracks the tokens of a streamed completion as it is relayed
+// to the client. onChunk is called with the completion tokens streamed so
+// far and onFinish once with the total tokens used when the stream ends.
+type countingStream struct {
+	io.ReadCloser
+	promptTokens int
+	onChunk      func(completionTokens int)
+	onFinish     func(totalTokens int)
+
+	// transcript, when set, collects the streamed text
+	transcript *strings.Builder
+
+	pending         []byte
+	completionChars int
+	usage           copilot.CompletionResponse
+	finishReason    string
+	finished        bool
+}
+
+func (s *countingStream) Read(p []byte) (int, error) {
+	n, err := s.ReadCloser.Read(p)
+	s.pending = append(s.pending, p[:n]...)
+	rest := s.pending
+	for {
+		line, tail, ok := bytes.Cut(rest, []byte("\n"))
+		if !ok {
+			break
+		}
+		s.countLine(line)
+		rest = tail
+	}
+	s.pending = append(s.pending[:0], rest...)
+	if err != nil {
+		s.finish()
+	}
+	return n, err
+}
+
+func (s *countingStream) Close() error {
+	s.finish()
+	return s.ReadCloser.Close()
+}
+
+// countLine accounts for one SSE line
+func (s *countingStream) countLine(line []byte) {
+	data, ok := bytes.CutPrefix(bytes.TrimSpace(line), []byte("data: "))
+	if !ok || len(data) == 0 || bytes.Equal(data, []byte("[DONE]")) {
+		return
+	}
+	var chunk copilot.CompletionResponse
+	if err := json.Unmarshal(data, &chunk); err != nil {
+		return
+	}
+	if chunk.Usage.TotalTokens > 0 {
+		s.usage.Usage = chunk.Usage
+	}
+	for _, choice := range chunk.Choices {
+		s.completionChars += len(deltaText(choice))
+		if s.transcript != nil {
+			s.transcript.WriteString(deltaText(choice))
+		}
+		if choice.FinishReason != "" {
+			s.finishReason = choice.FinishReason
+		}
+		for _, call := range choice.Delta.ToolCalls {
+			s.completionChars += len(call.Function.Name) + len(call.Function.Arguments)
+		}
+	}
+	if s.onChunk != nil {
+		s.onChunk(s.completionTokens())
+	}
+}
+
+// completionTokens returns the completion tokens streamed so far, preferring
+// the usage reported upstream over an estimate from the streamed text
+func (s *countingStream) completionTokens() int {
+	if s.usage.Usage.CompletionTokens > 0 {
+		return s.usage.Usage.CompletionTokens
+	}
+	return (s.completionChars + 3) / 4
+}
+
+// response summarizes the relayed stream as a completion response
+func (s *countingStream) response() *copilot.CompletionResponse {
+	resp := &copilot.CompletionResponse{Usage: s.usage.Usage}
+	if resp.Usage.TotalTokens == 0 {
+		resp.Usage.PromptTokens = s.promptTokens
+		resp.Usage.CompletionTokens = s.completionTokens()
+	}
+	choice := copilot.Choice{FinishReason: s.finishReason}
+	if s.transcript != nil {
+		choice.Message.Content = s.transcript.String()
+	}
+	resp.Choices = []copilot.Choice{choice}
+	return resp
+}
+
+// finish reports the tokens the stream used, once
+func (s *countingStream) finish() {
+	if s.finished {
+		return
+	}
+	s.finished = true
+	if s.onFinish == nil {
+		return
+	}
+	if s.usage.Usage.TotalTokens > 0 {
+		s.onFinish(s.usage.Usage.TotalTokens)
+		return
+	}
+	s.onFinish(s.promptTokens + s.completionTokens())
+}
+
+// lineStream relays a stream line by line, replacing every complete line
+// with what rewrite returns for it, or dropping it when that is nil. finish,
+// when set, returns what to append once the stream ends.
+type lineStream struct {
+	io.ReadCloser
+	rewrite func(line []byte) []byte
+	finish  func() []byte
+
+	buf     []byte
+	pending []byte
+	out     bytes.Buffer
+	err     error
+}
+
+func (s *lineStream) Read(p []byte) (int, error) {
+	for s.out.Len() == 0 && s.err == nil {
+		if s.buf == nil {
+			s.buf = make([]byte, 32*1024)
+		}
+		n, err := s.ReadCloser.Read(s.buf)
+		s.pending = append(s.pending, s.buf[:n]...)
+		for {
+			line, rest, ok := bytes.Cut(s.pending, []byte("\n"))
+			if !ok {
+				break
+			}
+			if rewritten := s.rewrite(line); rewritten != nil {
+				s.out.Write(rewritten)
+				s.out.WriteByte('\n')
+			}
+			s.pending = rest
+		}
+		if err != nil {
+			if len(s.pending) > 0 {
+				s.out.Write(s.rewrite(s.pending))
+				s.pending = nil
+			}
+			if s.finish != nil {
+				s.out.Write(s.finish())
+			}
+			s.err = err
+		}
+	}
+	if s.out.Len() > 0 {
+		return s.out.Read(p)
+	}
+	return 0, s.err
+}
+
+// eventReader relays an SSE stream one complete event at a time, holding
+// back the start of an event until the blank line ending it arrives. A
+// stream cut short can then append an event of its own on a clean boundary,
+// dropping only the event left incomplete.
+type eventReader struct {
+	src io.Reader
+
+	buf     []byte
+	pending []byte
+	ready   []byte
+	err     error
+}
+
+func newEventReader(src io.Reader) *eventReader {
+	return &eventReader{src: src}
+}
+
+func (r *eventReader) Read(p []byte) (int, error) {
+	for len(r.ready) == 0 {
+		if r.err != nil {
+			// A stream ending normally is relayed in full, even when its last
+			// event lacks the blank line
+			if r.err == io.EOF && len(r.pending) > 0 {
+				r.ready, r.pending = r.pending, nil
+				break
+			}
+			return 0, r.err
+		}
+		if r.buf == nil {
+			r.buf = make([]byte, 32*1024)
+		}
+		n, err := r.src.Read(r.buf)
+		r.pending = append(r.pending, r.buf[:n]...)
+		r.err = err
+		if end := bytes.LastIndex(r.pending, []byte("\n\n")); end >= 0 {
+			r.ready = append(r.ready[:0], r.pending[:end+2]...)
+			r.pending = append(r.pending[:0], r.pending[end+2:]...)
+		}
+	}
+	n := copy(p, r.ready)
+	r.ready = r.ready[n:]
+	return n, nil
+}
@@ -0,0 +1,60 @@
+// internal/proxy/stream_test.go
+package proxy
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+// usageStream is a streamed completion as handleStream relays it with
+// stream_options.include_usage: the usage comes in a chunk without choices
+const usageStream = `data: {"id":"chatcmpl-1","choices":[{"index":0,"delta":{"role":"assistant","content":"Hello"}}]}
+
+data: {"id":"chatcmpl-1","choices":[{"index":0,"delta":{"content":" there, how can I help?"},"finish_reason":"stop"}]}
+
+data: {"id":"chatcmpl-1","choices":[],"usage":{"prompt_tokens":11,"completion_tokens":7,"total_tokens":18}}
+
+data: {"choices":[{"index":0,"finish_reason":"stop","message":{"role":"assistant"}}]}
+
+`
+
+func TestCountingStreamPrefersReportedUsage(t *testing.T) {
+	var chunks []int
+	total := -1
+	stream := &countingStream{
+		ReadCloser:   io.NopCloser(strings.NewReader(usageStream)),
+		promptTokens: 100,
+		onChunk:      func(completionTokens int) { chunks = append(chunks, completionTokens) },
+		onFinish:     func(totalTokens int) { total = totalTokens },
+	}
+	if _, err := io.Copy(io.Discard, stream); err != nil {
+		t.Fatal(err)
+	}
+	stream.Close()
+
+	if total != 18 {
+		t.Errorf("total tokens = %d, want the reported 18", total)
+	}
+	if last := chunks[len(chunks)-1]; last != 7 {
+		t.Errorf("completion tokens = %d, want the reported 7", last)
+	}
+	if usage := stream.response().Usage; usage.PromptTokens != 11 || usage.CompletionTokens != 7 {
+		t.Errorf("usage = %+v, want 11 prompt and 7 completion tokens", usage)
+	}
+}
+
+func TestCountingStreamEstimatesWithoutUsage(t *testing.T) {
+	total := -1
+	stream := &countingStream{
+		ReadCloser:   io.NopCloser(strings.NewReader(`data: {"choices":[{"index":0,"delta":{"content":"12345678"}}]}` + "\n\n")),
+		promptTokens: 100,
+		onFinish:     func(totalTokens int) { total = totalTokens },
+	}
+	if _, err := io.Copy(io.Discard, stream); err != nil {
+		t.Fatal(err)
+	}
+	if total != 102 {
+		t.Errorf("total tokens = %d, want 100 prompt and 2 estimated", total)
+	}
+}
@@ -0,0 +1,56 @@
+// internal/proxy/streambuffer.go
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/acazau/ghcsd/pkg/copilot"
+	"github.com/acazau/ghcsd/pkg/streambuf"
+)
+
+// droppedStream ends a buffered stream dropped for its slow client with an
+// error chunk, so that the client can tell it apart from a complete answer
+type droppedStream struct {
+	io.ReadCloser
+	// events relays the stream up to its last complete event
+	events *eventReader
+	call   *completionCall
+	// ending is the rest of the error chunk once the stream is dropped
+	ending  []byte
+	dropped bool
+}
+
+// bufferStream reads body ahead into a bounded buffer, so that a slow client
+// does not stall reading the upstream response until the buffer is full
+func (h *Handler) bufferStream(call *completionCall, body io.ReadCloser) io.ReadCloser {
+	if h.streamBuffer.Size <= 0 {
+		return body
+	}
+	buffered := streambuf.New(body, h.streamBuffer)
+	return &droppedStream{ReadCloser: buffered, events: newEventReader(buffered), call: call}
+}
+
+func (s *droppedStream) Read(p []byte) (int, error) {
+	if !s.dropped {
+		n, err := s.events.Read(p)
+		if !errors.Is(err, streambuf.ErrSlowReader) {
+			return n, err
+		}
+		proxyLog.Warnf("[Warning] Dropped the stream of %s for %s: the client fell behind by more than the stream buffer", s.call.model, s.call.caller)
+		s.dropped = true
+		data, _ := json.Marshal(struct {
+			Error *copilot.StreamError `json:"error"`
+		}{&copilot.StreamError{Message: "the client did not keep up with the stream", Type: "server_error", Code: "client_too_slow"}})
+		// Only complete events were relayed, so the error starts one
+		s.ending = []byte(fmt.Sprintf("data: %s\n\n", data))
+	}
+	if len(s.ending) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, s.ending)
+	s.ending = s.ending[n:]
+	return n, nil
+}
@@ -0,0 +1,38 @@
+// internal/proxy/streambuffer_test.go
+package proxy
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/acazau/ghcsd/pkg/streambuf"
+)
+
+func TestDroppedStreamEndsOnEventBoundary(t *testing.T) {
+	chunk := `data: {"choices":[{"index":0,"delta":{"content":"a"}}]}`
+	cuts := [][]string{
+		{chunk + "\n\n", chunk[:20]},
+		{chunk + "\n"},
+		{chunk + "\n\n"},
+	}
+	for _, reads := range cuts {
+		src := &scriptedReader{reads: reads, err: streambuf.ErrSlowReader}
+		stream := &droppedStream{ReadCloser: src, events: newEventReader(src), call: &completionCall{model: "gpt-4o"}}
+		out, err := io.ReadAll(stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		events := parseEvents(t, out)
+		if len(events) == 0 {
+			t.Fatalf("no events in %q", out)
+		}
+		if last := events[len(events)-1]; last["error"] == nil {
+			t.Errorf("last event %v is not the error in %q", last, out)
+		}
+		if !strings.Contains(string(out), "client_too_slow") {
+			t.Errorf("stream %q lacks the client_too_slow error", out)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+// internal/proxy/streamlimit.go
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/acazau/ghcsd/pkg/copilot"
+)
+
+// finishMaxDuration is the finish reason of streams ended for running longer
+// than their route allows
+const finishMaxDuration = "max_duration"
+
+// errMaxStreamDuration is the cancellation cause of the upstream request of a
+// stream that ran too long
+var errMaxStreamDuration = errors.New("maximum stream duration exceeded")
+
+// streamLimits caps how long a stream may run, by route
+type streamLimits struct {
+	fallback time.Duration
+	routes   map[string]time.Duration
+	// ended counts the streams ended for running too long
+	ended atomic.Int64
+}
+
+// newStreamLimits creates the limits applying fallback to the routes without
+// one of their own. A limit of 0 leaves streams unlimited.
+func newStreamLimits(fallback time.Duration, routes map[string]time.Duration) *streamLimits {
+	return &streamLimits{fallback: fallback, routes: routes}
+}
+
+// limit returns the maximum duration of streams served on path
+func (l *streamLimits) limit(path string) time.Duration {
+	if limit, ok := l.routes[path]; ok {
+		return limit
+	}
+	return l.fallback
+}
+
+// deadlineStream relays a stream until it has run for limit. The upstream
+// request is then cancelled through expire and the stream ends with a chunk
+// giving each choice the max_duration finish reason, so that clients see a
+// complete stream rather than a dropped connection.
+type deadlineStream struct {
+	io.ReadCloser
+	// events relays the stream up to its last complete event
+	events *eventReader
+	ctx    context.Context
+	timer  *time.Timer
+	// ending is the rest of the closing chunk once the limit is reached
+	ending  []byte
+	expired bool
+}
+
+// limitStream ends body once it has run for the maximum duration of call.
+// ctx is the context of the upstream request, cancelled by expire.
+func (h *Handler) limitStream(ctx context.Context, call *completionCall, body io.ReadCloser, expire context.CancelCauseFunc) io.ReadCloser {
+	if call.maxDuration <= 0 {
+		return body
+	}
+	s := &deadlineStream{ReadCloser: body, events: newEventReader(body), ctx: ctx}
+	s.timer = time.AfterFunc(call.maxDuration, func() {
+		proxyLog.Warnf("[Warning] Ending the stream of %s for %s after the maximum stream duration of %s", call.model, call.caller, call.maxDuration)
+		h.streamLimits.ended.Add(1)
+		expire(errMaxStreamDuration)
+	})
+	n := call.request.N
+	if n < 1 {
+		n = 1
+	}
+	ending := copilot.CompletionResponse{Model: call.model, Created: time.Now().Unix()}
+	for i := 0; i < n; i++ {
+		choice := copilot.Choice{Index: i, FinishReason: finishMaxDuration}
+		choice.Message.Role = "assistant"
+		ending.Choices = append(ending.Choices, choice)
+	}
+	data, _ := json.Marshal(ending)
+	s.ending = []byte(fmt.Sprintf("data: %s\n\n", data))
+	return s
+}
+
+func (s *deadlineStream) Read(p []byte) (int, error) {
+	if !s.expired {
+		n, err := s.events.Read(p)
+		if !errors.Is(context.Cause(s.ctx), errMaxStreamDuration) {
+			if err != nil {
+				s.timer.Stop()
+			}
+			return n, err
+		}
+		// What upstream sent after the limit, such as the error chunk of
+		// the cancelled request, is dropped along with the incomplete event.
+		// Only complete events were relayed, so the ending starts one.
+		s.expired = true
+	}
+	if len(s.ending) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, s.ending)
+	s.ending = s.ending[n:]
+	return n, nil
+}
+
+func (s *deadlineStream) Close() error {
+	s.timer.Stop()
+	return s.ReadCloser.Close()
+}
@@ -0,0 +1,110 @@
+// internal/proxy/streamlimit_test.go
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scriptedReader returns its reads one at a time, calling before, when set,
+// ahead of each, and then err, or io.EOF when it is nil
+type scriptedReader struct {
+	reads  []string
+	before func(read int)
+	err    error
+	read   int
+}
+
+func (r *scriptedReader) Read(p []byte) (int, error) {
+	if r.before != nil {
+		r.before(r.read)
+	}
+	if r.read == len(r.reads) {
+		if r.err != nil {
+			return 0, r.err
+		}
+		return 0, io.EOF
+	}
+	n := copy(p, r.reads[r.read])
+	r.read++
+	return n, nil
+}
+
+func (r *scriptedReader) Close() error { return nil }
+
+// parseEvents splits an SSE stream into its events, failing on data lines
+// that are not JSON
+func parseEvents(t *testing.T, stream []byte) []map[string]interface{} {
+	t.Helper()
+	if len(stream) > 0 && !bytes.HasSuffix(stream, []byte("\n\n")) {
+		t.Errorf("stream does not end with a complete event: %q", stream)
+	}
+	var events []map[string]interface{}
+	for _, event := range strings.Split(strings.TrimSuffix(string(stream), "\n\n"), "\n\n") {
+		data, ok := strings.CutPrefix(event, "data: ")
+		if !ok || strings.Contains(data, "\n") {
+			t.Errorf("malformed event %q", event)
+			continue
+		}
+		var chunk map[string]interface{}
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Errorf("event %q is not JSON: %v", event, err)
+			continue
+		}
+		events = append(events, chunk)
+	}
+	return events
+}
+
+func TestDeadlineStreamEndsOnEventBoundary(t *testing.T) {
+	// Each expiry point cuts the stream in another place: within an event,
+	// between the two newlines ending one, and on a boundary
+	streams := [][]string{
+		{`data: {"choices":[{"index":0,"delta":{"content":"a"}}]}` + "\n\n", `data: {"choices":[{"index":0,`, `"delta":{"content":"b"}}]}` + "\n\n"},
+		{`data: {"choices":[{"index":0,"delta":{"content":"a"}}]}` + "\n", "\n" + `data: {"choices":[{"index":0,"delta":{"content":"b"}}]}` + "\n\n"},
+		{`data: {"choices":[{"index":0,"delta":{"content":"a"}}]}` + "\n\n", `data: {"choices":[{"index":0,"delta":{"content":"b"}}]}` + "\n\n"},
+	}
+	for _, reads := range streams {
+		ctx, expire := context.WithCancelCause(context.Background())
+		src := &scriptedReader{reads: reads, before: func(read int) {
+			if read == 2 {
+				expire(errMaxStreamDuration)
+			}
+		}}
+		h := &Handler{streamLimits: newStreamLimits(0, nil)}
+		call := &completionCall{model: "gpt-4o", maxDuration: time.Hour}
+		stream := h.limitStream(ctx, call, src, expire)
+		out, err := io.ReadAll(stream)
+		stream.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		events := parseEvents(t, out)
+		if len(events) == 0 {
+			t.Fatalf("no events in %q", out)
+		}
+		last, _ := json.Marshal(events[len(events)-1]["choices"])
+		if !strings.Contains(string(last), finishMaxDuration) {
+			t.Errorf("last event %s lacks the %s finish reason in %q", last, finishMaxDuration, out)
+		}
+	}
+}
+
+func TestDeadlineStreamRelaysCompleteStreams(t *testing.T) {
+	stream := "data: {\"choices\":[]}\n\ndata: [DONE]\n"
+	h := &Handler{streamLimits: newStreamLimits(0, nil)}
+	call := &completionCall{model: "gpt-4o", maxDuration: time.Hour}
+	ctx, expire := context.WithCancelCause(context.Background())
+	limited := h.limitStream(ctx, call, &scriptedReader{reads: []string{stream[:20], stream[20:]}}, expire)
+	out, err := io.ReadAll(limited)
+	limited.Close()
+	if err != nil || string(out) != stream {
+		t.Errorf("relayed %q, %v, want %q", out, err, stream)
+	}
+}
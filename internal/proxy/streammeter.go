@@ -0,0 +1,43 @@
+// internal/proxy/streammeter.go
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// streamMeterHeader asks for the stream meter on a single request
+const streamMeterHeader = "X-Ghcsd-Stream-Meter"
+
+// wantsStreamMeter reports whether the stream answering r ends with the
+// stream meter comment, either for every stream or at the caller's request
+func (h *Handler) wantsStreamMeter(r *http.Request) bool {
+	if h.streamMeter {
+		return true
+	}
+	enabled, _ := strconv.ParseBool(r.Header.Get(streamMeterHeader))
+	return enabled
+}
+
+// writeStreamMeter writes an SSE comment reporting the tokens generated per
+// second after the first one, the time to the first token and the completion
+// tokens of a relayed stream. Clients ignore comments, so it is safe to send
+// after the end of the stream.
+func writeStreamMeter(w io.Writer, call *completionCall) {
+	sample := call.speed.Load()
+	if sample == nil {
+		return
+	}
+	var fields []string
+	if sample.generation > 0 {
+		fields = append(fields, fmt.Sprintf("tps=%.1f", float64(sample.completionTokens)/sample.generation.Seconds()))
+	}
+	if sample.ttft > 0 {
+		fields = append(fields, fmt.Sprintf("ttft=%dms", sample.ttft.Milliseconds()))
+	}
+	fields = append(fields, fmt.Sprintf("tokens=%d", sample.completionTokens))
+	fmt.Fprintf(w, ": ghcsd %s\n\n", strings.Join(fields, " "))
+}
@@ -0,0 +1,206 @@
+// internal/proxy/tokencount.go
+
+//go:build !ghcsd_minimal && !ghcsd_no_anthropic
+
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/acazau/ghcsd/internal/config"
+	"github.com/acazau/ghcsd/pkg/copilot"
+	"github.com/acazau/ghcsd/pkg/logging"
+)
+
+// anthropicBlock is a content block of an Anthropic message. Only the fields
+// shared by the built-in block converters are decoded; raw keeps the whole
+// block for the others.
+type anthropicBlock struct {
+	Type    string          `json:"type"`
+	Text    string          `json:"text,omitempty"`
+	Name    string          `json:"name,omitempty"`
+	Input   json.RawMessage `json:"input,omitempty"`
+	Content json.RawMessage `json:"content,omitempty"`
+	raw     json.RawMessage
+}
+
+func (b *anthropicBlock) UnmarshalJSON(data []byte) error {
+	type plain anthropicBlock
+	if err := json.Unmarshal(data, (*plain)(b)); err != nil {
+		return err
+	}
+	b.raw = append(json.RawMessage(nil), data...)
+	return nil
+}
+
+// anthropicContent is a string or a list of content blocks, as accepted by
+// the system prompt, messages and tool results
+type anthropicContent []anthropicBlock
+
+func (c *anthropicContent) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*c = anthropicContent{{Type: "text", Text: text}}
+		return nil
+	}
+	var blocks []anthropicBlock
+	if err := json.Unmarshal(data, &blocks); err != nil {
+		return err
+	}
+	*c = blocks
+	return nil
+}
+
+// text flattens the content to the text counted against the prompt
+func (c anthropicContent) text() string {
+	var parts []string
+	for _, block := range c {
+		if text := block.text(); text != "" {
+			parts = append(parts, text)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// anthropicTool is a tool definition of an Anthropic request
+type anthropicTool struct {
+	// Type is set for server tools, e.g. "web_search_20250305"
+	Type        string          `json:"type,omitempty"`
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	InputSchema json.RawMessage `json:"input_schema,omitempty"`
+}
+
+func init() {
+	registerFrontendRoute("POST /v1/messages/count_tokens", func(h *Handler) http.HandlerFunc { return h.handleCountTokens })
+	convertFormats["anthropic"] = func(body io.Reader) (copilot.CompletionRequest, error) {
+		var req anthropicMessagesRequest
+		err := json.NewDecoder(body).Decode(&req)
+		return req.completionRequest(), err
+	}
+}
+
+// countTokensRequest is the body of POST /v1/messages/count_tokens
+type countTokensRequest struct {
+	Model    string           `json:"model"`
+	System   anthropicContent `json:"system,omitempty"`
+	Messages []struct {
+		Role    string           `json:"role"`
+		Content anthropicContent `json:"content"`
+	} `json:"messages"`
+	Tools []anthropicTool `json:"tools,omitempty"`
+}
+
+// anthropicMessagesRequest is the body of an Anthropic messages request, as
+// far as it is converted to a chat completion
+type anthropicMessagesRequest struct {
+	countTokensRequest
+	MaxTokens     int      `json:"max_tokens"`
+	Temperature   float32  `json:"temperature"`
+	TopP          float32  `json:"top_p"`
+	TopK          *int     `json:"top_k,omitempty"`
+	StopSequences []string `json:"stop_sequences,omitempty"`
+	Stream        bool     `json:"stream"`
+	ServiceTier   string   `json:"service_tier,omitempty"`
+}
+
+// completionRequest converts the request to the chat completion format
+func (req anthropicMessagesRequest) completionRequest() copilot.CompletionRequest {
+	out := req.countTokensRequest.completionRequest(req.Model)
+	out.MaxTokens = req.MaxTokens
+	out.Temperature = req.Temperature
+	out.TopP = req.TopP
+	out.TopK = req.TopK
+	out.Stop = req.StopSequences
+	out.Stream = req.Stream
+	out.ServiceTier = req.ServiceTier
+	return out
+}
+
+// completionRequest converts the request to the chat format the upstream
+// providers count
+func (req countTokensRequest) completionRequest(model string) copilot.CompletionRequest {
+	out := copilot.NewCompletionRequest(model)
+	if len(req.System) > 0 {
+		out.Messages = append(out.Messages, copilot.Message{Role: "system", Content: req.System.text()})
+	}
+	for _, msg := range req.Messages {
+		out.Messages = append(out.Messages, copilot.Message{Role: msg.Role, Content: msg.Content.text()})
+	}
+	for _, tool := range req.Tools {
+		description := tool.Description
+		if description == "" && tool.Type != "" && tool.Type != "custom" {
+			// Server tools are defined by Anthropic and carry no schema
+			description = tool.Type
+		}
+		out.Tools = append(out.Tools, copilot.Tool{
+			Type: "function",
+			Function: copilot.ToolFunction{
+				Name:        tool.Name,
+				Description: description,
+				Parameters:  tool.InputSchema,
+			},
+		})
+	}
+	return out
+}
+
+// handleCountTokens serves POST /v1/messages/count_tokens in the Anthropic
+// format. Tokens are counted by the upstream of the mapped model, which for
+// Copilot is the local estimate since it has no counting endpoint.
+func (h *Handler) handleCountTokens(w http.ResponseWriter, r *http.Request) {
+	var req countTokensRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.sendAnthropicError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	model := h.defaultModel
+	if req.Model != "" {
+		model = req.Model
+	}
+	modelInfo, valid := config.GetModelInfo(model)
+	if !valid {
+		h.sendAnthropicError(w, fmt.Sprintf("Invalid model requested: %s", model), http.StatusBadRequest)
+		return
+	}
+	if key := apiKeyFrom(r); key != nil && !key.AllowsModel(model, modelInfo.RealID) {
+		h.sendAnthropicError(w, fmt.Sprintf("API key %s is not allowed to use model %s", key.Name, model), http.StatusForbidden)
+		return
+	}
+	provider, err := h.providers.Get(modelInfo.Upstream)
+	if err != nil {
+		h.sendAnthropicError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tokens, err := provider.CountTokens(r.Context(), req.completionRequest(modelInfo.RealID))
+	if err != nil {
+		h.sendUpstreamError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"input_tokens": tokens})
+}
+
+// sendAnthropicError writes an error in the Anthropic API format
+func (h *Handler) sendAnthropicError(w http.ResponseWriter, message string, status int) {
+	h.logWithPrefix(anthropicLog, logging.Debug, "Error", fmt.Sprintf("%d: %s", status, message))
+	errType := "invalid_request_error"
+	switch status {
+	case http.StatusForbidden:
+		errType = "permission_error"
+	case http.StatusInternalServerError:
+		errType = "api_error"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"type":  "error",
+		"error": map[string]string{"type": errType, "message": message},
+	})
+}
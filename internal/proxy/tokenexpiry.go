@@ -0,0 +1,140 @@
+// internal/proxy/tokenexpiry.go
+package proxy
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/acazau/ghcsd/internal/events"
+	"github.com/acazau/ghcsd/pkg/copilot"
+)
+
+const (
+	// tokenExpiryWarning is how long before the Copilot token expires a
+	// warning is logged
+	tokenExpiryWarning = 5 * time.Minute
+	// tokenExpiryCheckInterval is how often the token expiry is checked
+	tokenExpiryCheckInterval = 30 * time.Second
+)
+
+// Copilot token states reported by /admin/status, from the best to the worst
+const (
+	tokenOK         = "ok"
+	tokenRefreshDue = "refresh_due"
+	tokenExpiring   = "expiring"
+	tokenExpired    = "expired"
+	tokenMissing    = "missing"
+	tokenUnknown    = "unknown"
+)
+
+// tokenSeverity orders the states that are warned about
+var tokenSeverity = map[string]int{tokenOK: 0, tokenRefreshDue: 1, tokenExpiring: 2, tokenExpired: 3}
+
+// tokenStatus is the admin API view of the Copilot token of the login
+type tokenStatus struct {
+	Status           string     `json:"status"`
+	ExpiresAt        *time.Time `json:"expires_at,omitempty"`
+	ExpiresInSeconds *int64     `json:"expires_in_seconds,omitempty"`
+	// RefreshAt is when GitHub advised exchanging the token again
+	RefreshAt *time.Time `json:"refresh_at,omitempty"`
+}
+
+// tokenExpiry tracks the warnings about the Copilot token nearing expiry
+type tokenExpiry struct {
+	warnings atomic.Int64
+	// warned is the state last warned about, reset once the token is renewed
+	warned string
+}
+
+// tokenStatus reports the lifetime of the Copilot token in use
+func (h *Handler) tokenStatus() tokenStatus {
+	token := h.client.GetToken()
+	if token == "" {
+		return tokenStatus{Status: tokenMissing}
+	}
+	info, ok := copilot.TokenLifetime(token)
+	if !ok {
+		return tokenStatus{Status: tokenUnknown}
+	}
+
+	now := time.Now()
+	expiresIn := int64(info.ExpiresAt.Sub(now).Seconds())
+	status := tokenStatus{Status: tokenOK, ExpiresAt: &info.ExpiresAt, ExpiresInSeconds: &expiresIn}
+	if !info.RefreshAt.IsZero() {
+		status.RefreshAt = &info.RefreshAt
+	}
+	switch {
+	case !now.Before(info.ExpiresAt):
+		status.Status = tokenExpired
+	case info.ExpiresAt.Sub(now) <= tokenExpiryWarning:
+		status.Status = tokenExpiring
+	case !info.RefreshAt.IsZero() && !now.Before(info.RefreshAt):
+		status.Status = tokenRefreshDue
+	}
+	return status
+}
+
+// tokenExpiresIn returns the seconds until the Copilot token expires, by
+// endpoint, for the metrics
+func (h *Handler) tokenExpiresIn() map[string]float64 {
+	status := h.tokenStatus()
+	if status.ExpiresAt == nil {
+		return nil
+	}
+	return map[string]float64{h.client.GetBaseURL(): time.Until(*status.ExpiresAt).Seconds()}
+}
+
+// watchTokenExpiry checks the Copilot token periodically and warns once each
+// time its state gets worse: when it is due for renewal, about to expire and
+// expired. Copilot rejects every request with an expired token until it is
+// renewed.
+func (h *Handler) watchTokenExpiry(ctx context.Context) {
+	ticker := time.NewTicker(tokenExpiryCheckInterval)
+	defer ticker.Stop()
+	for {
+		h.checkTokenExpiry()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkTokenExpiry warns when the state of the Copilot token got worse since
+// the last check
+func (h *Handler) checkTokenExpiry() {
+	status := h.tokenStatus()
+	severity, known := tokenSeverity[status.Status]
+	if !known {
+		return
+	}
+	if severity <= tokenSeverity[h.expiry.warned] {
+		if severity == 0 {
+			h.expiry.warned = ""
+		}
+		return
+	}
+	h.expiry.warned = status.Status
+	h.expiry.warnings.Add(1)
+
+	expiresAt := status.ExpiresAt.Format(time.RFC3339)
+	expiresIn := time.Until(*status.ExpiresAt).Round(time.Second)
+	switch status.Status {
+	case tokenRefreshDue:
+		authLog.Warnf("[Auth] The Copilot token is due for renewal and expires in %s, at %s", expiresIn, expiresAt)
+	case tokenExpiring:
+		authLog.Warnf("[Auth] The Copilot token expires in %s, at %s", expiresIn, expiresAt)
+	case tokenExpired:
+		authLog.Warnf("[Auth] The Copilot token expired at %s; Copilot rejects requests until it is renewed", expiresAt)
+	}
+	h.events.Publish(events.Event{
+		Type: events.TypeTokenExpiry,
+		Fields: map[string]interface{}{
+			"status":             status.Status,
+			"expires_at":         status.ExpiresAt,
+			"expires_in_seconds": *status.ExpiresInSeconds,
+		},
+	})
+}
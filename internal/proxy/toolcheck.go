@@ -0,0 +1,307 @@
+// internal/proxy/toolcheck.go
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"github.com/acazau/ghcsd/internal/config"
+	"github.com/acazau/ghcsd/internal/jsonschema"
+	"github.com/acazau/ghcsd/pkg/copilot"
+)
+
+// toolCallError is a generated tool call whose arguments do not match the
+// schema of its tool
+type toolCallError struct {
+	Choice     int      `json:"choice"`
+	Index      int      `json:"index"`
+	ToolCallID string   `json:"tool_call_id,omitempty"`
+	Name       string   `json:"name"`
+	Errors     []string `json:"errors"`
+}
+
+// annotatedCompletion is a completion response reporting the tool calls
+// that failed validation
+type annotatedCompletion struct {
+	*copilot.CompletionResponse
+	ToolCallErrors []toolCallError `json:"tool_call_errors,omitempty"`
+}
+
+// toolChecker validates the arguments of generated tool calls against the
+// parameter schemas of the declared tools. Invalid calls are reported in a
+// tool_call_errors field; in retry mode a non-streamed completion with
+// invalid calls is first sent back to the model once for correction.
+type toolChecker struct {
+	retry bool
+
+	invalid atomic.Int64
+	retried atomic.Int64
+}
+
+// newToolChecker creates a checker for mode, or returns nil when validation
+// is off
+func newToolChecker(mode string) *toolChecker {
+	if mode == "" || mode == config.ToolValidationOff {
+		return nil
+	}
+	return &toolChecker{retry: mode == config.ToolValidationRetry}
+}
+
+// toolSchemas holds the compiled parameter schemas of the declared tools. A
+// tool without a usable schema maps to nil and its calls are not checked.
+type toolSchemas map[string]*jsonschema.Schema
+
+func compileToolSchemas(tools []copilot.Tool) toolSchemas {
+	schemas := make(toolSchemas, len(tools))
+	for _, tool := range tools {
+		name := tool.Function.Name
+		schemas[name] = nil
+		if len(tool.Function.Parameters) == 0 {
+			continue
+		}
+		schema, err := jsonschema.Compile(tool.Function.Parameters)
+		if err != nil {
+			proxyLog.Warnf("[Tools] Not validating calls to %s: %v", name, err)
+			continue
+		}
+		schemas[name] = schema
+	}
+	return schemas
+}
+
+// check returns the problems of a tool call, or nil when it is valid
+func (s toolSchemas) check(call copilot.ToolCall) []string {
+	schema, declared := s[call.Function.Name]
+	if !declared {
+		return []string{fmt.Sprintf("no tool named %q was declared", call.Function.Name)}
+	}
+	if schema == nil {
+		return nil
+	}
+	arguments := strings.TrimSpace(call.Function.Arguments)
+	if arguments == "" {
+		arguments = "{}"
+	}
+	var invalid *jsonschema.ValidationError
+	if err := schema.Validate([]byte(arguments)); err != nil {
+		if errors.As(err, &invalid) {
+			return invalid.Problems
+		}
+		return []string{err.Error()}
+	}
+	return nil
+}
+
+// checkChoices validates the tool calls of every choice of a completion
+func (s toolSchemas) checkChoices(choices []copilot.Choice) []toolCallError {
+	var invalid []toolCallError
+	for _, choice := range choices {
+		for i, call := range choice.Message.ToolCalls {
+			if problems := s.check(call); problems != nil {
+				invalid = append(invalid, toolCallError{
+					Choice:     choice.Index,
+					Index:      i,
+					ToolCallID: call.ID,
+					Name:       call.Function.Name,
+					Errors:     problems,
+				})
+			}
+		}
+	}
+	return invalid
+}
+
+// checkCompletion validates the tool calls of a non-streamed completion and
+// returns the response to send, annotated with the calls still invalid
+func (c *toolChecker) checkCompletion(ctx context.Context, call *completionCall, resp *copilot.CompletionResponse) interface{} {
+	if c == nil || len(call.request.Tools) == 0 {
+		return resp
+	}
+	schemas := compileToolSchemas(call.request.Tools)
+	invalid := schemas.checkChoices(resp.Choices)
+	if len(invalid) > 0 && c.retry && len(resp.Choices) == 1 {
+		proxyLog.Infof("[Tools] %d invalid tool call(s) from %s, asking the model to correct them", len(invalid), call.model)
+		c.retried.Add(1)
+		retryReq := call.request
+		retryReq.Messages = append(slices.Clone(call.request.Messages), correctionMessages(resp.Choices[0], invalid)...)
+		retried, err := call.provider.Complete(ctx, retryReq)
+		if err != nil {
+			proxyLog.Warnf("[Tools] Correction request failed: %v", err)
+		} else {
+			resp = retried
+			invalid = schemas.checkChoices(resp.Choices)
+		}
+	}
+	if len(invalid) == 0 {
+		return resp
+	}
+	c.invalid.Add(int64(len(invalid)))
+	proxyLog.Warnf("[Tools] %d tool call(s) from %s do not match their schema", len(invalid), call.model)
+	return annotatedCompletion{CompletionResponse: resp, ToolCallErrors: invalid}
+}
+
+// correctionMessages replays the tool calls of choice followed by tool
+// results explaining what was wrong with the invalid ones
+func correctionMessages(choice copilot.Choice, invalid []toolCallError) []copilot.Message {
+	problems := make(map[int][]string, len(invalid))
+	for _, e := range invalid {
+		problems[e.Index] = e.Errors
+	}
+	messages := []copilot.Message{{
+		Role:      "assistant",
+		Content:   choice.Message.Content,
+		ToolCalls: choice.Message.ToolCalls,
+	}}
+	for i, call := range choice.Message.ToolCalls {
+		result := "Not executed because another tool call of this turn had invalid arguments. Call it again if it is still needed."
+		if errs, ok := problems[i]; ok {
+			result = fmt.Sprintf("Error: the arguments do not match the parameter schema of %s: %s. Call the tool again with corrected arguments.",
+				call.Function.Name, strings.Join(errs, "; "))
+		}
+		messages = append(messages, copilot.Message{Role: "tool", ToolCallID: call.ID, Content: result})
+	}
+	return messages
+}
+
+// checkStream wraps a streamed completion so that its tool calls are
+// validated when it ends. Streams cannot be retried once relayed, so invalid
+// calls are reported in a final chunk.
+func (c *toolChecker) checkStream(body io.ReadCloser, call *completionCall) io.ReadCloser {
+	if c == nil || len(call.request.Tools) == 0 {
+		return body
+	}
+	return &toolCheckStream{
+		ReadCloser: body,
+		checker:    c,
+		schemas:    compileToolSchemas(call.request.Tools),
+		model:      call.model,
+		calls:      make(map[[2]int]*copilot.ToolCall),
+	}
+}
+
+// toolCheckStream assembles the tool calls of a stream from their deltas
+type toolCheckStream struct {
+	io.ReadCloser
+	checker *toolChecker
+	schemas toolSchemas
+	model   string
+
+	pending []byte
+	id      string
+	// calls are keyed by choice index and tool call index
+	calls  map[[2]int]*copilot.ToolCall
+	order  [][2]int
+	failed bool
+
+	trailer *bytes.Reader
+}
+
+func (s *toolCheckStream) Read(p []byte) (int, error) {
+	if s.trailer != nil {
+		return s.trailer.Read(p)
+	}
+	n, err := s.ReadCloser.Read(p)
+	s.pending = append(s.pending, p[:n]...)
+	rest := s.pending
+	for {
+		line, tail, ok := bytes.Cut(rest, []byte("\n"))
+		if !ok {
+			break
+		}
+		s.addLine(line)
+		rest = tail
+	}
+	s.pending = append(s.pending[:0], rest...)
+	if err == io.EOF {
+		if trailer := s.finish(); trailer != nil {
+			s.trailer = bytes.NewReader(trailer)
+			return n, nil
+		}
+	}
+	return n, err
+}
+
+// addLine accumulates the tool call deltas of one SSE line
+func (s *toolCheckStream) addLine(line []byte) {
+	data, ok := bytes.CutPrefix(bytes.TrimSpace(line), []byte("data: "))
+	if !ok || len(data) == 0 {
+		return
+	}
+	var chunk copilot.CompletionResponse
+	if err := json.Unmarshal(data, &chunk); err != nil {
+		return
+	}
+	if chunk.Error != nil {
+		s.failed = true
+		return
+	}
+	if chunk.ID != "" {
+		s.id = chunk.ID
+	}
+	for _, choice := range chunk.Choices {
+		for i, delta := range choice.Delta.ToolCalls {
+			index := i
+			if delta.Index != nil {
+				index = *delta.Index
+			}
+			key := [2]int{choice.Index, index}
+			call, ok := s.calls[key]
+			if !ok {
+				call = &copilot.ToolCall{}
+				s.calls[key] = call
+				s.order = append(s.order, key)
+			}
+			if delta.ID != "" {
+				call.ID = delta.ID
+			}
+			if delta.Function.Name != "" {
+				call.Function.Name = delta.Function.Name
+			}
+			call.Function.Arguments += delta.Function.Arguments
+		}
+	}
+}
+
+// finish validates the assembled tool calls and returns the SSE chunk
+// reporting the invalid ones, or nil
+func (s *toolCheckStream) finish() []byte {
+	if s.failed {
+		return nil
+	}
+	var invalid []toolCallError
+	for _, key := range s.order {
+		call := s.calls[key]
+		if problems := s.schemas.check(*call); problems != nil {
+			invalid = append(invalid, toolCallError{
+				Choice:     key[0],
+				Index:      key[1],
+				ToolCallID: call.ID,
+				Name:       call.Function.Name,
+				Errors:     problems,
+			})
+		}
+	}
+	if len(invalid) == 0 {
+		return nil
+	}
+	s.checker.invalid.Add(int64(len(invalid)))
+	proxyLog.Warnf("[Tools] %d streamed tool call(s) from %s do not match their schema", len(invalid), s.model)
+	data, err := json.Marshal(map[string]interface{}{
+		"id":               s.id,
+		"object":           "chat.completion.chunk",
+		"model":            s.model,
+		"choices":          []copilot.Choice{},
+		"tool_call_errors": invalid,
+	})
+	if err != nil {
+		return nil
+	}
+	return []byte(fmt.Sprintf("data: %s\n\n", data))
+}
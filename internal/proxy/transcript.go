@@ -0,0 +1,164 @@
+// internal/proxy/transcript.go
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/acazau/ghcsd/internal/config"
+	"github.com/acazau/ghcsd/pkg/copilot"
+)
+
+// transcriptWriter appends every completion to a transcript file of its
+// conversation, so that a local history survives clients discarding it.
+// Conversations are told apart by their Copilot session.
+type transcriptWriter struct {
+	dir      string
+	markdown bool
+
+	mu sync.Mutex
+}
+
+// newTranscriptWriter creates a writer of transcripts in dir, or returns nil
+// when dir is empty
+func newTranscriptWriter(dir, format string) (*transcriptWriter, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create transcript directory: %w", err)
+	}
+	return &transcriptWriter{dir: dir, markdown: format == config.TranscriptMarkdown}, nil
+}
+
+// transcriptMessage is a message of a transcript entry
+type transcriptMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// transcriptEntry is one exchange of a JSON lines transcript: the messages
+// added since the previous answer and the answer generated for them
+type transcriptEntry struct {
+	Time         time.Time           `json:"time"`
+	RequestID    string              `json:"request_id,omitempty"`
+	Model        string              `json:"model"`
+	Messages     []transcriptMessage `json:"messages"`
+	Response     string              `json:"response"`
+	ToolCalls    []copilot.ToolCall  `json:"tool_calls,omitempty"`
+	FinishReason string              `json:"finish_reason,omitempty"`
+}
+
+// write appends the exchange of call and its response to the transcript.
+// It is a no-op on a nil writer.
+func (t *transcriptWriter) write(requestID string, call *completionCall, resp *copilot.CompletionResponse) {
+	if t == nil {
+		return
+	}
+	entry := transcriptEntry{
+		Time:      time.Now().UTC(),
+		RequestID: requestID,
+		Model:     call.model,
+		Messages:  newMessages(call.request.Messages),
+	}
+	if len(resp.Choices) > 0 {
+		choice := resp.Choices[0]
+		entry.Response = choice.Message.Content
+		entry.ToolCalls = choice.Message.ToolCalls
+		entry.FinishReason = choice.FinishReason
+	}
+
+	var data []byte
+	name := sanitizeFileName(call.sessionID)
+	if name == "" {
+		name = "default"
+	}
+	if t.markdown {
+		data = entry.markdown()
+		name += ".md"
+	} else {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			auditLog.Errorf("[Transcript] Failed to encode entry: %v", err)
+			return
+		}
+		data = append(line, '\n')
+		name += ".jsonl"
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f, err := os.OpenFile(filepath.Join(t.dir, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		auditLog.Errorf("[Transcript] Failed to open transcript: %v", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		auditLog.Errorf("[Transcript] Failed to write transcript: %v", err)
+	}
+}
+
+// markdown renders the entry as a markdown section
+func (e transcriptEntry) markdown() []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "## %s · %s", e.Time.Format(time.RFC3339), e.Model)
+	if e.RequestID != "" {
+		fmt.Fprintf(&b, " · %s", e.RequestID)
+	}
+	b.WriteString("\n\n")
+	for _, msg := range e.Messages {
+		fmt.Fprintf(&b, "**%s**\n\n%s\n\n", msg.Role, msg.Content)
+	}
+	b.WriteString("**assistant**\n\n")
+	if e.Response != "" {
+		b.WriteString(e.Response + "\n\n")
+	}
+	for _, call := range e.ToolCalls {
+		fmt.Fprintf(&b, "Tool call `%s`: `%s`\n\n", call.Function.Name, call.Function.Arguments)
+	}
+	if e.FinishReason != "" && e.FinishReason != "stop" && e.FinishReason != "tool_calls" {
+		fmt.Fprintf(&b, "_Finished: %s_\n\n", e.FinishReason)
+	}
+	return b.Bytes()
+}
+
+// newMessages returns the messages sent after the last assistant message,
+// which clients resend the earlier history with. The first request of a
+// conversation is recorded whole, system prompt included.
+func newMessages(messages []copilot.Message) []transcriptMessage {
+	start := 0
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == "assistant" {
+			start = i + 1
+			break
+		}
+	}
+	recorded := make([]transcriptMessage, 0, len(messages)-start)
+	for _, msg := range messages[start:] {
+		recorded = append(recorded, transcriptMessage{Role: msg.Role, Content: messageText(msg)})
+	}
+	return recorded
+}
+
+// messageText returns the text of a message, with placeholders for images
+func messageText(msg copilot.Message) string {
+	if msg.IsStringContent() {
+		return msg.GetStringContent()
+	}
+	var parts []string
+	for _, part := range msg.GetComplexContent() {
+		if part.Type == "text" {
+			parts = append(parts, part.Text)
+		} else {
+			parts = append(parts, "["+part.Type+"]")
+		}
+	}
+	return strings.Join(parts, "\n")
+}
@@ -0,0 +1,133 @@
+// internal/proxy/upstreamlimits.go
+package proxy
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/acazau/ghcsd/internal/version"
+	"github.com/acazau/ghcsd/pkg/copilot"
+)
+
+// headerUpstreamRateLimit prefixes the response headers relaying the rate
+// limit and quota headers of the upstream response
+const headerUpstreamRateLimit = "X-Ghcsd-Upstream-RateLimit-"
+
+// upstreamLimits keeps the latest rate limit and quota state each Copilot
+// endpoint reported, so that running out of quota can be seen coming
+type upstreamLimits struct {
+	mu       sync.Mutex
+	observed map[string]observedLimit
+}
+
+// observedLimit is the rate limit state of an endpoint and when it was seen
+type observedLimit struct {
+	limit copilot.RateLimit
+	at    time.Time
+}
+
+func newUpstreamLimits() *upstreamLimits {
+	return &upstreamLimits{observed: make(map[string]observedLimit)}
+}
+
+// observe records the rate limit headers of an upstream response
+func (u *upstreamLimits) observe(limit copilot.RateLimit) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.observed[limit.Endpoint] = observedLimit{limit: limit, at: time.Now()}
+}
+
+// rateLimitValues returns the numeric rate limit headers by suffix, the
+// lowest across endpoints
+func (u *upstreamLimits) rateLimitValues() map[string]float64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	values := make(map[string]float64)
+	for _, observed := range u.observed {
+		for suffix, raw := range observed.limit.Limits {
+			value, err := strconv.ParseFloat(raw, 64)
+			if err != nil {
+				continue
+			}
+			if current, ok := values[suffix]; !ok || value < current {
+				values[suffix] = value
+			}
+		}
+	}
+	return values
+}
+
+// quotaRemaining returns the remaining percentage of each limited quota,
+// the lowest across endpoints
+func (u *upstreamLimits) quotaRemaining() map[string]float64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	values := make(map[string]float64)
+	for _, observed := range u.observed {
+		for name, quota := range observed.limit.Quotas {
+			if quota.Unlimited {
+				continue
+			}
+			if current, ok := values[name]; !ok || quota.RemainingPercent < current {
+				values[name] = quota.RemainingPercent
+			}
+		}
+	}
+	return values
+}
+
+// upstreamLimitsEntry is the admin API view of the state of an endpoint
+type upstreamLimitsEntry struct {
+	Endpoint   string                   `json:"endpoint"`
+	ObservedAt time.Time                `json:"observed_at"`
+	RateLimits map[string]string        `json:"rate_limits,omitempty"`
+	Quotas     map[string]copilot.Quota `json:"quotas,omitempty"`
+}
+
+// snapshot returns the latest state of every endpoint, sorted by endpoint
+func (u *upstreamLimits) snapshot() []upstreamLimitsEntry {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	entries := make([]upstreamLimitsEntry, 0, len(u.observed))
+	for endpoint, observed := range u.observed {
+		entries = append(entries, upstreamLimitsEntry{
+			Endpoint:   endpoint,
+			ObservedAt: observed.at,
+			RateLimits: observed.limit.Limits,
+			Quotas:     observed.limit.Quotas,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Endpoint < entries[j].Endpoint })
+	return entries
+}
+
+// setRateLimitHeaders relays the rate limit and quota headers of the
+// upstream response of a call as X-Ghcsd-Upstream-RateLimit-* headers
+func setRateLimitHeaders(w http.ResponseWriter, limit *copilot.RateLimit) {
+	if limit == nil {
+		return
+	}
+	for suffix, value := range limit.Limits {
+		w.Header().Set(headerUpstreamRateLimit+suffix, value)
+	}
+	for name, quota := range limit.Quotas {
+		w.Header().Set(headerUpstreamRateLimit+"Quota-"+strings.ReplaceAll(name, "_", "-"), quota.Raw)
+	}
+}
+
+// handleStatus serves GET /admin/status, reporting the version, uptime and
+// load of the server, the latest rate limit and quota state of each Copilot
+// endpoint and the expiry of the Copilot token
+func (h *Handler) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"version":              version.Get(),
+		"uptime_seconds":       int64(time.Since(h.startedAt).Seconds()),
+		"inflight_requests":    h.inflight.len(),
+		"upstream_rate_limits": h.limits.snapshot(),
+		"copilot_token":        h.tokenStatus(),
+	})
+}
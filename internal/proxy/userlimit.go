@@ -0,0 +1,33 @@
+// internal/proxy/userlimit.go
+package proxy
+
+import (
+	"context"
+	"time"
+
+	"github.com/acazau/ghcsd/internal/state"
+)
+
+// userLimiter rate limits requests per end-user identifier, as supplied in
+// the OpenAI "user" field
+type userLimiter struct {
+	limits    state.RateLimitStore
+	perMinute int
+}
+
+// newUserLimiter creates a limiter, or returns nil when perMinute is not positive
+func newUserLimiter(limits state.RateLimitStore, perMinute int) *userLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	return &userLimiter{limits: limits, perMinute: perMinute}
+}
+
+// allow consumes a request for user, returning how long to wait when the
+// user is over its limit. Requests without a user are not limited.
+func (l *userLimiter) allow(ctx context.Context, user string) (bool, time.Duration) {
+	if l == nil || user == "" {
+		return true, 0
+	}
+	return takeRequest(ctx, l.limits, "user:"+user, l.perMinute)
+}
@@ -0,0 +1,143 @@
+// internal/proxy/warmup.go
+package proxy
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/acazau/ghcsd/internal/config"
+	"github.com/acazau/ghcsd/pkg/copilot"
+	"github.com/acazau/ghcsd/pkg/upstream"
+)
+
+const (
+	// warmUpConcurrency is the number of models warmed up at once
+	warmUpConcurrency = 4
+	// warmUpTimeout bounds the test completion of a model
+	warmUpTimeout = 30 * time.Second
+	// warmUpMaxTokens caps the answer to the test completion
+	warmUpMaxTokens = 16
+)
+
+// modelAvailability records the models the warm-up found the account cannot
+// use, keyed by upstream and real model ID
+type modelAvailability struct {
+	mu          sync.Mutex
+	unavailable map[[2]string]string
+}
+
+// markUnavailable records why a model cannot be used
+func (a *modelAvailability) markUnavailable(upstreamName, realID, reason string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.unavailable == nil {
+		a.unavailable = make(map[[2]string]string)
+	}
+	a.unavailable[[2]string{upstreamName, realID}] = reason
+}
+
+// reason returns why a model cannot be used, or "" when it is not known to
+// be unavailable
+func (a *modelAvailability) reason(upstreamName, realID string) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.unavailable[[2]string{upstreamName, realID}]
+}
+
+// warmUpTarget is a model served by an upstream and the IDs it is known by
+type warmUpTarget struct {
+	upstream string
+	realID   string
+	profile  string
+	aliases  []string
+}
+
+// warmUp sends a tiny completion to every configured model, so that models
+// the subscription cannot access are found at startup rather than by users.
+// They are logged and marked unavailable in the model listing. Other
+// failures may be transient and are only logged.
+func (h *Handler) warmUp(ctx context.Context) {
+	if h.client.GetToken() == "" {
+		proxyLog.Infof("[WarmUp] Skipped: not logged in to GitHub Copilot")
+		return
+	}
+
+	var targets []*warmUpTarget
+	byModel := make(map[[2]string]*warmUpTarget)
+	for _, id := range config.GetModelList() {
+		info, _ := config.GetModelInfo(id)
+		upstreamName := info.Upstream
+		if upstreamName == "" {
+			upstreamName = upstream.DefaultProvider
+		}
+		key := [2]string{upstreamName, info.RealID}
+		target, ok := byModel[key]
+		if !ok {
+			target = &warmUpTarget{upstream: upstreamName, realID: info.RealID, profile: info.HeaderProfile}
+			byModel[key] = target
+			targets = append(targets, target)
+		}
+		target.aliases = append(target.aliases, id)
+	}
+
+	proxyLog.Infof("[WarmUp] Checking %d models", len(targets))
+	var available atomic.Int32
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, warmUpConcurrency)
+	for _, target := range targets {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			if h.warmUpModel(ctx, target) {
+				available.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	proxyLog.Infof("[WarmUp] %d of %d models answered", available.Load(), len(targets))
+}
+
+// warmUpModel sends the test completion to one model and reports whether it
+// answered
+func (h *Handler) warmUpModel(ctx context.Context, target *warmUpTarget) bool {
+	name := strings.Join(target.aliases, ", ")
+	provider, err := h.providers.Get(target.upstream)
+	if err != nil {
+		proxyLog.Warnf("[Warning] Warm-up of model %s skipped: %v", name, err)
+		return false
+	}
+
+	req := copilot.NewCompletionRequest(target.realID)
+	req.MaxTokens = warmUpMaxTokens
+	req.Messages = []copilot.Message{{Role: "user", Content: "Reply with OK."}}
+	if target.profile != "" {
+		ctx = copilot.WithHeaderProfile(ctx, target.profile)
+	}
+	ctx, cancel := context.WithTimeout(ctx, warmUpTimeout)
+	defer cancel()
+	start := time.Now()
+	_, err = provider.Complete(ctx, req)
+	if err == nil {
+		proxyLog.Infof("[WarmUp] Model %s answered in %s", name, time.Since(start).Round(time.Millisecond))
+		return true
+	}
+
+	var apiErr *copilot.APIError
+	if errors.As(err, &apiErr) && (apiErr.Kind() == copilot.ErrorKindPermission || apiErr.Kind() == copilot.ErrorKindNotFound ||
+		apiErr.Code == "model_not_supported") {
+		reason := translateError(err).Message
+		h.availability.markUnavailable(target.upstream, target.realID, reason)
+		proxyLog.Warnf("[Warning] Model %s is not available to this account and is marked unavailable in /v1/models: %s", name, reason)
+		return false
+	}
+	proxyLog.Warnf("[Warning] Warm-up of model %s failed: %v", name, err)
+	return false
+}
@@ -0,0 +1,108 @@
+// internal/proxy/websocket.go
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/acazau/ghcsd/internal/websocket"
+	"github.com/acazau/ghcsd/pkg/logging"
+)
+
+// handleWebSocket serves streaming completions over a WebSocket for clients
+// behind proxies that mangle SSE. Each text message from the client is a chat
+// completion request; every event of the response stream is sent back as a
+// JSON text message with the same payload as the SSE "data:" line, followed
+// by a "[DONE]" message. Several requests can be sent over one connection.
+func (h *Handler) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	// Browsers let any page open a WebSocket, which the same-origin policy
+	// does not protect, so pages may only connect from allowed origins
+	if !h.websocketOriginAllowed(r) {
+		h.sendError(w, "Origin not allowed", http.StatusForbidden)
+		return
+	}
+	conn, err := websocket.Upgrade(w, r)
+	if err != nil {
+		h.sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer conn.Close()
+
+	for {
+		message, err := conn.ReadMessage()
+		if err != nil {
+			if err != websocket.ErrClosed {
+				h.logWithPrefix(proxyLog, logging.Debug, "WebSocket", fmt.Sprintf("Read failed: %v", err))
+			}
+			return
+		}
+		h.logWithPrefix(proxyLog, logging.Debug, "WebSocket Request", string(message))
+		if err := h.streamOverWebSocket(r, conn, message); err != nil {
+			h.logWithPrefix(proxyLog, logging.Debug, "WebSocket", fmt.Sprintf("Write failed: %v", err))
+			return
+		}
+	}
+}
+
+// websocketOriginAllowed reports whether the page a WebSocket is opened from
+// may use the API: requests without an Origin come from other clients than
+// browsers, and pages must be served by this host or from a CORS origin
+func (h *Handler) websocketOriginAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	return originAllowed(h.corsOrigins, origin)
+}
+
+// streamOverWebSocket runs one streaming completion and relays its events.
+// Request and upstream errors are reported as error messages on the socket;
+// only write failures are returned.
+func (h *Handler) streamOverWebSocket(r *http.Request, conn *websocket.Conn, body []byte) error {
+	call, reqErr := h.prepareCompletion(r, body)
+	if reqErr != nil {
+		return writeWebSocketError(conn, newErrorResponse(reqErr.message, errorType(reqErr.status), reqErr.code))
+	}
+	call.request.Stream = true
+
+	stream, disconnect, err := h.startForClient(r, call)
+	defer disconnect(nil)
+	if err != nil {
+		translated := translateError(err)
+		return writeWebSocketError(conn, newErrorResponse(translated.Message, translated.Type, translated.Code))
+	}
+	defer stream.Close()
+
+	scanner := bufio.NewScanner(stream)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		data, ok := bytes.CutPrefix(scanner.Bytes(), []byte("data: "))
+		if !ok || len(data) == 0 {
+			continue
+		}
+		if err := conn.WriteText(data); err != nil {
+			disconnect(errClientDisconnected)
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return writeWebSocketError(conn, newErrorResponse(err.Error(), "server_error", ""))
+	}
+	return conn.WriteText([]byte("[DONE]"))
+}
+
+func writeWebSocketError(conn *websocket.Conn, response ErrorResponse) error {
+	data, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+	return conn.WriteText(data)
+}
@@ -0,0 +1,174 @@
+// internal/state/memory.go
+package state
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// Memory is a store private to the process
+type Memory struct {
+	mu             sync.Mutex
+	token          string
+	tokenExpiresAt time.Time
+	buckets        map[string]*bucket
+	lastSweep      time.Time
+	tokens         map[string]int64
+	spend          map[string]*periodSpend
+	pins           map[string]*pin
+	lastPinSweep   time.Time
+}
+
+// pin is the model a conversation is pinned to
+type pin struct {
+	model     string
+	expiresAt time.Time
+}
+
+// periodSpend is the spend of each key in one period
+type periodSpend struct {
+	keys map[string]float64
+	last time.Time
+}
+
+// bucket is a token bucket refilling at perMinute per minute
+type bucket struct {
+	perMinute int
+	tokens    float64
+	last      time.Time
+}
+
+// NewMemory creates an empty in-memory store
+func NewMemory() *Memory {
+	return &Memory{
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+		tokens:    make(map[string]int64),
+		spend:     make(map[string]*periodSpend),
+		pins:      make(map[string]*pin),
+	}
+}
+
+func (m *Memory) Token(ctx context.Context) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if time.Now().Add(tokenExpiryMargin).After(m.tokenExpiresAt) {
+		return "", nil
+	}
+	return m.token, nil
+}
+
+func (m *Memory) SetToken(ctx context.Context, token string, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.token, m.tokenExpiresAt = token, expiresAt
+	return nil
+}
+
+func (m *Memory) Take(ctx context.Context, key string, perMinute int) (bool, time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(m.lastSweep) > bucketIdle {
+		for key, b := range m.buckets {
+			if now.Sub(b.last) > bucketIdle {
+				delete(m.buckets, key)
+			}
+		}
+		m.lastSweep = now
+	}
+
+	b, ok := m.buckets[key]
+	if !ok || b.perMinute != perMinute {
+		b = &bucket{perMinute: perMinute, tokens: float64(perMinute), last: now}
+		m.buckets[key] = b
+	}
+	rate := float64(perMinute) / 60 // tokens per second
+	b.tokens = math.Min(float64(perMinute), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0, nil
+	}
+	wait := time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	return false, wait, nil
+}
+
+func (m *Memory) AddTokens(ctx context.Context, model string, tokens int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tokens[model] += tokens
+	return nil
+}
+
+func (m *Memory) Tokens(ctx context.Context) (map[string]int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tokens := make(map[string]int64, len(m.tokens))
+	for model, n := range m.tokens {
+		tokens[model] = n
+	}
+	return tokens, nil
+}
+
+func (m *Memory) AddSpend(ctx context.Context, period, key string, amount float64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for name, p := range m.spend {
+		if now.Sub(p.last) > spendRetention {
+			delete(m.spend, name)
+		}
+	}
+	p, ok := m.spend[period]
+	if !ok {
+		p = &periodSpend{keys: make(map[string]float64)}
+		m.spend[period] = p
+	}
+	p.keys[key] += amount
+	p.last = now
+	return nil
+}
+
+func (m *Memory) Spend(ctx context.Context, period string) (map[string]float64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	spend := make(map[string]float64)
+	if p, ok := m.spend[period]; ok {
+		for key, amount := range p.keys {
+			spend[key] = amount
+		}
+	}
+	return spend, nil
+}
+
+func (m *Memory) PinModel(ctx context.Context, session, model string, ttl time.Duration) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(m.lastPinSweep) > ttl {
+		for key, p := range m.pins {
+			if now.After(p.expiresAt) {
+				delete(m.pins, key)
+			}
+		}
+		m.lastPinSweep = now
+	}
+
+	p, ok := m.pins[session]
+	if !ok || now.After(p.expiresAt) {
+		p = &pin{model: model}
+		m.pins[session] = p
+	}
+	p.expiresAt = now.Add(ttl)
+	return p.model, nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
@@ -0,0 +1,367 @@
+// internal/state/redis.go
+package state
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// redisTimeout bounds a command whose context has no deadline
+	redisTimeout = 5 * time.Second
+	// redisPoolSize is the number of idle connections kept
+	redisPoolSize = 16
+	// redisKeyPrefix namespaces the keys of the proxy
+	redisKeyPrefix = "ghcsd:"
+)
+
+// takeScript refills and takes from a token bucket stored in a hash, on the
+// clock of the Redis server so that replicas with skewed clocks agree. It
+// returns 0 when a request was taken, or else the milliseconds to wait.
+const takeScript = `
+redis.replicate_commands()
+local capacity = tonumber(ARGV[1])
+local rate = capacity / 60000
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'last', 'capacity')
+local tokens = tonumber(state[1])
+local last = tonumber(state[2])
+if tokens == nil or last == nil or tonumber(state[3]) ~= capacity then
+  tokens = capacity
+  last = now
+end
+tokens = math.min(capacity, tokens + math.max(0, now - last) * rate)
+local wait = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+else
+  wait = math.ceil((1 - tokens) / rate)
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'last', now, 'capacity', capacity)
+redis.call('PEXPIRE', KEYS[1], ARGV[2])
+return wait
+`
+
+// Redis is a store shared by every replica using the same Redis server
+type Redis struct {
+	address   string
+	tlsConfig *tls.Config
+	username  string
+	password  string
+	db        int
+	pool      chan *redisConn
+}
+
+// OpenRedis connects to the Redis server at a URL of the form
+// redis://[[user]:password@]host[:port][/db]; rediss:// connects over TLS
+func OpenRedis(rawURL string) (*Redis, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Redis URL: %w", err)
+	}
+	r := &Redis{pool: make(chan *redisConn, redisPoolSize)}
+	switch u.Scheme {
+	case "redis":
+	case "rediss":
+		r.tlsConfig = &tls.Config{ServerName: u.Hostname()}
+	default:
+		return nil, fmt.Errorf("invalid Redis URL scheme %q, expected redis or rediss", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, errors.New("invalid Redis URL: missing host")
+	}
+	port := u.Port()
+	if port == "" {
+		port = "6379"
+	}
+	r.address = net.JoinHostPort(u.Hostname(), port)
+	if u.User != nil {
+		r.username = u.User.Username()
+		r.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if r.db, err = strconv.Atoi(db); err != nil || r.db < 0 {
+			return nil, fmt.Errorf("invalid Redis database %q", db)
+		}
+	}
+
+	// Connect now so that a wrong address or password fails startup
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	if _, err := r.do(ctx, "PING"); err != nil {
+		return nil, fmt.Errorf("failed to connect to Redis at %s: %w", r.address, err)
+	}
+	return r, nil
+}
+
+func (r *Redis) Token(ctx context.Context) (string, error) {
+	reply, err := r.do(ctx, "GET", redisKeyPrefix+"copilot-token")
+	if err != nil || reply == nil {
+		return "", err
+	}
+	token, _ := reply.(string)
+	return token, nil
+}
+
+func (r *Redis) SetToken(ctx context.Context, token string, expiresAt time.Time) error {
+	ttl := time.Until(expiresAt) - tokenExpiryMargin
+	if ttl <= 0 {
+		return nil
+	}
+	_, err := r.do(ctx, "SET", redisKeyPrefix+"copilot-token", token, "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	return err
+}
+
+func (r *Redis) Take(ctx context.Context, key string, perMinute int) (bool, time.Duration, error) {
+	reply, err := r.do(ctx, "EVAL", takeScript, "1", redisKeyPrefix+"ratelimit:"+key,
+		strconv.Itoa(perMinute), strconv.FormatInt(bucketIdle.Milliseconds(), 10))
+	if err != nil {
+		return false, 0, err
+	}
+	wait, ok := reply.(int64)
+	if !ok {
+		return false, 0, fmt.Errorf("unexpected Redis reply %v", reply)
+	}
+	return wait == 0, time.Duration(wait) * time.Millisecond, nil
+}
+
+func (r *Redis) AddTokens(ctx context.Context, model string, tokens int64) error {
+	_, err := r.do(ctx, "HINCRBY", redisKeyPrefix+"usage:tokens", model, strconv.FormatInt(tokens, 10))
+	return err
+}
+
+func (r *Redis) Tokens(ctx context.Context) (map[string]int64, error) {
+	reply, err := r.do(ctx, "HGETALL", redisKeyPrefix+"usage:tokens")
+	if err != nil {
+		return nil, err
+	}
+	fields, _ := reply.([]interface{})
+	tokens := make(map[string]int64, len(fields)/2)
+	for i := 0; i+1 < len(fields); i += 2 {
+		model, _ := fields[i].(string)
+		value, _ := fields[i+1].(string)
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid token count %q of model %s", value, model)
+		}
+		tokens[model] = n
+	}
+	return tokens, nil
+}
+
+func (r *Redis) AddSpend(ctx context.Context, period, key string, amount float64) error {
+	hash := redisKeyPrefix + "spend:" + period
+	if _, err := r.do(ctx, "HINCRBYFLOAT", hash, key, strconv.FormatFloat(amount, 'f', -1, 64)); err != nil {
+		return err
+	}
+	_, err := r.do(ctx, "PEXPIRE", hash, strconv.FormatInt(spendRetention.Milliseconds(), 10))
+	return err
+}
+
+func (r *Redis) Spend(ctx context.Context, period string) (map[string]float64, error) {
+	reply, err := r.do(ctx, "HGETALL", redisKeyPrefix+"spend:"+period)
+	if err != nil {
+		return nil, err
+	}
+	fields, _ := reply.([]interface{})
+	spend := make(map[string]float64, len(fields)/2)
+	for i := 0; i+1 < len(fields); i += 2 {
+		key, _ := fields[i].(string)
+		value, _ := fields[i+1].(string)
+		amount, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid spend %q of key %s", value, key)
+		}
+		spend[key] = amount
+	}
+	return spend, nil
+}
+
+func (r *Redis) PinModel(ctx context.Context, session, model string, ttl time.Duration) (string, error) {
+	key := redisKeyPrefix + "pin:" + session
+	millis := strconv.FormatInt(ttl.Milliseconds(), 10)
+	reply, err := r.do(ctx, "SET", key, model, "NX", "PX", millis)
+	if err != nil {
+		return "", err
+	}
+	if reply != nil {
+		return model, nil
+	}
+	// Pinned already: keep the pin and extend it
+	reply, err = r.do(ctx, "GET", key)
+	if err != nil {
+		return "", err
+	}
+	pinned, _ := reply.(string)
+	if pinned == "" {
+		// Expired in between
+		return model, nil
+	}
+	_, err = r.do(ctx, "PEXPIRE", key, millis)
+	return pinned, err
+}
+
+// Close closes the idle connections
+func (r *Redis) Close() error {
+	for {
+		select {
+		case conn := <-r.pool:
+			conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// redisError is an error reply of the server
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// redisConn is a connection speaking the RESP2 protocol
+type redisConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// do sends a command on a pooled connection and returns its reply: a
+// string, an int64, a []interface{}, nil, or a redisError as the error
+func (r *Redis) do(ctx context.Context, args ...string) (interface{}, error) {
+	conn, err := r.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := conn.do(ctx, args...)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		// The connection is in an unknown state after a transport error
+		conn.Close()
+		return nil, err
+	}
+	select {
+	case r.pool <- conn:
+	default:
+		conn.Close()
+	}
+	return reply, err
+}
+
+// conn returns an idle connection or dials a new one
+func (r *Redis) conn(ctx context.Context) (*redisConn, error) {
+	select {
+	case conn := <-r.pool:
+		return conn, nil
+	default:
+	}
+
+	dialer := &net.Dialer{Timeout: redisTimeout}
+	netConn, err := dialer.DialContext(ctx, "tcp", r.address)
+	if err != nil {
+		return nil, err
+	}
+	if r.tlsConfig != nil {
+		tlsConn := tls.Client(netConn, r.tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			netConn.Close()
+			return nil, err
+		}
+		netConn = tlsConn
+	}
+	conn := &redisConn{Conn: netConn, reader: bufio.NewReader(netConn)}
+
+	var setup [][]string
+	switch {
+	case r.username != "" && r.password != "":
+		setup = append(setup, []string{"AUTH", r.username, r.password})
+	case r.password != "":
+		setup = append(setup, []string{"AUTH", r.password})
+	}
+	if r.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(r.db)})
+	}
+	for _, command := range setup {
+		if _, err := conn.do(ctx, command...); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (c *redisConn) do(ctx context.Context, args ...string) (interface{}, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(redisTimeout)
+	}
+	c.SetDeadline(deadline)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.Conn, b.String()); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+// readReply reads one reply, nested arrays included
+func (c *redisConn) readReply() (interface{}, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		var replyErr error
+		for i := range items {
+			item, err := c.readReply()
+			var itemErr redisError
+			if err != nil && !errors.As(err, &itemErr) {
+				return nil, err
+			}
+			if err != nil && replyErr == nil {
+				replyErr = err
+			}
+			items[i] = item
+		}
+		return items, replyErr
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
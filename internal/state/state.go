@@ -0,0 +1,80 @@
+// internal/state/state.go
+package state
+
+import (
+	"context"
+	"time"
+)
+
+// TokenCache stores the Copilot API token
+type TokenCache interface {
+	// Token returns the cached token, or "" when none is cached or it is
+	// about to expire
+	Token(ctx context.Context) (string, error)
+	// SetToken caches token until shortly before expiresAt
+	SetToken(ctx context.Context, token string, expiresAt time.Time) error
+}
+
+// RateLimitStore holds token buckets refilling at a rate per minute
+type RateLimitStore interface {
+	// Take consumes a request from the bucket named key, which holds up to
+	// perMinute requests and refills at perMinute per minute. It returns how
+	// long to wait when the bucket is empty. A bucket taken from at another
+	// rate starts over full.
+	Take(ctx context.Context, key string, perMinute int) (bool, time.Duration, error)
+}
+
+// UsageStore counts the tokens used per model
+type UsageStore interface {
+	AddTokens(ctx context.Context, model string, tokens int64) error
+	// Tokens returns the tokens used so far by model
+	Tokens(ctx context.Context) (map[string]int64, error)
+}
+
+// SpendStore accumulates the estimated spend of API keys per period, such as
+// a day or a month
+type SpendStore interface {
+	AddSpend(ctx context.Context, period, key string, amount float64) error
+	// Spend returns the spend of every key in period
+	Spend(ctx context.Context, period string) (map[string]float64, error)
+}
+
+// PinStore remembers the model each conversation is pinned to
+type PinStore interface {
+	// PinModel pins session to model unless it is pinned already, and returns
+	// the model it is pinned to. A pin expires after ttl without use.
+	PinModel(ctx context.Context, session, model string, ttl time.Duration) (string, error)
+}
+
+// Store holds the state that replicas of the proxy need to agree on: the
+// cached Copilot token, the rate limiter buckets, the usage and spend
+// counters and the model pins. It is kept in memory by default, or in Redis
+// so that replicas running behind a load balancer share it.
+type Store interface {
+	TokenCache
+	RateLimitStore
+	UsageStore
+	SpendStore
+	PinStore
+	Close() error
+}
+
+// tokenExpiryMargin is how long before its expiry a cached token is no
+// longer handed out, so that it is not used while being refreshed
+const tokenExpiryMargin = 2 * time.Minute
+
+// bucketIdle is how long a bucket is kept after its last request; an idle
+// bucket is full again anyway
+const bucketIdle = 10 * time.Minute
+
+// spendRetention is how long the spend of a period is kept after it was last
+// added to, enough for a month to be reported until the next one ends
+const spendRetention = 62 * 24 * time.Hour
+
+// Open returns the Redis store at url, or an in-memory store when url is empty
+func Open(url string) (Store, error) {
+	if url == "" {
+		return NewMemory(), nil
+	}
+	return OpenRedis(url)
+}
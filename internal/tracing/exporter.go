@@ -0,0 +1,280 @@
+// internal/tracing/exporter.go
+package tracing
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/acazau/ghcsd/internal/version"
+	"github.com/acazau/ghcsd/pkg/logging"
+)
+
+// tracingLog writes the failures to export spans
+var tracingLog = logging.For(logging.Tracing)
+
+const (
+	// exportInterval is how often queued spans are sent
+	exportInterval = 5 * time.Second
+	// exportBatchSize is the queue length that triggers an early export
+	exportBatchSize = 512
+	// maxQueuedSpans bounds the spans held while the collector is unreachable;
+	// newer spans are dropped beyond it
+	maxQueuedSpans = 4096
+	// exportTimeout bounds a single export request
+	exportTimeout = 10 * time.Second
+)
+
+// ExporterOptions configures an OTLP exporter
+type ExporterOptions struct {
+	// Endpoint is the OTLP/HTTP traces URL, e.g. http://localhost:4318/v1/traces
+	Endpoint string
+	// Headers are sent with every export, e.g. collector credentials
+	Headers map[string]string
+	// ServiceName is reported as the service.name resource attribute
+	ServiceName string
+	// Client sends the exports; it must not itself be traced
+	Client *http.Client
+}
+
+// Exporter sends finished spans to an OpenTelemetry collector using OTLP
+// over HTTP with JSON encoding, in batches
+type Exporter struct {
+	opts ExporterOptions
+
+	mu      sync.Mutex
+	queue   []otlpSpan
+	dropped int
+	flush   chan struct{}
+
+	stop    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+}
+
+// NewExporter creates an exporter and starts sending spans in the
+// background, or returns nil when no endpoint is configured
+func NewExporter(opts ExporterOptions) *Exporter {
+	if opts.Endpoint == "" {
+		return nil
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{}
+	}
+	if opts.ServiceName == "" {
+		opts.ServiceName = "ghcsd"
+	}
+	e := &Exporter{opts: opts, flush: make(chan struct{}, 1), stop: make(chan struct{}), stopped: make(chan struct{})}
+	go e.run()
+	return e
+}
+
+// enqueue converts a finished span to its OTLP form and queues it
+func (e *Exporter) enqueue(s *Span, end time.Time) {
+	span := otlpSpan{
+		TraceID:           hex.EncodeToString(s.context.TraceID[:]),
+		SpanID:            hex.EncodeToString(s.context.SpanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+	}
+	if s.parent != (SpanID{}) {
+		span.ParentSpanID = hex.EncodeToString(s.parent[:])
+	}
+	s.mu.Lock()
+	span.Attributes = otlpAttributes(s.attributes)
+	if s.errMessage != "" {
+		span.Status = &otlpStatus{Code: 2, Message: s.errMessage}
+	}
+	s.mu.Unlock()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.queue) >= maxQueuedSpans {
+		e.dropped++
+		return
+	}
+	e.queue = append(e.queue, span)
+	if len(e.queue) >= exportBatchSize {
+		select {
+		case e.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (e *Exporter) run() {
+	defer close(e.stopped)
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-e.flush:
+		case <-e.stop:
+			e.export()
+			return
+		}
+		e.export()
+	}
+}
+
+// Close sends the queued spans and stops the exporter. Spans finished
+// afterwards are queued but never sent.
+func (e *Exporter) Close() {
+	e.once.Do(func() { close(e.stop) })
+	<-e.stopped
+}
+
+// export sends the queued spans. Spans that fail to send are dropped rather
+// than retried, so that a missing collector cannot grow the queue.
+func (e *Exporter) export() {
+	e.mu.Lock()
+	spans := e.queue
+	dropped := e.dropped
+	e.queue = nil
+	e.dropped = 0
+	e.mu.Unlock()
+	if dropped > 0 {
+		tracingLog.Warnf("[Tracing] Dropped %d spans, the export queue is full", dropped)
+	}
+	if len(spans) == 0 {
+		return
+	}
+
+	payload := otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: otlpAttributes(map[string]interface{}{
+			"service.name":    e.opts.ServiceName,
+			"service.version": version.Get().Version,
+		})},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "github.com/acazau/ghcsd"},
+			Spans: spans,
+		}},
+	}}}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		tracingLog.Errorf("[Tracing] Failed to encode spans: %v", err)
+		return
+	}
+	if err := e.send(body); err != nil {
+		tracingLog.Warnf("[Tracing] Failed to export %d spans: %v", len(spans), err)
+	}
+}
+
+func (e *Exporter) send(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, e.opts.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range e.opts.Headers {
+		req.Header.Set(name, value)
+	}
+	client := *e.opts.Client
+	client.Timeout = exportTimeout
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("collector returned %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	return nil
+}
+
+// OTLP JSON encoding of the trace export request
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+// otlpAttributes converts attributes to OTLP key-value pairs, sorted by key
+func otlpAttributes(attributes map[string]interface{}) []otlpAttribute {
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	converted := make([]otlpAttribute, 0, len(keys))
+	for _, key := range keys {
+		var value otlpValue
+		switch v := attributes[key].(type) {
+		case string:
+			value.StringValue = &v
+		case bool:
+			value.BoolValue = &v
+		case int:
+			s := strconv.Itoa(v)
+			value.IntValue = &s
+		case int64:
+			s := strconv.FormatInt(v, 10)
+			value.IntValue = &s
+		case float64:
+			value.DoubleValue = &v
+		default:
+			s := fmt.Sprint(v)
+			value.StringValue = &s
+		}
+		converted = append(converted, otlpAttribute{Key: key, Value: value})
+	}
+	return converted
+}
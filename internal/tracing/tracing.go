@@ -0,0 +1,254 @@
+// internal/tracing/tracing.go
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Span kinds, as numbered by OTLP
+const (
+	KindInternal = 1
+	KindServer   = 2
+	KindClient   = 3
+)
+
+// TraceID identifies a trace
+type TraceID [16]byte
+
+// SpanID identifies a span within a trace
+type SpanID [8]byte
+
+// SpanContext is the part of a span propagated across process boundaries
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// Valid reports whether the trace and span IDs are set
+func (sc SpanContext) Valid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// Traceparent formats the span context as a W3C traceparent header value
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", hex.EncodeToString(sc.TraceID[:]), hex.EncodeToString(sc.SpanID[:]), flags)
+}
+
+// ParseTraceparent parses a W3C traceparent header value
+func ParseTraceparent(value string) (SpanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return SpanContext{}, false
+	}
+	// Version 00 has exactly four fields; later versions may append more
+	if parts[0] == "00" && len(parts) != 4 {
+		return SpanContext{}, false
+	}
+	var sc SpanContext
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return SpanContext{}, false
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return SpanContext{}, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return SpanContext{}, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return SpanContext{}, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, sc.Valid()
+}
+
+// Tracer creates spans and hands finished ones to its exporter. A nil
+// Tracer is valid and records nothing, so call sites need no checks.
+type Tracer struct {
+	exporter *Exporter
+}
+
+// NewTracer creates a tracer exporting to exporter, or returns nil when
+// exporter is nil
+func NewTracer(exporter *Exporter) *Tracer {
+	if exporter == nil {
+		return nil
+	}
+	return &Tracer{exporter: exporter}
+}
+
+// Close sends the spans still queued and stops the exporter
+func (t *Tracer) Close() {
+	if t == nil {
+		return
+	}
+	t.exporter.Close()
+}
+
+// Span is an operation being traced
+type Span struct {
+	tracer     *Tracer
+	name       string
+	kind       int
+	context    SpanContext
+	parent     SpanID
+	start      time.Time
+	mu         sync.Mutex
+	attributes map[string]interface{}
+	errMessage string
+	ended      bool
+}
+
+type spanKey struct{}
+
+type remoteKey struct{}
+
+// Start begins a span named name as a child of the span in ctx, or of the
+// remote parent extracted into ctx, and returns a context carrying it
+func (t *Tracer) Start(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	span := &Span{tracer: t, name: name, kind: kind, start: time.Now()}
+	parent, ok := SpanContextFrom(ctx)
+	if ok {
+		span.context.TraceID = parent.TraceID
+		span.context.Sampled = parent.Sampled
+		span.parent = parent.SpanID
+	} else {
+		rand.Read(span.context.TraceID[:])
+		span.context.Sampled = true
+	}
+	rand.Read(span.context.SpanID[:])
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// Extract returns a context carrying the remote parent span described by the
+// traceparent header of r, if any
+func Extract(ctx context.Context, header http.Header) context.Context {
+	sc, ok := ParseTraceparent(header.Get("traceparent"))
+	if !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// Inject sets the traceparent header for the span in ctx
+func Inject(ctx context.Context, header http.Header) {
+	if sc, ok := SpanContextFrom(ctx); ok {
+		header.Set("traceparent", sc.Traceparent())
+	}
+}
+
+// SpanContextFrom returns the context of the current span in ctx, or of the
+// remote parent when no local span was started
+func SpanContextFrom(ctx context.Context) (SpanContext, bool) {
+	if span, ok := ctx.Value(spanKey{}).(*Span); ok {
+		return span.context, true
+	}
+	sc, ok := ctx.Value(remoteKey{}).(SpanContext)
+	return sc, ok
+}
+
+// SetAttribute records an attribute of the span. Values are strings, bools,
+// ints or float64s.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.attributes == nil {
+		s.attributes = make(map[string]interface{})
+	}
+	s.attributes[key] = value
+}
+
+// SetError marks the span as failed
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errMessage = err.Error()
+}
+
+// TraceID returns the hex trace ID of the span, or "" for a nil span
+func (s *Span) TraceID() string {
+	if s == nil {
+		return ""
+	}
+	return hex.EncodeToString(s.context.TraceID[:])
+}
+
+// End finishes the span and queues it for export. Only the first call has
+// an effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.mu.Unlock()
+	if s.context.Sampled {
+		s.tracer.exporter.enqueue(s, time.Now())
+	}
+}
+
+// Transport wraps an outbound round tripper with client spans and
+// traceparent propagation
+func (t *Tracer) Transport(next http.RoundTripper) http.RoundTripper {
+	if t == nil {
+		return next
+	}
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &tracingTransport{tracer: t, next: next}
+}
+
+type tracingTransport struct {
+	tracer *Tracer
+	next   http.RoundTripper
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := t.tracer.Start(req.Context(), "HTTP "+req.Method, KindClient)
+	span.SetAttribute("http.request.method", req.Method)
+	span.SetAttribute("server.address", req.URL.Host)
+	span.SetAttribute("url.path", req.URL.Path)
+
+	req = req.Clone(ctx)
+	Inject(ctx, req.Header)
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		span.SetError(err)
+		span.End()
+		return nil, err
+	}
+	span.SetAttribute("http.response.status_code", resp.StatusCode)
+	if resp.StatusCode >= 500 {
+		span.SetError(fmt.Errorf("HTTP %d", resp.StatusCode))
+	}
+	// The span covers the response headers; streamed bodies are traced by
+	// the caller's own spans
+	span.End()
+	return resp, nil
+}
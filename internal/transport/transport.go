@@ -0,0 +1,71 @@
+// internal/transport/transport.go
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Options configures outbound HTTP clients
+type Options struct {
+	// CABundle is a PEM file of extra trusted CA certificates
+	CABundle string
+	// InsecureSkipVerify disables TLS certificate verification
+	InsecureSkipVerify bool
+	// DialTimeout bounds establishing TCP connections; 0 uses the default
+	DialTimeout time.Duration
+}
+
+// defaultDialTimeout matches the dialer of http.DefaultTransport
+const defaultDialTimeout = 30 * time.Second
+
+// NewClient builds the HTTP client used for every outbound request. It
+// honors HTTP_PROXY, HTTPS_PROXY and NO_PROXY, trusts the system CAs plus the
+// configured bundle and applies the dial timeout.
+func NewClient(opts Options) (*http.Client, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: opts.InsecureSkipVerify,
+	}
+
+	if opts.CABundle != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := os.ReadFile(opts.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", opts.CABundle)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	dialTimeout := opts.DialTimeout
+	if dialTimeout <= 0 {
+		dialTimeout = defaultDialTimeout
+	}
+	dialer := &net.Dialer{
+		Timeout:   dialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	return &http.Client{Transport: transport}, nil
+}
@@ -0,0 +1,59 @@
+// internal/version/version.go
+package version
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// Build information, injected at build time with
+// -ldflags "-X github.com/acazau/ghcsd/internal/version.Version=..."
+var (
+	Version   = "dev"
+	Commit    = "unknown"
+	BuildDate = "unknown"
+)
+
+// Info describes the running build
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+}
+
+// Get returns the build information, falling back to the VCS data embedded
+// by the Go toolchain when the values were not injected via ldflags
+func Get() Info {
+	info := Info{
+		Version:   Version,
+		Commit:    Commit,
+		BuildDate: BuildDate,
+		GoVersion: runtime.Version(),
+	}
+
+	if buildInfo, ok := debug.ReadBuildInfo(); ok {
+		if info.Version == "dev" && buildInfo.Main.Version != "" && buildInfo.Main.Version != "(devel)" {
+			info.Version = buildInfo.Main.Version
+		}
+		for _, setting := range buildInfo.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if info.Commit == "unknown" {
+					info.Commit = setting.Value
+				}
+			case "vcs.time":
+				if info.BuildDate == "unknown" {
+					info.BuildDate = setting.Value
+				}
+			}
+		}
+	}
+	return info
+}
+
+// String formats the build information for the --version flag
+func (i Info) String() string {
+	return fmt.Sprintf("ghcsd %s (commit %s, built %s, %s)", i.Version, i.Commit, i.BuildDate, i.GoVersion)
+}
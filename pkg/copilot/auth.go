@@ -1,4 +1,5 @@
-// File: internal/copilot/auth.go
+// File: pkg/copilot/auth.go
+
 package copilot
 
 import (
@@ -6,56 +7,74 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
+
+	"github.com/acazau/ghcsd/pkg/logging"
 )
 
 const (
-	deviceCodeURL = "https://github.com/login/device/code"
-	clientID      = "Iv1.b507a08c87ecfe98" // GitHub Copilot client ID
+	defaultGitHubURL    = "https://github.com"
+	defaultGitHubAPIURL = "https://api.github.com"
+	clientID            = "Iv1.b507a08c87ecfe98" // GitHub Copilot client ID
 )
 
+// authLog logs the steps of the GitHub login and the token exchange
+var authLog = logging.For(logging.Auth)
+
 // AuthManager handles GitHub Copilot authentication
 type AuthManager struct {
-	client    *http.Client
-	configDir string
-	debug     bool
+	client       *http.Client
+	configDir    string
+	githubURL    string
+	githubAPIURL string
+	// pat is a GitHub personal access token used instead of a stored login
+	pat string
 }
 
 // NewAuthManager creates a new AuthManager instance
-func NewAuthManager(client *http.Client, configDir string, debug bool) *AuthManager {
+func NewAuthManager(client *http.Client, configDir string) *AuthManager {
 	return &AuthManager{
-		client:    client,
-		configDir: configDir,
-		debug:     debug,
+		client:       client,
+		configDir:    configDir,
+		githubURL:    defaultGitHubURL,
+		githubAPIURL: defaultGitHubAPIURL,
 	}
 }
 
-func (a *AuthManager) debugLog(format string, v ...interface{}) {
-	if a.debug {
-		log.Printf("[Auth Manager] "+format, v...)
+// SetEndpoints overrides the GitHub web and API base URLs used for the device
+// flow and the Copilot token exchange, e.g. for GitHub Enterprise deployments.
+// Empty values keep the github.com defaults.
+func (a *AuthManager) SetEndpoints(githubURL, githubAPIURL string) {
+	if githubURL != "" {
+		a.githubURL = strings.TrimRight(githubURL, "/")
 	}
+	if githubAPIURL != "" {
+		a.githubAPIURL = strings.TrimRight(githubAPIURL, "/")
+	}
+}
+
+func (a *AuthManager) debugLog(format string, v ...interface{}) {
+	authLog.Debugf("[Auth Manager] "+format, v...)
 }
 
 // GetCopilotToken initiates the full token acquisition flow
 func (a *AuthManager) GetCopilotToken() (string, error) {
 	a.debugLog("Starting GetCopilotToken operation")
+	if a.pat != "" {
+		return a.exchangePersonalAccessToken()
+	}
 
 	// Try to load existing auth token
 	authToken, err := a.LoadAuthToken()
 	if err != nil {
 		a.debugLog("No existing auth token found, starting device code flow")
 		// If no auth token exists, start device code flow
-		deviceCode, err := a.RequestDeviceCode()
-		if err != nil {
-			return "", fmt.Errorf("failed to request device code: %w", err)
-		}
-
-		authToken, err = a.handleDeviceCodeFlow(deviceCode)
+		authToken, err = a.login("")
 		if err != nil {
 			return "", err
 		}
@@ -73,12 +92,7 @@ func (a *AuthManager) GetCopilotToken() (string, error) {
 		// If the token exchange fails, it might be because the auth token is expired
 		// Try to get a new token through the device code flow
 		a.debugLog("Auth token may be expired, starting new device code flow")
-		deviceCode, err := a.RequestDeviceCode()
-		if err != nil {
-			return "", fmt.Errorf("failed to request device code after token exchange failure: %w", err)
-		}
-
-		authToken, err = a.handleDeviceCodeFlow(deviceCode)
+		authToken, err = a.login(authToken)
 		if err != nil {
 			return "", err
 		}
@@ -93,13 +107,51 @@ func (a *AuthManager) GetCopilotToken() (string, error) {
 
 // LoadAuthToken loads the authentication token from the specified configuration directory
 func (a *AuthManager) LoadAuthToken() (string, error) {
-	tokenPath := filepath.Join(a.configDir, ".copilot-auth-token")
+	tokenPath := filepath.Join(a.configDir, authTokenFile)
 	a.debugLog("Loading auth token from: %s", tokenPath)
 	data, err := os.ReadFile(tokenPath)
 	if err != nil {
 		return "", fmt.Errorf("failed to read auth token file: %w", err)
 	}
-	return strings.TrimSpace(string(data)), nil
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("auth token file %s is empty", tokenPath)
+	}
+	return token, nil
+}
+
+// login runs the device flow for a new auth token and saves it, unless
+// another process replaced the stale token while this one waited for the
+// token file lock. The lock is held during the flow, so that processes
+// starting together share one login instead of each prompting the user.
+func (a *AuthManager) login(stale string) (string, error) {
+	unlock, err := lockTokenFile(a.configDir, loginLockTimeout)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	if current, err := a.LoadAuthToken(); err == nil && current != stale {
+		a.debugLog("Auth token was replaced by another process, using the new one")
+		return current, nil
+	}
+
+	deviceCode := a.PendingDeviceCode()
+	if deviceCode != nil {
+		fmt.Printf("\nResuming the login started before the restart\n")
+	} else if deviceCode, err = a.RequestDeviceCode(); err != nil {
+		return "", fmt.Errorf("failed to request device code: %w", err)
+	}
+	authToken, err := a.handleDeviceCodeFlow(deviceCode)
+	if err != nil {
+		return "", err
+	}
+	if err := a.writeAuthToken(authToken); err != nil {
+		a.debugLog("Failed to save auth token: %v", err)
+		return "", fmt.Errorf("failed to save auth token: %w", err)
+	}
+	a.debugLog("Successfully saved new auth token")
+	return authToken, nil
 }
 
 // DeviceCode represents the response from the device code request
@@ -111,13 +163,15 @@ type DeviceCode struct {
 	Interval        int    `json:"interval"`
 }
 
-// RequestDeviceCode initiates the device code flow
+// RequestDeviceCode initiates the device code flow. The code is kept in the
+// config directory until it is authorized or expires, so that a restarted
+// process can resume the flow with PendingDeviceCode.
 func (a *AuthManager) RequestDeviceCode() (*DeviceCode, error) {
 	a.debugLog("Requesting device code from GitHub...")
 
 	reqBody := bytes.NewBuffer([]byte(fmt.Sprintf(`{"client_id":"%s","scope":"copilot"}`, clientID)))
 
-	req, err := http.NewRequest("POST", deviceCodeURL, reqBody)
+	req, err := http.NewRequest("POST", a.githubURL+"/login/device/code", reqBody)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
@@ -152,6 +206,7 @@ func (a *AuthManager) RequestDeviceCode() (*DeviceCode, error) {
 	}
 
 	a.debugLog("Successfully received device code with verification URI: %s", deviceCode.VerificationURI)
+	a.savePendingDeviceCode(&deviceCode)
 	return &deviceCode, nil
 }
 
@@ -160,7 +215,17 @@ func (a *AuthManager) handleDeviceCodeFlow(deviceCode *DeviceCode) (string, erro
 	fmt.Printf("\nPlease visit: %s\n", deviceCode.VerificationURI)
 	fmt.Printf("And enter code: %s\n", deviceCode.UserCode)
 	a.debugLog("Waiting for user to authorize the device code")
+	authResp, err := a.pollForAuthorization(deviceCode)
+	if err != nil {
+		return "", err
+	}
+	return authResp.AccessToken, nil
+}
 
+// PollDeviceCode waits until the user has authorized the device code, then
+// saves and returns the new GitHub auth token. It lets callers present the
+// verification URI and user code themselves, e.g. over HTTP.
+func (a *AuthManager) PollDeviceCode(deviceCode *DeviceCode) (string, error) {
 	authResp, err := a.pollForAuthorization(deviceCode)
 	if err != nil {
 		return "", err
@@ -176,9 +241,14 @@ func (a *AuthManager) handleDeviceCodeFlow(deviceCode *DeviceCode) (string, erro
 	return authResp.AccessToken, nil
 }
 
+// ExchangeToken exchanges a GitHub auth token for a Copilot API token
+func (a *AuthManager) ExchangeToken(authToken string) (string, error) {
+	return a.fetchNewToken(authToken)
+}
+
 // pollForAuthorization continuously checks for device code authorization
 func (a *AuthManager) pollForAuthorization(deviceCode *DeviceCode) (*AuthResponse, error) {
-	tokenURL := "https://github.com/login/oauth/access_token"
+	tokenURL := a.githubURL + "/login/oauth/access_token"
 	startTime := time.Now()
 
 	for {
@@ -214,11 +284,13 @@ func (a *AuthManager) pollForAuthorization(deviceCode *DeviceCode) (*AuthRespons
 			}
 
 			if authResp.AccessToken != "" {
+				a.removePendingDeviceCode(deviceCode)
 				return &authResp, nil
 			}
 		}
 
 		if time.Since(startTime) > time.Duration(deviceCode.ExpiresIn)*time.Second {
+			a.removePendingDeviceCode(deviceCode)
 			return nil, fmt.Errorf("device code expired")
 		}
 
@@ -231,7 +303,7 @@ func (a *AuthManager) pollForAuthorization(deviceCode *DeviceCode) (*AuthRespons
 func (a *AuthManager) fetchNewToken(authToken string) (string, error) {
 	a.debugLog("Initiating new token fetch from GitHub API")
 
-	req, err := http.NewRequest("GET", "https://api.github.com/copilot_internal/v2/token", nil)
+	req, err := http.NewRequest("GET", a.githubAPIURL+"/copilot_internal/v2/token", nil)
 	if err != nil {
 		return "", err
 	}
@@ -252,7 +324,7 @@ func (a *AuthManager) fetchNewToken(authToken string) (string, error) {
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
 		a.debugLog("Error response from API: %s", string(body))
-		return "", fmt.Errorf("failed to get token (status %d): %s", resp.StatusCode, string(body))
+		return "", &tokenExchangeError{status: resp.StatusCode, body: string(body)}
 	}
 
 	body, err := io.ReadAll(resp.Body)
@@ -261,7 +333,9 @@ func (a *AuthManager) fetchNewToken(authToken string) (string, error) {
 	}
 
 	var result struct {
-		Token string `json:"token"`
+		Token     string `json:"token"`
+		ExpiresAt int64  `json:"expires_at"`
+		RefreshIn int64  `json:"refresh_in"`
 	}
 	if err := json.Unmarshal(body, &result); err != nil {
 		a.debugLog("Failed to parse API response: %v", err)
@@ -274,9 +348,27 @@ func (a *AuthManager) fetchNewToken(authToken string) (string, error) {
 	}
 
 	a.debugLog("Successfully parsed token response")
+	recordToken(result.Token, result.ExpiresAt, result.RefreshIn)
 	return result.Token, nil
 }
 
+// TokenExpiry returns the expiry time embedded in a Copilot API token, which
+// is a list of key=value fields such as "tid=...;exp=1712345678;..."
+func TokenExpiry(token string) (time.Time, bool) {
+	for _, field := range strings.Split(token, ";") {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok || key != "exp" {
+			continue
+		}
+		seconds, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return time.Time{}, false
+		}
+		return time.Unix(seconds, 0), true
+	}
+	return time.Time{}, false
+}
+
 type AuthResponse struct {
 	AccessToken string `json:"access_token"`
 }
@@ -286,15 +378,31 @@ type ErrorResponse struct {
 	ErrorDescription string `json:"error_description"`
 }
 
-// SaveAuthToken saves the authentication token to the config directory
+// SaveAuthToken saves the authentication token to the config directory. The
+// file is replaced atomically under a lock, so that several ghcsd processes
+// can share it.
 func (a *AuthManager) SaveAuthToken(token string) error {
-	tokenPath := filepath.Join(a.configDir, ".copilot-auth-token")
-	return os.WriteFile(tokenPath, []byte(token), 0600)
+	unlock, err := lockTokenFile(a.configDir, tokenLockTimeout)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return a.writeAuthToken(token)
+}
+
+// writeAuthToken replaces the token file; the caller must hold its lock
+func (a *AuthManager) writeAuthToken(token string) error {
+	return writeFileAtomic(filepath.Join(a.configDir, authTokenFile), []byte(token))
 }
 
 // RemoveAuthToken removes the saved authentication token
 func (a *AuthManager) RemoveAuthToken() error {
-	tokenPath := filepath.Join(a.configDir, ".copilot-auth-token")
+	unlock, err := lockTokenFile(a.configDir, tokenLockTimeout)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	tokenPath := filepath.Join(a.configDir, authTokenFile)
 	if err := os.Remove(tokenPath); err != nil && !os.IsNotExist(err) {
 		return err
 	}
@@ -0,0 +1,497 @@
+// pkg/copilot/client.go
+
+package copilot
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/acazau/ghcsd/pkg/logging"
+	"github.com/google/uuid"
+)
+
+// The loggers of the client: the requests to Copilot and the lines of
+// streamed responses
+var (
+	copilotLog = logging.For(logging.Copilot)
+	streamLog  = logging.For(logging.Stream)
+)
+
+// Client handles communication with the Copilot API
+type Client struct {
+	client    *http.Client
+	tokenMu   sync.RWMutex
+	token     string
+	model     string
+	sessionID string
+	machineID string
+	profile   string
+	baseURL   string
+}
+
+// DefaultBaseURL is the Copilot API endpoint used when none is configured
+const DefaultBaseURL = "https://api.githubcopilot.com"
+
+// NewClient creates a new Copilot client instance. An empty copilotAPIURL
+// selects the public Copilot API endpoint.
+func NewClient(token string, model string, copilotAPIURL string) (*Client, error) {
+	baseURL := DefaultBaseURL
+	if copilotAPIURL != "" {
+		parsed, err := url.Parse(copilotAPIURL)
+		if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+			return nil, fmt.Errorf("invalid Copilot API URL: %q", copilotAPIURL)
+		}
+		baseURL = strings.TrimRight(copilotAPIURL, "/")
+	}
+
+	return &Client{
+		client:    &http.Client{},
+		token:     token,
+		model:     model,
+		sessionID: generateSessionID(),
+		machineID: generateMachineID(),
+		baseURL:   baseURL,
+	}, nil
+}
+
+// generateSessionID creates a unique session identifier
+func generateSessionID() string {
+	return uuid.New().String() + fmt.Sprint(time.Now().UnixNano()/int64(time.Millisecond))
+}
+
+// generateMachineID creates a consistent machine identifier
+func generateMachineID() string {
+	return uuid.New().String()
+}
+
+func (c *Client) logWithPrefix(logger logging.Logger, level logging.Level, prefix, message string) {
+	if !logger.Enabled(level) {
+		return
+	}
+
+	// Mask bearer tokens in the message
+	maskedMessage := message
+	if strings.Contains(message, "Bearer ") {
+		parts := strings.Split(message, "Bearer ")
+		if len(parts) > 1 {
+			tokenPart := parts[1]
+			if len(tokenPart) > 20 {
+				maskedToken := tokenPart[:5] + "..." + tokenPart[len(tokenPart)-5:]
+				maskedMessage = parts[0] + "Bearer " + maskedToken
+			}
+		}
+	}
+	logger.Logf(level, "[%s] %s\n", prefix, maskedMessage)
+}
+
+// logRequest logs the method and URL of a request to Copilot at debug level
+// and its headers at trace level
+func (c *Client) logRequest(prefix string, r *http.Request) {
+	if !copilotLog.Enabled(logging.Debug) {
+		return
+	}
+	c.logWithPrefix(copilotLog, logging.Debug, prefix, fmt.Sprintf("Method: %s", r.Method))
+	c.logWithPrefix(copilotLog, logging.Debug, prefix, fmt.Sprintf("URL: %s", r.URL.String()))
+	if !copilotLog.Enabled(logging.Trace) {
+		return
+	}
+	c.logWithPrefix(copilotLog, logging.Trace, prefix, "Headers:")
+	for name, values := range r.Header {
+		for _, value := range values {
+			c.logWithPrefix(copilotLog, logging.Trace, prefix, fmt.Sprintf("  %s: %s", name, value))
+		}
+	}
+}
+
+// CompleteStream sends a completion request to the Copilot API and returns a stream.
+// Requests without a model use the model configured for this client.
+func (c *Client) CompleteStream(ctx context.Context, req CompletionRequest) (io.ReadCloser, error) {
+	if req.Model == "" {
+		req.Model = c.model
+	}
+	req.Stream = true
+
+	return c.sendRequest(ctx, req)
+}
+
+// Complete sends a completion request to the Copilot API and returns a response.
+// Requests without a model use the model configured for this client.
+func (c *Client) Complete(ctx context.Context, req CompletionRequest) (*CompletionResponse, error) {
+	if req.Model == "" {
+		req.Model = c.model
+	}
+	req.Stream = false
+
+	body, err := c.sendRequest(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	respBytes, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	var response CompletionResponse
+	if err := json.Unmarshal(respBytes, &response); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	// Policy errors can arrive as an error payload with a success status
+	if response.Error != nil {
+		code := response.Error.Code
+		if code == "" {
+			code = response.Error.Type
+		}
+		return nil, &APIError{StatusCode: http.StatusOK, Message: response.Error.Message, Code: code, Body: string(respBytes)}
+	}
+
+	return &response, nil
+}
+
+// sendRequest handles the common logic for sending requests to the Copilot API
+func (c *Client) sendRequest(ctx context.Context, req CompletionRequest) (io.ReadCloser, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	c.logWithPrefix(copilotLog, logging.Debug, "Copilot Request", string(body))
+
+	apiURL := fmt.Sprintf("%s/chat/completions", c.baseURL)
+	httpReq, err := http.NewRequestWithContext(
+		ctx,
+		"POST",
+		apiURL,
+		bytes.NewReader(body),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	c.setHeaders(ctx, httpReq)
+	// Copilot rejects image content unless the request is flagged as one
+	if req.HasImages() {
+		httpReq.Header.Set("Copilot-Vision-Request", "true")
+	}
+
+	c.logRequest("Copilot Request", httpReq)
+
+	resp, err := c.client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %w", err)
+	}
+	c.observeRateLimit(ctx, resp)
+
+	if resp.StatusCode >= 400 {
+		// Read error response
+		respBody, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, &APIError{StatusCode: resp.StatusCode, RetryAfter: resp.Header.Get("Retry-After")}
+		}
+		return nil, newAPIError(resp, respBody)
+	}
+
+	if req.Stream {
+		return c.handleStream(resp.Body), nil
+	}
+
+	// For non-streaming responses, log the response body
+	if copilotLog.Enabled(logging.Debug) {
+		respBody, err := io.ReadAll(resp.Body)
+		if err == nil {
+			c.logWithPrefix(copilotLog, logging.Debug, "Copilot Response", string(respBody))
+			// Create new reader with the same content
+			return io.NopCloser(bytes.NewReader(respBody)), nil
+		}
+		// If we failed to read the body for logging, return the original
+		return resp.Body, nil
+	}
+
+	return resp.Body, nil
+}
+
+// setHeaders sets the authentication and editor headers Copilot expects.
+// A session ID or header profile carried by ctx takes precedence over the
+// client's own.
+func (c *Client) setHeaders(ctx context.Context, httpReq *http.Request) {
+	sessionID := c.sessionID
+	if id, ok := ctx.Value(sessionIDKey{}).(string); ok && id != "" {
+		sessionID = id
+	}
+	profile, ok := LookupHeaderProfile(c.profile)
+	if name, _ := ctx.Value(headerProfileKey{}).(string); name != "" {
+		if requested, found := LookupHeaderProfile(name); found {
+			profile, ok = requested, true
+		}
+	}
+	if !ok {
+		profile = defaultHeaderProfile
+	}
+
+	token := strings.TrimSpace(c.GetToken())
+	httpReq.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	httpReq.Header.Set("Content-Type", "application/json")
+	profile.apply(httpReq.Header)
+	httpReq.Header.Set("VScode-SessionId", sessionID)
+	httpReq.Header.Set("VScode-MachineId", c.machineID)
+	httpReq.Header.Set("X-Request-Id", uuid.New().String())
+}
+
+// sessionIDKey is the context key for a per-request session ID
+type sessionIDKey struct{}
+
+// WithSessionID returns a context that makes the client send sessionID as
+// VScode-SessionId for requests made with it
+func WithSessionID(ctx context.Context, sessionID string) context.Context {
+	return context.WithValue(ctx, sessionIDKey{}, sessionID)
+}
+
+// ListModels returns the models available to the Copilot subscription
+func (c *Client) ListModels(ctx context.Context) ([]ModelInfo, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/models", c.baseURL), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	c.setHeaders(ctx, httpReq)
+
+	c.logRequest("Copilot Request", httpReq)
+
+	resp, err := c.client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+	if resp.StatusCode >= 400 {
+		return nil, newAPIError(resp, respBody)
+	}
+
+	var models struct {
+		Data []ModelInfo `json:"data"`
+	}
+	if err := json.Unmarshal(respBody, &models); err != nil {
+		return nil, fmt.Errorf("failed to decode models: %w", err)
+	}
+	return models.Data, nil
+}
+
+// handleStream processes the streaming response from Copilot
+func (c *Client) handleStream(body io.ReadCloser) io.ReadCloser {
+	pipeReader, pipeWriter := io.Pipe()
+	streamReader := &streamReader{
+		reader: bufio.NewReader(body),
+		client: c,
+	}
+
+	go func() {
+		defer body.Close()
+		defer pipeWriter.Close()
+
+		// Track every choice index seen, with the last finish reason upstream
+		// reported for it, so that each one gets a final message carrying the
+		// real finish reason (e.g. "length" when truncated) when n > 1
+		finishReasons := map[int]string{0: ""}
+
+		for {
+			line, err := streamReader.reader.ReadBytes('\n')
+			if err != nil {
+				// The upstream connection ended without [DONE]; tell the
+				// client instead of leaving it with a silently truncated answer
+				message := "upstream stream ended unexpectedly"
+				if err != io.EOF {
+					message = fmt.Sprintf("upstream stream failed: %v", err)
+				}
+				c.writeStreamError(pipeWriter, &StreamError{
+					Message: message,
+					Type:    "server_error",
+					Code:    "stream_interrupted",
+				})
+				return
+			}
+
+			line = bytes.TrimSpace(line)
+			if len(line) == 0 {
+				continue
+			}
+
+			if bytes.HasPrefix(line, []byte("data: ")) {
+				line = bytes.TrimPrefix(line, []byte("data: "))
+			}
+
+			if bytes.Equal(line, []byte("[DONE]")) {
+				finalMsg := CompletionResponse{
+					Choices: finalChoices(finishReasons),
+				}
+				if data, err := json.Marshal(finalMsg); err == nil {
+					c.logWithPrefix(streamLog, logging.Trace, "Copilot Response", string(data))
+					fmt.Fprintf(pipeWriter, "data: %s\n\n", data)
+				}
+				return
+			}
+
+			// Log the raw response line
+			c.logWithPrefix(streamLog, logging.Trace, "Copilot Response", string(line))
+
+			var response CompletionResponse
+			if err := json.Unmarshal(line, &response); err != nil {
+				streamLog.Warnf("[Copilot Response] Error unmarshalling stream: %v, line: %s", err, string(line))
+				continue
+			}
+
+			if response.Error != nil {
+				c.writeStreamError(pipeWriter, response.Error)
+				return
+			}
+
+			for _, choice := range response.Choices {
+				if choice.FinishReason != "" {
+					finishReasons[choice.Index] = choice.FinishReason
+				} else if _, ok := finishReasons[choice.Index]; !ok {
+					finishReasons[choice.Index] = ""
+				}
+			}
+
+			// The usage chunk requested by stream_options has no choices
+			if len(response.Choices) > 0 || response.Usage.TotalTokens > 0 {
+				if data, err := json.Marshal(response); err == nil {
+					fmt.Fprintf(pipeWriter, "data: %s\n\n", data)
+				}
+			}
+		}
+	}()
+
+	return pipeReader
+}
+
+// writeStreamError ends a stream with an OpenAI-style error chunk
+func (c *Client) writeStreamError(w io.Writer, streamErr *StreamError) {
+	data, err := json.Marshal(struct {
+		Error *StreamError `json:"error"`
+	}{streamErr})
+	if err != nil {
+		return
+	}
+	c.logWithPrefix(streamLog, logging.Debug, "Copilot Response", string(data))
+	fmt.Fprintf(w, "data: %s\n\n", data)
+}
+
+// finalChoices builds the closing choice for every streamed choice index,
+// using the finish reason reported upstream and "stop" when there was none
+func finalChoices(finishReasons map[int]string) []Choice {
+	sorted := make([]int, 0, len(finishReasons))
+	for index := range finishReasons {
+		sorted = append(sorted, index)
+	}
+	sort.Ints(sorted)
+
+	choices := make([]Choice, 0, len(sorted))
+	for _, index := range sorted {
+		reason := finishReasons[index]
+		if reason == "" {
+			reason = "stop"
+		}
+		choice := Choice{Index: index, FinishReason: reason}
+		choice.Message.Role = "assistant"
+		choices = append(choices, choice)
+	}
+	return choices
+}
+
+type streamReader struct {
+	reader *bufio.Reader
+	client *Client
+}
+
+func (sr *streamReader) Read(p []byte) (int, error) {
+	return sr.reader.Read(p)
+}
+
+func (sr *streamReader) Close() error {
+	return nil
+}
+
+// SetSessionID overrides the VScode-SessionId sent with requests.
+// An empty value keeps the generated session ID.
+func (c *Client) SetSessionID(sessionID string) {
+	if sessionID != "" {
+		c.sessionID = sessionID
+	}
+}
+
+// SetMachineID overrides the VScode-MachineId sent with requests.
+// An empty value keeps the generated machine ID.
+func (c *Client) SetMachineID(machineID string) {
+	if machineID != "" {
+		c.machineID = machineID
+	}
+}
+
+// SetHeaderProfile selects the named header profile sent with requests
+// that do not select their own. An empty name sends the default headers.
+func (c *Client) SetHeaderProfile(name string) {
+	c.profile = name
+}
+
+// GetSessionID returns the session ID sent with requests
+func (c *Client) GetSessionID() string {
+	return c.sessionID
+}
+
+// GetMachineID returns the machine ID sent with requests
+func (c *Client) GetMachineID() string {
+	return c.machineID
+}
+
+// SessionIDFromKey derives a stable Copilot session ID from a client-supplied
+// conversation key, so all requests of a conversation share one session
+func SessionIDFromKey(key string) string {
+	return uuid.NewSHA1(uuid.NameSpaceURL, []byte("ghcsd-session:"+key)).String()
+}
+
+// GetModel returns the model configured for this client
+func (c *Client) GetModel() string {
+	return c.model
+}
+
+// SetHTTPClient replaces the HTTP client used for requests to Copilot
+func (c *Client) SetHTTPClient(client *http.Client) {
+	if client != nil {
+		c.client = client
+	}
+}
+
+// GetBaseURL returns the Copilot API endpoint used by this client
+func (c *Client) GetBaseURL() string {
+	return c.baseURL
+}
+
+// GetToken returns the token configured for this client
+func (c *Client) GetToken() string {
+	c.tokenMu.RLock()
+	defer c.tokenMu.RUnlock()
+	return c.token
+}
+
+// SetToken replaces the Copilot API token, e.g. after a login completed while
+// the client is in use
+func (c *Client) SetToken(token string) {
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+	c.token = token
+}
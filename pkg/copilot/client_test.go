@@ -0,0 +1,72 @@
+// pkg/copilot/client_test.go
+
+package copilot
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"testing"
+)
+
+// readChunks parses the chunks of an SSE stream written by handleStream
+func readChunks(t *testing.T, stream io.Reader) []CompletionResponse {
+	t.Helper()
+	var chunks []CompletionResponse
+	scanner := bufio.NewScanner(stream)
+	for scanner.Scan() {
+		data, ok := bytes.CutPrefix(scanner.Bytes(), []byte("data: "))
+		if !ok {
+			continue
+		}
+		var chunk CompletionResponse
+		if err := json.Unmarshal(data, &chunk); err != nil {
+			t.Fatalf("invalid chunk %s: %v", data, err)
+		}
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+func TestHandleStreamForwardsUsage(t *testing.T) {
+	recorded, err := os.Open("testdata/stream_usage.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClient("test-token", "gpt-4o", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var content string
+	var usage []CompletionResponse
+	chunks := readChunks(t, client.handleStream(recorded))
+	for _, chunk := range chunks {
+		if chunk.Error != nil {
+			t.Fatalf("unexpected error chunk: %+v", chunk.Error)
+		}
+		for _, choice := range chunk.Choices {
+			text, _ := choice.Delta.Content.(string)
+			content += text
+		}
+		if chunk.Usage.TotalTokens > 0 {
+			usage = append(usage, chunk)
+		}
+	}
+
+	if content != "Hello!" {
+		t.Errorf("content = %q, want %q", content, "Hello!")
+	}
+	if len(usage) != 1 {
+		t.Fatalf("got %d usage chunks, want 1", len(usage))
+	}
+	if u := usage[0].Usage; u.PromptTokens != 11 || u.CompletionTokens != 3 || u.TotalTokens != 14 {
+		t.Errorf("usage = %+v, want 11 prompt and 3 completion tokens", u)
+	}
+	last := chunks[len(chunks)-1]
+	if len(last.Choices) != 1 || last.Choices[0].FinishReason != "stop" {
+		t.Errorf("last chunk = %+v, want the final stop chunk", last)
+	}
+}
@@ -0,0 +1,74 @@
+// pkg/copilot/devicecode.go
+
+package copilot
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// pendingDeviceCodeFile holds the device code of the login in progress in the
+// configuration directory, so that a restarted process can resume it
+const pendingDeviceCodeFile = ".copilot-device-code"
+
+// pendingDeviceCode is the content of pendingDeviceCodeFile
+type pendingDeviceCode struct {
+	DeviceCode
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// savePendingDeviceCode keeps code until it is authorized or expires
+func (a *AuthManager) savePendingDeviceCode(code *DeviceCode) {
+	data, err := json.Marshal(pendingDeviceCode{
+		DeviceCode: *code,
+		ExpiresAt:  time.Now().Add(time.Duration(code.ExpiresIn) * time.Second),
+	})
+	if err == nil {
+		err = writeFileAtomic(filepath.Join(a.configDir, pendingDeviceCodeFile), data)
+	}
+	if err != nil {
+		authLog.Warnf("[Auth] Failed to save the pending device code: %v", err)
+	}
+}
+
+// loadPendingDeviceCode reads the saved device code, if any
+func (a *AuthManager) loadPendingDeviceCode() (pendingDeviceCode, bool) {
+	var pending pendingDeviceCode
+	data, err := os.ReadFile(filepath.Join(a.configDir, pendingDeviceCodeFile))
+	if err != nil || json.Unmarshal(data, &pending) != nil || pending.DeviceCode.DeviceCode == "" {
+		return pendingDeviceCode{}, false
+	}
+	return pending, true
+}
+
+// PendingDeviceCode returns the device code of a login that an earlier
+// process started and did not finish, with ExpiresIn set to the time left to
+// authorize it, or nil when there is none
+func (a *AuthManager) PendingDeviceCode() *DeviceCode {
+	pending, ok := a.loadPendingDeviceCode()
+	if !ok {
+		return nil
+	}
+	left := time.Until(pending.ExpiresAt)
+	if left < time.Second {
+		a.removePendingDeviceCode(&pending.DeviceCode)
+		return nil
+	}
+	code := pending.DeviceCode
+	code.ExpiresIn = int(left / time.Second)
+	return &code
+}
+
+// removePendingDeviceCode forgets code once it is authorized or expired,
+// unless a newer code replaced it meanwhile
+func (a *AuthManager) removePendingDeviceCode(code *DeviceCode) {
+	if pending, ok := a.loadPendingDeviceCode(); ok && pending.DeviceCode.DeviceCode != code.DeviceCode {
+		return
+	}
+	err := os.Remove(filepath.Join(a.configDir, pendingDeviceCodeFile))
+	if err != nil && !os.IsNotExist(err) {
+		authLog.Warnf("[Auth] Failed to remove the pending device code: %v", err)
+	}
+}
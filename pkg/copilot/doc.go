@@ -0,0 +1,18 @@
+// pkg/copilot/doc.go
+
+// Package copilot is a client for the GitHub Copilot chat API. It covers the
+// GitHub device flow and Copilot token exchange (AuthManager), chat
+// completions and model listing (Client), and the OpenAI-compatible request
+// and response types used throughout ghcsd.
+//
+// Programs can embed Copilot access without running the daemon:
+//
+//	auth := copilot.NewAuthManager(http.DefaultClient, configDir)
+//	token, err := auth.GetCopilotToken()
+//	...
+//	client, err := copilot.NewClient(token, "gpt-4o", "")
+//	...
+//	req := copilot.NewCompletionRequest("gpt-4o")
+//	req.Messages = []copilot.Message{{Role: "user", Content: "Hello"}}
+//	resp, err := client.Complete(ctx, req)
+package copilot
@@ -0,0 +1,151 @@
+// pkg/copilot/errors.go
+
+package copilot
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ErrorKind classifies an upstream error independently of any API dialect
+type ErrorKind int
+
+const (
+	ErrorKindServer ErrorKind = iota
+	ErrorKindInvalidRequest
+	ErrorKindAuthentication
+	ErrorKindPermission
+	ErrorKindNotFound
+	ErrorKindRateLimit
+	ErrorKindContentFilter
+	ErrorKindOverloaded
+)
+
+// StreamError is sent as the last chunk of a stream when it fails after the
+// response has started, so clients can tell a truncated answer from a complete one
+type StreamError struct {
+	Message string `json:"message"`
+	Type    string `json:"type"`
+	Code    string `json:"code,omitempty"`
+}
+
+func (e *StreamError) Error() string {
+	return fmt.Sprintf("stream failed: %s", e.Message)
+}
+
+// Kind classifies the error: content filter errors are told apart, and any
+// other error ending a stream is a server error
+func (e *StreamError) Kind() ErrorKind {
+	if isContentFilter(e.Code, e.Message) || isContentFilter(e.Type, "") {
+		return ErrorKindContentFilter
+	}
+	return ErrorKindServer
+}
+
+// APIError is returned when the Copilot API responds with an error status
+type APIError struct {
+	StatusCode int
+	Message    string
+	Code       string
+	RetryAfter string
+	Body       string
+}
+
+func (e *APIError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("request failed with status %d: %s", e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("request failed with status %d", e.StatusCode)
+}
+
+// Kind classifies the error based on its status code and error code
+func (e *APIError) Kind() ErrorKind {
+	if isContentFilter(e.Code, e.Message) {
+		return ErrorKindContentFilter
+	}
+
+	switch {
+	case e.StatusCode == http.StatusUnauthorized:
+		return ErrorKindAuthentication
+	case e.StatusCode == http.StatusForbidden:
+		return ErrorKindPermission
+	case e.StatusCode == http.StatusNotFound:
+		return ErrorKindNotFound
+	case e.StatusCode == http.StatusTooManyRequests:
+		return ErrorKindRateLimit
+	case e.StatusCode == http.StatusServiceUnavailable:
+		return ErrorKindOverloaded
+	case e.StatusCode >= 400 && e.StatusCode < 500:
+		return ErrorKindInvalidRequest
+	default:
+		return ErrorKindServer
+	}
+}
+
+// isContentFilter reports whether an error code or message says that the
+// prompt or completion was blocked by the content filter
+func isContentFilter(code, message string) bool {
+	code = strings.ToLower(code)
+	message = strings.ToLower(message)
+	return strings.Contains(code, "content_filter") || strings.Contains(message, "content management policy") ||
+		strings.Contains(message, "content filter")
+}
+
+// newAPIError builds an APIError from an upstream error response.
+// Copilot and GitHub use a few different body shapes, all of which are handled:
+// {"error":{"message":"...","code":"..."}}, {"message":"...","code":"..."},
+// {"error":"...","error_description":"..."} and plain text.
+func newAPIError(resp *http.Response, body []byte) *APIError {
+	apiErr := &APIError{
+		StatusCode: resp.StatusCode,
+		RetryAfter: resp.Header.Get("Retry-After"),
+		Body:       string(body),
+	}
+
+	var parsed struct {
+		Error            json.RawMessage `json:"error"`
+		ErrorDescription string          `json:"error_description"`
+		Message          string          `json:"message"`
+		Code             string          `json:"code"`
+	}
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		apiErr.Message = strings.TrimSpace(string(body))
+		return apiErr
+	}
+
+	apiErr.Message = parsed.Message
+	apiErr.Code = parsed.Code
+
+	if len(parsed.Error) > 0 {
+		var nested struct {
+			Message string `json:"message"`
+			Code    string `json:"code"`
+			Type    string `json:"type"`
+		}
+		var flat string
+		if err := json.Unmarshal(parsed.Error, &nested); err == nil {
+			if nested.Message != "" {
+				apiErr.Message = nested.Message
+			}
+			if nested.Code != "" {
+				apiErr.Code = nested.Code
+			} else if nested.Type != "" {
+				apiErr.Code = nested.Type
+			}
+		} else if err := json.Unmarshal(parsed.Error, &flat); err == nil {
+			apiErr.Code = flat
+			if parsed.ErrorDescription != "" {
+				apiErr.Message = parsed.ErrorDescription
+			} else if apiErr.Message == "" {
+				apiErr.Message = flat
+			}
+		}
+	}
+
+	if apiErr.Message == "" {
+		apiErr.Message = strings.TrimSpace(string(body))
+	}
+	return apiErr
+}
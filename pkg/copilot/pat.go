@@ -0,0 +1,104 @@
+// pkg/copilot/pat.go
+
+package copilot
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// tokenExchangeError is returned when GitHub refuses to exchange an auth
+// token for a Copilot API token
+type tokenExchangeError struct {
+	status int
+	body   string
+}
+
+func (e *tokenExchangeError) Error() string {
+	return fmt.Sprintf("failed to get token (status %d): %s", e.status, e.body)
+}
+
+// SetPersonalAccessToken makes GetCopilotToken exchange a GitHub personal
+// access token, classic or fine-grained, instead of using the stored login
+// or the device flow. The token is never written to disk.
+func (a *AuthManager) SetPersonalAccessToken(token string) {
+	a.pat = strings.TrimSpace(token)
+}
+
+// exchangePersonalAccessToken exchanges the configured personal access token
+// for a Copilot API token, explaining why GitHub refused it
+func (a *AuthManager) exchangePersonalAccessToken() (string, error) {
+	if strings.ContainsAny(a.pat, " \t\r\n") {
+		return "", errors.New("invalid GitHub personal access token: it contains whitespace")
+	}
+	fineGrained := strings.HasPrefix(a.pat, "github_pat_")
+	if !fineGrained && !strings.HasPrefix(a.pat, "ghp_") {
+		a.debugLog("Personal access token has an unrecognized prefix, trying it anyway")
+	}
+
+	a.debugLog("Exchanging personal access token for Copilot API token")
+	token, err := a.fetchNewToken(a.pat)
+	if err == nil {
+		return token, nil
+	}
+	var exchangeErr *tokenExchangeError
+	if !errors.As(err, &exchangeErr) {
+		return "", fmt.Errorf("failed to exchange GitHub personal access token: %w", err)
+	}
+
+	switch exchangeErr.status {
+	case http.StatusUnauthorized:
+		return "", errors.New("GitHub rejected the personal access token: it is invalid, expired or revoked")
+	case http.StatusForbidden, http.StatusNotFound:
+		if fineGrained {
+			return "", errors.New("the personal access token cannot be used for Copilot: grant it the Copilot Requests permission and make sure its account has a Copilot seat")
+		}
+		if scopes, ok := a.tokenScopes(a.pat); ok && !hasScope(scopes, "copilot") {
+			granted := "none"
+			if len(scopes) > 0 {
+				granted = strings.Join(scopes, ", ")
+			}
+			return "", fmt.Errorf("the personal access token lacks the copilot scope (granted scopes: %s)", granted)
+		}
+		return "", errors.New("the personal access token cannot be used for Copilot: make sure its account has a Copilot seat")
+	}
+	return "", fmt.Errorf("failed to exchange GitHub personal access token: %w", err)
+}
+
+// tokenScopes returns the OAuth scopes of a classic token, as reported by
+// the GitHub API
+func (a *AuthManager) tokenScopes(token string) ([]string, bool) {
+	req, err := http.NewRequest("GET", a.githubAPIURL+"/user", nil)
+	if err != nil {
+		return nil, false
+	}
+	req.Header.Set("Authorization", "token "+token)
+	req.Header.Set("Accept", "application/json")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, false
+	}
+	resp.Body.Close()
+	header, ok := resp.Header["X-Oauth-Scopes"]
+	if resp.StatusCode != http.StatusOK || !ok {
+		return nil, false
+	}
+	var scopes []string
+	for _, scope := range strings.Split(strings.Join(header, ","), ",") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes, true
+}
+
+func hasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+// pkg/copilot/ratelimit.go
+
+package copilot
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	rateLimitHeaderPrefix = "X-Ratelimit-"
+	quotaHeaderPrefix     = "X-Quota-Snapshot-"
+)
+
+// RateLimit is the rate limit and quota state Copilot reported in the
+// headers of a response
+type RateLimit struct {
+	// Endpoint is the base URL of the Copilot API that responded
+	Endpoint string
+	// Limits holds the x-ratelimit-* headers by their lower-cased suffix,
+	// e.g. "remaining" or "reset"
+	Limits map[string]string
+	// Quotas holds the x-quota-snapshot-* headers by quota name, e.g.
+	// "chat" or "premium_interactions"
+	Quotas map[string]Quota
+}
+
+// Quota is a snapshot of a Copilot subscription quota
+type Quota struct {
+	// Entitlement is the number of requests included per period
+	Entitlement float64 `json:"entitlement"`
+	// Unlimited is set when the quota has no entitlement limit
+	Unlimited bool `json:"unlimited"`
+	// RemainingPercent is the share of the entitlement left, 0 to 100
+	RemainingPercent float64 `json:"remaining_percent"`
+	// Overage is the number of requests made beyond the entitlement
+	Overage          float64   `json:"overage"`
+	OveragePermitted bool      `json:"overage_permitted"`
+	ResetAt          time.Time `json:"reset_at"`
+	// Raw is the header value as Copilot sent it
+	Raw string `json:"-"`
+}
+
+// ParseRateLimit extracts the rate limit and quota headers of a response,
+// reporting whether there were any
+func ParseRateLimit(header http.Header) (RateLimit, bool) {
+	limit := RateLimit{Limits: make(map[string]string), Quotas: make(map[string]Quota)}
+	for name, values := range header {
+		if len(values) == 0 {
+			continue
+		}
+		canonical := http.CanonicalHeaderKey(name)
+		if suffix, ok := strings.CutPrefix(canonical, rateLimitHeaderPrefix); ok && suffix != "" {
+			limit.Limits[strings.ToLower(suffix)] = values[0]
+		} else if quota, ok := strings.CutPrefix(canonical, quotaHeaderPrefix); ok && quota != "" {
+			limit.Quotas[strings.ToLower(quota)] = parseQuota(values[0])
+		}
+	}
+	return limit, len(limit.Limits) > 0 || len(limit.Quotas) > 0
+}
+
+// parseQuota parses a quota snapshot such as
+// "ent=300&ov=0.0&ovPerm=false&rem=96.2&rst=2025-07-01T00:00:00Z", where an
+// entitlement of -1 is unlimited. Unknown or malformed fields are ignored.
+func parseQuota(value string) Quota {
+	quota := Quota{Raw: value}
+	fields, _ := url.ParseQuery(value)
+	if ent, err := strconv.ParseFloat(fields.Get("ent"), 64); err == nil {
+		quota.Entitlement = ent
+		quota.Unlimited = ent < 0
+	}
+	if rem, err := strconv.ParseFloat(fields.Get("rem"), 64); err == nil {
+		quota.RemainingPercent = rem
+	}
+	if ov, err := strconv.ParseFloat(fields.Get("ov"), 64); err == nil {
+		quota.Overage = ov
+	}
+	quota.OveragePermitted, _ = strconv.ParseBool(fields.Get("ovPerm"))
+	if rst, err := time.Parse(time.RFC3339, fields.Get("rst")); err == nil {
+		quota.ResetAt = rst
+	}
+	return quota
+}
+
+// rateLimitObserverKey is the context key for a rate limit observer
+type rateLimitObserverKey struct{}
+
+// WithRateLimitObserver returns a context that makes the client call observe
+// with the rate limit and quota headers of every chat completion response,
+// successful or not, made with it
+func WithRateLimitObserver(ctx context.Context, observe func(RateLimit)) context.Context {
+	return context.WithValue(ctx, rateLimitObserverKey{}, observe)
+}
+
+// observeRateLimit reports the rate limit headers of resp to the observer
+// carried by ctx, if any
+func (c *Client) observeRateLimit(ctx context.Context, resp *http.Response) {
+	observe, _ := ctx.Value(rateLimitObserverKey{}).(func(RateLimit))
+	if observe == nil {
+		return
+	}
+	if limit, ok := ParseRateLimit(resp.Header); ok {
+		limit.Endpoint = c.baseURL
+		observe(limit)
+	}
+}
@@ -0,0 +1,44 @@
+// pkg/copilot/renew.go
+
+package copilot
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ErrLoginRequired is returned by RenewToken when no GitHub token can be
+// exchanged anymore, so that only a new device login can recover
+var ErrLoginRequired = errors.New("a new GitHub login is required")
+
+// RenewToken exchanges the personal access token, or else the stored GitHub
+// auth token, for a new Copilot API token. Unlike GetCopilotToken it never
+// starts a device flow, so that a running server can call it.
+func (a *AuthManager) RenewToken() (string, error) {
+	var candidates []string
+	if a.pat != "" {
+		candidates = append(candidates, a.pat)
+	}
+	if stored, err := a.LoadAuthToken(); err == nil && stored != a.pat {
+		candidates = append(candidates, stored)
+	}
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("%w: no GitHub token is stored", ErrLoginRequired)
+	}
+
+	var rejected error
+	for _, authToken := range candidates {
+		token, err := a.fetchNewToken(authToken)
+		if err == nil {
+			return token, nil
+		}
+		var exchangeErr *tokenExchangeError
+		if !errors.As(err, &exchangeErr) || exchangeErr.status != http.StatusUnauthorized {
+			return "", err
+		}
+		a.debugLog("GitHub rejected an auth token: %v", err)
+		rejected = err
+	}
+	return "", fmt.Errorf("%w: %v", ErrLoginRequired, rejected)
+}
@@ -0,0 +1,83 @@
+// pkg/copilot/tokenfile.go
+
+package copilot
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// authTokenFile holds the GitHub auth token in the configuration directory
+const authTokenFile = ".copilot-auth-token"
+
+const (
+	// tokenLockTimeout bounds the wait for the token file lock to save or
+	// remove the token
+	tokenLockTimeout = 30 * time.Second
+	// loginLockTimeout bounds the wait for the login of another process,
+	// which holds the lock until its device code expires, 15 minutes at most
+	loginLockTimeout = 16 * time.Minute
+	// tokenLockPoll is how often a held lock is tried again
+	tokenLockPoll = 100 * time.Millisecond
+)
+
+// writeFileAtomic replaces path with data by writing a temporary file next
+// to it and renaming it over path, so that readers, other processes
+// included, see either the old or the new token and never a partial one
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	// Removing fails harmlessly once the file has been renamed
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// lockTokenFile takes the advisory lock serializing the ghcsd processes that
+// change the auth token in dir, waiting up to timeout for it to be free.
+// Readers need no lock since the token is replaced atomically.
+func lockTokenFile(dir string, timeout time.Duration) (unlock func(), err error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create config directory: %w", err)
+	}
+	f, err := os.OpenFile(filepath.Join(dir, authTokenFile+".lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open auth token lock: %w", err)
+	}
+	deadline := time.Now().Add(timeout)
+	for waited := false; ; waited = true {
+		locked, err := tryLockFile(f)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to lock auth token: %w", err)
+		}
+		if locked {
+			break
+		}
+		if time.Now().After(deadline) {
+			f.Close()
+			return nil, fmt.Errorf("auth token is locked by another ghcsd process, gave up after %s", timeout)
+		}
+		if !waited {
+			authLog.Infof("[Auth] Waiting for another ghcsd process to finish changing the auth token")
+		}
+		time.Sleep(tokenLockPoll)
+	}
+	// Closing the file releases the lock
+	return func() { f.Close() }, nil
+}
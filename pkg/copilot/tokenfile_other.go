@@ -0,0 +1,23 @@
+// pkg/copilot/tokenfile_other.go
+
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly || windows)
+
+package copilot
+
+import (
+	"os"
+	"runtime"
+	"sync"
+)
+
+// noLockWarning is logged the first time a lock is taken
+var noLockWarning sync.Once
+
+// tryLockFile does nothing where no file locking is available; concurrent
+// processes still never see a partial token since it is replaced atomically
+func tryLockFile(f *os.File) (bool, error) {
+	noLockWarning.Do(func() {
+		authLog.Warnf("[Auth] File locking is not available on %s: ghcsd processes sharing %s may log in at the same time", runtime.GOOS, f.Name())
+	})
+	return true, nil
+}
@@ -0,0 +1,34 @@
+// pkg/copilot/tokenfile_test.go
+
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly || windows
+
+package copilot
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLockTokenFileTimesOut(t *testing.T) {
+	dir := t.TempDir()
+	unlock, err := lockTokenFile(dir, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if _, err := lockTokenFile(dir, 200*time.Millisecond); err == nil || !strings.Contains(err.Error(), "locked by another") {
+		t.Fatalf("second lock = %v, want a timeout", err)
+	}
+	if waited := time.Since(start); waited < 200*time.Millisecond || waited > 2*time.Second {
+		t.Errorf("waited %s for a lock with a 200ms timeout", waited)
+	}
+
+	unlock()
+	unlock, err = lockTokenFile(dir, time.Second)
+	if err != nil {
+		t.Fatalf("lock after unlock = %v", err)
+	}
+	unlock()
+}
@@ -0,0 +1,27 @@
+// pkg/copilot/tokenfile_unix.go
+
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package copilot
+
+import (
+	"os"
+	"syscall"
+)
+
+// tryLockFile takes an exclusive flock on f, held until f is closed, and
+// reports false when another process holds it
+func tryLockFile(f *os.File) (bool, error) {
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		switch err {
+		case nil:
+			return true, nil
+		case syscall.EWOULDBLOCK:
+			return false, nil
+		case syscall.EINTR:
+			continue
+		}
+		return false, err
+	}
+}
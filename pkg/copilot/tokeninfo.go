@@ -0,0 +1,61 @@
+// pkg/copilot/tokeninfo.go
+
+package copilot
+
+import (
+	"sync"
+	"time"
+)
+
+// TokenInfo is the lifetime of a Copilot API token
+type TokenInfo struct {
+	// ExpiresAt is when Copilot stops accepting the token
+	ExpiresAt time.Time
+	// RefreshAt is when GitHub advised exchanging the token again; zero when
+	// unknown
+	RefreshAt time.Time
+}
+
+// issued is the last Copilot token exchanged in this process and the
+// lifetime GitHub reported for it
+var issued struct {
+	mu    sync.Mutex
+	token string
+	info  TokenInfo
+}
+
+// recordToken keeps the expires_at and refresh_in GitHub sent with token,
+// in seconds since the epoch and from now
+func recordToken(token string, expiresAt, refreshIn int64) {
+	var info TokenInfo
+	if expiresAt > 0 {
+		info.ExpiresAt = time.Unix(expiresAt, 0)
+	}
+	if refreshIn > 0 {
+		info.RefreshAt = time.Now().Add(time.Duration(refreshIn) * time.Second).Truncate(time.Second)
+	}
+	issued.mu.Lock()
+	defer issued.mu.Unlock()
+	issued.token, issued.info = token, info
+}
+
+// TokenLifetime returns the lifetime of token: the one GitHub reported if it
+// is the last token exchanged in this process, or else the expiry embedded
+// in the token
+func TokenLifetime(token string) (TokenInfo, bool) {
+	issued.mu.Lock()
+	var info TokenInfo
+	if issued.token == token {
+		info = issued.info
+	}
+	issued.mu.Unlock()
+
+	if info.ExpiresAt.IsZero() {
+		expiresAt, ok := TokenExpiry(token)
+		if !ok {
+			return TokenInfo{}, false
+		}
+		info.ExpiresAt = expiresAt
+	}
+	return info, true
+}
@@ -0,0 +1,630 @@
+// pkg/copilot/types.go
+
+package copilot
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// MessageContent represents a single content item in a message
+type MessageContent struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// Message represents a single message in the conversation
+type Message struct {
+	Role    string      `json:"role"`
+	Content interface{} `json:"content"` // Can be string or []MessageContent
+	Name    string      `json:"name,omitempty"`
+	// ToolCalls are the calls made by an assistant message
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+	// ToolCallID is the call a tool message answers
+	ToolCallID string `json:"tool_call_id,omitempty"`
+	// FunctionCall is the call of a legacy assistant message, replaced by
+	// ToolCalls in NormalizeRoles
+	FunctionCall *ToolCallFunction `json:"function_call,omitempty"`
+}
+
+// StreamOptions represents streaming-specific configuration
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// CompletionRequest represents the request structure for the Copilot API
+type CompletionRequest struct {
+	Intent        bool           `json:"intent"`
+	Model         string         `json:"model"`
+	N             int            `json:"n"`
+	Stream        bool           `json:"stream"`
+	StreamOptions *StreamOptions `json:"stream_options,omitempty"`
+	Temperature   float32        `json:"temperature"`
+	TopP          float32        `json:"top_p"`
+	Messages      []Message      `json:"messages"`
+	MaxTokens     int            `json:"max_tokens"`
+	Stop          StopSequences  `json:"stop,omitempty"`
+	Tools         []Tool         `json:"tools,omitempty"`
+	ToolChoice    *ToolChoice    `json:"tool_choice,omitempty"`
+	// ParallelToolCalls is a pointer so that an explicit false is forwarded
+	ParallelToolCalls *bool `json:"parallel_tool_calls,omitempty"`
+	// User identifies the end user on whose behalf the request is made
+	User           string          `json:"user,omitempty"`
+	ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
+	// The penalties are pointers so that they are only forwarded when set
+	PresencePenalty  *float32           `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float32           `json:"frequency_penalty,omitempty"`
+	LogitBias        map[string]float32 `json:"logit_bias,omitempty"`
+	// Logprobs requests the log probabilities of the completion tokens, and
+	// TopLogprobs the most likely alternatives at each position
+	Logprobs    bool `json:"logprobs,omitempty"`
+	TopLogprobs *int `json:"top_logprobs,omitempty"`
+	// Seed asks for deterministic sampling, on a best effort basis
+	Seed *int64 `json:"seed,omitempty"`
+	// TopK is accepted from clients that send it but is never forwarded,
+	// since the Copilot API does not support it
+	TopK *int `json:"top_k,omitempty"`
+	// ServiceTier is the service tier of the OpenAI and Anthropic APIs. It is
+	// never forwarded; the proxy prioritizes the request by it instead.
+	ServiceTier string `json:"service_tier,omitempty"`
+}
+
+// ValidateSampling checks the sampling parameters against the ranges
+// accepted by the OpenAI API
+func (r *CompletionRequest) ValidateSampling() error {
+	if r.Temperature < 0 || r.Temperature > 2 {
+		return fmt.Errorf("temperature must be between 0 and 2")
+	}
+	if r.TopP < 0 || r.TopP > 1 {
+		return fmt.Errorf("top_p must be between 0 and 1")
+	}
+	if r.MaxTokens < 0 {
+		return fmt.Errorf("max_tokens must not be negative")
+	}
+	if p := r.PresencePenalty; p != nil && (*p < -2 || *p > 2) {
+		return fmt.Errorf("presence_penalty must be between -2 and 2")
+	}
+	if p := r.FrequencyPenalty; p != nil && (*p < -2 || *p > 2) {
+		return fmt.Errorf("frequency_penalty must be between -2 and 2")
+	}
+	for token, bias := range r.LogitBias {
+		if bias < -100 || bias > 100 {
+			return fmt.Errorf("logit_bias for token %s must be between -100 and 100", token)
+		}
+	}
+	if r.TopK != nil && *r.TopK < 0 {
+		return fmt.Errorf("top_k must not be negative")
+	}
+	if n := r.TopLogprobs; n != nil {
+		if *n < 0 || *n > MaxTopLogprobs {
+			return fmt.Errorf("top_logprobs must be between 0 and %d", MaxTopLogprobs)
+		}
+		if !r.Logprobs {
+			return fmt.Errorf("logprobs must be true when top_logprobs is set")
+		}
+	}
+	return nil
+}
+
+// MaxTopLogprobs is the largest top_logprobs the OpenAI API accepts
+const MaxTopLogprobs = 20
+
+// Response format types supported by the OpenAI API
+const (
+	ResponseFormatText       = "text"
+	ResponseFormatJSONObject = "json_object"
+	ResponseFormatJSONSchema = "json_schema"
+)
+
+// ResponseFormat is the OpenAI "response_format" parameter, selecting plain
+// text, any JSON object or JSON conforming to a schema
+type ResponseFormat struct {
+	Type       string          `json:"type"`
+	JSONSchema json.RawMessage `json:"json_schema,omitempty"`
+}
+
+// Validate checks the type and, for json_schema, that a schema is present
+func (f *ResponseFormat) Validate() error {
+	switch f.Type {
+	case ResponseFormatText, ResponseFormatJSONObject:
+		return nil
+	case ResponseFormatJSONSchema:
+		var schema struct {
+			Schema json.RawMessage `json:"schema"`
+		}
+		if err := json.Unmarshal(f.JSONSchema, &schema); err != nil || len(schema.Schema) == 0 {
+			return fmt.Errorf("response_format json_schema requires json_schema.schema")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported response_format type: %s", f.Type)
+	}
+}
+
+// ApplyResponseFormat prepares the response format for the upstream model.
+// Models that support response_format receive it unchanged; for the others it
+// is replaced by a system message instructing the model to answer in JSON.
+func (r *CompletionRequest) ApplyResponseFormat(supported bool) {
+	format := r.ResponseFormat
+	if format == nil || format.Type == ResponseFormatText {
+		r.ResponseFormat = nil
+		return
+	}
+	if supported {
+		return
+	}
+	r.ResponseFormat = nil
+
+	instruction := "Respond only with a valid JSON object, without any text or formatting around it."
+	if format.Type == ResponseFormatJSONSchema {
+		var schema struct {
+			Schema json.RawMessage `json:"schema"`
+		}
+		json.Unmarshal(format.JSONSchema, &schema)
+		instruction = "Respond only with JSON conforming to the following JSON schema, without any text or formatting around it:\n" +
+			string(schema.Schema)
+	}
+
+	// Place the instruction after the leading system messages
+	at := 0
+	for at < len(r.Messages) && r.Messages[at].Role == "system" {
+		at++
+	}
+	messages := make([]Message, 0, len(r.Messages)+1)
+	messages = append(messages, r.Messages[:at]...)
+	messages = append(messages, Message{Role: "system", Content: instruction})
+	r.Messages = append(messages, r.Messages[at:]...)
+}
+
+// Tool represents a tool the model may call
+type Tool struct {
+	Type     string       `json:"type"`
+	Function ToolFunction `json:"function"`
+}
+
+// ToolFunction describes a function tool and its JSON schema parameters
+type ToolFunction struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+}
+
+// Tool choice modes supported by the OpenAI API
+const (
+	ToolChoiceAuto     = "auto"
+	ToolChoiceNone     = "none"
+	ToolChoiceRequired = "required"
+	ToolChoiceFunction = "function"
+)
+
+// ToolChoice holds the OpenAI "tool_choice" parameter, which is either a mode
+// string ("auto", "none", "required") or an object forcing a named function
+type ToolChoice struct {
+	Mode         string
+	FunctionName string
+}
+
+// MarshalJSON encodes the tool choice in the form the OpenAI API expects
+func (tc ToolChoice) MarshalJSON() ([]byte, error) {
+	if tc.Mode == ToolChoiceFunction {
+		return json.Marshal(map[string]interface{}{
+			"type":     "function",
+			"function": map[string]string{"name": tc.FunctionName},
+		})
+	}
+	return json.Marshal(tc.Mode)
+}
+
+// UnmarshalJSON decodes both the string and the object form of "tool_choice"
+func (tc *ToolChoice) UnmarshalJSON(data []byte) error {
+	var mode string
+	if err := json.Unmarshal(data, &mode); err == nil {
+		*tc = ToolChoice{Mode: mode}
+		return nil
+	}
+
+	var named struct {
+		Type     string `json:"type"`
+		Function struct {
+			Name string `json:"name"`
+		} `json:"function"`
+	}
+	if err := json.Unmarshal(data, &named); err != nil {
+		return fmt.Errorf("tool_choice must be a string or an object: %w", err)
+	}
+	if named.Function.Name == "" {
+		return fmt.Errorf("tool_choice object requires function.name")
+	}
+	*tc = ToolChoice{Mode: ToolChoiceFunction, FunctionName: named.Function.Name}
+	return nil
+}
+
+// ApplyToolChoice normalizes the tool settings of the request. A "none" tool
+// choice strips the tools entirely since some Copilot models ignore it.
+func (r *CompletionRequest) ApplyToolChoice() {
+	if r.ToolChoice != nil && r.ToolChoice.Mode == ToolChoiceNone {
+		r.Tools = nil
+		r.ToolChoice = nil
+		r.ParallelToolCalls = nil
+	}
+	if len(r.Tools) == 0 {
+		r.ToolChoice = nil
+		r.ParallelToolCalls = nil
+	}
+}
+
+// StopSequences holds the OpenAI "stop" parameter, which clients may send
+// either as a single string or as an array of strings
+type StopSequences []string
+
+// UnmarshalJSON accepts both the string and the array form of "stop"
+func (s *StopSequences) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		if single == "" {
+			*s = nil
+		} else {
+			*s = StopSequences{single}
+		}
+		return nil
+	}
+
+	var multiple []string
+	if err := json.Unmarshal(data, &multiple); err != nil {
+		return fmt.Errorf("stop must be a string or an array of strings: %w", err)
+	}
+	*s = multiple
+	return nil
+}
+
+// ToolCall is a function call made by the model. In streamed deltas each call
+// carries its Index, and its arguments arrive in fragments across chunks.
+type ToolCall struct {
+	Index    *int             `json:"index,omitempty"`
+	ID       string           `json:"id,omitempty"`
+	Type     string           `json:"type,omitempty"`
+	Function ToolCallFunction `json:"function"`
+}
+
+// ToolCallFunction holds the name and JSON encoded arguments of a tool call
+type ToolCallFunction struct {
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments"`
+}
+
+// Choice represents a single completion choice in the response
+type Choice struct {
+	Index   int `json:"index"`
+	Message struct {
+		Content   string     `json:"content"`
+		Role      string     `json:"role"`
+		ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+	} `json:"message"`
+	Delta struct {
+		Content   interface{} `json:"content"`
+		Role      interface{} `json:"role"`
+		ToolCalls []ToolCall  `json:"tool_calls,omitempty"`
+	} `json:"delta"`
+	// Logprobs holds the log probabilities of the tokens of the message or
+	// delta, when requested
+	Logprobs     *Logprobs `json:"logprobs,omitempty"`
+	FinishReason string    `json:"finish_reason"`
+}
+
+// Logprobs are the log probabilities of the tokens of a choice
+type Logprobs struct {
+	Content []TokenLogprob `json:"content"`
+	Refusal []TokenLogprob `json:"refusal,omitempty"`
+}
+
+// TokenLogprob is the log probability of a token and of the most likely
+// tokens in its place
+type TokenLogprob struct {
+	Token       string       `json:"token"`
+	Logprob     float64      `json:"logprob"`
+	Bytes       []int        `json:"bytes"`
+	TopLogprobs []TopLogprob `json:"top_logprobs"`
+}
+
+// TopLogprob is one of the most likely tokens at a position
+type TopLogprob struct {
+	Token   string  `json:"token"`
+	Logprob float64 `json:"logprob"`
+	Bytes   []int   `json:"bytes"`
+}
+
+// CompletionResponse represents the response structure from the Copilot API
+type CompletionResponse struct {
+	ID      string   `json:"id"`
+	Choices []Choice `json:"choices"`
+	Created int64    `json:"created"`
+	Model   string   `json:"model"`
+	Usage   struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+		TotalTokens      int `json:"total_tokens"`
+	} `json:"usage"`
+	Error *StreamError `json:"error,omitempty"`
+	// SystemFingerprint identifies the backend configuration that served
+	// the completion, when upstream reports it
+	SystemFingerprint string `json:"system_fingerprint,omitempty"`
+}
+
+// ModelInfo describes a model returned by the Copilot models endpoint
+type ModelInfo struct {
+	ID           string            `json:"id"`
+	Name         string            `json:"name"`
+	Vendor       string            `json:"vendor"`
+	Version      string            `json:"version"`
+	Capabilities ModelCapabilities `json:"capabilities"`
+}
+
+// ModelCapabilities lists the limits and features Copilot reports for a model
+type ModelCapabilities struct {
+	Family string `json:"family"`
+	Type   string `json:"type"`
+	Limits struct {
+		MaxContextWindowTokens int `json:"max_context_window_tokens"`
+		MaxOutputTokens        int `json:"max_output_tokens"`
+		MaxPromptTokens        int `json:"max_prompt_tokens"`
+	} `json:"limits"`
+	Supports struct {
+		Streaming         bool `json:"streaming"`
+		ToolCalls         bool `json:"tool_calls"`
+		ParallelToolCalls bool `json:"parallel_tool_calls"`
+		Vision            bool `json:"vision"`
+	} `json:"supports"`
+}
+
+// DefaultMaxTokens is the max_tokens of requests created by NewCompletionRequest
+const DefaultMaxTokens = 32768
+
+// NewCompletionRequest creates a default completion request with standard parameters
+func NewCompletionRequest(model string) CompletionRequest {
+	return CompletionRequest{
+		Intent:      false,
+		Model:       model,
+		N:           1,
+		Stream:      false,
+		Temperature: 0,
+		TopP:        1,
+		MaxTokens:   DefaultMaxTokens,
+		Messages:    []Message{}, // Empty slice, will be filled by caller
+	}
+}
+
+// IsStringContent checks if the message content is a string
+func (m *Message) IsStringContent() bool {
+	_, ok := m.Content.(string)
+	return ok
+}
+
+// GetStringContent returns the content as a string if it is one,
+// otherwise returns an empty string
+func (m *Message) GetStringContent() string {
+	if str, ok := m.Content.(string); ok {
+		return str
+	}
+	return ""
+}
+
+// GetComplexContent attempts to extract the complex content array
+// returns nil if content is not of the expected type
+func (m *Message) GetComplexContent() []MessageContent {
+	if contentArr, ok := m.Content.([]MessageContent); ok {
+		return contentArr
+	}
+	// Handle the case where content might be a []interface{} from JSON unmarshaling
+	if contentArr, ok := m.Content.([]interface{}); ok {
+		result := make([]MessageContent, 0, len(contentArr))
+		for _, item := range contentArr {
+			if mapItem, ok := item.(map[string]interface{}); ok {
+				content := MessageContent{}
+				if typeStr, ok := mapItem["type"].(string); ok {
+					content.Type = typeStr
+				}
+				if text, ok := mapItem["text"].(string); ok {
+					content.Text = text
+				}
+				result = append(result, content)
+			}
+		}
+		return result
+	}
+	return nil
+}
+
+// contentParts returns the content parts of a message sent as an array,
+// decoded from JSON as generic maps
+func (m *Message) contentParts() []map[string]interface{} {
+	items, ok := m.Content.([]interface{})
+	if !ok {
+		return nil
+	}
+	parts := make([]map[string]interface{}, 0, len(items))
+	for _, item := range items {
+		if part, ok := item.(map[string]interface{}); ok {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
+// HasImages reports whether any message of the request contains an image
+func (r *CompletionRequest) HasImages() bool {
+	for i := range r.Messages {
+		for _, part := range r.Messages[i].contentParts() {
+			if part["type"] == "image_url" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// NormalizeRoles maps the message roles of newer and older OpenAI clients to
+// the ones the chat API accepts: developer messages become system messages,
+// and legacy function calls and their function results become tool calls and
+// tool results. It returns an error for any other role.
+func (r *CompletionRequest) NormalizeRoles() error {
+	messages := make([]Message, len(r.Messages))
+	// pendingCall is the ID given to the last legacy function call, until a
+	// function message answers it
+	var pendingCall string
+	for i, msg := range r.Messages {
+		switch msg.Role {
+		case "system", "user", "tool":
+		case "developer":
+			msg.Role = "system"
+		case "assistant":
+			if msg.FunctionCall != nil {
+				pendingCall = fmt.Sprintf("call_legacy_%d", i)
+				msg.ToolCalls = append(msg.ToolCalls, ToolCall{ID: pendingCall, Type: "function", Function: *msg.FunctionCall})
+				msg.FunctionCall = nil
+			}
+		case "function":
+			if pendingCall == "" {
+				return fmt.Errorf("messages[%d]: function message does not answer a function_call", i)
+			}
+			msg.Role = "tool"
+			msg.ToolCallID = pendingCall
+			msg.Name = ""
+			pendingCall = ""
+		default:
+			return fmt.Errorf("messages[%d]: unsupported role %q, expected system, developer, user, assistant, tool or function", i, msg.Role)
+		}
+		messages[i] = msg
+	}
+	r.Messages = messages
+	return nil
+}
+
+// MoveToolImages makes images returned by tools usable by the model. The chat
+// API only accepts images in user messages, so the text of a tool result is
+// kept in the tool message and its images are moved to a user message after
+// the tool results of the turn. Models without vision get a notice instead.
+func (r *CompletionRequest) MoveToolImages(vision bool) {
+	messages := make([]Message, 0, len(r.Messages))
+	var pending []interface{}
+	flush := func() {
+		if len(pending) == 0 {
+			return
+		}
+		content := append([]interface{}{
+			map[string]interface{}{"type": "text", "text": "Images returned by the tool calls above:"},
+		}, pending...)
+		messages = append(messages, Message{Role: "user", Content: content})
+		pending = nil
+	}
+
+	for _, msg := range r.Messages {
+		if msg.Role != "tool" {
+			flush()
+			messages = append(messages, msg)
+			continue
+		}
+
+		var texts []string
+		var images []interface{}
+		for _, part := range msg.contentParts() {
+			if part["type"] == "image_url" {
+				images = append(images, part)
+			} else if text, ok := part["text"].(string); ok {
+				texts = append(texts, text)
+			}
+		}
+		if len(images) == 0 {
+			messages = append(messages, msg)
+			continue
+		}
+
+		if vision {
+			texts = append(texts, fmt.Sprintf("[%d image(s) attached in the following user message]", len(images)))
+			pending = append(pending, images...)
+		} else {
+			texts = append(texts, fmt.Sprintf("[%d image(s) omitted: the model does not accept images]", len(images)))
+		}
+		msg.Content = strings.Join(texts, "\n")
+		messages = append(messages, msg)
+	}
+	flush()
+	r.Messages = messages
+}
+
+// NormalizeContent turns content sent as an array of parts into content the
+// model accepts. User messages to models with vision keep their text and
+// image parts; every other message is flattened to text, with a notice in
+// place of its images. Parts of other types, such as audio or files, are
+// replaced by a notice as Copilot rejects them.
+func (r *CompletionRequest) NormalizeContent(vision bool) {
+	for i := range r.Messages {
+		msg := &r.Messages[i]
+		if typed, ok := msg.Content.([]MessageContent); ok {
+			items := make([]interface{}, 0, len(typed))
+			for _, part := range typed {
+				items = append(items, map[string]interface{}{"type": part.Type, "text": part.Text})
+			}
+			msg.Content = items
+		}
+		if _, ok := msg.Content.([]interface{}); !ok {
+			continue
+		}
+
+		structured := vision && msg.Role == "user"
+		var parts []interface{}
+		var texts []string
+		images := 0
+		omitted := make(map[string]int)
+		for _, part := range msg.contentParts() {
+			partType, _ := part["type"].(string)
+			switch partType {
+			case "text":
+				text, _ := part["text"].(string)
+				parts = append(parts, map[string]interface{}{"type": "text", "text": text})
+				texts = append(texts, text)
+			case "refusal":
+				text, _ := part["refusal"].(string)
+				parts = append(parts, map[string]interface{}{"type": "text", "text": text})
+				texts = append(texts, text)
+			case "image_url":
+				if structured {
+					parts = append(parts, part)
+				}
+				images++
+			default:
+				omitted[partType]++
+			}
+		}
+
+		var notices []string
+		if images > 0 && !structured {
+			if vision {
+				notices = append(notices, fmt.Sprintf("[%d image(s) omitted: images are only accepted in user messages]", images))
+			} else {
+				notices = append(notices, fmt.Sprintf("[%d image(s) omitted: the model does not accept images]", images))
+			}
+		}
+		omittedTypes := make([]string, 0, len(omitted))
+		for partType := range omitted {
+			omittedTypes = append(omittedTypes, partType)
+		}
+		sort.Strings(omittedTypes)
+		for _, partType := range omittedTypes {
+			notices = append(notices, fmt.Sprintf("[%d %s part(s) omitted: not supported]", omitted[partType], partType))
+		}
+
+		if !structured {
+			msg.Content = strings.Join(append(texts, notices...), "\n")
+			continue
+		}
+		for _, notice := range notices {
+			parts = append(parts, map[string]interface{}{"type": "text", "text": notice})
+		}
+		if parts == nil {
+			parts = []interface{}{}
+		}
+		msg.Content = parts
+	}
+}
@@ -0,0 +1,6 @@
+// pkg/ghcsdpb/generate.go
+
+// Package ghcsdpb holds the gRPC API of the proxy, generated from ghcsd.proto
+package ghcsdpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative ghcsd.proto
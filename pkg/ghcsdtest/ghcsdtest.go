@@ -0,0 +1,107 @@
+// pkg/ghcsdtest/ghcsdtest.go
+
+// Package ghcsdtest runs a complete ghcsd server in tests, answering from
+// fixtures instead of Copilot, so that programs integrating with ghcsd can
+// test against the real routes, middleware and conversions:
+//
+//	func TestSummarize(t *testing.T) {
+//		server := ghcsdtest.StartTestServer(t, ghcsdtest.Options{
+//			Fixtures: []ghcsdtest.Fixture{{Contains: "summarize", Response: "A short summary."}},
+//			Env:      map[string]string{"GHCSD_API_KEYS": "test-key"},
+//		})
+//		summary, err := summarize(server.URL+"/v1", "test-key", document)
+//		...
+//	}
+package ghcsdtest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/acazau/ghcsd/internal/config"
+	"github.com/acazau/ghcsd/internal/proxy"
+	"github.com/acazau/ghcsd/pkg/upstream"
+)
+
+// Fixture is a canned answer of the fake upstream, matched against the
+// prompt of each completion. See upstream.MockFixture.
+type Fixture = upstream.MockFixture
+
+// Options configure a test server
+type Options struct {
+	// Fixtures answer the completions in order of precedence. Completions no
+	// fixture matches are answered by echoing their last user message.
+	Fixtures []Fixture
+	// Env sets environment variables for the duration of the test, to
+	// configure the server as it would be in production, e.g. its API keys
+	Env map[string]string
+}
+
+// Server is a running test server
+type Server struct {
+	// URL is the base URL of the API, e.g. http://127.0.0.1:41203
+	URL string
+	// AdminURL is the base URL of the admin and metrics endpoints, the same
+	// as URL unless GHCSD_ADMIN_LISTEN is set in the options
+	AdminURL string
+
+	api *httptest.Server
+}
+
+// StartTestServer starts a server for the duration of the test, with its
+// login, configuration and cache directories in temporary directories. It
+// sets environment variables, so it cannot be used in parallel tests.
+func StartTestServer(t testing.TB, opts Options) *Server {
+	t.Helper()
+	dir := t.TempDir()
+	mockDir := filepath.Join(dir, "fixtures")
+	if err := os.Mkdir(mockDir, 0700); err != nil {
+		t.Fatalf("ghcsdtest: %v", err)
+	}
+	if len(opts.Fixtures) > 0 {
+		data, err := json.Marshal(opts.Fixtures)
+		if err != nil {
+			t.Fatalf("ghcsdtest: invalid fixtures: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(mockDir, "fixtures.json"), data, 0600); err != nil {
+			t.Fatalf("ghcsdtest: %v", err)
+		}
+	}
+	t.Setenv("GHCSD_CACHE_DIR", filepath.Join(dir, "cache"))
+	for name, value := range opts.Env {
+		t.Setenv(name, value)
+	}
+
+	cfg, err := config.Load(filepath.Join(dir, "config"))
+	if err != nil {
+		t.Fatalf("ghcsdtest: invalid configuration: %v", err)
+	}
+	cfg.Mock = true
+	cfg.MockDir = mockDir
+	api, control, shutdown, err := proxy.NewRouter(cfg, "tid=mock")
+	if err != nil {
+		t.Fatalf("ghcsdtest: failed to create router: %v", err)
+	}
+	// Cleanups run last in first out, so the servers close first
+	t.Cleanup(shutdown)
+
+	server := &Server{api: httptest.NewServer(api)}
+	t.Cleanup(server.api.Close)
+	server.URL = server.api.URL
+	server.AdminURL = server.URL
+	if control != nil {
+		admin := httptest.NewServer(control)
+		t.Cleanup(admin.Close)
+		server.AdminURL = admin.URL
+	}
+	return server
+}
+
+// Client returns an HTTP client for the server
+func (s *Server) Client() *http.Client {
+	return s.api.Client()
+}
@@ -0,0 +1,101 @@
+// pkg/ghcsdtest/ghcsdtest_test.go
+
+package ghcsdtest_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/acazau/ghcsd/pkg/ghcsdtest"
+)
+
+// summarize is the client code of the package example, asking an
+// OpenAI-compatible API for a summary of document
+func summarize(baseURL, apiKey, document string) (string, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"model":    "gpt-4o",
+		"messages": []map[string]string{{"role": "user", "content": "Please summarize: " + document}},
+	})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest(http.MethodPost, baseURL+"/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status %s", resp.Status)
+	}
+	var completion struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&completion); err != nil {
+		return "", err
+	}
+	if len(completion.Choices) == 0 {
+		return "", fmt.Errorf("no choices")
+	}
+	return completion.Choices[0].Message.Content, nil
+}
+
+func TestSummarize(t *testing.T) {
+	server := ghcsdtest.StartTestServer(t, ghcsdtest.Options{
+		Fixtures: []ghcsdtest.Fixture{{Contains: "summarize", Response: "A short summary."}},
+		Env:      map[string]string{"GHCSD_API_KEYS": "test-key"},
+	})
+	summary, err := summarize(server.URL+"/v1", "test-key", "A long document.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary != "A short summary." {
+		t.Errorf("summary = %q, want the fixture response", summary)
+	}
+
+	if _, err := summarize(server.URL+"/v1", "wrong-key", "A long document."); err == nil {
+		t.Error("a wrong API key was accepted")
+	}
+}
+
+func TestServerStopsOnCleanup(t *testing.T) {
+	t.Run("server", func(t *testing.T) {
+		server := ghcsdtest.StartTestServer(t, ghcsdtest.Options{
+			Env: map[string]string{"GHCSD_WARMUP": "true"},
+		})
+		if _, err := summarize(server.URL+"/v1", "", "A long document."); err != nil {
+			t.Fatal(err)
+		}
+	})
+	http.DefaultClient.CloseIdleConnections()
+
+	// Goroutines of closed connections may take a moment to return
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stacks := make([]byte, 1<<20)
+		stacks = stacks[:runtime.Stack(stacks, true)]
+		leaked := strings.Contains(string(stacks), "ghcsd/internal/")
+		if !leaked {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("goroutines of the server are still running after the test:\n%s", stacks)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,203 @@
+// pkg/logging/logging.go
+
+// Package logging filters the logs of the proxy by level and component. The
+// level of each component can be changed while the process runs; logs that
+// pass are written with the standard log package.
+package logging
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Level is the severity of a log message. A logger set to a level writes
+// the messages of that level and the more severe ones.
+type Level int32
+
+const (
+	// Off writes no messages
+	Off Level = iota
+	Error
+	Warn
+	Info
+	Debug
+	// Trace adds the most verbose messages, such as every streamed line
+	Trace
+)
+
+var levelNames = []string{"off", "error", "warn", "info", "debug", "trace"}
+
+func (l Level) String() string {
+	if l < Off || int(l) >= len(levelNames) {
+		return fmt.Sprintf("level(%d)", int32(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parses a level name, such as "debug"
+func ParseLevel(name string) (Level, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "warning" {
+		return Warn, nil
+	}
+	for i, levelName := range levelNames {
+		if name == levelName {
+			return Level(i), nil
+		}
+	}
+	return Off, fmt.Errorf("unknown log level %q, expected one of %s", name, strings.Join(levelNames, ", "))
+}
+
+// MarshalText encodes the level as its name
+func (l Level) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+// UnmarshalText decodes a level name
+func (l *Level) UnmarshalText(text []byte) error {
+	level, err := ParseLevel(string(text))
+	if err != nil {
+		return err
+	}
+	*l = level
+	return nil
+}
+
+// The components of the proxy whose level can be set apart from the others
+const (
+	// Auth is the GitHub login and the Copilot token
+	Auth = "auth"
+	// Copilot is the requests to the Copilot API and their responses
+	Copilot = "copilot"
+	// Stream is the lines of streamed completions
+	Stream = "stream"
+	// Proxy is the HTTP API and the request pipeline
+	Proxy = "proxy"
+	// Anthropic is the Anthropic-format endpoints
+	Anthropic = "anthropic"
+	// Ollama is the Ollama API
+	Ollama = "ollama"
+	// Upstream is the upstream providers and the load balancer
+	Upstream = "upstream"
+	// Audit is the audit log, transcripts and captures
+	Audit = "audit"
+	// Tracing is the export of traces
+	Tracing = "tracing"
+)
+
+// Components lists the components, sorted
+func Components() []string {
+	components := []string{Auth, Copilot, Stream, Proxy, Anthropic, Ollama, Upstream, Audit, Tracing}
+	sort.Strings(components)
+	return components
+}
+
+// Settings are the level of all components and the components set apart
+type Settings struct {
+	Level      Level            `json:"level"`
+	Components map[string]Level `json:"components"`
+}
+
+// Validate checks that every component exists
+func (s Settings) Validate() error {
+	known := Components()
+	for component := range s.Components {
+		if i := sort.SearchStrings(known, component); i == len(known) || known[i] != component {
+			return fmt.Errorf("unknown log component %q, expected one of %s", component, strings.Join(known, ", "))
+		}
+	}
+	return nil
+}
+
+// level returns the level of component
+func (s *Settings) level(component string) Level {
+	if level, ok := s.Components[component]; ok {
+		return level
+	}
+	return s.Level
+}
+
+var (
+	// current holds the settings in effect, replaced as a whole so that
+	// loggers read them without locking
+	current atomic.Pointer[Settings]
+	// mu serializes changes of the settings
+	mu sync.Mutex
+)
+
+func init() {
+	current.Store(&Settings{Level: Info})
+}
+
+// Current returns a copy of the settings in effect
+func Current() Settings {
+	s := current.Load()
+	components := make(map[string]Level, len(s.Components))
+	for component, level := range s.Components {
+		components[component] = level
+	}
+	return Settings{Level: s.Level, Components: components}
+}
+
+// Configure replaces the settings in effect
+func Configure(s Settings) error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	components := make(map[string]Level, len(s.Components))
+	for component, level := range s.Components {
+		components[component] = level
+	}
+	current.Store(&Settings{Level: s.Level, Components: components})
+	return nil
+}
+
+// Update changes the settings in effect under a lock, so that concurrent
+// updates are not lost
+func Update(fn func(*Settings) error) (Settings, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	s := Current()
+	if err := fn(&s); err != nil {
+		return Settings{}, err
+	}
+	if err := s.Validate(); err != nil {
+		return Settings{}, err
+	}
+	current.Store(&s)
+	return Current(), nil
+}
+
+// Logger writes the logs of a component
+type Logger struct {
+	component string
+}
+
+// For returns the logger of component
+func For(component string) Logger {
+	return Logger{component: component}
+}
+
+// Enabled reports whether messages of level are written
+func (l Logger) Enabled(level Level) bool {
+	return level != Off && level <= current.Load().level(l.component)
+}
+
+// Logf writes a message of level
+func (l Logger) Logf(level Level, format string, v ...interface{}) {
+	if l.Enabled(level) {
+		log.Printf(format, v...)
+	}
+}
+
+func (l Logger) Errorf(format string, v ...interface{}) { l.Logf(Error, format, v...) }
+func (l Logger) Warnf(format string, v ...interface{})  { l.Logf(Warn, format, v...) }
+func (l Logger) Infof(format string, v ...interface{})  { l.Logf(Info, format, v...) }
+func (l Logger) Debugf(format string, v ...interface{}) { l.Logf(Debug, format, v...) }
+func (l Logger) Tracef(format string, v ...interface{}) { l.Logf(Trace, format, v...) }
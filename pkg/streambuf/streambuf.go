@@ -0,0 +1,178 @@
+// pkg/streambuf/streambuf.go
+
+// Package streambuf decouples reading a stream from consuming it. A
+// goroutine reads the source ahead into a bounded buffer, so that a slow
+// consumer does not stall the source until the buffer is full; the policy
+// then decides whether the source waits for the consumer or the stream is
+// dropped.
+package streambuf
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// Policy is what happens when the buffer of a stream is full
+type Policy string
+
+const (
+	// Park stops reading the source until the consumer catches up
+	Park Policy = "park"
+	// Drop gives up on the consumer: the source is closed and the consumer
+	// gets ErrSlowReader once it has read what was buffered
+	Drop Policy = "drop"
+)
+
+// ParsePolicy parses a policy name
+func ParsePolicy(name string) (Policy, error) {
+	switch policy := Policy(name); policy {
+	case Park, Drop:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown stream buffer policy %q, expected park or drop", name)
+}
+
+// ErrSlowReader ends a stream dropped because its consumer fell behind
+var ErrSlowReader = errors.New("stream dropped: the reader fell behind")
+
+// Stats are shared by the buffers of many streams
+type Stats struct {
+	buffered atomic.Int64
+	full     atomic.Int64
+	dropped  atomic.Int64
+}
+
+// Buffered returns the bytes currently buffered
+func (s *Stats) Buffered() int64 { return s.buffered.Load() }
+
+// Full returns the number of times a buffer filled up
+func (s *Stats) Full() int64 { return s.full.Load() }
+
+// Dropped returns the number of streams dropped
+func (s *Stats) Dropped() int64 { return s.dropped.Load() }
+
+// Options configure a buffer
+type Options struct {
+	// Size is the number of bytes read ahead. A single read larger than
+	// Size is still accepted into an empty buffer.
+	Size   int
+	Policy Policy
+	// Stats, when set, accumulates the occupancy of the buffer
+	Stats *Stats
+}
+
+// reader is the consuming side of a buffered stream
+type reader struct {
+	src  io.ReadCloser
+	opts Options
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	chunks   [][]byte
+	buffered int
+	err      error
+	closed   bool
+}
+
+// New starts reading src ahead into a buffer and returns the reader of the
+// buffered stream. Closing it closes src.
+func New(src io.ReadCloser, opts Options) io.ReadCloser {
+	if opts.Stats == nil {
+		opts.Stats = &Stats{}
+	}
+	r := &reader{src: src, opts: opts}
+	r.cond = sync.NewCond(&r.mu)
+	go r.fill()
+	return r
+}
+
+// fill reads the source into the buffer until it ends or the stream is
+// closed or dropped
+func (r *reader) fill() {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.src.Read(buf)
+		if n > 0 && !r.push(buf[:n]) {
+			return
+		}
+		if err != nil {
+			r.mu.Lock()
+			if r.err == nil {
+				r.err = err
+			}
+			r.cond.Broadcast()
+			r.mu.Unlock()
+			return
+		}
+	}
+}
+
+// push adds a chunk to the buffer, waiting for room when parked. It reports
+// whether reading should go on.
+func (r *reader) push(data []byte) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.buffered > 0 && r.buffered+len(data) > r.opts.Size {
+		r.opts.Stats.full.Add(1)
+		if r.opts.Policy == Drop {
+			r.opts.Stats.dropped.Add(1)
+			r.err = ErrSlowReader
+			r.cond.Broadcast()
+			r.src.Close()
+			return false
+		}
+		for r.buffered > 0 && r.buffered+len(data) > r.opts.Size && !r.closed {
+			r.cond.Wait()
+		}
+	}
+	if r.closed {
+		return false
+	}
+	r.chunks = append(r.chunks, append([]byte(nil), data...))
+	r.buffered += len(data)
+	r.opts.Stats.buffered.Add(int64(len(data)))
+	r.cond.Broadcast()
+	return true
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for len(r.chunks) == 0 && r.err == nil && !r.closed {
+		r.cond.Wait()
+	}
+	if len(r.chunks) == 0 {
+		if r.closed {
+			return 0, io.ErrClosedPipe
+		}
+		return 0, r.err
+	}
+	n := copy(p, r.chunks[0])
+	if n == len(r.chunks[0]) {
+		r.chunks = r.chunks[1:]
+	} else {
+		r.chunks[0] = r.chunks[0][n:]
+	}
+	r.buffered -= n
+	r.opts.Stats.buffered.Add(-int64(n))
+	r.cond.Broadcast()
+	return n, nil
+}
+
+// Close discards what is buffered and closes the source
+func (r *reader) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	r.opts.Stats.buffered.Add(-int64(r.buffered))
+	r.chunks, r.buffered = nil, 0
+	r.cond.Broadcast()
+	r.mu.Unlock()
+	return r.src.Close()
+}
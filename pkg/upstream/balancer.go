@@ -0,0 +1,368 @@
+// pkg/upstream/balancer.go
+
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/acazau/ghcsd/pkg/copilot"
+	"github.com/acazau/ghcsd/pkg/logging"
+)
+
+// upstreamLog writes the ejections and recoveries of endpoints
+var upstreamLog = logging.For(logging.Upstream)
+
+// Load balancing strategies of a Balancer
+const (
+	// RoundRobin spreads requests across endpoints in proportion to their weights
+	RoundRobin = "round-robin"
+	// LeastOutstanding sends each request to the endpoint with the fewest
+	// requests in flight relative to its weight
+	LeastOutstanding = "least-outstanding"
+)
+
+const (
+	// ejectAfterFailures is the number of consecutive failures after which an
+	// endpoint stops receiving requests
+	ejectAfterFailures = 3
+	// ejectDuration is how long an ejected endpoint is skipped before a single
+	// request is let through to probe it
+	ejectDuration = 30 * time.Second
+	// healthCheckTimeout bounds a single active health check
+	healthCheckTimeout = 10 * time.Second
+)
+
+// ValidStrategy reports whether strategy is a known load balancing strategy
+func ValidStrategy(strategy string) bool {
+	return strategy == RoundRobin || strategy == LeastOutstanding
+}
+
+// Endpoint is one of the providers a Balancer routes requests to
+type Endpoint struct {
+	// Name identifies the endpoint in logs and status, e.g. its base URL
+	Name     string
+	Provider Provider
+	// Weight is the endpoint's share of the requests; values below 1 count as 1
+	Weight int
+}
+
+// EndpointStatus is a snapshot of the state of a balanced endpoint
+type EndpointStatus struct {
+	Name                string     `json:"name"`
+	Weight              int        `json:"weight"`
+	Healthy             bool       `json:"healthy"`
+	Outstanding         int        `json:"outstanding"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	LastError           string     `json:"last_error,omitempty"`
+	EjectedUntil        *time.Time `json:"ejected_until,omitempty"`
+}
+
+// endpointState tracks the load and health of an endpoint
+type endpointState struct {
+	Endpoint
+	// current is the smooth weighted round-robin counter
+	current      int
+	outstanding  int
+	failures     int
+	lastError    string
+	ejectedUntil time.Time
+	// probing is set while the request probing an ejected endpoint is in flight
+	probing bool
+}
+
+// Balancer is a Provider that routes requests across several endpoints,
+// e.g. Copilot deployments or accounts. Endpoints failing repeatedly are
+// ejected for a while, and a request failing on one endpoint is retried on
+// the next.
+type Balancer struct {
+	name     string
+	strategy string
+
+	mu        sync.Mutex
+	endpoints []*endpointState
+}
+
+// NewBalancer creates a balancer registered under name that routes across
+// endpoints with the given strategy, RoundRobin when empty
+func NewBalancer(name, strategy string, endpoints []Endpoint) (*Balancer, error) {
+	if strategy == "" {
+		strategy = RoundRobin
+	}
+	if !ValidStrategy(strategy) {
+		return nil, fmt.Errorf("unknown load balancing strategy: %s", strategy)
+	}
+	if len(endpoints) == 0 {
+		return nil, errors.New("load balancer needs at least one endpoint")
+	}
+	b := &Balancer{name: name, strategy: strategy}
+	for _, endpoint := range endpoints {
+		endpoint.Weight = max(endpoint.Weight, 1)
+		b.endpoints = append(b.endpoints, &endpointState{Endpoint: endpoint})
+	}
+	return b, nil
+}
+
+// Name returns the name the balancer is registered under
+func (b *Balancer) Name() string {
+	return b.name
+}
+
+// Complete sends a non-streaming completion request to an endpoint, trying
+// the others in turn while endpoints fail
+func (b *Balancer) Complete(ctx context.Context, req copilot.CompletionRequest) (*copilot.CompletionResponse, error) {
+	tried := make(map[*endpointState]bool)
+	var lastErr error
+	for endpoint := b.pick(tried); endpoint != nil; endpoint = b.pick(tried) {
+		tried[endpoint] = true
+		resp, err := endpoint.Provider.Complete(ctx, req)
+		b.record(endpoint, err)
+		b.release(endpoint)
+		if err == nil || !IsEndpointFailure(err) || ctx.Err() != nil {
+			return resp, err
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// CompleteStream starts a streaming completion on an endpoint, trying the
+// others in turn while endpoints fail to start it. The endpoint counts the
+// request as outstanding until the stream is closed.
+func (b *Balancer) CompleteStream(ctx context.Context, req copilot.CompletionRequest) (io.ReadCloser, error) {
+	tried := make(map[*endpointState]bool)
+	var lastErr error
+	for endpoint := b.pick(tried); endpoint != nil; endpoint = b.pick(tried) {
+		tried[endpoint] = true
+		stream, err := endpoint.Provider.CompleteStream(ctx, req)
+		b.record(endpoint, err)
+		if err == nil {
+			return &balancedStream{ReadCloser: stream, release: func() { b.release(endpoint) }}, nil
+		}
+		b.release(endpoint)
+		if !IsEndpointFailure(err) || ctx.Err() != nil {
+			return nil, err
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// CountTokens counts the prompt tokens with the first endpoint
+func (b *Balancer) CountTokens(ctx context.Context, req copilot.CompletionRequest) (int, error) {
+	return b.endpoints[0].Provider.CountTokens(ctx, req)
+}
+
+// ListModels lists the models of the first healthy endpoint that answers
+func (b *Balancer) ListModels(ctx context.Context) ([]copilot.ModelInfo, error) {
+	var lastErr error
+	for _, endpoint := range b.ordered() {
+		models, err := endpoint.Provider.ListModels(ctx)
+		if err == nil {
+			return models, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// StartHealthChecks checks every endpoint by listing its models each
+// interval until ctx is done. Failed checks count like failed requests, and
+// a successful check brings an ejected endpoint back.
+func (b *Balancer) StartHealthChecks(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			for _, endpoint := range b.endpoints {
+				checkCtx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+				_, err := endpoint.Provider.ListModels(checkCtx)
+				cancel()
+				b.record(endpoint, err)
+			}
+		}
+	}()
+}
+
+// Status returns the state of every endpoint
+func (b *Balancer) Status() []EndpointStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	statuses := make([]EndpointStatus, 0, len(b.endpoints))
+	for _, endpoint := range b.endpoints {
+		status := EndpointStatus{
+			Name:                endpoint.Name,
+			Weight:              endpoint.Weight,
+			Healthy:             endpoint.failures < ejectAfterFailures,
+			Outstanding:         endpoint.outstanding,
+			ConsecutiveFailures: endpoint.failures,
+			LastError:           endpoint.lastError,
+		}
+		if endpoint.ejectedUntil.After(now) {
+			until := endpoint.ejectedUntil
+			status.EjectedUntil = &until
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// Strategy returns the load balancing strategy
+func (b *Balancer) Strategy() string {
+	return b.strategy
+}
+
+// IsEndpointFailure reports whether err indicates a problem with the
+// endpoint itself, such as a network error, a server error, a rate limit or
+// rejected credentials, rather than with the request
+func IsEndpointFailure(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var apiErr *copilot.APIError
+	if !errors.As(err, &apiErr) {
+		return true
+	}
+	switch apiErr.Kind() {
+	case copilot.ErrorKindInvalidRequest, copilot.ErrorKindNotFound, copilot.ErrorKindContentFilter:
+		return false
+	}
+	return true
+}
+
+// available reports whether an endpoint may receive a request. Once its
+// ejection has elapsed, a single probing request is let through.
+func (e *endpointState) available(now time.Time) bool {
+	if e.failures < ejectAfterFailures {
+		return true
+	}
+	return !now.Before(e.ejectedUntil) && !e.probing
+}
+
+// pick selects the endpoint for the next request among those not yet tried
+// and marks the request outstanding on it. When every remaining endpoint is
+// ejected one is used anyway, since failing the request is no better. It
+// returns nil once every endpoint has been tried.
+func (b *Balancer) pick(tried map[*endpointState]bool) *endpointState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	var candidates, remaining []*endpointState
+	for _, endpoint := range b.endpoints {
+		if tried[endpoint] {
+			continue
+		}
+		remaining = append(remaining, endpoint)
+		if endpoint.available(now) {
+			candidates = append(candidates, endpoint)
+		}
+	}
+	if len(remaining) == 0 {
+		return nil
+	}
+	if len(candidates) == 0 {
+		candidates = remaining
+	}
+
+	var chosen *endpointState
+	switch b.strategy {
+	case LeastOutstanding:
+		for _, endpoint := range candidates {
+			// Compare outstanding/weight without dividing
+			if chosen == nil || endpoint.outstanding*chosen.Weight < chosen.outstanding*endpoint.Weight {
+				chosen = endpoint
+			}
+		}
+	default:
+		// Smooth weighted round-robin, which interleaves the endpoints
+		// instead of sending bursts to the heaviest one
+		total := 0
+		for _, endpoint := range candidates {
+			endpoint.current += endpoint.Weight
+			total += endpoint.Weight
+			if chosen == nil || endpoint.current > chosen.current {
+				chosen = endpoint
+			}
+		}
+		chosen.current -= total
+	}
+
+	if chosen.failures >= ejectAfterFailures {
+		chosen.probing = true
+	}
+	chosen.outstanding++
+	return chosen
+}
+
+// record updates the health of an endpoint with the outcome of a request
+func (b *Balancer) record(endpoint *endpointState, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	endpoint.probing = false
+	if IsEndpointFailure(err) {
+		endpoint.failures++
+		endpoint.lastError = err.Error()
+		if endpoint.failures >= ejectAfterFailures {
+			if endpoint.failures == ejectAfterFailures {
+				upstreamLog.Warnf("[Upstream] Ejecting %s after %d consecutive failures: %v", endpoint.Name, endpoint.failures, err)
+			}
+			endpoint.ejectedUntil = time.Now().Add(ejectDuration)
+		}
+		return
+	}
+	if err != nil {
+		// The request was at fault, which says nothing about the endpoint
+		return
+	}
+	if endpoint.failures >= ejectAfterFailures {
+		upstreamLog.Infof("[Upstream] %s recovered", endpoint.Name)
+	}
+	endpoint.failures = 0
+	endpoint.lastError = ""
+	endpoint.ejectedUntil = time.Time{}
+}
+
+// release ends a request on an endpoint
+func (b *Balancer) release(endpoint *endpointState) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	endpoint.outstanding--
+}
+
+// ordered returns the endpoints with the healthy ones first
+func (b *Balancer) ordered() []*endpointState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	var healthy, ejected []*endpointState
+	for _, endpoint := range b.endpoints {
+		if endpoint.available(now) {
+			healthy = append(healthy, endpoint)
+		} else {
+			ejected = append(ejected, endpoint)
+		}
+	}
+	return append(healthy, ejected...)
+}
+
+// balancedStream releases its endpoint when the stream is closed
+type balancedStream struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (s *balancedStream) Close() error {
+	s.once.Do(s.release)
+	return s.ReadCloser.Close()
+}
@@ -0,0 +1,51 @@
+// pkg/upstream/copilot.go
+
+package upstream
+
+import (
+	"context"
+	"io"
+
+	"github.com/acazau/ghcsd/pkg/copilot"
+)
+
+// CopilotProvider serves completions through the GitHub Copilot API
+type CopilotProvider struct {
+	client *copilot.Client
+}
+
+// NewCopilotProvider wraps a Copilot client as a Provider
+func NewCopilotProvider(client *copilot.Client) *CopilotProvider {
+	return &CopilotProvider{client: client}
+}
+
+// Name returns the provider name
+func (p *CopilotProvider) Name() string {
+	return DefaultProvider
+}
+
+// Complete sends a non-streaming completion request to Copilot
+func (p *CopilotProvider) Complete(ctx context.Context, req copilot.CompletionRequest) (*copilot.CompletionResponse, error) {
+	return p.client.Complete(ctx, req)
+}
+
+// CompleteStream sends a streaming completion request to Copilot
+func (p *CopilotProvider) CompleteStream(ctx context.Context, req copilot.CompletionRequest) (io.ReadCloser, error) {
+	return p.client.CompleteStream(ctx, req)
+}
+
+// CountTokens estimates the prompt tokens locally since Copilot has no
+// token counting endpoint
+func (p *CopilotProvider) CountTokens(ctx context.Context, req copilot.CompletionRequest) (int, error) {
+	return EstimateTokens(req), nil
+}
+
+// ListModels returns the models enabled for the Copilot subscription
+func (p *CopilotProvider) ListModels(ctx context.Context) ([]copilot.ModelInfo, error) {
+	return p.client.ListModels(ctx)
+}
+
+// Client returns the underlying Copilot client
+func (p *CopilotProvider) Client() *copilot.Client {
+	return p.client
+}
@@ -0,0 +1,8 @@
+// pkg/upstream/doc.go
+
+// Package upstream defines the Provider interface implemented by the backends
+// serving chat completions, a Registry selecting them by name, the Copilot
+// provider, a mock provider answering from fixtures and prompt token
+// estimation. Other backends can be plugged into an
+// embedding program by implementing Provider.
+package upstream
@@ -0,0 +1,300 @@
+// pkg/upstream/mock.go
+
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/acazau/ghcsd/pkg/copilot"
+)
+
+// MockFixture is a canned answer of the mock provider. The first fixture
+// matching a request answers it; a fixture without criteria matches any.
+type MockFixture struct {
+	// Model restricts the fixture to requests for a real model ID
+	Model string `json:"model,omitempty"`
+	// Prompt matches the text of the last user message, ignoring the
+	// surrounding whitespace
+	Prompt string `json:"prompt,omitempty"`
+	// Contains matches a last user message containing the text
+	Contains string `json:"contains,omitempty"`
+
+	Response     string             `json:"response,omitempty"`
+	ToolCalls    []copilot.ToolCall `json:"tool_calls,omitempty"`
+	FinishReason string             `json:"finish_reason,omitempty"`
+	// DelayMs is the time to the first token; ChunkDelayMs is the time
+	// between the streamed words and adds up for non-streamed answers
+	DelayMs      int `json:"delay_ms,omitempty"`
+	ChunkDelayMs int `json:"chunk_delay_ms,omitempty"`
+
+	// Error answers with an upstream error instead of a completion
+	Error *MockError `json:"error,omitempty"`
+}
+
+// MockError is an upstream error returned by a fixture
+type MockError struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+	Code    string `json:"code,omitempty"`
+}
+
+// MockProvider answers completions from fixtures without contacting any
+// upstream, for offline development and tests. Requests no fixture matches
+// are answered by echoing their last user message.
+type MockProvider struct {
+	fixtures []MockFixture
+}
+
+// NewMockProvider creates a mock provider answering from fixtures. It is
+// registered as the default provider, replacing Copilot.
+func NewMockProvider(fixtures []MockFixture) *MockProvider {
+	return &MockProvider{fixtures: fixtures}
+}
+
+// LoadMockFixtures reads the fixtures of every .json file in dir, in file
+// name order. A file holds a fixture or a list of fixtures.
+func LoadMockFixtures(dir string) ([]MockFixture, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	var fixtures []MockFixture
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read mock fixture: %w", err)
+		}
+		data = bytes.TrimSpace(data)
+		var loaded []MockFixture
+		if bytes.HasPrefix(data, []byte("[")) {
+			err = json.Unmarshal(data, &loaded)
+		} else {
+			var fixture MockFixture
+			err = json.Unmarshal(data, &fixture)
+			loaded = []MockFixture{fixture}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid mock fixture %s: %w", filepath.Base(path), err)
+		}
+		fixtures = append(fixtures, loaded...)
+	}
+	return fixtures, nil
+}
+
+// Name returns the provider name
+func (p *MockProvider) Name() string {
+	return DefaultProvider
+}
+
+// answer returns the fixture answering req
+func (p *MockProvider) answer(req copilot.CompletionRequest) MockFixture {
+	prompt := lastUserText(req)
+	for _, fixture := range p.fixtures {
+		if fixture.Model != "" && fixture.Model != req.Model {
+			continue
+		}
+		if fixture.Prompt != "" && strings.TrimSpace(fixture.Prompt) != strings.TrimSpace(prompt) {
+			continue
+		}
+		if fixture.Contains != "" && !strings.Contains(prompt, fixture.Contains) {
+			continue
+		}
+		return fixture
+	}
+	return MockFixture{Response: "Mock response to: " + prompt}
+}
+
+// lastUserText returns the text of the last user message
+func lastUserText(req copilot.CompletionRequest) string {
+	for i := len(req.Messages) - 1; i >= 0; i-- {
+		msg := req.Messages[i]
+		if msg.Role != "user" {
+			continue
+		}
+		if msg.IsStringContent() {
+			return msg.GetStringContent()
+		}
+		var texts []string
+		for _, part := range msg.GetComplexContent() {
+			if part.Type == "text" {
+				texts = append(texts, part.Text)
+			}
+		}
+		return strings.Join(texts, "\n")
+	}
+	return ""
+}
+
+// error returns the upstream error of a fixture, or nil
+func (f MockFixture) error() error {
+	if f.Error == nil {
+		return nil
+	}
+	return &copilot.APIError{StatusCode: f.Error.Status, Message: f.Error.Message, Code: f.Error.Code}
+}
+
+func (f MockFixture) finishReason() string {
+	switch {
+	case f.FinishReason != "":
+		return f.FinishReason
+	case len(f.ToolCalls) > 0:
+		return "tool_calls"
+	default:
+		return "stop"
+	}
+}
+
+// words splits the response into the chunks it is streamed in
+func (f MockFixture) words() []string {
+	words := strings.SplitAfter(f.Response, " ")
+	if len(words) == 1 && words[0] == "" {
+		return nil
+	}
+	return words
+}
+
+// usage counts the tokens of the exchange like the prompt estimate does
+func (f MockFixture) usage(req copilot.CompletionRequest) (prompt, completion int) {
+	chars := len(f.Response)
+	for _, call := range f.ToolCalls {
+		chars += len(call.Function.Name) + len(call.Function.Arguments)
+	}
+	return EstimateTokens(req), (chars + charsPerToken - 1) / charsPerToken
+}
+
+// sleep waits for d unless ctx is done first
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Complete answers a non-streaming completion from the fixtures
+func (p *MockProvider) Complete(ctx context.Context, req copilot.CompletionRequest) (*copilot.CompletionResponse, error) {
+	fixture := p.answer(req)
+	delay := time.Duration(fixture.DelayMs+fixture.ChunkDelayMs*len(fixture.words())) * time.Millisecond
+	if err := sleep(ctx, delay); err != nil {
+		return nil, err
+	}
+	if err := fixture.error(); err != nil {
+		return nil, err
+	}
+
+	resp := &copilot.CompletionResponse{ID: "chatcmpl-mock", Created: time.Now().Unix(), Model: req.Model}
+	var choice copilot.Choice
+	choice.Message.Role = "assistant"
+	choice.Message.Content = fixture.Response
+	choice.Message.ToolCalls = fixture.ToolCalls
+	choice.FinishReason = fixture.finishReason()
+	resp.Choices = []copilot.Choice{choice}
+	resp.Usage.PromptTokens, resp.Usage.CompletionTokens = fixture.usage(req)
+	resp.Usage.TotalTokens = resp.Usage.PromptTokens + resp.Usage.CompletionTokens
+	return resp, nil
+}
+
+// CompleteStream answers a streaming completion from the fixtures, one word
+// per chunk
+func (p *MockProvider) CompleteStream(ctx context.Context, req copilot.CompletionRequest) (io.ReadCloser, error) {
+	fixture := p.answer(req)
+	if err := sleep(ctx, time.Duration(fixture.DelayMs)*time.Millisecond); err != nil {
+		return nil, err
+	}
+	if err := fixture.error(); err != nil {
+		return nil, err
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		created := time.Now().Unix()
+		write := func(delta map[string]interface{}, finishReason interface{}, usage map[string]int) error {
+			chunk := map[string]interface{}{
+				"id":      "chatcmpl-mock",
+				"object":  "chat.completion.chunk",
+				"created": created,
+				"model":   req.Model,
+				"choices": []interface{}{map[string]interface{}{"index": 0, "delta": delta, "finish_reason": finishReason}},
+			}
+			if usage != nil {
+				chunk["usage"] = usage
+			}
+			data, _ := json.Marshal(chunk)
+			_, err := fmt.Fprintf(writer, "data: %s\n\n", data)
+			return err
+		}
+
+		chunkDelay := time.Duration(fixture.ChunkDelayMs) * time.Millisecond
+		for i, word := range fixture.words() {
+			if i > 0 {
+				if err := sleep(ctx, chunkDelay); err != nil {
+					writer.CloseWithError(err)
+					return
+				}
+			}
+			delta := map[string]interface{}{"content": word}
+			if i == 0 {
+				delta["role"] = "assistant"
+			}
+			if err := write(delta, nil, nil); err != nil {
+				return
+			}
+		}
+		if len(fixture.ToolCalls) > 0 {
+			calls := make([]copilot.ToolCall, len(fixture.ToolCalls))
+			for i, call := range fixture.ToolCalls {
+				index := i
+				call.Index = &index
+				if call.Type == "" {
+					call.Type = "function"
+				}
+				calls[i] = call
+			}
+			delta := map[string]interface{}{"tool_calls": calls}
+			if len(fixture.words()) == 0 {
+				delta["role"] = "assistant"
+			}
+			if err := write(delta, nil, nil); err != nil {
+				return
+			}
+		}
+		promptTokens, completionTokens := fixture.usage(req)
+		usage := map[string]int{
+			"prompt_tokens":     promptTokens,
+			"completion_tokens": completionTokens,
+			"total_tokens":      promptTokens + completionTokens,
+		}
+		if err := write(map[string]interface{}{}, fixture.finishReason(), usage); err != nil {
+			return
+		}
+		fmt.Fprint(writer, "data: [DONE]\n\n")
+		writer.Close()
+	}()
+	return reader, nil
+}
+
+// CountTokens estimates the prompt tokens like the Copilot provider
+func (p *MockProvider) CountTokens(ctx context.Context, req copilot.CompletionRequest) (int, error) {
+	return EstimateTokens(req), nil
+}
+
+// ListModels lists no models, so that the configured ones apply unchanged
+func (p *MockProvider) ListModels(ctx context.Context) ([]copilot.ModelInfo, error) {
+	return nil, nil
+}
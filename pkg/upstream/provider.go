@@ -0,0 +1,83 @@
+// pkg/upstream/provider.go
+
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/acazau/ghcsd/pkg/copilot"
+)
+
+// DefaultProvider is the name of the provider used for models that do not
+// select one explicitly
+const DefaultProvider = "copilot"
+
+// Provider is an upstream backend that serves chat completions. Requests and
+// responses use the OpenAI-compatible types of the copilot package, which act
+// as the common format between frontends and backends.
+type Provider interface {
+	// Name returns the name the provider is registered and selected by
+	Name() string
+	// Complete sends a non-streaming completion request
+	Complete(ctx context.Context, req copilot.CompletionRequest) (*copilot.CompletionResponse, error)
+	// CompleteStream sends a streaming completion request and returns an SSE
+	// stream of OpenAI-style chunks
+	CompleteStream(ctx context.Context, req copilot.CompletionRequest) (io.ReadCloser, error)
+	// CountTokens returns the number of prompt tokens of the request
+	CountTokens(ctx context.Context, req copilot.CompletionRequest) (int, error)
+	// ListModels returns the models the provider can serve
+	ListModels(ctx context.Context) ([]copilot.ModelInfo, error)
+}
+
+// Registry holds the available providers by name
+type Registry struct {
+	mu        sync.RWMutex
+	providers map[string]Provider
+}
+
+// NewRegistry creates a registry containing the given providers
+func NewRegistry(providers ...Provider) *Registry {
+	r := &Registry{providers: make(map[string]Provider)}
+	for _, p := range providers {
+		r.Register(p)
+	}
+	return r
+}
+
+// Register adds a provider, replacing any provider with the same name
+func (r *Registry) Register(p Provider) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.providers[p.Name()] = p
+}
+
+// Get returns the provider with the given name. An empty name selects the
+// default provider.
+func (r *Registry) Get(name string) (Provider, error) {
+	if name == "" {
+		name = DefaultProvider
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	p, ok := r.providers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown upstream provider: %s", name)
+	}
+	return p, nil
+}
+
+// Names returns the names of all registered providers in sorted order
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.providers))
+	for name := range r.providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,44 @@
+// pkg/upstream/tokens.go
+
+package upstream
+
+import (
+	"encoding/json"
+
+	"github.com/acazau/ghcsd/pkg/copilot"
+)
+
+// Rough per-item overheads of the chat format, in tokens
+const (
+	tokensPerMessage = 4
+	tokensPerRequest = 3
+	charsPerToken    = 4
+)
+
+// EstimateTokens approximates the prompt tokens of a request without a
+// tokenizer, using the common heuristic of four characters per token plus the
+// fixed overhead the chat format adds per message. Replayed tool calls and
+// their IDs count towards the prompt like message content.
+func EstimateTokens(req copilot.CompletionRequest) int {
+	chars := 0
+	for _, msg := range req.Messages {
+		chars += len(msg.Role) + len(msg.Name) + len(msg.ToolCallID)
+		for _, call := range msg.ToolCalls {
+			chars += len(call.ID) + len(call.Function.Name) + len(call.Function.Arguments)
+		}
+		if msg.IsStringContent() {
+			chars += len(msg.GetStringContent())
+		} else {
+			for _, part := range msg.GetComplexContent() {
+				chars += len(part.Text)
+			}
+		}
+	}
+	for _, tool := range req.Tools {
+		if data, err := json.Marshal(tool); err == nil {
+			chars += len(data)
+		}
+	}
+
+	return tokensPerRequest + len(req.Messages)*tokensPerMessage + (chars+charsPerToken-1)/charsPerToken
+}